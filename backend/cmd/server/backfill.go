@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"margin.at/internal/config"
+	"margin.at/internal/db"
+	"margin.at/internal/lexicon"
+	"margin.at/internal/sync"
+)
+
+const backfillUsage = "usage: margin backfill [--relay url] [--rate requests/s] [--concurrency n] [--restart]"
+
+func runBackfillCommand(database *db.DB, cfg sync.Config, args []string) error {
+	fs := flag.NewFlagSet("backfill", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	relay := fs.String("relay", relayHTTPURL(config.Get().FirehoseRelayHost), "")
+	rate := fs.Float64("rate", 10, "")
+	concurrency := fs.Int("concurrency", 4, "")
+	restart := fs.Bool("restart", false, "")
+	if err := fs.Parse(args); err != nil || fs.NArg() > 0 || *rate <= 0 || *concurrency < 1 {
+		return fmt.Errorf(backfillUsage)
+	}
+
+	if err := database.Migrate(); err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	err := sync.NewService(database, cfg).Backfill(ctx, sync.BackfillOptions{
+		Relay:             *relay,
+		RequestsPerSecond: *rate,
+		Concurrency:       *concurrency,
+		Restart:           *restart,
+	})
+	if err != nil && ctx.Err() != nil {
+		fmt.Println("Interrupted; run again to resume.")
+	}
+	return err
+}
+
+// syncConfig is the repo sync configuration set in the environment.
+func syncConfig(cfg *config.Config, lexicons *lexicon.Catalog) sync.Config {
+	sc := sync.DefaultConfig()
+	sc.Workers = cfg.SyncWorkers
+	sc.Lexicons = lexicons
+	return sc
+}
+
+// relayHTTPURL turns the firehose relay's websocket URL into its XRPC base.
+func relayHTTPURL(host string) string {
+	if rest, ok := strings.CutPrefix(host, "wss://"); ok {
+		return "https://" + rest
+	}
+	if rest, ok := strings.CutPrefix(host, "ws://"); ok {
+		return "http://" + rest
+	}
+	return host
+}
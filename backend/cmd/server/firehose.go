@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"margin.at/internal/config"
+	"margin.at/internal/db"
+	"margin.at/internal/firehose"
+	"margin.at/internal/lexicon"
+)
+
+const replayUsage = "usage: margin firehose replay --from <time_us> --to <time_us> [--collections nsid,...] [--resume] [--relay url]"
+
+func runFirehoseCommand(database *db.DB, cfg firehose.Config, args []string) error {
+	if len(args) == 0 || args[0] != "replay" {
+		return fmt.Errorf(replayUsage)
+	}
+
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	from := fs.Int64("from", 0, "")
+	to := fs.Int64("to", 0, "")
+	collections := fs.String("collections", "", "")
+	resume := fs.Bool("resume", false, "")
+	relay := fs.String("relay", "", "")
+	if err := fs.Parse(args[1:]); err != nil || fs.NArg() > 0 || *from <= 0 || *to <= 0 {
+		return fmt.Errorf(replayUsage)
+	}
+
+	if err := database.Migrate(); err != nil {
+		return err
+	}
+
+	opts := firehose.ReplayOptions{
+		From:     *from,
+		To:       *to,
+		Resume:   *resume,
+		RelayURL: *relay,
+	}
+	if *collections != "" {
+		opts.Collections = strings.Split(*collections, ",")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Without a sync service the replay applies events only, and leaves
+	// repo syncs to the live server.
+	ingester := firehose.NewIngester(database, nil, cfg)
+	err := ingester.Replay(ctx, opts)
+
+	cursor, _ := database.GetCursor(firehose.ReplayCursorID)
+	fmt.Printf("Replay cursor: %d\n", cursor)
+	if err != nil && ctx.Err() != nil {
+		fmt.Println("Interrupted; rerun with --resume to continue.")
+	}
+	return err
+}
+
+// firehoseConfig is the ingester configuration set in the environment.
+func firehoseConfig(cfg *config.Config, lexicons *lexicon.Catalog) firehose.Config {
+	fc := firehose.DefaultConfig()
+	fc.Source = cfg.FirehoseSource
+	fc.RelayHost = cfg.FirehoseRelayHost
+	fc.Compress = cfg.FirehoseCompress
+	fc.BatchSize = cfg.FirehoseBatchSize
+	fc.BatchInterval = cfg.FirehoseBatchInterval
+	fc.Workers = cfg.FirehoseWorkers
+	fc.WorkerQueueSize = cfg.FirehoseQueueSize
+	fc.StallTimeout = cfg.FirehoseStallTimeout
+	fc.RelayRewind = cfg.FirehoseRelayRewind
+	fc.Lexicons = lexicons
+	return fc
+}
@@ -17,36 +17,82 @@ import (
 	"github.com/joho/godotenv"
 
 	"margin.at/internal/api"
+	"margin.at/internal/config"
 	"margin.at/internal/db"
 	"margin.at/internal/firehose"
+	"margin.at/internal/lexicon"
 	internalMiddleware "margin.at/internal/middleware"
 	"margin.at/internal/oauth"
+	"margin.at/internal/safehttp"
 	"margin.at/internal/sync"
+	"margin.at/internal/urlcanon"
 )
 
 func main() {
 	godotenv.Load("../.env", ".env")
 
-	database, err := db.New(getEnv("DATABASE_URL", "margin.db"))
+	cfg := config.Get()
+	database, err := db.New(getEnv("DATABASE_URL", "margin.db"), newURLCanonicalizer(cfg))
 	if err != nil {
 		log.Fatalf("Failed to connect to database: %v", err)
 	}
 	defer database.Close()
 
+	lexicons, err := lexicon.Load(cfg.LexiconDir)
+	if err != nil {
+		log.Printf("Record validation disabled, failed to load lexicons: %v", err)
+	} else {
+		log.Printf("Validating %d record types against lexicons in %s", len(lexicons.Records()), cfg.LexiconDir)
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrateCommand(database, os.Args[2:]); err != nil {
+			log.Fatalf("Migration failed: %v", err)
+		}
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "rehash" {
+		if err := runRehashCommand(database, os.Args[2:]); err != nil {
+			log.Fatalf("Rehash failed: %v", err)
+		}
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "backfill" {
+		if err := runBackfillCommand(database, syncConfig(cfg, lexicons), os.Args[2:]); err != nil {
+			log.Fatalf("Backfill failed: %v", err)
+		}
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "firehose" {
+		if err := runFirehoseCommand(database, firehoseConfig(cfg, lexicons), os.Args[2:]); err != nil {
+			log.Fatalf("Firehose command failed: %v", err)
+		}
+		return
+	}
+
 	if err := database.Migrate(); err != nil {
 		log.Fatalf("Failed to run migrations: %v", err)
 	}
 
-	syncSvc := sync.NewService(database)
+	syncSvc := sync.NewService(database, syncConfig(cfg, lexicons))
+	syncSvc.StartQueue(context.Background())
 
 	oauthHandler, err := oauth.NewHandler(database, syncSvc)
 	if err != nil {
 		log.Fatalf("Failed to initialize OAuth: %v", err)
 	}
 
-	ingester := firehose.NewIngester(database, syncSvc)
+	firehoseCfg := firehoseConfig(cfg, lexicons)
+	ingester := firehose.NewIngester(database, syncSvc, firehoseCfg)
+	ingester.OnIdentityChange(func(did string) { api.Cache.Delete(did) })
 	firehose.RelayURL = getEnv("BLOCK_RELAY_URL", "wss://jetstream2.us-east.bsky.network/subscribe")
 	log.Printf("Firehose URL: %s", firehose.RelayURL)
+	if firehoseCfg.Source == firehose.SourceRelay {
+		log.Printf("Firehose source: subscribeRepos from %s", firehoseCfg.RelayHost)
+	}
 
 	go func() {
 		if err := ingester.Start(context.Background()); err != nil {
@@ -54,6 +100,9 @@ func main() {
 		}
 	}()
 
+	pageMetadata := api.NewPageMetadataRefresher(database)
+	pageMetadata.Start(context.Background())
+
 	r := chi.NewRouter()
 
 	r.Use(internalMiddleware.PrivacyLogger)
@@ -73,9 +122,13 @@ func main() {
 	}))
 
 	tokenRefresher := api.NewTokenRefresher(database, oauthHandler.GetPrivateKey())
-	annotationSvc := api.NewAnnotationService(database, tokenRefresher)
+	var canonicalLinks *urlcanon.LinkResolver
+	if cfg.ResolveCanonicalLinks {
+		canonicalLinks = urlcanon.NewLinkResolver(safehttp.NewClient(safehttp.Config{Timeout: urlcanon.DefaultTimeout}))
+	}
+	annotationSvc := api.NewAnnotationService(database, tokenRefresher, canonicalLinks)
 
-	handler := api.NewHandler(database, annotationSvc, tokenRefresher, syncSvc)
+	handler := api.NewHandler(database, annotationSvc, tokenRefresher, syncSvc, canonicalLinks, ingester)
 	handler.RegisterRoutes(r)
 
 	r.Post("/api/annotations", annotationSvc.CreateAnnotation)
@@ -112,6 +165,8 @@ func main() {
 	r.Get("/{handle}/highlight/{rkey}", ogHandler.HandleAnnotationPage)
 	r.Get("/{handle}/bookmark/{rkey}", ogHandler.HandleAnnotationPage)
 
+	r.Get("/debug/vars", handler.AdminDebugVars)
+
 	r.Get("/api/tags/trending", handler.HandleGetTrendingTags)
 	r.Put("/api/profile", handler.UpdateProfile)
 	r.Get("/api/profile/{did}", handler.GetProfile)
@@ -145,6 +200,7 @@ func main() {
 
 	log.Println("Shutting down server...")
 	ingester.Stop()
+	pageMetadata.Stop()
 
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
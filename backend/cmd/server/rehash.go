@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"margin.at/internal/config"
+	"margin.at/internal/db"
+	"margin.at/internal/urlcanon"
+)
+
+func newURLCanonicalizer(cfg *config.Config) *urlcanon.Canonicalizer {
+	c := urlcanon.Default()
+	if len(cfg.URLStripParams) > 0 {
+		c = c.With(urlcanon.StripParams(cfg.URLStripParams...))
+	}
+	for host, params := range cfg.URLKeepParams {
+		c = c.With(urlcanon.ForHost(host, urlcanon.KeepParams(params...)))
+	}
+	return c
+}
+
+func runRehashCommand(database *db.DB, args []string) error {
+	dryRun := false
+	for _, arg := range args {
+		switch arg {
+		case "--dry-run":
+			dryRun = true
+		default:
+			return fmt.Errorf("usage: margin rehash [--dry-run]")
+		}
+	}
+
+	if err := database.Migrate(); err != nil {
+		return err
+	}
+
+	results, err := database.RehashTargets(dryRun)
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "TABLE\tSCANNED\tCHANGED")
+	for _, r := range results {
+		fmt.Fprintf(tw, "%s\t%d\t%d\n", r.Table, r.Scanned, r.Changed)
+	}
+	tw.Flush()
+	if dryRun {
+		fmt.Println("Dry run: no rows were updated.")
+	}
+	return err
+}
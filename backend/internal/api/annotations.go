@@ -10,16 +10,21 @@ import (
 	"time"
 
 	"margin.at/internal/db"
+	"margin.at/internal/urlcanon"
 	"margin.at/internal/xrpc"
 )
 
 type AnnotationService struct {
-	db        *db.DB
-	refresher *TokenRefresher
+	db             *db.DB
+	refresher      *TokenRefresher
+	canonicalLinks *urlcanon.LinkResolver
 }
 
-func NewAnnotationService(database *db.DB, refresher *TokenRefresher) *AnnotationService {
-	return &AnnotationService{db: database, refresher: refresher}
+// NewAnnotationService returns the service that writes records for users.
+// canonicalLinks, when not nil, files new records under the target page's
+// canonical URL.
+func NewAnnotationService(database *db.DB, refresher *TokenRefresher, canonicalLinks *urlcanon.LinkResolver) *AnnotationService {
+	return &AnnotationService{db: database, refresher: refresher, canonicalLinks: canonicalLinks}
 }
 
 type CreateAnnotationRequest struct {
@@ -64,7 +69,7 @@ func (s *AnnotationService) CreateAnnotation(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	urlHash := db.HashURL(req.URL)
+	urlHash := targetHash(r.Context(), s.db, s.canonicalLinks, req.URL)
 
 	motivation := "commenting"
 	if req.Selector != nil && req.Text == "" {
@@ -212,6 +217,7 @@ func (s *AnnotationService) CreateAnnotation(w http.ResponseWriter, r *http.Requ
 		BodyValue:    bodyValuePtr,
 		TargetSource: req.URL,
 		TargetHash:   urlHash,
+		TargetDomain: s.db.URLDomain(req.URL),
 		TargetTitle:  targetTitlePtr,
 		SelectorJSON: selectorJSONPtr,
 		TagsJSON:     tagsJSONPtr,
@@ -669,7 +675,7 @@ func (s *AnnotationService) CreateHighlight(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	urlHash := db.HashURL(req.URL)
+	urlHash := targetHash(r.Context(), s.db, s.canonicalLinks, req.URL)
 	record := xrpc.NewHighlightRecord(req.URL, urlHash, req.Selector, req.Color, req.Tags)
 
 	validSelfLabels := map[string]bool{"sexual": true, "nudity": true, "violence": true, "gore": true, "spam": true, "misleading": true}
@@ -733,6 +739,7 @@ func (s *AnnotationService) CreateHighlight(w http.ResponseWriter, r *http.Reque
 		AuthorDID:    session.DID,
 		TargetSource: req.URL,
 		TargetHash:   urlHash,
+		TargetDomain: s.db.URLDomain(req.URL),
 		TargetTitle:  titlePtr,
 		SelectorJSON: selectorJSONPtr,
 		Color:        colorPtr,
@@ -781,7 +788,7 @@ func (s *AnnotationService) CreateBookmark(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	urlHash := db.HashURL(req.URL)
+	urlHash := targetHash(r.Context(), s.db, s.canonicalLinks, req.URL)
 	record := xrpc.NewBookmarkRecord(req.URL, urlHash, req.Title, req.Description)
 	if len(req.Tags) > 0 {
 		record.Tags = req.Tags
@@ -827,16 +834,17 @@ func (s *AnnotationService) CreateBookmark(w http.ResponseWriter, r *http.Reques
 
 	cid := result.CID
 	bookmark := &db.Bookmark{
-		URI:         result.URI,
-		AuthorDID:   session.DID,
-		Source:      req.URL,
-		SourceHash:  urlHash,
-		Title:       titlePtr,
-		Description: descPtr,
-		TagsJSON:    tagsJSONPtr,
-		CreatedAt:   time.Now(),
-		IndexedAt:   time.Now(),
-		CID:         &cid,
+		URI:          result.URI,
+		AuthorDID:    session.DID,
+		Source:       req.URL,
+		SourceHash:   urlHash,
+		SourceDomain: s.db.URLDomain(req.URL),
+		Title:        titlePtr,
+		Description:  descPtr,
+		TagsJSON:     tagsJSONPtr,
+		CreatedAt:    time.Now(),
+		IndexedAt:    time.Now(),
+		CID:          &cid,
 	}
 	s.db.CreateBookmark(bookmark)
 
@@ -8,7 +8,7 @@ import (
 )
 
 func (s *AnnotationService) checkDuplicateAnnotation(did, url, text string) (*db.Annotation, error) {
-	recentAnnos, err := s.db.GetAnnotationsByAuthor(did, 5, 0)
+	recentAnnos, err := s.db.QueryAnnotations(db.FeedQuery{Authors: []string{did}, Limit: 5})
 	if err != nil {
 		return nil, err
 	}
@@ -23,7 +23,7 @@ func (s *AnnotationService) checkDuplicateAnnotation(did, url, text string) (*db
 }
 
 func (s *AnnotationService) checkDuplicateHighlight(did, url string, selector json.RawMessage) (*db.Highlight, error) {
-	recentHighs, err := s.db.GetHighlightsByAuthor(did, 5, 0)
+	recentHighs, err := s.db.QueryHighlights(db.FeedQuery{Authors: []string{did}, Limit: 5})
 	if err != nil {
 		return nil, err
 	}
@@ -46,7 +46,7 @@ func (s *AnnotationService) checkDuplicateHighlight(did, url string, selector js
 }
 
 func (s *AnnotationService) checkDuplicateBookmark(did, url string) (*db.Bookmark, error) {
-	urlHash := db.HashURL(url)
+	urlHash := s.db.HashURL(url)
 	bookmarks, err := s.db.GetBookmarksByTargetHash(urlHash, 50, 0)
 	if err != nil {
 		return nil, err
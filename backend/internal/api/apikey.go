@@ -16,16 +16,18 @@ import (
 	"github.com/go-chi/chi/v5"
 
 	"margin.at/internal/db"
+	"margin.at/internal/urlcanon"
 	"margin.at/internal/xrpc"
 )
 
 type APIKeyHandler struct {
-	db        *db.DB
-	refresher *TokenRefresher
+	db             *db.DB
+	refresher      *TokenRefresher
+	canonicalLinks *urlcanon.LinkResolver
 }
 
-func NewAPIKeyHandler(database *db.DB, refresher *TokenRefresher) *APIKeyHandler {
-	return &APIKeyHandler{db: database, refresher: refresher}
+func NewAPIKeyHandler(database *db.DB, refresher *TokenRefresher, canonicalLinks *urlcanon.LinkResolver) *APIKeyHandler {
+	return &APIKeyHandler{db: database, refresher: refresher, canonicalLinks: canonicalLinks}
 }
 
 type CreateKeyRequest struct {
@@ -186,7 +188,7 @@ func (h *APIKeyHandler) QuickBookmark(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	urlHash := db.HashURL(req.URL)
+	urlHash := targetHash(r.Context(), h.db, h.canonicalLinks, req.URL)
 	record := xrpc.NewBookmarkRecord(req.URL, urlHash, req.Title, req.Description)
 
 	if err := record.Validate(); err != nil {
@@ -217,15 +219,16 @@ func (h *APIKeyHandler) QuickBookmark(w http.ResponseWriter, r *http.Request) {
 
 	cid := result.CID
 	bookmark := &db.Bookmark{
-		URI:         result.URI,
-		AuthorDID:   apiKey.OwnerDID,
-		Source:      req.URL,
-		SourceHash:  urlHash,
-		Title:       titlePtr,
-		Description: descPtr,
-		CreatedAt:   time.Now(),
-		IndexedAt:   time.Now(),
-		CID:         &cid,
+		URI:          result.URI,
+		AuthorDID:    apiKey.OwnerDID,
+		Source:       req.URL,
+		SourceHash:   urlHash,
+		SourceDomain: h.db.URLDomain(req.URL),
+		Title:        titlePtr,
+		Description:  descPtr,
+		CreatedAt:    time.Now(),
+		IndexedAt:    time.Now(),
+		CID:          &cid,
 	}
 	h.db.CreateBookmark(bookmark)
 
@@ -268,7 +271,7 @@ func (h *APIKeyHandler) QuickSave(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	urlHash := db.HashURL(req.URL)
+	urlHash := targetHash(r.Context(), h.db, h.canonicalLinks, req.URL)
 
 	var isHighlight bool
 	if req.Selector != nil && req.Text == "" {
@@ -305,6 +308,7 @@ func (h *APIKeyHandler) QuickSave(w http.ResponseWriter, r *http.Request) {
 				AuthorDID:    apiKey.OwnerDID,
 				TargetSource: req.URL,
 				TargetHash:   urlHash,
+				TargetDomain: h.db.URLDomain(req.URL),
 				SelectorJSON: &selectorStr,
 				Color:        colorPtr,
 				CreatedAt:    time.Now(),
@@ -353,6 +357,7 @@ func (h *APIKeyHandler) QuickSave(w http.ResponseWriter, r *http.Request) {
 				BodyValue:    bodyValuePtr,
 				TargetSource: req.URL,
 				TargetHash:   urlHash,
+				TargetDomain: h.db.URLDomain(req.URL),
 				SelectorJSON: selectorStrPtr,
 				CreatedAt:    time.Now(),
 				IndexedAt:    time.Now(),
@@ -407,7 +412,7 @@ func (h *APIKeyHandler) QuickHighlight(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	urlHash := db.HashURL(req.URL)
+	urlHash := targetHash(r.Context(), h.db, h.canonicalLinks, req.URL)
 	color := req.Color
 	if color == "" {
 		color = "yellow"
@@ -442,6 +447,7 @@ func (h *APIKeyHandler) QuickHighlight(w http.ResponseWriter, r *http.Request) {
 		AuthorDID:    apiKey.OwnerDID,
 		TargetSource: req.URL,
 		TargetHash:   urlHash,
+		TargetDomain: h.db.URLDomain(req.URL),
 		SelectorJSON: &selectorStr,
 		Color:        colorPtr,
 		CreatedAt:    time.Now(),
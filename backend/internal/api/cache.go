@@ -8,6 +8,7 @@ import (
 type ProfileCache interface {
 	Get(did string) (Author, bool)
 	Set(did string, profile Author)
+	Delete(did string)
 }
 type InMemoryCache struct {
 	cache sync.Map
@@ -46,3 +47,7 @@ func (c *InMemoryCache) Set(did string, profile Author) {
 		ExpiresAt: time.Now().Add(c.ttl),
 	})
 }
+
+func (c *InMemoryCache) Delete(did string) {
+	c.cache.Delete(did)
+}
@@ -0,0 +1,43 @@
+package api
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"margin.at/internal/db"
+	"margin.at/internal/urlcanon"
+)
+
+// targetHash hashes the URL a user is writing a record against. When links
+// is set, the record follows the target page's <link rel="canonical">: it is
+// filed under the canonical page and the alias is remembered so lookups by
+// the original URL find it. links is nil unless enabled, because it costs a
+// page fetch on every write to a URL not seen before.
+func targetHash(ctx context.Context, database *db.DB, links *urlcanon.LinkResolver, rawURL string) string {
+	hash := database.HashURL(rawURL)
+	if links == nil {
+		return hash
+	}
+
+	if alias, err := database.GetURLAlias(hash); err == nil && alias != nil {
+		return alias.CanonicalHash
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	canonicalURL, err := links.Resolve(ctx, rawURL)
+	if err != nil || canonicalURL == "" {
+		return hash
+	}
+
+	canonicalHash := database.HashURL(canonicalURL)
+	if canonicalHash == hash {
+		return hash
+	}
+	if err := database.SaveURLAlias(rawURL, canonicalURL); err != nil {
+		log.Printf("Failed to save URL alias %s -> %s: %v", rawURL, canonicalURL, err)
+		return hash
+	}
+	return canonicalHash
+}
@@ -0,0 +1,25 @@
+package api
+
+import (
+	"expvar"
+	"net/http"
+
+	"margin.at/internal/config"
+)
+
+// AdminDebugVars serves the expvar metrics, which include the command line
+// and memory stats, to admins only.
+func (h *Handler) AdminDebugVars(w http.ResponseWriter, r *http.Request) {
+	session, err := h.refresher.GetSessionWithAutoRefresh(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if !config.Get().IsAdmin(session.DID) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	expvar.Handler().ServeHTTP(w, r)
+}
@@ -0,0 +1,47 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"margin.at/internal/db"
+)
+
+// parseFeedFilters applies the since, until and domain parameters to q.
+// Dates are RFC 3339 timestamps or plain YYYY-MM-DD days. A plain since day
+// starts at midnight and a plain until day is inclusive. It writes a 400 and returns false when a date is malformed.
+func parseFeedFilters(w http.ResponseWriter, r *http.Request, q *db.FeedQuery) bool {
+	params := r.URL.Query()
+
+	if since := params.Get("since"); since != "" {
+		t, _, err := parseDateParam(since)
+		if err != nil {
+			WriteBadRequest(w, "invalid since: expected RFC 3339 or YYYY-MM-DD")
+			return false
+		}
+		q.Since = t
+	}
+	if until := params.Get("until"); until != "" {
+		t, day, err := parseDateParam(until)
+		if err != nil {
+			WriteBadRequest(w, "invalid until: expected RFC 3339 or YYYY-MM-DD")
+			return false
+		}
+		if day {
+			t = t.AddDate(0, 0, 1)
+		}
+		q.Until = t
+	}
+	q.Domain = params.Get("domain")
+	return true
+}
+
+func parseDateParam(value string) (t time.Time, day bool, err error) {
+	if t, err = time.Parse(time.RFC3339, value); err == nil {
+		return t.UTC(), false, nil
+	}
+	if t, err = time.Parse("2006-01-02", value); err == nil {
+		return t, true, nil
+	}
+	return time.Time{}, false, err
+}
@@ -0,0 +1,17 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// GetFirehoseStatus reports the ingester's relay health.
+func (h *Handler) GetFirehoseStatus(w http.ResponseWriter, r *http.Request) {
+	if h.ingester == nil {
+		http.Error(w, "Firehose ingester not running", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.ingester.Status())
+}
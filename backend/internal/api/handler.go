@@ -4,7 +4,6 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
 	"net/url"
@@ -17,7 +16,10 @@ import (
 	"github.com/go-chi/chi/v5"
 
 	"margin.at/internal/db"
+	"margin.at/internal/firehose"
+	"margin.at/internal/safehttp"
 	internal_sync "margin.at/internal/sync"
+	"margin.at/internal/urlcanon"
 	"margin.at/internal/xrpc"
 )
 
@@ -28,21 +30,25 @@ type Handler struct {
 	apiKeys           *APIKeyHandler
 	syncService       *internal_sync.Service
 	moderation        *ModerationHandler
+	// ingester is the running firehose ingester, or nil when there is none.
+	ingester *firehose.Ingester
 }
 
-func NewHandler(database *db.DB, annotationService *AnnotationService, refresher *TokenRefresher, syncService *internal_sync.Service) *Handler {
+func NewHandler(database *db.DB, annotationService *AnnotationService, refresher *TokenRefresher, syncService *internal_sync.Service, canonicalLinks *urlcanon.LinkResolver, ingester *firehose.Ingester) *Handler {
 	return &Handler{
 		db:                database,
 		annotationService: annotationService,
 		refresher:         refresher,
-		apiKeys:           NewAPIKeyHandler(database, refresher),
+		apiKeys:           NewAPIKeyHandler(database, refresher, canonicalLinks),
 		syncService:       syncService,
 		moderation:        NewModerationHandler(database, refresher),
+		ingester:          ingester,
 	}
 }
 
 func (h *Handler) RegisterRoutes(r chi.Router) {
 	r.Get("/health", h.Health)
+	r.Get("/health/firehose", h.GetFirehoseStatus)
 
 	r.Route("/api", func(r chi.Router) {
 		r.Get("/annotations", h.GetAnnotations)
@@ -69,6 +75,7 @@ func (h *Handler) RegisterRoutes(r chi.Router) {
 		r.Get("/collections/containing", collectionService.GetAnnotationCollections)
 		r.Get("/collection", collectionService.GetCollection)
 		r.Post("/sync", h.SyncAll)
+		r.Get("/sync/status", h.GetSyncStatus)
 
 		r.Get("/targets", h.GetByTarget)
 		r.Get("/discover", h.DiscoverForURL)
@@ -80,6 +87,7 @@ func (h *Handler) RegisterRoutes(r chi.Router) {
 		r.Get("/users/{did}/tags", h.HandleGetUserTags)
 
 		r.Get("/trending-tags", h.HandleGetTrendingTags)
+		r.Get("/search", h.Search)
 
 		r.Get("/replies", h.GetReplies)
 		r.Get("/likes", h.GetLikeCount)
@@ -115,6 +123,9 @@ func (h *Handler) RegisterRoutes(r chi.Router) {
 		r.Delete("/moderation/admin/label", h.moderation.AdminDeleteLabel)
 		r.Get("/moderation/admin/labels", h.moderation.AdminGetLabels)
 		r.Get("/moderation/labeler", h.moderation.GetLabelerInfo)
+
+		r.Get("/admin/ingest-failures", h.AdminGetIngestFailures)
+		r.Post("/admin/ingest-failures/retry", h.AdminRetryIngestFailures)
 	})
 }
 
@@ -138,14 +149,15 @@ func (h *Handler) GetAnnotations(w http.ResponseWriter, r *http.Request) {
 	var err error
 
 	if source != "" {
-		urlHash := db.HashURL(source)
-		annotations, err = h.db.GetAnnotationsByTargetHash(urlHash, limit, offset)
+		annotations, err = h.db.QueryAnnotations(db.FeedQuery{TargetHashes: h.db.TargetHashes(source), Limit: limit, Offset: offset})
 	} else if motivation != "" {
 		annotations, err = h.db.GetAnnotationsByMotivation(motivation, limit, offset)
-	} else if tag != "" {
-		annotations, err = h.db.GetAnnotationsByTag(tag, limit, offset)
 	} else {
-		annotations, err = h.db.GetRecentAnnotations(limit, offset)
+		q := db.FeedQuery{Limit: limit, Offset: offset}
+		if tag != "" {
+			q.Tags.All = []string{tag}
+		}
+		annotations, err = h.db.QueryAnnotations(q)
 	}
 
 	if err != nil {
@@ -167,183 +179,92 @@ func (h *Handler) GetAnnotations(w http.ResponseWriter, r *http.Request) {
 func (h *Handler) GetFeed(w http.ResponseWriter, r *http.Request) {
 	limit := parseIntParam(r, "limit", 50)
 	offset := parseIntParam(r, "offset", 0)
-	tag := r.URL.Query().Get("tag")
 	creator := r.URL.Query().Get("creator")
 	feedType := r.URL.Query().Get("type")
+	motivation := r.URL.Query().Get("motivation")
+
+	cursor, ok := parseCursorParam(w, r)
+	if !ok {
+		return
+	}
+
+	q := db.FeedQuery{
+		Kinds:  feedKinds(motivation),
+		Tags:   parseTagFilter(r),
+		Sort:   db.SortRecent,
+		Cursor: cursor,
+	}
+	if !parseFeedFilters(w, r, &q) {
+		return
+	}
 
 	viewerDID := h.getViewerDID(r)
 
 	if viewerDID != "" && (feedType == "my-feed" || creator == viewerDID) {
-		h.serveUserFeedFromPDS(w, r, viewerDID, tag, r.URL.Query().Get("motivation"), limit, offset)
+		h.serveUserFeedFromPDS(w, r, viewerDID, q, motivation, limit, offset)
 		return
 	}
 
-	var annotations []db.Annotation
-	var highlights []db.Highlight
-	var bookmarks []db.Bookmark
-	var collectionItems []db.CollectionItem
-	var err error
+	if creator != "" {
+		q.Authors = []string{creator}
+	}
+	if !q.Tags.IsZero() || creator != "" {
+		q.Kinds = withoutKind(q.Kinds, db.KindCollectionItem)
+	}
+	switch feedType {
+	case "margin", "semble":
+		q.Source = feedType
+	case "popular":
+		q.Sort = db.SortPopular
+	case "shelved":
+		q.Sort = db.SortShelved
+	}
 
-	motivation := r.URL.Query().Get("motivation")
+	if q.Sort == db.SortRecent && (cursor != nil || offset == 0) {
+		h.serveFeedPage(w, r, q, limit, viewerDID)
+		return
+	}
 
-	fetchLimit := limit + offset
+	q.Limit = limit + offset
+	result, err := h.db.QueryFeed(q)
+	if err != nil {
+		log.Printf("Error fetching feed: %v\n", err)
+		result = &db.Feed{}
+	}
 
-	if tag != "" {
-		if creator != "" {
-			if motivation == "" || motivation == "commenting" {
-				switch feedType {
-				case "margin":
-					annotations, _ = h.db.GetMarginAnnotationsByTagAndAuthor(tag, creator, fetchLimit, 0)
-				case "semble":
-					annotations, _ = h.db.GetSembleAnnotationsByTagAndAuthor(tag, creator, fetchLimit, 0)
-				default:
-					annotations, _ = h.db.GetAnnotationsByTagAndAuthor(tag, creator, fetchLimit, 0)
-				}
-			}
-			if motivation == "" || motivation == "highlighting" {
-				switch feedType {
-				case "margin":
-					highlights, _ = h.db.GetMarginHighlightsByTagAndAuthor(tag, creator, fetchLimit, 0)
-				case "semble":
-					highlights, _ = h.db.GetSembleHighlightsByTagAndAuthor(tag, creator, fetchLimit, 0)
-				default:
-					highlights, _ = h.db.GetHighlightsByTagAndAuthor(tag, creator, fetchLimit, 0)
-				}
-			}
-			if motivation == "" || motivation == "bookmarking" {
-				switch feedType {
-				case "margin":
-					bookmarks, _ = h.db.GetMarginBookmarksByTagAndAuthor(tag, creator, fetchLimit, 0)
-				case "semble":
-					bookmarks, _ = h.db.GetSembleBookmarksByTagAndAuthor(tag, creator, fetchLimit, 0)
-				default:
-					bookmarks, _ = h.db.GetBookmarksByTagAndAuthor(tag, creator, fetchLimit, 0)
-				}
-			}
-			collectionItems = []db.CollectionItem{}
-		} else {
-			if motivation == "" || motivation == "commenting" {
-				switch feedType {
-				case "margin":
-					annotations, _ = h.db.GetMarginAnnotationsByTag(tag, fetchLimit, 0)
-				case "semble":
-					annotations, _ = h.db.GetSembleAnnotationsByTag(tag, fetchLimit, 0)
-				default:
-					annotations, _ = h.db.GetAnnotationsByTag(tag, fetchLimit, 0)
-				}
-			}
-			if motivation == "" || motivation == "highlighting" {
-				switch feedType {
-				case "margin":
-					highlights, _ = h.db.GetMarginHighlightsByTag(tag, fetchLimit, 0)
-				case "semble":
-					highlights, _ = h.db.GetSembleHighlightsByTag(tag, fetchLimit, 0)
-				default:
-					highlights, _ = h.db.GetHighlightsByTag(tag, fetchLimit, 0)
-				}
-			}
-			if motivation == "" || motivation == "bookmarking" {
-				switch feedType {
-				case "margin":
-					bookmarks, _ = h.db.GetMarginBookmarksByTag(tag, fetchLimit, 0)
-				case "semble":
-					bookmarks, _ = h.db.GetSembleBookmarksByTag(tag, fetchLimit, 0)
-				default:
-					bookmarks, _ = h.db.GetBookmarksByTag(tag, fetchLimit, 0)
-				}
-			}
-			collectionItems = []db.CollectionItem{}
-		}
-	} else if creator != "" {
-		if motivation == "" || motivation == "commenting" {
-			switch feedType {
-			case "margin":
-				annotations, _ = h.db.GetMarginAnnotationsByAuthor(creator, fetchLimit, 0)
-			case "semble":
-				annotations, _ = h.db.GetSembleAnnotationsByAuthor(creator, fetchLimit, 0)
-			default:
-				annotations, _ = h.db.GetAnnotationsByAuthor(creator, fetchLimit, 0)
-			}
-		}
-		if motivation == "" || motivation == "highlighting" {
-			switch feedType {
-			case "margin":
-				highlights, _ = h.db.GetMarginHighlightsByAuthor(creator, fetchLimit, 0)
-			case "semble":
-				highlights, _ = h.db.GetSembleHighlightsByAuthor(creator, fetchLimit, 0)
-			default:
-				highlights, _ = h.db.GetHighlightsByAuthor(creator, fetchLimit, 0)
-			}
-		}
-		if motivation == "" || motivation == "bookmarking" {
-			switch feedType {
-			case "margin":
-				bookmarks, _ = h.db.GetMarginBookmarksByAuthor(creator, fetchLimit, 0)
-			case "semble":
-				bookmarks, _ = h.db.GetSembleBookmarksByAuthor(creator, fetchLimit, 0)
-			default:
-				bookmarks, _ = h.db.GetBookmarksByAuthor(creator, fetchLimit, 0)
-			}
-		}
-		collectionItems = []db.CollectionItem{}
+	feed := h.assembleFeed(r.Context(), result.Annotations, result.Highlights, result.Bookmarks, result.CollectionItems, viewerDID)
+	feed = h.filterFeedByModeration(feed, viewerDID)
+
+	switch feedType {
+	case "popular":
+		sortFeedByPopularity(feed)
+	default:
+		sortFeed(feed)
+	}
+
+	if offset < len(feed) {
+		feed = feed[offset:]
 	} else {
-		if motivation == "" || motivation == "commenting" {
-			switch feedType {
-			case "margin":
-				annotations, _ = h.db.GetMarginAnnotations(fetchLimit, 0)
-			case "semble":
-				annotations, _ = h.db.GetSembleAnnotations(fetchLimit, 0)
-			case "popular":
-				annotations, _ = h.db.GetPopularAnnotations(fetchLimit, 0)
-			case "shelved":
-				annotations, _ = h.db.GetShelvedAnnotations(fetchLimit, 0)
-			default:
-				annotations, _ = h.db.GetRecentAnnotations(fetchLimit, 0)
-			}
-		}
-		if motivation == "" || motivation == "highlighting" {
-			switch feedType {
-			case "margin":
-				highlights, _ = h.db.GetMarginHighlights(fetchLimit, 0)
-			case "semble":
-				highlights, _ = h.db.GetSembleHighlights(fetchLimit, 0)
-			case "popular":
-				highlights, _ = h.db.GetPopularHighlights(fetchLimit, 0)
-			case "shelved":
-				highlights, _ = h.db.GetShelvedHighlights(fetchLimit, 0)
-			default:
-				highlights, _ = h.db.GetRecentHighlights(fetchLimit, 0)
-			}
-		}
-		if motivation == "" || motivation == "bookmarking" {
-			switch feedType {
-			case "margin":
-				bookmarks, _ = h.db.GetMarginBookmarks(fetchLimit, 0)
-			case "semble":
-				bookmarks, _ = h.db.GetSembleBookmarks(fetchLimit, 0)
-			case "popular":
-				bookmarks, _ = h.db.GetPopularBookmarks(fetchLimit, 0)
-			case "shelved":
-				bookmarks, _ = h.db.GetShelvedBookmarks(fetchLimit, 0)
-			default:
-				bookmarks, _ = h.db.GetRecentBookmarks(fetchLimit, 0)
-			}
-		}
-		if motivation == "" {
-			switch feedType {
-			case "popular":
-				collectionItems, err = h.db.GetPopularCollectionItems(fetchLimit, 0)
-			case "shelved":
-				collectionItems, err = h.db.GetShelvedCollectionItems(fetchLimit, 0)
-			default:
-				collectionItems, err = h.db.GetRecentCollectionItems(fetchLimit, 0)
-			}
-			if err != nil {
-				log.Printf("Error fetching collection items: %v\n", err)
-			}
-		}
+		feed = []interface{}{}
+	}
+
+	if len(feed) > limit {
+		feed = feed[:limit]
 	}
 
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"@context":   "http://www.w3.org/ns/anno.jsonld",
+		"type":       "Collection",
+		"items":      feed,
+		"totalItems": len(feed),
+	})
+}
+
+// assembleFeed hydrates each record type and merges them into one feed,
+// dropping records that their own author also added to a collection so they
+// only appear once, as the collection item.
+func (h *Handler) assembleFeed(ctx context.Context, annotations []db.Annotation, highlights []db.Highlight, bookmarks []db.Bookmark, collectionItems []db.CollectionItem, viewerDID string) []interface{} {
 	authAnnos, _ := hydrateAnnotations(h.db, annotations, viewerDID)
 	authHighs, _ := hydrateHighlights(h.db, highlights, viewerDID)
 	authBooks, _ := hydrateBookmarks(h.db, bookmarks, viewerDID)
@@ -356,7 +277,7 @@ func (h *Handler) GetFeed(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 		if len(sembleURIs) > 0 {
-			ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+			ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
 			defer cancel()
 			ensureSembleCardsIndexed(ctx, h.db, sembleURIs)
 		}
@@ -401,78 +322,49 @@ func (h *Handler) GetFeed(w http.ResponseWriter, r *http.Request) {
 	for _, ci := range authCollectionItems {
 		feed = append(feed, ci)
 	}
+	return feed
+}
 
-	if feedType != "" && feedType != "all" && feedType != "my-feed" {
-		var filtered []interface{}
-		for _, item := range feed {
-			isSemble := false
-			var uri string
-			switch v := item.(type) {
-			case APIAnnotation:
-				uri = v.ID
-			case APIHighlight:
-				uri = v.ID
-			case APIBookmark:
-				uri = v.ID
-			case APICollectionItem:
-				if v.Annotation != nil {
-					uri = v.Annotation.ID
-				} else if v.Highlight != nil {
-					uri = v.Highlight.ID
-				} else if v.Bookmark != nil {
-					uri = v.Bookmark.ID
-				} else {
-					uri = v.ID
-				}
-			}
-			if strings.Contains(uri, "network.cosmik") {
-				isSemble = true
-			}
-
-			switch feedType {
-			case "semble":
-				if isSemble {
-					filtered = append(filtered, item)
-				}
-			case "margin":
-				if !isSemble {
-					filtered = append(filtered, item)
-				}
-			case "popular", "shelved":
-				filtered = append(filtered, item)
-			}
-		}
-		feed = filtered
-	}
-
-	feed = h.filterFeedByModeration(feed, viewerDID)
-
-	switch feedType {
-	case "popular":
-		sortFeedByPopularity(feed)
+// feedKinds maps the feed's motivation parameter onto the record types it
+// selects.
+func feedKinds(motivation string) []db.FeedKind {
+	switch motivation {
+	case "commenting":
+		return []db.FeedKind{db.KindAnnotation}
+	case "highlighting":
+		return []db.FeedKind{db.KindHighlight}
+	case "bookmarking":
+		return []db.FeedKind{db.KindBookmark}
 	default:
-		sortFeed(feed)
+		return []db.FeedKind{db.KindAnnotation, db.KindHighlight, db.KindBookmark, db.KindCollectionItem}
 	}
+}
 
-	log.Printf("[DEBUG] FeedType: %s, Total Items before slice: %d", feedType, len(feed))
-	if len(feed) > 0 {
-		first := feed[0]
-		switch v := first.(type) {
-		case APIAnnotation:
-			log.Printf("[DEBUG] First Item (Annotation): %s, Likes: %d, Replies: %d", v.ID, v.LikeCount, v.ReplyCount)
-		case APIHighlight:
-			log.Printf("[DEBUG] First Item (Highlight): %s, Likes: %d, Replies: %d", v.ID, v.LikeCount, v.ReplyCount)
+func withoutKind(kinds []db.FeedKind, kind db.FeedKind) []db.FeedKind {
+	var out []db.FeedKind
+	for _, k := range kinds {
+		if k != kind {
+			out = append(out, k)
 		}
 	}
+	return out
+}
 
-	if offset < len(feed) {
-		feed = feed[offset:]
-	} else {
-		feed = []interface{}{}
+func (h *Handler) serveFeedPage(w http.ResponseWriter, r *http.Request, q db.FeedQuery, limit int, viewerDID string) {
+	q.Limit = limit + 1
+	result, err := h.db.QueryFeed(q)
+	if err != nil {
+		log.Printf("Error fetching feed page: %v", err)
+		result = &db.Feed{}
 	}
 
-	if len(feed) > limit {
-		feed = feed[:limit]
+	page := newFeedPage(result.Annotations, result.Highlights, result.Bookmarks, result.CollectionItems, limit)
+
+	feed := h.assembleFeed(r.Context(), page.annotations, page.highlights, page.bookmarks, page.collectionItems, viewerDID)
+	feed = h.filterFeedByModeration(feed, viewerDID)
+	page.sort(feed)
+	if feed == nil {
+		feed = []interface{}{}
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -481,10 +373,21 @@ func (h *Handler) GetFeed(w http.ResponseWriter, r *http.Request) {
 		"type":       "Collection",
 		"items":      feed,
 		"totalItems": len(feed),
+		"cursor":     page.cursor,
 	})
 }
 
-func (h *Handler) serveUserFeedFromPDS(w http.ResponseWriter, r *http.Request, did, tag, motivation string, limit, offset int) {
+// serveUserFeedFromPDS serves the first page of the viewer's own feed from
+// their PDS, so records they just wrote show up before the firehose indexes
+// them, and stores what it fetched. Later pages are read from the index by
+// keyset, as the PDS only lists its newest records cheaply.
+func (h *Handler) serveUserFeedFromPDS(w http.ResponseWriter, r *http.Request, did string, q db.FeedQuery, motivation string, limit, offset int) {
+	if q.Cursor != nil {
+		q.Authors = []string{did}
+		h.serveFeedPage(w, r, q, limit, did)
+		return
+	}
+
 	var wg sync.WaitGroup
 	var rawAnnos, rawHighs, rawBooks []interface{}
 	var errAnnos, errHighs, errBooks error
@@ -533,21 +436,21 @@ func (h *Handler) serveUserFeedFromPDS(w http.ResponseWriter, r *http.Request, d
 
 	for _, r := range rawAnnos {
 		if a, ok := r.(*db.Annotation); ok {
-			if tag == "" || containsTag(a.TagsJSON, tag) {
+			if q.Matches(a.TagsJSON, a.CreatedAt, a.TargetDomain) {
 				annotations = append(annotations, *a)
 			}
 		}
 	}
 	for _, r := range rawHighs {
 		if h, ok := r.(*db.Highlight); ok {
-			if tag == "" || containsTag(h.TagsJSON, tag) {
+			if q.Matches(h.TagsJSON, h.CreatedAt, h.TargetDomain) {
 				highlights = append(highlights, *h)
 			}
 		}
 	}
 	for _, r := range rawBooks {
 		if b, ok := r.(*db.Bookmark); ok {
-			if tag == "" || containsTag(b.TagsJSON, tag) {
+			if q.Matches(b.TagsJSON, b.CreatedAt, b.SourceDomain) {
 				bookmarks = append(bookmarks, *b)
 			}
 		}
@@ -566,12 +469,15 @@ func (h *Handler) serveUserFeedFromPDS(w http.ResponseWriter, r *http.Request, d
 	}()
 
 	collectionItems := []db.CollectionItem{}
-	if tag == "" && motivation == "" {
+	if q.Tags.IsZero() && q.Domain == "" && motivation == "" {
 		items, err := h.db.GetCollectionItemsByAuthor(did)
 		if err != nil {
 			log.Printf("Error fetching collection items for user feed: %v", err)
-		} else {
-			collectionItems = items
+		}
+		for _, item := range items {
+			if q.InRange(item.CreatedAt) {
+				collectionItems = append(collectionItems, item)
+			}
 		}
 	}
 
@@ -589,10 +495,17 @@ func (h *Handler) serveUserFeedFromPDS(w http.ResponseWriter, r *http.Request, d
 		}
 	}
 
-	authAnnos, _ := hydrateAnnotations(h.db, annotations, did)
-	authHighs, _ := hydrateHighlights(h.db, highlights, did)
-	authBooks, _ := hydrateBookmarks(h.db, bookmarks, did)
-	authCollectionItems, _ := hydrateCollectionItems(h.db, collectionItems, did)
+	var page *feedPage
+	if offset == 0 {
+		page = newFeedPage(annotations, highlights, bookmarks, collectionItems, limit)
+	} else {
+		page = &feedPage{annotations: annotations, highlights: highlights, bookmarks: bookmarks, collectionItems: collectionItems}
+	}
+
+	authAnnos, _ := hydrateAnnotations(h.db, page.annotations, did)
+	authHighs, _ := hydrateHighlights(h.db, page.highlights, did)
+	authBooks, _ := hydrateBookmarks(h.db, page.bookmarks, did)
+	authCollectionItems, _ := hydrateCollectionItems(h.db, page.collectionItems, did)
 
 	var feed []interface{}
 	for _, a := range authAnnos {
@@ -610,16 +523,21 @@ func (h *Handler) serveUserFeedFromPDS(w http.ResponseWriter, r *http.Request, d
 		}
 	}
 
-	sortFeed(feed)
-
-	if offset < len(feed) {
-		feed = feed[offset:]
+	if offset == 0 {
+		page.sort(feed)
 	} else {
-		feed = []interface{}{}
+		sortFeed(feed)
+		if offset < len(feed) {
+			feed = feed[offset:]
+		} else {
+			feed = nil
+		}
+		if len(feed) > limit {
+			feed = feed[:limit]
+		}
 	}
-
-	if len(feed) > limit {
-		feed = feed[:limit]
+	if feed == nil {
+		feed = []interface{}{}
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -628,24 +546,8 @@ func (h *Handler) serveUserFeedFromPDS(w http.ResponseWriter, r *http.Request, d
 		"type":       "Collection",
 		"items":      feed,
 		"totalItems": len(feed),
+		"cursor":     page.cursor,
 	})
-
-}
-
-func containsTag(tagsJSON *string, tag string) bool {
-	if tagsJSON == nil || *tagsJSON == "" {
-		return false
-	}
-	var tags []string
-	if err := json.Unmarshal([]byte(*tagsJSON), &tags); err != nil {
-		return false
-	}
-	for _, t := range tags {
-		if t == tag {
-			return true
-		}
-	}
-	return false
 }
 
 func sortFeed(feed []interface{}) {
@@ -896,22 +798,36 @@ func (h *Handler) GetByTarget(w http.ResponseWriter, r *http.Request) {
 
 	limit := parseIntParam(r, "limit", 50)
 	offset := parseIntParam(r, "offset", 0)
+	cursor, ok := parseCursorParam(w, r)
+	if !ok {
+		return
+	}
+
+	urlHash := h.db.HashURL(source)
 
-	urlHash := db.HashURL(source)
-	rawHash := db.HashString(source)
+	var annotations []db.Annotation
+	var highlights []db.Highlight
+	var bookmarks []db.Bookmark
+	var nextCursor string
 
-	annotations, _ := h.db.GetAnnotationsByTargetHash(urlHash, limit, offset)
-	highlights, _ := h.db.GetHighlightsByTargetHash(urlHash, limit, offset)
-	bookmarks, _ := h.db.GetBookmarksByTargetHash(urlHash, limit, offset)
+	q := db.FeedQuery{TargetHashes: h.db.TargetHashes(source)}
+	if !parseFeedFilters(w, r, &q) {
+		return
+	}
 
-	if rawHash != urlHash {
-		rawAnnotations, _ := h.db.GetAnnotationsByTargetHash(rawHash, limit, offset)
-		rawHighlights, _ := h.db.GetHighlightsByTargetHash(rawHash, limit, offset)
-		rawBookmarks, _ := h.db.GetBookmarksByTargetHash(rawHash, limit, offset)
+	if cursor != nil || offset == 0 {
+		q.Cursor, q.Limit = cursor, limit+1
+		annotations, _ = h.db.QueryAnnotations(q)
+		highlights, _ = h.db.QueryHighlights(q)
+		bookmarks, _ = h.db.QueryBookmarks(q)
 
-		annotations = mergeAnnotations(annotations, rawAnnotations)
-		highlights = mergeHighlights(highlights, rawHighlights)
-		bookmarks = mergeBookmarks(bookmarks, rawBookmarks)
+		page := newFeedPage(annotations, highlights, bookmarks, nil, limit)
+		annotations, highlights, bookmarks, nextCursor = page.annotations, page.highlights, page.bookmarks, page.cursor
+	} else {
+		q.Limit, q.Offset = limit, offset
+		annotations, _ = h.db.QueryAnnotations(q)
+		highlights, _ = h.db.QueryHighlights(q)
+		bookmarks, _ = h.db.QueryBookmarks(q)
 	}
 
 	enrichedAnnotations, _ := hydrateAnnotations(h.db, annotations, h.getViewerDID(r))
@@ -926,6 +842,7 @@ func (h *Handler) GetByTarget(w http.ResponseWriter, r *http.Request) {
 		"annotations": enrichedAnnotations,
 		"highlights":  enrichedHighlights,
 		"bookmarks":   enrichedBookmarks,
+		"cursor":      nextCursor,
 	})
 }
 
@@ -975,10 +892,17 @@ func (h *Handler) DiscoverForURL(w http.ResponseWriter, r *http.Request) {
 	localHighlights, _ := h.db.GetHighlightsByURIs(highlightURIs)
 	localBookmarks, _ := h.db.GetBookmarksByURIs(bookmarkURIs)
 
-	urlHash := db.HashURL(source)
-	dbAnnotations, _ := h.db.GetAnnotationsByTargetHash(urlHash, 100, 0)
-	dbHighlights, _ := h.db.GetHighlightsByTargetHash(urlHash, 100, 0)
-	dbBookmarks, _ := h.db.GetBookmarksByTargetHash(urlHash, 100, 0)
+	urlHash := h.db.HashURL(source)
+	local, err := h.db.QueryFeed(db.FeedQuery{
+		Kinds:        []db.FeedKind{db.KindAnnotation, db.KindHighlight, db.KindBookmark},
+		TargetHashes: h.db.TargetHashes(source),
+		Limit:        100,
+	})
+	if err != nil {
+		log.Printf("Error fetching local items for %s: %v", source, err)
+		local = &db.Feed{}
+	}
+	dbAnnotations, dbHighlights, dbBookmarks := local.Annotations, local.Highlights, local.Bookmarks
 
 	annoMap := make(map[string]db.Annotation)
 	for _, a := range localAnnotations {
@@ -1040,17 +964,15 @@ func (h *Handler) GetHighlights(w http.ResponseWriter, r *http.Request) {
 	limit := parseIntParam(r, "limit", 50)
 	offset := parseIntParam(r, "offset", 0)
 
-	var highlights []db.Highlight
-	var err error
-
+	q := db.FeedQuery{Limit: limit, Offset: offset}
 	if did != "" {
-		highlights, err = h.db.GetHighlightsByAuthor(did, limit, offset)
+		q.Authors = []string{did}
 	} else if tag != "" {
-		highlights, err = h.db.GetHighlightsByTag(tag, limit, offset)
-	} else {
-		highlights, err = h.db.GetRecentHighlights(limit, offset)
+		q.Tags.All = []string{tag}
 	}
 
+	highlights, err := h.db.QueryHighlights(q)
+
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -1077,7 +999,7 @@ func (h *Handler) GetBookmarks(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	bookmarks, err := h.db.GetBookmarksByAuthor(did, limit, offset)
+	bookmarks, err := h.db.QueryBookmarks(db.FeedQuery{Authors: []string{did}, Limit: limit, Offset: offset})
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -1101,13 +1023,17 @@ func (h *Handler) GetUserAnnotations(w http.ResponseWriter, r *http.Request) {
 	}
 	limit := parseIntParam(r, "limit", 50)
 	offset := parseIntParam(r, "offset", 0)
+	cursor, ok := parseCursorParam(w, r)
+	if !ok {
+		return
+	}
 
 	var annotations []db.Annotation
 	var err error
 
 	viewerDID := h.getViewerDID(r)
 
-	if offset == 0 && viewerDID != "" && did == viewerDID {
+	if offset == 0 && cursor == nil && viewerDID != "" && did == viewerDID {
 		go func() {
 			if _, err := h.FetchLatestUserRecords(r, did, xrpc.CollectionAnnotation, limit); err != nil {
 				log.Printf("Background sync error (annotations): %v", err)
@@ -1115,7 +1041,20 @@ func (h *Handler) GetUserAnnotations(w http.ResponseWriter, r *http.Request) {
 		}()
 	}
 
-	annotations, err = h.db.GetAnnotationsByAuthor(did, limit, offset)
+	q := db.FeedQuery{Authors: []string{did}, Tags: parseTagFilter(r)}
+	if !parseFeedFilters(w, r, &q) {
+		return
+	}
+
+	var nextCursor string
+	if cursor != nil || offset == 0 {
+		q.Cursor, q.Limit = cursor, limit+1
+		annotations, err = h.db.QueryAnnotations(q)
+		annotations, nextCursor = pageOf(annotations, limit, func(a db.Annotation) (time.Time, string) { return a.CreatedAt, a.URI })
+	} else {
+		q.Limit, q.Offset = limit, offset
+		annotations, err = h.db.QueryAnnotations(q)
+	}
 
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -1131,6 +1070,7 @@ func (h *Handler) GetUserAnnotations(w http.ResponseWriter, r *http.Request) {
 		"creator":    did,
 		"items":      enriched,
 		"totalItems": len(enriched),
+		"cursor":     nextCursor,
 	})
 }
 
@@ -1141,13 +1081,17 @@ func (h *Handler) GetUserHighlights(w http.ResponseWriter, r *http.Request) {
 	}
 	limit := parseIntParam(r, "limit", 50)
 	offset := parseIntParam(r, "offset", 0)
+	cursor, ok := parseCursorParam(w, r)
+	if !ok {
+		return
+	}
 
 	var highlights []db.Highlight
 	var err error
 
 	viewerDID := h.getViewerDID(r)
 
-	if offset == 0 && viewerDID != "" && did == viewerDID {
+	if offset == 0 && cursor == nil && viewerDID != "" && did == viewerDID {
 		go func() {
 			if _, err := h.FetchLatestUserRecords(r, did, xrpc.CollectionHighlight, limit); err != nil {
 				log.Printf("Background sync error (highlights): %v", err)
@@ -1155,7 +1099,20 @@ func (h *Handler) GetUserHighlights(w http.ResponseWriter, r *http.Request) {
 		}()
 	}
 
-	highlights, err = h.db.GetHighlightsByAuthor(did, limit, offset)
+	q := db.FeedQuery{Authors: []string{did}, Tags: parseTagFilter(r)}
+	if !parseFeedFilters(w, r, &q) {
+		return
+	}
+
+	var nextCursor string
+	if cursor != nil || offset == 0 {
+		q.Cursor, q.Limit = cursor, limit+1
+		highlights, err = h.db.QueryHighlights(q)
+		highlights, nextCursor = pageOf(highlights, limit, func(hl db.Highlight) (time.Time, string) { return hl.CreatedAt, hl.URI })
+	} else {
+		q.Limit, q.Offset = limit, offset
+		highlights, err = h.db.QueryHighlights(q)
+	}
 
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -1171,6 +1128,7 @@ func (h *Handler) GetUserHighlights(w http.ResponseWriter, r *http.Request) {
 		"creator":    did,
 		"items":      enriched,
 		"totalItems": len(enriched),
+		"cursor":     nextCursor,
 	})
 }
 
@@ -1181,13 +1139,17 @@ func (h *Handler) GetUserBookmarks(w http.ResponseWriter, r *http.Request) {
 	}
 	limit := parseIntParam(r, "limit", 50)
 	offset := parseIntParam(r, "offset", 0)
+	cursor, ok := parseCursorParam(w, r)
+	if !ok {
+		return
+	}
 
 	var bookmarks []db.Bookmark
 	var err error
 
 	viewerDID := h.getViewerDID(r)
 
-	if offset == 0 && viewerDID != "" && did == viewerDID {
+	if offset == 0 && cursor == nil && viewerDID != "" && did == viewerDID {
 		go func() {
 			if _, err := h.FetchLatestUserRecords(r, did, xrpc.CollectionBookmark, limit); err != nil {
 				log.Printf("Background sync error (bookmarks): %v", err)
@@ -1195,7 +1157,20 @@ func (h *Handler) GetUserBookmarks(w http.ResponseWriter, r *http.Request) {
 		}()
 	}
 
-	bookmarks, err = h.db.GetBookmarksByAuthor(did, limit, offset)
+	q := db.FeedQuery{Authors: []string{did}, Tags: parseTagFilter(r)}
+	if !parseFeedFilters(w, r, &q) {
+		return
+	}
+
+	var nextCursor string
+	if cursor != nil || offset == 0 {
+		q.Cursor, q.Limit = cursor, limit+1
+		bookmarks, err = h.db.QueryBookmarks(q)
+		bookmarks, nextCursor = pageOf(bookmarks, limit, func(b db.Bookmark) (time.Time, string) { return b.CreatedAt, b.URI })
+	} else {
+		q.Limit, q.Offset = limit, offset
+		bookmarks, err = h.db.QueryBookmarks(q)
+	}
 
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -1211,6 +1186,7 @@ func (h *Handler) GetUserBookmarks(w http.ResponseWriter, r *http.Request) {
 		"creator":    did,
 		"items":      enriched,
 		"totalItems": len(enriched),
+		"cursor":     nextCursor,
 	})
 }
 
@@ -1231,11 +1207,31 @@ func (h *Handler) GetUserTargetItems(w http.ResponseWriter, r *http.Request) {
 
 	limit := parseIntParam(r, "limit", 50)
 	offset := parseIntParam(r, "offset", 0)
+	cursor, ok := parseCursorParam(w, r)
+	if !ok {
+		return
+	}
 
-	urlHash := db.HashURL(source)
+	urlHash := h.db.HashURL(source)
 
-	annotations, _ := h.db.GetAnnotationsByAuthorAndTargetHash(did, urlHash, limit, offset)
-	highlights, _ := h.db.GetHighlightsByAuthorAndTargetHash(did, urlHash, limit, offset)
+	var annotations []db.Annotation
+	var highlights []db.Highlight
+	var nextCursor string
+
+	q := db.FeedQuery{Authors: []string{did}, TargetHashes: h.db.TargetHashes(source)}
+
+	if cursor != nil || offset == 0 {
+		q.Cursor, q.Limit = cursor, limit+1
+		annotations, _ = h.db.QueryAnnotations(q)
+		highlights, _ = h.db.QueryHighlights(q)
+
+		page := newFeedPage(annotations, highlights, nil, nil, limit)
+		annotations, highlights, nextCursor = page.annotations, page.highlights, page.cursor
+	} else {
+		q.Limit, q.Offset = limit, offset
+		annotations, _ = h.db.QueryAnnotations(q)
+		highlights, _ = h.db.QueryHighlights(q)
+	}
 
 	enrichedAnnotations, _ := hydrateAnnotations(h.db, annotations, h.getViewerDID(r))
 	enrichedHighlights, _ := hydrateHighlights(h.db, highlights, h.getViewerDID(r))
@@ -1248,6 +1244,7 @@ func (h *Handler) GetUserTargetItems(w http.ResponseWriter, r *http.Request) {
 		"sourceHash":  urlHash,
 		"annotations": enrichedAnnotations,
 		"highlights":  enrichedHighlights,
+		"cursor":      nextCursor,
 	})
 }
 
@@ -1347,132 +1344,35 @@ func (h *Handler) GetURLMetadata(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "url parameter required", http.StatusBadRequest)
 		return
 	}
-
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Get(targetURL)
-	if err != nil {
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]string{"title": "", "error": "failed to fetch"})
+	if err := safehttp.CheckURL(targetURL); err != nil {
+		http.Error(w, "url must be a public http or https URL", http.StatusBadRequest)
 		return
 	}
-	defer resp.Body.Close()
 
-	body, err := io.ReadAll(io.LimitReader(resp.Body, 500*1024))
+	urlHash := h.db.HashURL(targetURL)
+	cached, err := h.db.GetPageMetadata(urlHash)
 	if err != nil {
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]string{"title": ""})
-		return
-	}
-
-	content := string(body)
-
-	extract := func(key string) string {
-		attr := fmt.Sprintf("property=\"og:%s\"", key)
-		if idx := strings.Index(content, attr); idx != -1 {
-			rest := content[idx:]
-			if contentIdx := strings.Index(rest, "content=\""); contentIdx != -1 {
-				start := contentIdx + 9
-				if end := strings.Index(rest[start:], "\""); end != -1 {
-					return rest[start : start+end]
-				}
-			}
-		}
-
-		attr = fmt.Sprintf("name=\"%s\"", key)
-		if idx := strings.Index(content, attr); idx != -1 {
-			rest := content[idx:]
-			if contentIdx := strings.Index(rest, "content=\""); contentIdx != -1 {
-				start := contentIdx + 9
-				if end := strings.Index(rest[start:], "\""); end != -1 {
-					return rest[start : start+end]
-				}
-			}
-		}
-		return ""
-	}
-
-	title := extract("title")
-	if title == "" {
-		if idx := strings.Index(content, "<title>"); idx != -1 {
-			start := idx + 7
-			if end := strings.Index(content[start:], "</title>"); end != -1 {
-				title = content[start : start+end]
-			}
-		}
-	}
-
-	description := extract("description")
-	image := extract("image")
-
-	var favicon string
-	findIcon := func(rel string) string {
-		search := fmt.Sprintf("rel=\"%s\"", rel)
-		if idx := strings.Index(content, search); idx != -1 {
-			startTag := strings.LastIndex(content[:idx], "<link")
-			if startTag != -1 {
-				endTag := strings.Index(content[startTag:], ">")
-				if endTag != -1 {
-					tag := content[startTag : startTag+endTag]
-					if hrefIdx := strings.Index(tag, "href=\""); hrefIdx != -1 {
-						start := hrefIdx + 6
-						if end := strings.Index(tag[start:], "\""); end != -1 {
-							return tag[start : start+end]
-						}
-					}
-				}
-			}
-		}
-		return ""
-	}
-
-	favicon = findIcon("icon")
-	if favicon == "" {
-		favicon = findIcon("shortcut icon")
-	}
-	if favicon == "" {
-		favicon = findIcon("apple-touch-icon")
+		log.Printf("Failed to load page metadata for %s: %v", targetURL, err)
 	}
 
-	resolveURL := func(base, target string) string {
-		if target == "" {
-			return ""
-		}
-		if strings.HasPrefix(target, "http") {
-			return target
-		}
-		if strings.HasPrefix(target, "//") {
-			return "https:" + target
-		}
-		u, err := url.Parse(base)
-		if err != nil {
-			return target
+	// Pages that have been fetched are served from the cache, stale or not;
+	// the refresher picks up anything past its next fetch time.
+	if cached == nil || cached.FetchedAt == nil {
+		if cached != nil && cached.FailureCount > 0 && time.Now().Before(cached.NextFetchAt) {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]string{"title": "", "error": "failed to fetch"})
+			return
 		}
-		t, err := url.Parse(target)
+		cached, err = fetchPageMetadata(r.Context(), h.db, urlHash, targetURL, cached)
 		if err != nil {
-			return target
-		}
-		return u.ResolveReference(t).String()
-	}
-
-	image = resolveURL(targetURL, image)
-	favicon = resolveURL(targetURL, favicon)
-
-	if favicon == "" {
-		u, err := url.Parse(targetURL)
-		if err == nil {
-			favicon = fmt.Sprintf("%s://%s/favicon.ico", u.Scheme, u.Host)
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]string{"title": "", "error": "failed to fetch"})
+			return
 		}
 	}
 
-	data := map[string]string{
-		"title":       title,
-		"description": description,
-		"image":       image,
-		"icon":        favicon,
-	}
-
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(data)
+	json.NewEncoder(w).Encode(newURLMetadataResponse(cached))
 }
 
 func (h *Handler) GetNotifications(w http.ResponseWriter, r *http.Request) {
@@ -1583,57 +1483,3 @@ func (h *Handler) filterFeedByModeration(feed []interface{}, viewerDID string) [
 	}
 	return filtered
 }
-
-func mergeAnnotations(a, b []db.Annotation) []db.Annotation {
-	seen := make(map[string]bool)
-	var result []db.Annotation
-	for _, item := range a {
-		if !seen[item.URI] {
-			seen[item.URI] = true
-			result = append(result, item)
-		}
-	}
-	for _, item := range b {
-		if !seen[item.URI] {
-			seen[item.URI] = true
-			result = append(result, item)
-		}
-	}
-	return result
-}
-
-func mergeHighlights(a, b []db.Highlight) []db.Highlight {
-	seen := make(map[string]bool)
-	var result []db.Highlight
-	for _, item := range a {
-		if !seen[item.URI] {
-			seen[item.URI] = true
-			result = append(result, item)
-		}
-	}
-	for _, item := range b {
-		if !seen[item.URI] {
-			seen[item.URI] = true
-			result = append(result, item)
-		}
-	}
-	return result
-}
-
-func mergeBookmarks(a, b []db.Bookmark) []db.Bookmark {
-	seen := make(map[string]bool)
-	var result []db.Bookmark
-	for _, item := range a {
-		if !seen[item.URI] {
-			seen[item.URI] = true
-			result = append(result, item)
-		}
-	}
-	for _, item := range b {
-		if !seen[item.URI] {
-			seen[item.URI] = true
-			result = append(result, item)
-		}
-	}
-	return result
-}
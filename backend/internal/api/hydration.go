@@ -5,7 +5,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
-	"net/http"
 	"net/url"
 	"strings"
 	"sync"
@@ -579,7 +578,7 @@ func fetchProfiles(dids []string) (map[string]Author, error) {
 		q.Add("actors", did)
 	}
 
-	resp, err := http.Get(config.Get().BskyGetProfilesURL() + "?" + q.Encode())
+	resp, err := outboundClient.Get(config.Get().BskyGetProfilesURL() + "?" + q.Encode())
 	if err != nil {
 		log.Printf("Hydration fetch error: %v\n", err)
 		return nil, err
@@ -0,0 +1,97 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"margin.at/internal/config"
+	"margin.at/internal/db"
+)
+
+func (h *Handler) AdminGetIngestFailures(w http.ResponseWriter, r *http.Request) {
+	session, err := h.refresher.GetSessionWithAutoRefresh(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if !config.Get().IsAdmin(session.DID) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	collection := r.URL.Query().Get("collection")
+	kind := r.URL.Query().Get("kind")
+	limit := parseIntParam(r, "limit", 50)
+	offset := parseIntParam(r, "offset", 0)
+
+	failures, total, err := h.db.ListIngestFailures(collection, kind, limit, offset)
+	if err != nil {
+		log.Printf("Failed to list ingest failures: %v", err)
+		http.Error(w, "Failed to fetch ingest failures", http.StatusInternalServerError)
+		return
+	}
+	if failures == nil {
+		failures = []db.IngestFailure{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"items":      failures,
+		"totalItems": total,
+	})
+}
+
+func (h *Handler) AdminRetryIngestFailures(w http.ResponseWriter, r *http.Request) {
+	session, err := h.refresher.GetSessionWithAutoRefresh(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if !config.Get().IsAdmin(session.DID) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if h.ingester == nil {
+		http.Error(w, "Firehose ingester not running", http.StatusServiceUnavailable)
+		return
+	}
+
+	var req struct {
+		ID  int64   `json:"id"`
+		IDs []int64 `json:"ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	ids := req.IDs
+	if req.ID != 0 {
+		ids = append(ids, req.ID)
+	}
+	if len(ids) == 0 {
+		http.Error(w, "id or ids is required", http.StatusBadRequest)
+		return
+	}
+
+	type retryResult struct {
+		ID     int64  `json:"id"`
+		Status string `json:"status"`
+		Error  string `json:"error,omitempty"`
+	}
+
+	results := make([]retryResult, len(ids))
+	for i, id := range ids {
+		results[i] = retryResult{ID: id, Status: "ok"}
+		if err := h.ingester.RetryIngestFailure(id); err != nil {
+			results[i].Status = "failed"
+			results[i].Error = err.Error()
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"results": results})
+}
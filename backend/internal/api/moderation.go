@@ -468,10 +468,10 @@ func (m *ModerationHandler) AdminCheckAccess(w http.ResponseWriter, r *http.Requ
 }
 
 func (m *ModerationHandler) deleteContent(uri string) {
-	m.db.Exec("DELETE FROM annotations WHERE uri = $1", uri)
-	m.db.Exec("DELETE FROM highlights WHERE uri = $1", uri)
-	m.db.Exec("DELETE FROM bookmarks WHERE uri = $1", uri)
-	m.db.Exec("DELETE FROM replies WHERE uri = $1", uri)
+	m.db.DeleteAnnotation(uri)
+	m.db.DeleteHighlight(uri)
+	m.db.DeleteBookmark(uri)
+	m.db.DeleteReply(uri)
 }
 
 func (m *ModerationHandler) AdminCreateLabel(w http.ResponseWriter, r *http.Request) {
@@ -238,7 +238,7 @@ func isCrawler(userAgent string) bool {
 }
 
 func (h *OGHandler) resolveHandle(handle string) (string, error) {
-	resp, err := http.Get(fmt.Sprintf("https://public.api.bsky.app/xrpc/com.atproto.identity.resolveHandle?handle=%s", url.QueryEscape(handle)))
+	resp, err := outboundClient.Get(fmt.Sprintf("https://public.api.bsky.app/xrpc/com.atproto.identity.resolveHandle?handle=%s", url.QueryEscape(handle)))
 	if err == nil && resp.StatusCode == http.StatusOK {
 		var result struct {
 			Did string `json:"did"`
@@ -1057,7 +1057,7 @@ func fetchAvatarImage(avatarURL string) image.Image {
 		return nil
 	}
 
-	resp, err := http.Get(avatarURL)
+	resp, err := outboundClient.Get(avatarURL)
 	if err != nil {
 		return nil
 	}
@@ -1230,13 +1230,19 @@ func fetchTwemojiImage(emoji string) image.Image {
 
 	url := fmt.Sprintf("https://cdnjs.cloudflare.com/ajax/libs/twemoji/14.0.2/72x72/%s.png", hexCode)
 
-	resp, err := http.Get(url)
+	resp, err := outboundClient.Get(url)
 	if err != nil || resp.StatusCode != 200 {
+		if resp != nil {
+			resp.Body.Close()
+		}
 		if strings.Contains(hexCode, "-fe0f") {
 			simpleHex := strings.ReplaceAll(hexCode, "-fe0f", "")
 			url = fmt.Sprintf("https://cdnjs.cloudflare.com/ajax/libs/twemoji/14.0.2/72x72/%s.png", simpleHex)
-			resp, err = http.Get(url)
+			resp, err = outboundClient.Get(url)
 			if err != nil || resp.StatusCode != 200 {
+				if resp != nil {
+					resp.Body.Close()
+				}
 				return nil
 			}
 		} else {
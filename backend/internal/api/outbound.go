@@ -0,0 +1,8 @@
+package api
+
+import "margin.at/internal/safehttp"
+
+// outboundClient makes every request the API sends to another server. Most
+// destinations come from user input or records (page URLs, PDS endpoints,
+// avatar URLs), so all of them go through the SSRF-hardened client.
+var outboundClient = safehttp.NewClient(safehttp.Config{})
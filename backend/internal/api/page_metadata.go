@@ -0,0 +1,239 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"margin.at/internal/db"
+	"margin.at/internal/metadata"
+	"margin.at/internal/urlcanon"
+)
+
+const (
+	pageMetadataTTL      = 24 * time.Hour
+	pageMetadataMinTTL   = time.Hour
+	pageMetadataMaxTTL   = 7 * 24 * time.Hour
+	pageMetadataRetry    = time.Hour
+	pageMetadataBatch    = 20
+	pageMetadataInterval = 30 * time.Second
+	maxPageBytes         = 500 * 1024
+)
+
+var (
+	maxAgePattern = regexp.MustCompile(`(?i)\bmax-age\s*=\s*(\d+)`)
+)
+
+// urlMetadataResponse is the body of /api/url-metadata: the title,
+// description, image and icon it has always returned, plus what the metadata
+// parser finds beyond them, omitted when the page does not say.
+type urlMetadataResponse struct {
+	Title        string     `json:"title"`
+	Description  string     `json:"description"`
+	Image        string     `json:"image"`
+	Icon         string     `json:"icon"`
+	SiteName     string     `json:"siteName,omitempty"`
+	CanonicalURL string     `json:"canonicalUrl,omitempty"`
+	Language     string     `json:"language,omitempty"`
+	Author       string     `json:"author,omitempty"`
+	PublishedAt  *time.Time `json:"publishedAt,omitempty"`
+	Type         string     `json:"type,omitempty"`
+	ReadingTime  int        `json:"readingTime,omitempty"`
+}
+
+func newURLMetadataResponse(m *db.PageMetadata) urlMetadataResponse {
+	return urlMetadataResponse{
+		Title:        m.Title,
+		Description:  m.Description,
+		Image:        m.Image,
+		Icon:         m.Favicon,
+		SiteName:     m.SiteName,
+		CanonicalURL: m.CanonicalURL,
+		Language:     m.Language,
+		Author:       m.Author,
+		PublishedAt:  m.PublishedAt,
+		Type:         m.Type,
+		ReadingTime:  m.ReadingTime,
+	}
+}
+
+// PageMetadataRefresher re-fetches cached page metadata as it falls due, and
+// fetches pages queued by records that arrived without a title.
+type PageMetadataRefresher struct {
+	db     *db.DB
+	cancel context.CancelFunc
+}
+
+func NewPageMetadataRefresher(database *db.DB) *PageMetadataRefresher {
+	return &PageMetadataRefresher{db: database}
+}
+
+func (r *PageMetadataRefresher) Start(ctx context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	r.cancel = cancel
+
+	go r.run(ctx)
+}
+
+func (r *PageMetadataRefresher) Stop() {
+	if r.cancel != nil {
+		r.cancel()
+	}
+}
+
+func (r *PageMetadataRefresher) run(ctx context.Context) {
+	ticker := time.NewTicker(pageMetadataInterval)
+	defer ticker.Stop()
+
+	for {
+		r.refreshDue(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (r *PageMetadataRefresher) refreshDue(ctx context.Context) {
+	pages, err := r.db.DuePageMetadata(pageMetadataBatch)
+	if err != nil {
+		log.Printf("Failed to load due page metadata: %v", err)
+		return
+	}
+	for i := range pages {
+		if ctx.Err() != nil {
+			return
+		}
+		// Failures are recorded on the row and retried later.
+		fetchPageMetadata(ctx, r.db, pages[i].URLHash, pages[i].URL, &pages[i])
+	}
+}
+
+// fetchPageMetadata fetches pageURL and stores the result, revalidating with
+// the cached ETag and Last-Modified when there is a previous fetch.
+func fetchPageMetadata(ctx context.Context, database *db.DB, urlHash, pageURL string, cached *db.PageMetadata) (*db.PageMetadata, error) {
+	m, err := doFetchPageMetadata(ctx, database, urlHash, pageURL, cached)
+	if err != nil {
+		failures := 0
+		if cached != nil {
+			failures = cached.FailureCount
+		}
+		next := time.Now().Add(retryDelay(failures))
+		if markErr := database.MarkPageMetadataFailed(urlHash, pageURL, err.Error(), next); markErr != nil {
+			log.Printf("Failed to record page metadata failure for %s: %v", pageURL, markErr)
+		}
+		return nil, err
+	}
+	return m, nil
+}
+
+func doFetchPageMetadata(ctx context.Context, database *db.DB, urlHash, pageURL string, cached *db.PageMetadata) (*db.PageMetadata, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, pageURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", urlcanon.UserAgent)
+	req.Header.Set("Accept", "text/html")
+	revalidate := cached != nil && cached.FetchedAt != nil
+	if revalidate {
+		if cached.ETag != "" {
+			req.Header.Set("If-None-Match", cached.ETag)
+		}
+		if cached.LastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.LastModified)
+		}
+	}
+
+	resp, err := outboundClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	now := time.Now()
+	next := now.Add(cacheLifetime(resp.Header))
+
+	if resp.StatusCode == http.StatusNotModified && revalidate {
+		if err := database.MarkPageMetadataUnchanged(urlHash, now, next); err != nil {
+			return nil, err
+		}
+		cached.FetchedAt, cached.NextFetchAt, cached.FailureCount, cached.LastError = &now, next, 0, ""
+		return cached, nil
+	}
+	if resp.StatusCode >= 400 {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+
+	// Resolve against the final URL so relative links survive redirects.
+	page, err := metadata.Parse(resp.Request.URL.String(), io.LimitReader(resp.Body, maxPageBytes))
+	if err != nil {
+		return nil, err
+	}
+	if page.NeedsOEmbed() {
+		if o, err := metadata.FetchOEmbed(ctx, outboundClient, page.OEmbedURL); err == nil {
+			page.ApplyOEmbed(o)
+		}
+	}
+
+	m := &db.PageMetadata{
+		URLHash:      urlHash,
+		URL:          pageURL,
+		Title:        page.Title,
+		Description:  page.Description,
+		Image:        page.Image,
+		Favicon:      page.Favicon,
+		SiteName:     page.SiteName,
+		CanonicalURL: page.CanonicalURL,
+		Language:     page.Language,
+		Author:       page.Author,
+		PublishedAt:  page.PublishedAt,
+		Type:         page.Type,
+		ReadingTime:  page.ReadingTime,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		FetchedAt:    &now,
+		NextFetchAt:  next,
+	}
+	if err := database.SavePageMetadata(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// cacheLifetime honours the page's Cache-Control max-age within sensible
+// bounds, so a page asking for no caching is not fetched on every tick.
+func cacheLifetime(header http.Header) time.Duration {
+	match := maxAgePattern.FindStringSubmatch(header.Get("Cache-Control"))
+	if match == nil {
+		return pageMetadataTTL
+	}
+	seconds, err := strconv.Atoi(match[1])
+	if err != nil {
+		return pageMetadataTTL
+	}
+	ttl := time.Duration(seconds) * time.Second
+	if ttl < pageMetadataMinTTL {
+		return pageMetadataMinTTL
+	}
+	if ttl > pageMetadataMaxTTL {
+		return pageMetadataMaxTTL
+	}
+	return ttl
+}
+
+func retryDelay(failures int) time.Duration {
+	delay := pageMetadataRetry
+	for i := 0; i < failures && delay < pageMetadataMaxTTL; i++ {
+		delay *= 2
+	}
+	if delay > pageMetadataMaxTTL {
+		return pageMetadataMaxTTL
+	}
+	return delay
+}
@@ -0,0 +1,133 @@
+package api
+
+import (
+	"net/http"
+	"sort"
+	"time"
+
+	"margin.at/internal/db"
+)
+
+// parseCursorParam reads the opaque "cursor" query parameter. It writes a 400
+// and returns ok=false when the token is malformed.
+func parseCursorParam(w http.ResponseWriter, r *http.Request) (cursor *db.Cursor, ok bool) {
+	token := r.URL.Query().Get("cursor")
+	if token == "" {
+		return nil, true
+	}
+	cursor, err := db.DecodeCursor(token)
+	if err != nil {
+		WriteBadRequest(w, "invalid cursor")
+		return nil, false
+	}
+	return cursor, true
+}
+
+type pageKey struct {
+	createdAt time.Time
+	uri       string
+}
+
+func (k pageKey) after(o pageKey) bool {
+	if k.createdAt.Equal(o.createdAt) {
+		return k.uri > o.uri
+	}
+	return k.createdAt.After(o.createdAt)
+}
+
+// feedPage is one keyset page merged across record types. Each source is
+// fetched with limit+1 rows past the cursor, so the merged set holds more
+// than limit entries exactly when another page exists.
+type feedPage struct {
+	annotations     []db.Annotation
+	highlights      []db.Highlight
+	bookmarks       []db.Bookmark
+	collectionItems []db.CollectionItem
+	position        map[string]int
+	cursor          string
+}
+
+func newFeedPage(annotations []db.Annotation, highlights []db.Highlight, bookmarks []db.Bookmark, collectionItems []db.CollectionItem, limit int) *feedPage {
+	var keys []pageKey
+	for _, a := range annotations {
+		keys = append(keys, pageKey{a.CreatedAt, a.URI})
+	}
+	for _, h := range highlights {
+		keys = append(keys, pageKey{h.CreatedAt, h.URI})
+	}
+	for _, b := range bookmarks {
+		keys = append(keys, pageKey{b.CreatedAt, b.URI})
+	}
+	for _, ci := range collectionItems {
+		keys = append(keys, pageKey{ci.CreatedAt, ci.URI})
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].after(keys[j])
+	})
+
+	page := &feedPage{position: make(map[string]int)}
+	if len(keys) > limit {
+		keys = keys[:limit]
+		last := keys[len(keys)-1]
+		page.cursor = db.Cursor{CreatedAt: last.createdAt, URI: last.uri}.Encode()
+	}
+	for i, k := range keys {
+		page.position[k.uri] = i
+	}
+
+	for _, a := range annotations {
+		if _, ok := page.position[a.URI]; ok {
+			page.annotations = append(page.annotations, a)
+		}
+	}
+	for _, h := range highlights {
+		if _, ok := page.position[h.URI]; ok {
+			page.highlights = append(page.highlights, h)
+		}
+	}
+	for _, b := range bookmarks {
+		if _, ok := page.position[b.URI]; ok {
+			page.bookmarks = append(page.bookmarks, b)
+		}
+	}
+	for _, ci := range collectionItems {
+		if _, ok := page.position[ci.URI]; ok {
+			page.collectionItems = append(page.collectionItems, ci)
+		}
+	}
+	return page
+}
+
+// sort orders hydrated feed items to match the page's keyset order.
+func (p *feedPage) sort(feed []interface{}) {
+	sort.SliceStable(feed, func(i, j int) bool {
+		return p.position[getItemURI(feed[i])] < p.position[getItemURI(feed[j])]
+	})
+}
+
+func getItemURI(item interface{}) string {
+	switch v := item.(type) {
+	case APIAnnotation:
+		return v.ID
+	case APIHighlight:
+		return v.ID
+	case APIBookmark:
+		return v.ID
+	case APICollectionItem:
+		return v.ID
+	default:
+		return ""
+	}
+}
+
+// pageOf trims a single-type keyset result fetched with limit+1 rows and
+// returns the cursor for the next page, if any.
+func pageOf[T any](items []T, limit int, key func(T) (time.Time, string)) ([]T, string) {
+	if len(items) <= limit {
+		return items, ""
+	}
+	items = items[:limit]
+	createdAt, uri := key(items[limit-1])
+	return items, db.Cursor{CreatedAt: createdAt, URI: uri}.Encode()
+}
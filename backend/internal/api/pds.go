@@ -25,7 +25,7 @@ func (h *Handler) FetchLatestUserRecords(r *http.Request, did string, collection
 		req, _ := http.NewRequestWithContext(r.Context(), "GET", url, nil)
 		req.Header.Set("Authorization", "Bearer "+client.AccessToken)
 
-		resp, err := http.DefaultClient.Do(req)
+		resp, err := outboundClient.Do(req)
 		if err != nil {
 			return fmt.Errorf("failed to fetch %s: %w", collection, err)
 		}
@@ -49,7 +49,7 @@ func (h *Handler) FetchLatestUserRecords(r *http.Request, did string, collection
 		}
 
 		for _, rec := range output.Records {
-			parsed, err := parseRecord(did, collection, rec.URI, rec.CID, rec.Value)
+			parsed, err := parseRecord(h.db, did, collection, rec.URI, rec.CID, rec.Value)
 			if err == nil && parsed != nil {
 				switch v := parsed.(type) {
 				case *db.Annotation:
@@ -75,7 +75,7 @@ func (h *Handler) FetchLatestUserRecords(r *http.Request, did string, collection
 	return results, nil
 }
 
-func parseRecord(did, collection, uri, cid string, value json.RawMessage) (interface{}, error) {
+func parseRecord(database *db.DB, did, collection, uri, cid string, value json.RawMessage) (interface{}, error) {
 	cidPtr := &cid
 
 	switch collection {
@@ -91,7 +91,7 @@ func parseRecord(did, collection, uri, cid string, value json.RawMessage) (inter
 
 		var targetHash string
 		if targetSource != "" {
-			targetHash = db.HashURL(targetSource)
+			targetHash = database.HashURL(targetSource)
 		}
 
 		motivation := record.Motivation
@@ -135,6 +135,7 @@ func parseRecord(did, collection, uri, cid string, value json.RawMessage) (inter
 			BodyURI:      bodyURIPtr,
 			TargetSource: targetSource,
 			TargetHash:   targetHash,
+			TargetDomain: database.URLDomain(targetSource),
 			TargetTitle:  targetTitlePtr,
 			SelectorJSON: selectorJSONPtr,
 			TagsJSON:     tagsJSONPtr,
@@ -156,7 +157,7 @@ func parseRecord(did, collection, uri, cid string, value json.RawMessage) (inter
 
 		var targetHash string
 		if record.Target.Source != "" {
-			targetHash = db.HashURL(record.Target.Source)
+			targetHash = database.HashURL(record.Target.Source)
 		}
 
 		var titlePtr, selectorJSONPtr, colorPtr, tagsJSONPtr *string
@@ -182,6 +183,7 @@ func parseRecord(did, collection, uri, cid string, value json.RawMessage) (inter
 			AuthorDID:    did,
 			TargetSource: record.Target.Source,
 			TargetHash:   targetHash,
+			TargetDomain: database.URLDomain(record.Target.Source),
 			TargetTitle:  titlePtr,
 			SelectorJSON: selectorJSONPtr,
 			Color:        colorPtr,
@@ -221,7 +223,7 @@ func parseRecord(did, collection, uri, cid string, value json.RawMessage) (inter
 
 		var sourceHash string
 		if record.Source != "" {
-			sourceHash = db.HashURL(record.Source)
+			sourceHash = database.HashURL(record.Source)
 		}
 
 		var titlePtr, descPtr, tagsJSONPtr *string
@@ -240,16 +242,17 @@ func parseRecord(did, collection, uri, cid string, value json.RawMessage) (inter
 		}
 
 		return &db.Bookmark{
-			URI:         uri,
-			AuthorDID:   did,
-			Source:      record.Source,
-			SourceHash:  sourceHash,
-			Title:       titlePtr,
-			Description: descPtr,
-			TagsJSON:    tagsJSONPtr,
-			CreatedAt:   createdAt,
-			IndexedAt:   time.Now(),
-			CID:         cidPtr,
+			URI:          uri,
+			AuthorDID:    did,
+			Source:       record.Source,
+			SourceHash:   sourceHash,
+			SourceDomain: database.URLDomain(record.Source),
+			Title:        titlePtr,
+			Description:  descPtr,
+			TagsJSON:     tagsJSONPtr,
+			CreatedAt:    createdAt,
+			IndexedAt:    time.Now(),
+			CID:          cidPtr,
 		}, nil
 
 	case xrpc.CollectionPreferences:
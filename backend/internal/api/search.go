@@ -0,0 +1,159 @@
+package api
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	"margin.at/internal/db"
+)
+
+type APISearchResult struct {
+	Kind    string      `json:"kind"`
+	Snippet string      `json:"snippet"`
+	Score   float64     `json:"score"`
+	Item    interface{} `json:"item"`
+}
+
+var searchKinds = map[string]string{
+	"annotation":   "annotation",
+	"annotations":  "annotation",
+	"commenting":   "annotation",
+	"highlight":    "highlight",
+	"highlights":   "highlight",
+	"highlighting": "highlight",
+	"bookmark":     "bookmark",
+	"bookmarks":    "bookmark",
+	"bookmarking":  "bookmark",
+	"reply":        "reply",
+	"replies":      "reply",
+}
+
+func (h *Handler) Search(w http.ResponseWriter, r *http.Request) {
+	text := strings.TrimSpace(r.URL.Query().Get("q"))
+	if text == "" {
+		WriteBadRequest(w, "q query parameter required")
+		return
+	}
+
+	limit := parseIntParam(r, "limit", 20)
+	if limit <= 0 || limit > 100 {
+		limit = 20
+	}
+	offset := parseIntParam(r, "offset", 0)
+	if offset < 0 {
+		offset = 0
+	}
+
+	query := db.SearchQuery{
+		Text:      text,
+		AuthorDID: r.URL.Query().Get("creator"),
+		Limit:     limit,
+		Offset:    offset,
+	}
+	if types := r.URL.Query().Get("type"); types != "" {
+		for _, t := range strings.Split(types, ",") {
+			kind, ok := searchKinds[strings.TrimSpace(t)]
+			if !ok {
+				WriteBadRequest(w, "unknown type: "+t)
+				return
+			}
+			query.Kinds = append(query.Kinds, kind)
+		}
+	}
+
+	viewerDID := h.getViewerDID(r)
+	if viewerDID != "" {
+		hidden, err := h.db.GetAllHiddenDIDs(viewerDID)
+		if err == nil {
+			for did := range hidden {
+				query.ExcludeAuthors = append(query.ExcludeAuthors, did)
+			}
+		}
+	}
+
+	results, total, err := h.db.Search(query)
+	if err != nil {
+		log.Printf("Search failed for %q: %v", text, err)
+		WriteJSONError(w, http.StatusInternalServerError, "Search failed")
+		return
+	}
+
+	items, err := h.hydrateSearchResults(results, viewerDID)
+	if err != nil {
+		log.Printf("Failed to hydrate search results: %v", err)
+		WriteJSONError(w, http.StatusInternalServerError, "Search failed")
+		return
+	}
+
+	WriteSuccess(w, map[string]interface{}{
+		"query":      text,
+		"items":      items,
+		"totalItems": total,
+	})
+}
+
+func (h *Handler) hydrateSearchResults(results []db.SearchResult, viewerDID string) ([]APISearchResult, error) {
+	urisByKind := make(map[string][]string)
+	for _, res := range results {
+		urisByKind[res.Kind] = append(urisByKind[res.Kind], res.URI)
+	}
+
+	hydrated := make(map[string]interface{})
+
+	if uris := urisByKind["annotation"]; len(uris) > 0 {
+		annotations, err := h.db.GetAnnotationsByURIs(uris)
+		if err != nil {
+			return nil, err
+		}
+		enriched, _ := hydrateAnnotations(h.db, annotations, viewerDID)
+		for _, a := range enriched {
+			hydrated[a.ID] = a
+		}
+	}
+	if uris := urisByKind["highlight"]; len(uris) > 0 {
+		highlights, err := h.db.GetHighlightsByURIs(uris)
+		if err != nil {
+			return nil, err
+		}
+		enriched, _ := hydrateHighlights(h.db, highlights, viewerDID)
+		for _, hl := range enriched {
+			hydrated[hl.ID] = hl
+		}
+	}
+	if uris := urisByKind["bookmark"]; len(uris) > 0 {
+		bookmarks, err := h.db.GetBookmarksByURIs(uris)
+		if err != nil {
+			return nil, err
+		}
+		enriched, _ := hydrateBookmarks(h.db, bookmarks, viewerDID)
+		for _, b := range enriched {
+			hydrated[b.ID] = b
+		}
+	}
+	if uris := urisByKind["reply"]; len(uris) > 0 {
+		replies, err := h.db.GetRepliesByURIs(uris)
+		if err != nil {
+			return nil, err
+		}
+		enriched, _ := hydrateReplies(h.db, replies)
+		for _, rep := range enriched {
+			hydrated[rep.ID] = rep
+		}
+	}
+
+	items := []APISearchResult{}
+	for _, res := range results {
+		item, ok := hydrated[res.URI]
+		if !ok {
+			continue
+		}
+		items = append(items, APISearchResult{
+			Kind:    res.Kind,
+			Snippet: res.Snippet,
+			Score:   res.Score,
+			Item:    item,
+		})
+	}
+	return items, nil
+}
@@ -123,7 +123,6 @@ func fetchSembleCard(ctx context.Context, database *db.DB, uri string) error {
 		return fmt.Errorf("failed to resolve PDS: %w", err)
 	}
 
-	client := &http.Client{Timeout: 10 * time.Second}
 	url := fmt.Sprintf("%s/xrpc/com.atproto.repo.getRecord?repo=%s&collection=%s&rkey=%s", pds, did, collection, rkey)
 
 	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
@@ -131,7 +130,7 @@ func fetchSembleCard(ctx context.Context, database *db.DB, uri string) error {
 		return err
 	}
 
-	resp, err := client.Do(req)
+	resp, err := outboundClient.Do(req)
 	if err != nil {
 		return fmt.Errorf("failed to fetch record: %w", err)
 	}
@@ -169,7 +168,7 @@ func fetchSembleCard(ctx context.Context, database *db.DB, uri string) error {
 			return fmt.Errorf("missing target source")
 		}
 
-		targetHash := db.HashURL(targetSource)
+		targetHash := database.HashURL(targetSource)
 		motivation := "commenting"
 		bodyValue := note.Text
 
@@ -180,6 +179,7 @@ func fetchSembleCard(ctx context.Context, database *db.DB, uri string) error {
 			BodyValue:    &bodyValue,
 			TargetSource: targetSource,
 			TargetHash:   targetHash,
+			TargetDomain: database.URLDomain(targetSource),
 			CreatedAt:    createdAt,
 			IndexedAt:    time.Now(),
 		}
@@ -195,7 +195,7 @@ func fetchSembleCard(ctx context.Context, database *db.DB, uri string) error {
 		if source == "" {
 			return fmt.Errorf("missing source")
 		}
-		sourceHash := db.HashURL(source)
+		sourceHash := database.HashURL(source)
 
 		var titlePtr *string
 		if urlContent.Metadata != nil && urlContent.Metadata.Title != "" {
@@ -204,13 +204,14 @@ func fetchSembleCard(ctx context.Context, database *db.DB, uri string) error {
 		}
 
 		bookmark := &db.Bookmark{
-			URI:        uri,
-			AuthorDID:  did,
-			Source:     source,
-			SourceHash: sourceHash,
-			Title:      titlePtr,
-			CreatedAt:  createdAt,
-			IndexedAt:  time.Now(),
+			URI:          uri,
+			AuthorDID:    did,
+			Source:       source,
+			SourceHash:   sourceHash,
+			SourceDomain: database.URLDomain(source),
+			Title:        titlePtr,
+			CreatedAt:    createdAt,
+			IndexedAt:    time.Now(),
 		}
 		return database.CreateBookmark(bookmark)
 	}
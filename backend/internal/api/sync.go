@@ -1,13 +1,15 @@
 package api
 
 import (
-	"context"
 	"encoding/json"
+	"log"
 	"net/http"
 
-	"margin.at/internal/xrpc"
+	"margin.at/internal/db"
 )
 
+// SyncAll queues a sync of the caller's repo and returns its job, which
+// GetSyncStatus reports on as it runs.
 func (h *Handler) SyncAll(w http.ResponseWriter, r *http.Request) {
 	session, err := h.refresher.GetSessionWithAutoRefresh(r)
 	if err != nil {
@@ -15,20 +17,42 @@ func (h *Handler) SyncAll(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	results, err := h.syncService.PerformSync(r.Context(), session.DID, func(ctx context.Context, did string) (*xrpc.Client, error) {
-		var client *xrpc.Client
-		err := h.refresher.ExecuteWithAutoRefresh(r, session, func(c *xrpc.Client, d string) error {
-			client = c
-			return nil
-		})
-		return client, err
-	})
+	if err := h.syncService.Enqueue(session.DID); err != nil {
+		log.Printf("Failed to queue sync of %s: %v", session.DID, err)
+		http.Error(w, "Failed to queue sync", http.StatusInternalServerError)
+		return
+	}
+	job, err := h.db.GetSyncJob(session.DID)
+	if err != nil {
+		log.Printf("Failed to get sync job of %s: %v", session.DID, err)
+		http.Error(w, "Failed to queue sync", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job)
+}
 
+// GetSyncStatus reports the caller's current or last sync, with the result
+// of each collection synced so far. A repo never synced is "idle".
+func (h *Handler) GetSyncStatus(w http.ResponseWriter, r *http.Request) {
+	session, err := h.refresher.GetSessionWithAutoRefresh(r)
 	if err != nil {
-		http.Error(w, "Sync failed: "+err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(results)
+	job, err := h.db.GetSyncJob(session.DID)
+	if err != nil {
+		log.Printf("Failed to get sync job of %s: %v", session.DID, err)
+		http.Error(w, "Failed to get sync status", http.StatusInternalServerError)
+		return
+	}
+	if job == nil {
+		job = &db.SyncJob{DID: session.DID, Status: db.SyncJobIdle, Collections: map[string]string{}}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job)
 }
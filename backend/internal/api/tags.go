@@ -6,8 +6,20 @@ import (
 	"strconv"
 
 	"github.com/go-chi/chi/v5"
+	"margin.at/internal/db"
 )
 
+// parseTagFilter reads repeated tag parameters: every "tag" must match,
+// at least one "anyTag" must match, and no "-tag" may match.
+func parseTagFilter(r *http.Request) db.TagFilter {
+	q := r.URL.Query()
+	return db.TagFilter{
+		All:  q["tag"],
+		Any:  q["anyTag"],
+		None: q["-tag"],
+	}
+}
+
 func (h *Handler) HandleGetTrendingTags(w http.ResponseWriter, r *http.Request) {
 	limit := 10
 	if l := r.URL.Query().Get("limit"); l != "" {
@@ -2,8 +2,10 @@ package config
 
 import (
 	"os"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 type Config struct {
@@ -12,6 +14,39 @@ type Config struct {
 	BaseURL       string
 	AdminDIDs     []string
 	ServiceDID    string
+
+	// URLStripParams and URLKeepParams extend the default URL
+	// canonicalization rules. URLKeepParams maps a host to the only query
+	// parameters that identify a page on it.
+	URLStripParams        []string
+	URLKeepParams         map[string][]string
+	ResolveCanonicalLinks bool
+
+	// The firehose ingester commits events in batches of up to
+	// FirehoseBatchSize, or whatever arrived within FirehoseBatchInterval.
+	FirehoseBatchSize     int
+	FirehoseBatchInterval time.Duration
+	// Events are spread by repo over FirehoseWorkers workers, each queueing
+	// at most FirehoseQueueSize of them.
+	FirehoseWorkers   int
+	FirehoseQueueSize int
+	// FirehoseSource is "jetstream", or "relay" to consume subscribeRepos
+	// from FirehoseRelayHost directly.
+	FirehoseSource    string
+	FirehoseRelayHost string
+	// FirehoseCompress requests zstd-compressed frames from Jetstream.
+	FirehoseCompress bool
+	// A relay silent for FirehoseStallTimeout is dropped. Switching Jetstream
+	// instance rewinds the cursor by FirehoseRelayRewind.
+	FirehoseStallTimeout time.Duration
+	FirehoseRelayRewind  time.Duration
+
+	// SyncWorkers is how many queued repo syncs run at once.
+	SyncWorkers int
+
+	// LexiconDir holds the lexicon JSON that incoming records are validated
+	// against.
+	LexiconDir string
 }
 
 var (
@@ -36,6 +71,24 @@ func Get() *Config {
 			BaseURL:       os.Getenv("BASE_URL"),
 			AdminDIDs:     adminDIDs,
 			ServiceDID:    os.Getenv("SERVICE_DID"),
+
+			URLStripParams:        splitList(os.Getenv("URL_STRIP_PARAMS")),
+			URLKeepParams:         parseKeepParams(os.Getenv("URL_KEEP_PARAMS")),
+			ResolveCanonicalLinks: os.Getenv("RESOLVE_CANONICAL_LINKS") == "true",
+
+			FirehoseBatchSize:     getIntEnvOrDefault("FIREHOSE_BATCH_SIZE", 100),
+			FirehoseBatchInterval: getDurationEnvOrDefault("FIREHOSE_BATCH_INTERVAL", 250*time.Millisecond),
+			FirehoseWorkers:       getIntEnvOrDefault("FIREHOSE_WORKERS", 8),
+			FirehoseQueueSize:     getIntEnvOrDefault("FIREHOSE_QUEUE_SIZE", 256),
+			FirehoseSource:        getEnvOrDefault("FIREHOSE_SOURCE", "jetstream"),
+			FirehoseRelayHost:     getEnvOrDefault("FIREHOSE_RELAY_HOST", "wss://bsky.network"),
+			FirehoseCompress:      os.Getenv("FIREHOSE_COMPRESS") != "false",
+			FirehoseStallTimeout:  getDurationEnvOrDefault("FIREHOSE_STALL_TIMEOUT", 2*time.Minute),
+			FirehoseRelayRewind:   getDurationEnvOrDefault("FIREHOSE_RELAY_REWIND", 10*time.Second),
+
+			SyncWorkers: getIntEnvOrDefault("SYNC_WORKERS", 4),
+
+			LexiconDir: getEnvOrDefault("LEXICON_DIR", "../lexicons"),
 		}
 	})
 	return instance
@@ -48,6 +101,42 @@ func getEnvOrDefault(key, defaultValue string) string {
 	return defaultValue
 }
 
+func getIntEnvOrDefault(key string, defaultValue int) int {
+	if value, err := strconv.Atoi(os.Getenv(key)); err == nil && value > 0 {
+		return value
+	}
+	return defaultValue
+}
+
+func getDurationEnvOrDefault(key string, defaultValue time.Duration) time.Duration {
+	if value, err := time.ParseDuration(os.Getenv(key)); err == nil && value > 0 {
+		return value
+	}
+	return defaultValue
+}
+
+func splitList(raw string) []string {
+	var items []string
+	for _, item := range strings.Split(raw, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parseKeepParams reads "host=a,b;other.host=c".
+func parseKeepParams(raw string) map[string][]string {
+	rules := make(map[string][]string)
+	for _, entry := range strings.Split(raw, ";") {
+		host, params, ok := strings.Cut(entry, "=")
+		if host = strings.TrimSpace(host); ok && host != "" {
+			rules[host] = splitList(params)
+		}
+	}
+	return rules
+}
+
 func (c *Config) BskyResolveHandleURL(handle string) string {
 	return c.BskyPublicAPI + "/xrpc/com.atproto.identity.resolveHandle?handle=" + handle
 }
@@ -0,0 +1,109 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+	secpecdsa "github.com/decred/dcrd/dcrec/secp256k1/v4/ecdsa"
+	"github.com/multiformats/go-multibase"
+)
+
+var ErrInvalidSignature = errors.New("invalid signature")
+
+// PublicKey is an atproto signing key, either secp256k1 (k256) or P-256.
+type PublicKey interface {
+	// Verify checks a 64-byte compact r||s signature over the SHA-256 of
+	// data. High-S signatures are rejected, as atproto requires.
+	Verify(data, sig []byte) error
+}
+
+// Multicodec prefixes of compressed public keys in did:key and Multikey.
+var (
+	k256Prefix = []byte{0xe7, 0x01}
+	p256Prefix = []byte{0x80, 0x24}
+)
+
+// ParsePublicKeyMultibase decodes the publicKeyMultibase of a Multikey
+// verification method.
+func ParsePublicKeyMultibase(encoded string) (PublicKey, error) {
+	_, raw, err := multibase.Decode(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid multibase key: %w", err)
+	}
+	switch {
+	case bytes.HasPrefix(raw, k256Prefix):
+		pub, err := secp256k1.ParsePubKey(raw[len(k256Prefix):])
+		if err != nil {
+			return nil, fmt.Errorf("invalid k256 key: %w", err)
+		}
+		return k256Key{pub}, nil
+	case bytes.HasPrefix(raw, p256Prefix):
+		x, y := elliptic.UnmarshalCompressed(elliptic.P256(), raw[len(p256Prefix):])
+		if x == nil {
+			return nil, fmt.Errorf("invalid p256 key")
+		}
+		return p256Key{&ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type")
+	}
+}
+
+// ParseDIDKey decodes a did:key identifier.
+func ParseDIDKey(didKey string) (PublicKey, error) {
+	encoded, ok := strings.CutPrefix(didKey, "did:key:")
+	if !ok {
+		return nil, fmt.Errorf("not a did:key: %s", didKey)
+	}
+	return ParsePublicKeyMultibase(encoded)
+}
+
+type k256Key struct {
+	pub *secp256k1.PublicKey
+}
+
+func (k k256Key) Verify(data, sig []byte) error {
+	if len(sig) != 64 {
+		return ErrInvalidSignature
+	}
+	var r, s secp256k1.ModNScalar
+	if overflow := r.SetByteSlice(sig[:32]); overflow || r.IsZero() {
+		return ErrInvalidSignature
+	}
+	if overflow := s.SetByteSlice(sig[32:]); overflow || s.IsZero() || s.IsOverHalfOrder() {
+		return ErrInvalidSignature
+	}
+	hash := sha256.Sum256(data)
+	if !secpecdsa.NewSignature(&r, &s).Verify(hash[:], k.pub) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+type p256Key struct {
+	pub *ecdsa.PublicKey
+}
+
+var p256HalfOrder = new(big.Int).Rsh(elliptic.P256().Params().N, 1)
+
+func (k p256Key) Verify(data, sig []byte) error {
+	if len(sig) != 64 {
+		return ErrInvalidSignature
+	}
+	r := new(big.Int).SetBytes(sig[:32])
+	s := new(big.Int).SetBytes(sig[32:])
+	if s.Cmp(p256HalfOrder) > 0 {
+		return ErrInvalidSignature
+	}
+	hash := sha256.Sum256(data)
+	if !ecdsa.Verify(k.pub, hash[:], r, s) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
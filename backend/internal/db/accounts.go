@@ -0,0 +1,115 @@
+package db
+
+import (
+	"database/sql"
+	"time"
+)
+
+const AccountStatusDeleted = "deleted"
+
+// Account is the last known identity and hosting status of a DID, as
+// reported by the firehose.
+type Account struct {
+	DID       string    `json:"did"`
+	Handle    string    `json:"handle"`
+	PDS       string    `json:"pds"`
+	Active    bool      `json:"active"`
+	Status    string    `json:"status,omitempty"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// activeAuthor is a WHERE condition, taking false as its argument, that
+// drops rows whose author column names a deactivated or taken-down account.
+// Their records stay stored but are hidden until the account is active again.
+func activeAuthor(column string) string {
+	return "NOT EXISTS (SELECT 1 FROM accounts WHERE accounts.did = " + column + " AND accounts.active = ?)"
+}
+
+func (db *DB) GetAccount(did string) (*Account, error) {
+	var a Account
+	err := db.QueryRow(db.Rebind(`
+		SELECT did, handle, pds, active, status, updated_at FROM accounts WHERE did = ?
+	`), did).Scan(&a.DID, &a.Handle, &a.PDS, &a.Active, &a.Status, &a.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// SetAccountIdentity records a handle and, when known, PDS for did. Events
+// older than the stored row are ignored.
+func (db *DB) SetAccountIdentity(did, handle, pds string, at time.Time) error {
+	_, err := db.Exec(db.Rebind(`
+		INSERT INTO accounts (did, handle, pds, updated_at)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT(did) DO UPDATE SET
+			handle = excluded.handle,
+			pds = CASE WHEN excluded.pds != '' THEN excluded.pds ELSE accounts.pds END,
+			updated_at = excluded.updated_at
+		WHERE accounts.updated_at <= excluded.updated_at
+	`), did, handle, pds, at)
+	return err
+}
+
+// SetAccountPDS stores a PDS resolved from the DID document. It does not
+// count as an event, so a new row starts out older than any firehose event.
+func (db *DB) SetAccountPDS(did, pds string) error {
+	_, err := db.Exec(db.Rebind(`
+		INSERT INTO accounts (did, pds, updated_at)
+		VALUES (?, ?, ?)
+		ON CONFLICT(did) DO UPDATE SET pds = excluded.pds
+	`), did, pds, time.Time{})
+	return err
+}
+
+// SetAccountStatus records whether did is active and why not. Events older
+// than the stored row are ignored.
+func (db *DB) SetAccountStatus(did string, active bool, status string, at time.Time) error {
+	_, err := db.Exec(db.Rebind(`
+		INSERT INTO accounts (did, active, status, updated_at)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT(did) DO UPDATE SET
+			active = excluded.active,
+			status = excluded.status,
+			updated_at = excluded.updated_at
+		WHERE accounts.updated_at <= excluded.updated_at
+	`), did, active, status, at)
+	return err
+}
+
+// PurgeAccount deletes everything authored by did. Search documents follow
+// their source rows through triggers.
+func (db *DB) PurgeAccount(did string) error {
+	return db.inTx(func(tx *sql.Tx) error {
+		stmts := []string{
+			`DELETE FROM record_tags WHERE author_did = ?`,
+			`DELETE FROM annotations WHERE author_did = ?`,
+			`DELETE FROM highlights WHERE author_did = ?`,
+			`DELETE FROM bookmarks WHERE author_did = ?`,
+			`DELETE FROM replies WHERE author_did = ?`,
+			`DELETE FROM likes WHERE author_did = ?`,
+			`DELETE FROM collection_items WHERE author_did = ?`,
+			`DELETE FROM collections WHERE author_did = ?`,
+			`DELETE FROM profiles WHERE author_did = ?`,
+			`DELETE FROM preferences WHERE author_did = ?`,
+			`DELETE FROM api_keys WHERE owner_did = ?`,
+			`DELETE FROM sessions WHERE did = ?`,
+			`DELETE FROM blocks WHERE actor_did = ?`,
+			`DELETE FROM mutes WHERE actor_did = ?`,
+		}
+		for _, stmt := range stmts {
+			if _, err := tx.Exec(db.Rebind(stmt), did); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.Exec(db.Rebind(`DELETE FROM notifications WHERE actor_did = ? OR recipient_did = ?`), did, did); err != nil {
+			return err
+		}
+		prefix := "at://" + did + "/"
+		_, err := tx.Exec(db.Rebind(`DELETE FROM edit_history WHERE SUBSTR(uri, 1, ?) = ?`), len(prefix), prefix)
+		return err
+	})
+}
@@ -0,0 +1,140 @@
+package db
+
+import (
+	"database/sql"
+	"time"
+)
+
+const (
+	BackfillSynced  = "synced"
+	BackfillSkipped = "skipped"
+	BackfillFailed  = "failed"
+)
+
+// BackfillState is how far a backfill has walked a relay's repo list.
+type BackfillState struct {
+	Relay      string    `json:"relay"`
+	ListCursor string    `json:"listCursor"`
+	Complete   bool      `json:"complete"`
+	StartedAt  time.Time `json:"startedAt"`
+	UpdatedAt  time.Time `json:"updatedAt"`
+}
+
+// BackfillCounts tallies backfill_repos by status.
+type BackfillCounts map[string]int
+
+func (db *DB) GetBackfillState(relay string) (*BackfillState, error) {
+	var s BackfillState
+	err := db.QueryRow(db.Rebind(`
+		SELECT relay, list_cursor, complete, started_at, updated_at FROM backfill_state WHERE relay = ?
+	`), relay).Scan(&s.Relay, &s.ListCursor, &s.Complete, &s.StartedAt, &s.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// SaveBackfillCursor records that every repo before listCursor has been
+// handled. An empty cursor with complete set marks the end of the list.
+func (db *DB) SaveBackfillCursor(relay, listCursor string, complete bool) error {
+	now := time.Now()
+	_, err := db.Exec(db.Rebind(`
+		INSERT INTO backfill_state (relay, list_cursor, complete, started_at, updated_at)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(relay) DO UPDATE SET
+			list_cursor = excluded.list_cursor,
+			complete = excluded.complete,
+			updated_at = excluded.updated_at
+	`), relay, listCursor, complete, now, now)
+	return err
+}
+
+// ResetBackfill forgets the progress of relay and of every repo, so the
+// next run starts over.
+func (db *DB) ResetBackfill(relay string) error {
+	if _, err := db.Exec(db.Rebind(`DELETE FROM backfill_state WHERE relay = ?`), relay); err != nil {
+		return err
+	}
+	_, err := db.Exec(`DELETE FROM backfill_repos`)
+	return err
+}
+
+func (db *DB) SetBackfillRepo(did, status, errMsg string) error {
+	_, err := db.Exec(db.Rebind(`
+		INSERT INTO backfill_repos (did, status, error, updated_at)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT(did) DO UPDATE SET
+			status = excluded.status,
+			error = excluded.error,
+			updated_at = excluded.updated_at
+	`), did, status, errMsg, time.Now())
+	return err
+}
+
+// BackfillDone returns which of dids a previous run already synced or
+// skipped. Failed repos are retried.
+func (db *DB) BackfillDone(dids []string) (map[string]bool, error) {
+	done := make(map[string]bool)
+	if len(dids) == 0 {
+		return done, nil
+	}
+	sq := newSelectQuery("did", "backfill_repos")
+	sq.whereIn("did", dids)
+	sq.where("status != ?", BackfillFailed)
+	query, args := sq.build()
+	rows, err := db.Query(db.Rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var did string
+		if err := rows.Scan(&did); err != nil {
+			return nil, err
+		}
+		done[did] = true
+	}
+	return done, rows.Err()
+}
+
+// BackfillReposWithStatus lists up to limit repos last recorded with status.
+func (db *DB) BackfillReposWithStatus(status string, limit int) ([]string, error) {
+	rows, err := db.Query(db.Rebind(`SELECT did FROM backfill_repos WHERE status = ? ORDER BY updated_at LIMIT ?`), status, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var dids []string
+	for rows.Next() {
+		var did string
+		if err := rows.Scan(&did); err != nil {
+			return nil, err
+		}
+		dids = append(dids, did)
+	}
+	return dids, rows.Err()
+}
+
+func (db *DB) BackfillCounts() (BackfillCounts, error) {
+	rows, err := db.Query(`SELECT status, COUNT(*) FROM backfill_repos GROUP BY status`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := BackfillCounts{}
+	for rows.Next() {
+		var status string
+		var n int
+		if err := rows.Scan(&status, &n); err != nil {
+			return nil, err
+		}
+		counts[status] = n
+	}
+	return counts, rows.Err()
+}
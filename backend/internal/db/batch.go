@@ -0,0 +1,134 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// Exec, Query and QueryRow shadow the embedded *sql.DB so that every query
+// made through a batch-scoped DB joins the batch transaction.
+
+func (db *DB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	if db.tx != nil {
+		return db.tx.Exec(query, args...)
+	}
+	return db.DB.Exec(query, args...)
+}
+
+func (db *DB) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	if db.tx != nil {
+		return db.tx.Query(query, args...)
+	}
+	return db.DB.Query(query, args...)
+}
+
+func (db *DB) QueryRow(query string, args ...interface{}) *sql.Row {
+	if db.tx != nil {
+		return db.tx.QueryRow(query, args...)
+	}
+	return db.DB.QueryRow(query, args...)
+}
+
+// Batch runs fn in a single transaction. All writes made through the DB
+// passed to fn commit together when fn returns nil, and none do otherwise.
+func (db *DB) Batch(fn func(tx *DB) error) error {
+	if db.tx != nil {
+		return fn(db)
+	}
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var hooks []func()
+	if err := fn(&DB{DB: db.DB, driver: db.driver, canon: db.canon, tx: tx, afterCommit: &hooks}); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	for _, hook := range hooks {
+		hook()
+	}
+	return nil
+}
+
+// AfterCommit runs fn once the batch transaction commits, or right away
+// outside a batch. It is for side effects such as cache invalidation that
+// must not see the batch's writes before other connections can. When the
+// batch rolls back fn never runs.
+func (db *DB) AfterCommit(fn func()) {
+	if db.tx == nil {
+		fn()
+		return
+	}
+	*db.afterCommit = append(*db.afterCommit, fn)
+}
+
+// IsBusy reports whether err is SQLite giving up on a lock held by another
+// connection, which retrying the transaction can resolve.
+func IsBusy(err error) bool {
+	var sqliteErr sqlite3.Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+	return sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked
+}
+
+// Isolate runs fn under a savepoint when called inside a batch, so a failed
+// statement in fn discards only fn's writes. Without it one bad record would
+// abort the whole batch on Postgres. When fn returns an error its writes are
+// rolled back and the error returned.
+func (db *DB) Isolate(fn func() error) error {
+	if db.tx == nil {
+		return fn()
+	}
+	if _, err := db.tx.Exec(`SAVEPOINT batch_item`); err != nil {
+		return err
+	}
+	fnErr := fn()
+	if fnErr == nil {
+		if _, err := db.tx.Exec(`RELEASE SAVEPOINT batch_item`); err == nil {
+			return nil
+		}
+	}
+	if _, err := db.tx.Exec(`ROLLBACK TO SAVEPOINT batch_item`); err != nil {
+		return err
+	}
+	if _, err := db.tx.Exec(`RELEASE SAVEPOINT batch_item`); err != nil {
+		return err
+	}
+	return fnErr
+}
+
+// inTx runs fn in its own transaction, or under a savepoint of the batch
+// transaction when there is one.
+func (db *DB) inTx(fn func(tx *sql.Tx) error) error {
+	if db.tx != nil {
+		if _, err := db.tx.Exec(`SAVEPOINT nested_write`); err != nil {
+			return err
+		}
+		if err := fn(db.tx); err != nil {
+			db.tx.Exec(`ROLLBACK TO SAVEPOINT nested_write`)
+			db.tx.Exec(`RELEASE SAVEPOINT nested_write`)
+			return err
+		}
+		_, err := db.tx.Exec(`RELEASE SAVEPOINT nested_write`)
+		return err
+	}
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -9,11 +9,16 @@ import (
 
 	_ "github.com/lib/pq"
 	_ "github.com/mattn/go-sqlite3"
+
+	"margin.at/internal/urlcanon"
 )
 
 type DB struct {
 	*sql.DB
-	driver string
+	driver      string
+	canon       *urlcanon.Canonicalizer
+	tx          *sql.Tx
+	afterCommit *[]func()
 }
 
 type Annotation struct {
@@ -25,6 +30,7 @@ type Annotation struct {
 	BodyURI      *string   `json:"bodyUri,omitempty"`
 	TargetSource string    `json:"targetSource"`
 	TargetHash   string    `json:"targetHash"`
+	TargetDomain string    `json:"targetDomain,omitempty"`
 	TargetTitle  *string   `json:"targetTitle,omitempty"`
 	SelectorJSON *string   `json:"selector,omitempty"`
 	TagsJSON     *string   `json:"tags,omitempty"`
@@ -48,6 +54,7 @@ type Highlight struct {
 	AuthorDID    string    `json:"authorDid"`
 	TargetSource string    `json:"targetSource"`
 	TargetHash   string    `json:"targetHash"`
+	TargetDomain string    `json:"targetDomain,omitempty"`
 	TargetTitle  *string   `json:"targetTitle,omitempty"`
 	SelectorJSON *string   `json:"selector,omitempty"`
 	Color        *string   `json:"color,omitempty"`
@@ -58,16 +65,17 @@ type Highlight struct {
 }
 
 type Bookmark struct {
-	URI         string    `json:"uri"`
-	AuthorDID   string    `json:"authorDid"`
-	Source      string    `json:"source"`
-	SourceHash  string    `json:"sourceHash"`
-	Title       *string   `json:"title,omitempty"`
-	Description *string   `json:"description,omitempty"`
-	TagsJSON    *string   `json:"tags,omitempty"`
-	CreatedAt   time.Time `json:"createdAt"`
-	IndexedAt   time.Time `json:"indexedAt"`
-	CID         *string   `json:"cid,omitempty"`
+	URI          string    `json:"uri"`
+	AuthorDID    string    `json:"authorDid"`
+	Source       string    `json:"source"`
+	SourceHash   string    `json:"sourceHash"`
+	SourceDomain string    `json:"sourceDomain,omitempty"`
+	Title        *string   `json:"title,omitempty"`
+	Description  *string   `json:"description,omitempty"`
+	TagsJSON     *string   `json:"tags,omitempty"`
+	CreatedAt    time.Time `json:"createdAt"`
+	IndexedAt    time.Time `json:"indexedAt"`
+	CID          *string   `json:"cid,omitempty"`
 }
 
 type Reply struct {
@@ -203,12 +211,25 @@ type ContentLabel struct {
 	CreatedAt time.Time `json:"createdAt"`
 }
 
-func New(dsn string) (*DB, error) {
+// New opens the database at dsn. Target URLs are hashed with canon, or with
+// urlcanon.Default when it is nil.
+func New(dsn string, canon *urlcanon.Canonicalizer) (*DB, error) {
+	if canon == nil {
+		canon = urlcanon.Default()
+	}
+
 	driver := "sqlite3"
 	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
 		driver = "postgres"
 	}
 
+	if driver == "sqlite3" {
+		// Pragmas set with Exec only reach one pooled connection. Concurrent
+		// firehose workers need every connection to wait for the write lock,
+		// and to take it up front so two transactions cannot deadlock.
+		dsn = withDSNParams(dsn, "_busy_timeout=5000", "_txlock=immediate")
+	}
+
 	db, err := sql.Open(driver, dsn)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database connection: %w", err)
@@ -236,271 +257,24 @@ func New(dsn string) (*DB, error) {
 		return nil, fmt.Errorf("failed to ping database: %w", err)
 	}
 
-	return &DB{DB: db, driver: driver}, nil
+	return &DB{DB: db, driver: driver, canon: canon}, nil
 }
 
-func (db *DB) Migrate() error {
-
-	dateType := "DATETIME"
-	if db.driver == "postgres" {
-		dateType = "TIMESTAMP"
-	}
-
-	_, err := db.Exec(`
-		CREATE TABLE IF NOT EXISTS annotations (
-			uri TEXT PRIMARY KEY,
-			author_did TEXT NOT NULL,
-			motivation TEXT,
-			body_value TEXT,
-			body_format TEXT DEFAULT 'text/plain',
-			body_uri TEXT,
-			target_source TEXT NOT NULL,
-			target_hash TEXT NOT NULL,
-			target_title TEXT,
-			selector_json TEXT,
-			tags_json TEXT,
-			created_at ` + dateType + ` NOT NULL,
-			indexed_at ` + dateType + ` NOT NULL,
-			cid TEXT
-		)`)
-	if err != nil {
-		return err
-	}
-
-	db.Exec(`CREATE INDEX IF NOT EXISTS idx_annotations_target_hash ON annotations(target_hash)`)
-	db.Exec(`CREATE INDEX IF NOT EXISTS idx_annotations_author_did ON annotations(author_did)`)
-	db.Exec(`CREATE INDEX IF NOT EXISTS idx_annotations_motivation ON annotations(motivation)`)
-	db.Exec(`CREATE INDEX IF NOT EXISTS idx_annotations_created_at ON annotations(created_at DESC)`)
-
-	db.Exec(`CREATE TABLE IF NOT EXISTS highlights (
-		uri TEXT PRIMARY KEY,
-		author_did TEXT NOT NULL,
-		target_source TEXT NOT NULL,
-		target_hash TEXT NOT NULL,
-		target_title TEXT,
-		selector_json TEXT,
-		color TEXT,
-		tags_json TEXT,
-		created_at ` + dateType + ` NOT NULL,
-		indexed_at ` + dateType + ` NOT NULL,
-		cid TEXT
-	)`)
-	db.Exec(`CREATE INDEX IF NOT EXISTS idx_highlights_target_hash ON highlights(target_hash)`)
-	db.Exec(`CREATE INDEX IF NOT EXISTS idx_highlights_author_did ON highlights(author_did)`)
-
-	db.Exec(`CREATE TABLE IF NOT EXISTS bookmarks (
-		uri TEXT PRIMARY KEY,
-		author_did TEXT NOT NULL,
-		source TEXT NOT NULL,
-		source_hash TEXT NOT NULL,
-		title TEXT,
-		description TEXT,
-		tags_json TEXT,
-		created_at ` + dateType + ` NOT NULL,
-		indexed_at ` + dateType + ` NOT NULL,
-		cid TEXT
-	)`)
-	db.Exec(`CREATE INDEX IF NOT EXISTS idx_bookmarks_source_hash ON bookmarks(source_hash)`)
-	db.Exec(`CREATE INDEX IF NOT EXISTS idx_bookmarks_author_did ON bookmarks(author_did)`)
-
-	db.Exec(`CREATE TABLE IF NOT EXISTS replies (
-		uri TEXT PRIMARY KEY,
-		author_did TEXT NOT NULL,
-		parent_uri TEXT NOT NULL,
-		root_uri TEXT NOT NULL,
-		text TEXT NOT NULL,
-		format TEXT DEFAULT 'text/plain',
-		created_at ` + dateType + ` NOT NULL,
-		indexed_at ` + dateType + ` NOT NULL,
-		cid TEXT
-	)`)
-	db.Exec(`CREATE INDEX IF NOT EXISTS idx_replies_parent_uri ON replies(parent_uri)`)
-	db.Exec(`CREATE INDEX IF NOT EXISTS idx_replies_root_uri ON replies(root_uri)`)
-
-	db.Exec(`CREATE TABLE IF NOT EXISTS likes (
-		uri TEXT PRIMARY KEY,
-		author_did TEXT NOT NULL,
-		subject_uri TEXT NOT NULL,
-		created_at ` + dateType + ` NOT NULL,
-		indexed_at ` + dateType + ` NOT NULL
-	)`)
-	db.Exec(`CREATE INDEX IF NOT EXISTS idx_likes_subject_uri ON likes(subject_uri)`)
-	db.Exec(`CREATE INDEX IF NOT EXISTS idx_likes_author_did ON likes(author_did)`)
-	db.Exec(`CREATE INDEX IF NOT EXISTS idx_likes_author_subject ON likes(author_did, subject_uri)`)
-
-	db.Exec(`CREATE TABLE IF NOT EXISTS collections (
-		uri TEXT PRIMARY KEY,
-		author_did TEXT NOT NULL,
-		name TEXT NOT NULL,
-		description TEXT,
-		icon TEXT,
-		created_at ` + dateType + ` NOT NULL,
-		indexed_at ` + dateType + ` NOT NULL
-	)`)
-	db.Exec(`CREATE INDEX IF NOT EXISTS idx_collections_author_did ON collections(author_did)`)
-
-	db.Exec(`CREATE TABLE IF NOT EXISTS collection_items (
-		uri TEXT PRIMARY KEY,
-		author_did TEXT NOT NULL,
-		collection_uri TEXT NOT NULL,
-		annotation_uri TEXT NOT NULL,
-		position INTEGER DEFAULT 0,
-		created_at ` + dateType + ` NOT NULL,
-		indexed_at ` + dateType + ` NOT NULL
-	)`)
-	db.Exec(`CREATE INDEX IF NOT EXISTS idx_collection_items_collection ON collection_items(collection_uri)`)
-	db.Exec(`CREATE INDEX IF NOT EXISTS idx_collection_items_annotation ON collection_items(annotation_uri)`)
-
-	db.Exec(`CREATE TABLE IF NOT EXISTS sessions (
-		id TEXT PRIMARY KEY,
-		did TEXT NOT NULL,
-		handle TEXT NOT NULL,
-		access_token TEXT NOT NULL,
-		refresh_token TEXT NOT NULL,
-		dpop_key TEXT,
-		created_at ` + dateType + ` NOT NULL,
-		expires_at ` + dateType + ` NOT NULL
-	)`)
-	db.Exec(`CREATE INDEX IF NOT EXISTS idx_sessions_did ON sessions(did)`)
-
-	autoInc := "INTEGER PRIMARY KEY AUTOINCREMENT"
-	if db.driver == "postgres" {
-		autoInc = "SERIAL PRIMARY KEY"
+// withDSNParams adds each key=value param to dsn unless it already sets
+// that key.
+func withDSNParams(dsn string, params ...string) string {
+	for _, param := range params {
+		key := param[:strings.Index(param, "=")+1]
+		if strings.Contains(dsn, "?"+key) || strings.Contains(dsn, "&"+key) {
+			continue
+		}
+		if strings.Contains(dsn, "?") {
+			dsn += "&" + param
+		} else {
+			dsn += "?" + param
+		}
 	}
-
-	db.Exec(`CREATE TABLE IF NOT EXISTS edit_history (
-		id ` + autoInc + `,
-		uri TEXT NOT NULL,
-		record_type TEXT NOT NULL,
-		previous_content TEXT NOT NULL,
-		previous_cid TEXT,
-		edited_at ` + dateType + ` NOT NULL
-	)`)
-	db.Exec(`CREATE INDEX IF NOT EXISTS idx_edit_history_uri ON edit_history(uri)`)
-	db.Exec(`CREATE INDEX IF NOT EXISTS idx_edit_history_edited_at ON edit_history(edited_at DESC)`)
-
-	db.Exec(`CREATE TABLE IF NOT EXISTS notifications (
-		id ` + autoInc + `,
-		recipient_did TEXT NOT NULL,
-		actor_did TEXT NOT NULL,
-		type TEXT NOT NULL,
-		subject_uri TEXT NOT NULL,
-		created_at ` + dateType + ` NOT NULL,
-		read_at ` + dateType + `
-	)`)
-	db.Exec(`CREATE INDEX IF NOT EXISTS idx_notifications_recipient ON notifications(recipient_did)`)
-	db.Exec(`CREATE INDEX IF NOT EXISTS idx_notifications_created_at ON notifications(created_at DESC)`)
-
-	db.Exec(`CREATE TABLE IF NOT EXISTS api_keys (
-		id TEXT PRIMARY KEY,
-		owner_did TEXT NOT NULL,
-		name TEXT NOT NULL,
-		key_hash TEXT NOT NULL,
-		created_at ` + dateType + ` NOT NULL,
-		last_used_at ` + dateType + `,
-		uri TEXT,
-		cid TEXT,
-		indexed_at ` + dateType + ` DEFAULT CURRENT_TIMESTAMP
-	)`)
-	db.Exec(`CREATE INDEX IF NOT EXISTS idx_api_keys_owner ON api_keys(owner_did)`)
-	db.Exec(`CREATE INDEX IF NOT EXISTS idx_api_keys_hash ON api_keys(key_hash)`)
-
-	db.Exec(`CREATE TABLE IF NOT EXISTS profiles (
-		uri TEXT PRIMARY KEY,
-		author_did TEXT NOT NULL,
-		display_name TEXT,
-		avatar TEXT,
-		bio TEXT,
-		website TEXT,
-		links_json TEXT,
-		created_at ` + dateType + ` NOT NULL,
-		indexed_at ` + dateType + ` NOT NULL,
-		cid TEXT
-	)`)
-	db.Exec(`CREATE INDEX IF NOT EXISTS idx_profiles_author_did ON profiles(author_did)`)
-
-	db.Exec(`CREATE TABLE IF NOT EXISTS preferences (
-		uri TEXT PRIMARY KEY,
-		author_did TEXT NOT NULL,
-		external_link_skipped_hostnames TEXT,
-		subscribed_labelers TEXT,
-		label_preferences TEXT,
-		disable_external_link_warning BOOLEAN,
-		created_at ` + dateType + ` NOT NULL,
-		indexed_at ` + dateType + ` NOT NULL,
-		cid TEXT
-	)`)
-	db.Exec(`CREATE INDEX IF NOT EXISTS idx_preferences_author_did ON preferences(author_did)`)
-
-	db.runMigrations()
-
-	db.Exec(`CREATE TABLE IF NOT EXISTS cursors (
-		id TEXT PRIMARY KEY,
-		last_cursor BIGINT NOT NULL,
-		updated_at ` + dateType + ` NOT NULL
-	)`)
-
-	db.Exec(`CREATE TABLE IF NOT EXISTS blocks (
-		id ` + autoInc + `,
-		actor_did TEXT NOT NULL,
-		subject_did TEXT NOT NULL,
-		created_at ` + dateType + ` NOT NULL,
-		UNIQUE(actor_did, subject_did)
-	)`)
-	db.Exec(`CREATE INDEX IF NOT EXISTS idx_blocks_actor ON blocks(actor_did)`)
-	db.Exec(`CREATE INDEX IF NOT EXISTS idx_blocks_subject ON blocks(subject_did)`)
-
-	db.Exec(`CREATE TABLE IF NOT EXISTS mutes (
-		id ` + autoInc + `,
-		actor_did TEXT NOT NULL,
-		subject_did TEXT NOT NULL,
-		created_at ` + dateType + ` NOT NULL,
-		UNIQUE(actor_did, subject_did)
-	)`)
-	db.Exec(`CREATE INDEX IF NOT EXISTS idx_mutes_actor ON mutes(actor_did)`)
-	db.Exec(`CREATE INDEX IF NOT EXISTS idx_mutes_subject ON mutes(subject_did)`)
-
-	db.Exec(`CREATE TABLE IF NOT EXISTS moderation_reports (
-		id ` + autoInc + `,
-		reporter_did TEXT NOT NULL,
-		subject_did TEXT NOT NULL,
-		subject_uri TEXT,
-		reason_type TEXT NOT NULL,
-		reason_text TEXT,
-		status TEXT NOT NULL DEFAULT 'pending',
-		created_at ` + dateType + ` NOT NULL,
-		resolved_at ` + dateType + `,
-		resolved_by TEXT
-	)`)
-	db.Exec(`CREATE INDEX IF NOT EXISTS idx_mod_reports_status ON moderation_reports(status)`)
-	db.Exec(`CREATE INDEX IF NOT EXISTS idx_mod_reports_subject ON moderation_reports(subject_did)`)
-	db.Exec(`CREATE INDEX IF NOT EXISTS idx_mod_reports_reporter ON moderation_reports(reporter_did)`)
-
-	db.Exec(`CREATE TABLE IF NOT EXISTS moderation_actions (
-		id ` + autoInc + `,
-		report_id INTEGER NOT NULL,
-		actor_did TEXT NOT NULL,
-		action TEXT NOT NULL,
-		comment TEXT,
-		created_at ` + dateType + ` NOT NULL
-	)`)
-	db.Exec(`CREATE INDEX IF NOT EXISTS idx_mod_actions_report ON moderation_actions(report_id)`)
-
-	db.Exec(`CREATE TABLE IF NOT EXISTS content_labels (
-		id ` + autoInc + `,
-		src TEXT NOT NULL,
-		uri TEXT NOT NULL,
-		val TEXT NOT NULL,
-		neg INTEGER NOT NULL DEFAULT 0,
-		created_by TEXT NOT NULL,
-		created_at ` + dateType + ` NOT NULL
-	)`)
-	db.Exec(`CREATE INDEX IF NOT EXISTS idx_content_labels_uri ON content_labels(uri)`)
-	db.Exec(`CREATE INDEX IF NOT EXISTS idx_content_labels_src ON content_labels(src)`)
-
-	db.runMigrations()
-
-	return nil
+	return dsn
 }
 
 func (db *DB) GetProfilesByDIDs(dids []string) (map[string]*Profile, error) {
@@ -571,6 +345,21 @@ func (db *DB) SetCursor(id string, cursor int64) error {
 	return err
 }
 
+// AdvanceCursor is SetCursor for writers that may finish out of order: it
+// never moves the stored cursor backwards.
+func (db *DB) AdvanceCursor(id string, cursor int64) error {
+	query := `
+		INSERT INTO cursors (id, last_cursor, updated_at)
+		VALUES ($1, $2, $3)
+		ON CONFLICT(id) DO UPDATE SET
+			last_cursor = EXCLUDED.last_cursor,
+			updated_at = EXCLUDED.updated_at
+		WHERE cursors.last_cursor < EXCLUDED.last_cursor
+	`
+	_, err := db.Exec(query, id, cursor, time.Now())
+	return err
+}
+
 func (db *DB) GetProfile(did string) (*Profile, error) {
 	var p Profile
 	err := db.QueryRow("SELECT uri, author_did, display_name, avatar, bio, website, links_json, created_at, indexed_at FROM profiles WHERE author_did = $1", did).Scan(
@@ -694,104 +483,6 @@ func (db *DB) GetPreferenceURIs(did string) ([]string, error) {
 	return uris, nil
 }
 
-func (db *DB) runMigrations() {
-	dateType := "DATETIME"
-	if db.driver == "postgres" {
-		dateType = "TIMESTAMP"
-	}
-	db.Exec(`ALTER TABLE sessions ADD COLUMN dpop_key TEXT`)
-
-	db.Exec(`ALTER TABLE annotations ADD COLUMN motivation TEXT`)
-	db.Exec(`ALTER TABLE annotations ADD COLUMN body_value TEXT`)
-	db.Exec(`ALTER TABLE annotations ADD COLUMN body_format TEXT DEFAULT 'text/plain'`)
-	db.Exec(`ALTER TABLE annotations ADD COLUMN body_uri TEXT`)
-	db.Exec(`ALTER TABLE annotations ADD COLUMN target_source TEXT`)
-	db.Exec(`ALTER TABLE annotations ADD COLUMN target_hash TEXT`)
-	db.Exec(`ALTER TABLE annotations ADD COLUMN target_title TEXT`)
-	db.Exec(`ALTER TABLE annotations ADD COLUMN selector_json TEXT`)
-	db.Exec(`ALTER TABLE annotations ADD COLUMN tags_json TEXT`)
-	db.Exec(`ALTER TABLE annotations ADD COLUMN cid TEXT`)
-
-	db.Exec(`UPDATE annotations SET target_source = url WHERE target_source IS NULL AND url IS NOT NULL`)
-	db.Exec(`UPDATE annotations SET target_hash = url_hash WHERE target_hash IS NULL AND url_hash IS NOT NULL`)
-	db.Exec(`UPDATE annotations SET body_value = text WHERE body_value IS NULL AND text IS NOT NULL`)
-	db.Exec(`UPDATE annotations SET target_title = title WHERE target_title IS NULL AND title IS NOT NULL`)
-	db.Exec(`UPDATE annotations SET motivation = 'commenting' WHERE motivation IS NULL`)
-
-	db.Exec(`ALTER TABLE profiles ADD COLUMN website TEXT`)
-	db.Exec(`ALTER TABLE profiles ADD COLUMN display_name TEXT`)
-	db.Exec(`ALTER TABLE profiles ADD COLUMN avatar TEXT`)
-
-	if db.driver == "postgres" {
-		db.Exec(`ALTER TABLE cursors ALTER COLUMN last_cursor TYPE BIGINT`)
-	}
-
-	db.Exec(`ALTER TABLE api_keys ADD COLUMN uri TEXT`)
-	db.Exec(`ALTER TABLE api_keys ADD COLUMN cid TEXT`)
-	db.Exec(`ALTER TABLE api_keys ADD COLUMN indexed_at ` + dateType + ` DEFAULT CURRENT_TIMESTAMP`)
-
-	db.migrateModeration(dateType)
-
-	db.Exec(`ALTER TABLE preferences ADD COLUMN subscribed_labelers TEXT`)
-	db.Exec(`ALTER TABLE preferences ADD COLUMN label_preferences TEXT`)
-	db.Exec(`ALTER TABLE preferences ADD COLUMN disable_external_link_warning BOOLEAN`)
-}
-
-func (db *DB) migrateModeration(dateType string) {
-	_, err := db.Exec(`SELECT subject_did FROM moderation_reports LIMIT 0`)
-	if err != nil {
-		db.Exec(`DROP TABLE IF EXISTS moderation_reports`)
-		db.Exec(`DROP TABLE IF EXISTS moderation_actions`)
-
-		autoInc := "INTEGER PRIMARY KEY AUTOINCREMENT"
-		if db.driver == "postgres" {
-			autoInc = "SERIAL PRIMARY KEY"
-		}
-
-		db.Exec(`CREATE TABLE IF NOT EXISTS moderation_reports (
-			id ` + autoInc + `,
-			reporter_did TEXT NOT NULL,
-			subject_did TEXT NOT NULL,
-			subject_uri TEXT,
-			reason_type TEXT NOT NULL,
-			reason_text TEXT,
-			status TEXT NOT NULL DEFAULT 'pending',
-			created_at ` + dateType + ` NOT NULL,
-			resolved_at ` + dateType + `,
-			resolved_by TEXT
-		)`)
-		db.Exec(`CREATE INDEX IF NOT EXISTS idx_mod_reports_status ON moderation_reports(status)`)
-		db.Exec(`CREATE INDEX IF NOT EXISTS idx_mod_reports_subject ON moderation_reports(subject_did)`)
-		db.Exec(`CREATE INDEX IF NOT EXISTS idx_mod_reports_reporter ON moderation_reports(reporter_did)`)
-
-		db.Exec(`CREATE TABLE IF NOT EXISTS moderation_actions (
-			id ` + autoInc + `,
-			report_id INTEGER NOT NULL,
-			actor_did TEXT NOT NULL,
-			action TEXT NOT NULL,
-			comment TEXT,
-			created_at ` + dateType + ` NOT NULL
-		)`)
-		db.Exec(`CREATE INDEX IF NOT EXISTS idx_mod_actions_report ON moderation_actions(report_id)`)
-	}
-
-	autoInc := "INTEGER PRIMARY KEY AUTOINCREMENT"
-	if db.driver == "postgres" {
-		autoInc = "SERIAL PRIMARY KEY"
-	}
-	db.Exec(`CREATE TABLE IF NOT EXISTS content_labels (
-		id ` + autoInc + `,
-		src TEXT NOT NULL,
-		uri TEXT NOT NULL,
-		val TEXT NOT NULL,
-		neg INTEGER NOT NULL DEFAULT 0,
-		created_by TEXT NOT NULL,
-		created_at ` + dateType + ` NOT NULL
-	)`)
-	db.Exec(`CREATE INDEX IF NOT EXISTS idx_content_labels_uri ON content_labels(uri)`)
-	db.Exec(`CREATE INDEX IF NOT EXISTS idx_content_labels_src ON content_labels(src)`)
-}
-
 func (db *DB) Close() error {
 	return db.DB.Close()
 }
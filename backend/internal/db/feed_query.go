@@ -0,0 +1,277 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+type FeedKind string
+
+const (
+	KindAnnotation     FeedKind = "annotation"
+	KindHighlight      FeedKind = "highlight"
+	KindBookmark       FeedKind = "bookmark"
+	KindCollectionItem FeedKind = "collectionItem"
+)
+
+type FeedSort string
+
+const (
+	SortRecent  FeedSort = "recent"
+	SortPopular FeedSort = "popular"
+	SortShelved FeedSort = "shelved"
+)
+
+// FeedQuery describes a feed as a set of independent filters. Every field is
+// optional; the zero value lists every record type, newest first.
+type FeedQuery struct {
+	// Kinds restricts the record types returned. Empty means all of them.
+	Kinds []FeedKind
+	// Source is "margin", "semble" or empty for both.
+	Source       string
+	Tags         TagFilter
+	Authors      []string
+	TargetHashes []string
+	// Domain matches records whose target is on this domain or one of its
+	// subdomains.
+	Domain string
+	// Since and Until bound created_at. Since is inclusive and Until
+	// exclusive. Popular and shelved feeds fill in their own window when
+	// these are zero.
+	Since time.Time
+	Until time.Time
+	Sort  FeedSort
+	// Cursor is only honoured by the recent sort.
+	Cursor *Cursor
+	Limit  int
+	Offset int
+}
+
+// Feed holds the rows a FeedQuery matched, per record type.
+type Feed struct {
+	Annotations     []Annotation
+	Highlights      []Highlight
+	Bookmarks       []Bookmark
+	CollectionItems []CollectionItem
+}
+
+type feedTable struct {
+	name    string
+	columns string
+	// hashColumn is the target hash column. It is empty for collection
+	// items, which have no target_domain either.
+	hashColumn string
+	// subjectColumn is the URI that likes, replies and source matching
+	// apply to.
+	subjectColumn string
+	tagged        bool
+}
+
+const (
+	annotationColumns     = "uri, author_did, motivation, body_value, body_format, body_uri, target_source, target_hash, target_title, selector_json, tags_json, created_at, indexed_at, cid"
+	highlightColumns      = "uri, author_did, target_source, target_hash, target_title, selector_json, color, tags_json, created_at, indexed_at, cid"
+	bookmarkColumns       = "uri, author_did, source, source_hash, title, description, tags_json, created_at, indexed_at, cid"
+	collectionItemColumns = "uri, author_did, collection_uri, annotation_uri, position, created_at, indexed_at"
+)
+
+var feedTables = map[FeedKind]feedTable{
+	KindAnnotation:     {"annotations", annotationColumns, "target_hash", "uri", true},
+	KindHighlight:      {"highlights", highlightColumns, "target_hash", "uri", true},
+	KindBookmark:       {"bookmarks", bookmarkColumns, "source_hash", "uri", true},
+	KindCollectionItem: {"collection_items", collectionItemColumns, "", "annotation_uri", false},
+}
+
+func (q FeedQuery) Includes(kind FeedKind) bool {
+	if len(q.Kinds) == 0 {
+		return true
+	}
+	for _, k := range q.Kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+func (q FeedQuery) compile(kind FeedKind) *selectQuery {
+	t := feedTables[kind]
+	sq := newSelectQuery(t.columns, t.name)
+
+	sq.whereIn("author_did", q.Authors)
+	sq.where(activeAuthor(t.name+".author_did"), false)
+	domain := q.domain()
+	if t.hashColumn != "" {
+		sq.whereIn(t.hashColumn, q.TargetHashes)
+		if domain != "" {
+			// Every reversed form with this prefix is the domain or one of
+			// its subdomains. '/' sorts right after '.', closing the range.
+			prefix := ReverseDomain(domain)
+			sq.where("target_domain_rev >= ? AND target_domain_rev < ?", prefix, strings.TrimSuffix(prefix, ".")+"/")
+		}
+	} else if len(q.TargetHashes) > 0 || domain != "" {
+		sq.where("1 = 0")
+	}
+	if t.tagged {
+		q.Tags.apply(sq)
+	} else if !q.Tags.IsZero() {
+		sq.where("1 = 0")
+	}
+	switch q.Source {
+	case "margin":
+		sq.where(t.subjectColumn + " NOT LIKE '%network.cosmik%'")
+	case "semble":
+		sq.where(t.subjectColumn + " LIKE '%network.cosmik%'")
+	}
+
+	since, until := q.Since, q.Until
+	switch q.Sort {
+	case SortPopular:
+		if since.IsZero() {
+			since = time.Now().AddDate(0, 0, -14)
+		}
+	case SortShelved:
+		if since.IsZero() {
+			since = time.Now().AddDate(0, 0, -14)
+		}
+		if until.IsZero() {
+			until = time.Now().AddDate(0, 0, -1)
+		}
+	}
+	if !since.IsZero() {
+		sq.where("created_at >= ?", since)
+	}
+	if !until.IsZero() {
+		sq.where("created_at < ?", until)
+	}
+
+	engagement := fmt.Sprintf("((SELECT COUNT(*) FROM likes WHERE subject_uri = %[1]s.%[2]s) + (SELECT COUNT(*) FROM replies WHERE root_uri = %[1]s.%[2]s))", t.name, t.subjectColumn)
+	switch q.Sort {
+	case SortPopular:
+		sq.where(engagement + " > 0").order(engagement + " DESC, created_at DESC")
+	case SortShelved:
+		sq.where(engagement + " = 0").order("RANDOM()")
+	default:
+		if q.Cursor != nil {
+			sq.where("(created_at < ? OR (created_at = ? AND uri < ?))", q.Cursor.CreatedAt, q.Cursor.CreatedAt, q.Cursor.URI)
+		}
+		sq.order("created_at DESC, uri DESC")
+	}
+
+	return sq.limitTo(q.Limit).offsetBy(q.Offset)
+}
+
+// QueryFeed runs the query against each record type it includes.
+func (db *DB) QueryFeed(q FeedQuery) (*Feed, error) {
+	feed := &Feed{}
+	var err error
+	if q.Includes(KindAnnotation) {
+		if feed.Annotations, err = db.QueryAnnotations(q); err != nil {
+			return nil, err
+		}
+	}
+	if q.Includes(KindHighlight) {
+		if feed.Highlights, err = db.QueryHighlights(q); err != nil {
+			return nil, err
+		}
+	}
+	if q.Includes(KindBookmark) {
+		if feed.Bookmarks, err = db.QueryBookmarks(q); err != nil {
+			return nil, err
+		}
+	}
+	if q.Includes(KindCollectionItem) {
+		if feed.CollectionItems, err = db.QueryCollectionItems(q); err != nil {
+			return nil, err
+		}
+	}
+	return feed, nil
+}
+
+func (db *DB) QueryAnnotations(q FeedQuery) ([]Annotation, error) {
+	query, args := q.compile(KindAnnotation).build()
+	rows, err := db.Query(db.Rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanAnnotations(rows)
+}
+
+func (db *DB) QueryHighlights(q FeedQuery) ([]Highlight, error) {
+	query, args := q.compile(KindHighlight).build()
+	rows, err := db.Query(db.Rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var highlights []Highlight
+	for rows.Next() {
+		var h Highlight
+		if err := rows.Scan(&h.URI, &h.AuthorDID, &h.TargetSource, &h.TargetHash, &h.TargetTitle, &h.SelectorJSON, &h.Color, &h.TagsJSON, &h.CreatedAt, &h.IndexedAt, &h.CID); err != nil {
+			return nil, err
+		}
+		highlights = append(highlights, h)
+	}
+	return highlights, nil
+}
+
+func (db *DB) QueryBookmarks(q FeedQuery) ([]Bookmark, error) {
+	query, args := q.compile(KindBookmark).build()
+	rows, err := db.Query(db.Rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var bookmarks []Bookmark
+	for rows.Next() {
+		var b Bookmark
+		if err := rows.Scan(&b.URI, &b.AuthorDID, &b.Source, &b.SourceHash, &b.Title, &b.Description, &b.TagsJSON, &b.CreatedAt, &b.IndexedAt, &b.CID); err != nil {
+			return nil, err
+		}
+		bookmarks = append(bookmarks, b)
+	}
+	return bookmarks, nil
+}
+
+// QueryCollectionItems matches nothing when the query filters on tags, target
+// hashes or domain, which collection items do not carry.
+func (db *DB) QueryCollectionItems(q FeedQuery) ([]CollectionItem, error) {
+	query, args := q.compile(KindCollectionItem).build()
+	rows, err := db.Query(db.Rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []CollectionItem
+	for rows.Next() {
+		var item CollectionItem
+		if err := rows.Scan(&item.URI, &item.AuthorDID, &item.CollectionURI, &item.AnnotationURI, &item.Position, &item.CreatedAt, &item.IndexedAt); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// Matches evaluates the query's tag, date and domain filters against a record
+// that was fetched from a PDS rather than the database.
+func (q FeedQuery) Matches(tagsJSON *string, createdAt time.Time, domain string) bool {
+	if !q.Tags.Matches(tagsJSON) || !q.InRange(createdAt) {
+		return false
+	}
+	want := q.domain()
+	return want == "" || domain == want || strings.HasSuffix(domain, "."+want)
+}
+
+func (q FeedQuery) domain() string {
+	return strings.TrimPrefix(strings.ToLower(strings.TrimSpace(q.Domain)), "www.")
+}
+
+func (q FeedQuery) InRange(createdAt time.Time) bool {
+	return (q.Since.IsZero() || !createdAt.Before(q.Since)) && (q.Until.IsZero() || createdAt.Before(q.Until))
+}
@@ -0,0 +1,153 @@
+package db
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Kinds of ingest failure. Only database failures are retried on their own;
+// the others need a fix to the record or to the code first. A commit failure
+// is a relay commit that failed verification, which a retry checks again
+// against the repo's current signing key.
+const (
+	IngestFailureParse    = "parse"
+	IngestFailureSchema   = "schema"
+	IngestFailureCID      = "cid"
+	IngestFailureDatabase = "db"
+	IngestFailureCommit   = "commit"
+)
+
+// IngestFailure is a record the firehose could not index or delete, kept so
+// it can be inspected and retried. Operation is the firehose operation that
+// failed; a failed delete has no record. Frame is the relay commit, base64
+// encoded, that a commit failure came from.
+type IngestFailure struct {
+	ID            int64      `json:"id"`
+	URI           string     `json:"uri"`
+	Collection    string     `json:"collection"`
+	Operation     string     `json:"operation"`
+	Record        string     `json:"record"`
+	CID           string     `json:"cid,omitempty"`
+	Frame         string     `json:"-"`
+	Kind          string     `json:"kind"`
+	Error         string     `json:"error"`
+	Attempts      int        `json:"attempts"`
+	FirstFailedAt time.Time  `json:"firstFailedAt"`
+	LastFailedAt  time.Time  `json:"lastFailedAt"`
+	NextAttemptAt *time.Time `json:"nextAttemptAt,omitempty"`
+}
+
+const ingestFailureColumns = "id, uri, collection, operation, record, cid, frame, kind, error, attempts, first_failed_at, last_failed_at, next_attempt_at"
+
+func scanIngestFailure(row interface{ Scan(...interface{}) error }) (*IngestFailure, error) {
+	var f IngestFailure
+	if err := row.Scan(&f.ID, &f.URI, &f.Collection, &f.Operation, &f.Record, &f.CID, &f.Frame, &f.Kind, &f.Error, &f.Attempts, &f.FirstFailedAt, &f.LastFailedAt, &f.NextAttemptAt); err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// RecordIngestFailure stores a failure, or counts another attempt of one
+// already stored for the same URI.
+func (db *DB) RecordIngestFailure(f *IngestFailure) error {
+	now := time.Now()
+	_, err := db.Exec(db.Rebind(`
+		INSERT INTO ingest_failures (uri, collection, operation, record, cid, frame, kind, error, attempts, first_failed_at, last_failed_at, next_attempt_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, 1, ?, ?, ?)
+		ON CONFLICT(uri) DO UPDATE SET
+			operation = excluded.operation,
+			record = excluded.record,
+			cid = excluded.cid,
+			frame = excluded.frame,
+			kind = excluded.kind,
+			error = excluded.error,
+			attempts = ingest_failures.attempts + 1,
+			last_failed_at = excluded.last_failed_at,
+			next_attempt_at = excluded.next_attempt_at
+	`), f.URI, f.Collection, f.Operation, f.Record, f.CID, f.Frame, f.Kind, f.Error, now, now, f.NextAttemptAt)
+	return err
+}
+
+// ClearIngestFailure forgets the failure for uri, once it has been indexed
+// or deleted.
+func (db *DB) ClearIngestFailure(uri string) error {
+	_, err := db.Exec(db.Rebind(`DELETE FROM ingest_failures WHERE uri = ?`), uri)
+	return err
+}
+
+func (db *DB) GetIngestFailure(id int64) (*IngestFailure, error) {
+	f, err := scanIngestFailure(db.QueryRow(db.Rebind(`SELECT `+ingestFailureColumns+` FROM ingest_failures WHERE id = ?`), id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return f, err
+}
+
+func (db *DB) GetIngestFailureByURI(uri string) (*IngestFailure, error) {
+	f, err := scanIngestFailure(db.QueryRow(db.Rebind(`SELECT `+ingestFailureColumns+` FROM ingest_failures WHERE uri = ?`), uri))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return f, err
+}
+
+// ListIngestFailures returns failures newest first, optionally only those of
+// one collection or kind.
+func (db *DB) ListIngestFailures(collection, kind string, limit, offset int) ([]IngestFailure, int, error) {
+	sq := newSelectQuery(ingestFailureColumns, "ingest_failures")
+	if collection != "" {
+		sq.where("collection = ?", collection)
+	}
+	if kind != "" {
+		sq.where("kind = ?", kind)
+	}
+
+	countQuery := newSelectQuery("COUNT(*)", "ingest_failures")
+	countQuery.conds, countQuery.args = sq.conds, sq.args
+	query, args := countQuery.build()
+	var total int
+	if err := db.QueryRow(db.Rebind(query), args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	query, args = sq.order("last_failed_at DESC").limitTo(limit).offsetBy(offset).build()
+	rows, err := db.Query(db.Rebind(query), args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var failures []IngestFailure
+	for rows.Next() {
+		f, err := scanIngestFailure(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		failures = append(failures, *f)
+	}
+	return failures, total, rows.Err()
+}
+
+// DueIngestFailures returns failures whose next automatic retry is due.
+func (db *DB) DueIngestFailures(limit int) ([]IngestFailure, error) {
+	rows, err := db.Query(db.Rebind(`
+		SELECT `+ingestFailureColumns+` FROM ingest_failures
+		WHERE next_attempt_at IS NOT NULL AND next_attempt_at <= ?
+		ORDER BY next_attempt_at
+		LIMIT ?
+	`), time.Now(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var failures []IngestFailure
+	for rows.Next() {
+		f, err := scanIngestFailure(rows)
+		if err != nil {
+			return nil, err
+		}
+		failures = append(failures, *f)
+	}
+	return failures, rows.Err()
+}
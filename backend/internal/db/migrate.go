@@ -0,0 +1,279 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(d Dialect) []string
+	Down    func(d Dialect) []string
+	// UpFunc runs after the Up statements inside the same transaction, for
+	// steps that need to inspect the existing schema before changing it.
+	UpFunc func(tx *sql.Tx, d Dialect) error
+}
+
+type MigrationStatus struct {
+	Version   int        `json:"version"`
+	Name      string     `json:"name"`
+	Applied   bool       `json:"applied"`
+	AppliedAt *time.Time `json:"appliedAt,omitempty"`
+}
+
+type Dialect struct {
+	Driver string
+}
+
+func (d Dialect) IsPostgres() bool {
+	return d.Driver == "postgres"
+}
+
+func (d Dialect) DateType() string {
+	if d.IsPostgres() {
+		return "TIMESTAMP"
+	}
+	return "DATETIME"
+}
+
+func (d Dialect) AutoIncrement() string {
+	if d.IsPostgres() {
+		return "SERIAL PRIMARY KEY"
+	}
+	return "INTEGER PRIMARY KEY AUTOINCREMENT"
+}
+
+func (d Dialect) Rebind(query string) string {
+	return (&DB{driver: d.Driver}).Rebind(query)
+}
+
+const migrationLockID = 727274
+
+func (db *DB) Dialect() Dialect {
+	return Dialect{Driver: db.driver}
+}
+
+func (db *DB) Driver() string {
+	return db.driver
+}
+
+func (db *DB) Migrate() error {
+	return db.MigrateUp(0)
+}
+
+func (db *DB) ensureMigrationsTable() error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at ` + db.Dialect().DateType() + ` NOT NULL
+	)`)
+	if err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+	return nil
+}
+
+func (db *DB) appliedMigrations() (map[int]time.Time, error) {
+	if err := db.ensureMigrationsTable(); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+	return applied, rows.Err()
+}
+
+func sortedMigrations() []Migration {
+	sorted := make([]Migration, len(migrations))
+	copy(sorted, migrations)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Version < sorted[j].Version
+	})
+	return sorted
+}
+
+func (db *DB) MigrationStatus() ([]MigrationStatus, error) {
+	applied, err := db.appliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	var status []MigrationStatus
+	for _, m := range sortedMigrations() {
+		s := MigrationStatus{Version: m.Version, Name: m.Name}
+		if at, ok := applied[m.Version]; ok {
+			s.Applied = true
+			appliedAt := at
+			s.AppliedAt = &appliedAt
+		}
+		status = append(status, s)
+	}
+	return status, nil
+}
+
+func (db *DB) SchemaVersion() (int, error) {
+	applied, err := db.appliedMigrations()
+	if err != nil {
+		return 0, err
+	}
+	version := 0
+	for v := range applied {
+		if v > version {
+			version = v
+		}
+	}
+	return version, nil
+}
+
+// MigrateUp applies every pending migration up to and including target, or
+// all of them when target is 0. Each migration runs in its own transaction.
+func (db *DB) MigrateUp(target int) error {
+	applied, err := db.appliedMigrations()
+	if err != nil {
+		return err
+	}
+
+	for _, m := range sortedMigrations() {
+		if target > 0 && m.Version > target {
+			break
+		}
+		if _, ok := applied[m.Version]; ok {
+			continue
+		}
+		if err := db.applyMigration(m, true); err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %w", m.Version, m.Name, err)
+		}
+		log.Printf("Applied migration %d: %s", m.Version, m.Name)
+	}
+	return db.ensureSearchFTS()
+}
+
+// MigrateDown rolls back the given number of most recently applied migrations.
+func (db *DB) MigrateDown(steps int) error {
+	applied, err := db.appliedMigrations()
+	if err != nil {
+		return err
+	}
+
+	all := sortedMigrations()
+	for i := len(all) - 1; i >= 0 && steps > 0; i-- {
+		m := all[i]
+		if _, ok := applied[m.Version]; !ok {
+			continue
+		}
+		if m.Down == nil {
+			return fmt.Errorf("migration %d (%s) is irreversible", m.Version, m.Name)
+		}
+		if err := db.applyMigration(m, false); err != nil {
+			return fmt.Errorf("rollback of migration %d (%s) failed: %w", m.Version, m.Name, err)
+		}
+		log.Printf("Rolled back migration %d: %s", m.Version, m.Name)
+		steps--
+	}
+	return nil
+}
+
+func (db *DB) applyMigration(m Migration, up bool) error {
+	d := db.Dialect()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if d.IsPostgres() {
+		if _, err := tx.Exec(`SELECT pg_advisory_xact_lock($1)`, migrationLockID); err != nil {
+			return fmt.Errorf("failed to acquire migration lock: %w", err)
+		}
+	}
+
+	var count int
+	if err := tx.QueryRow(d.Rebind(`SELECT COUNT(*) FROM schema_migrations WHERE version = ?`), m.Version).Scan(&count); err != nil {
+		return err
+	}
+	if up && count > 0 || !up && count == 0 {
+		return nil
+	}
+
+	var statements []string
+	if up && m.Up != nil {
+		statements = m.Up(d)
+	} else if !up {
+		statements = m.Down(d)
+	}
+
+	for _, stmt := range statements {
+		if _, err := tx.Exec(stmt); err != nil {
+			return fmt.Errorf("%w\n%s", err, stmt)
+		}
+	}
+
+	if up {
+		if m.UpFunc != nil {
+			if err := m.UpFunc(tx, d); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.Exec(d.Rebind(`INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)`), m.Version, m.Name, time.Now()); err != nil {
+			return err
+		}
+	} else {
+		if _, err := tx.Exec(d.Rebind(`DELETE FROM schema_migrations WHERE version = ?`), m.Version); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func columnExists(tx *sql.Tx, d Dialect, table, column string) (bool, error) {
+	var count int
+	var err error
+	if d.IsPostgres() {
+		err = tx.QueryRow(`SELECT COUNT(*) FROM information_schema.columns WHERE table_name = $1 AND column_name = $2`, table, column).Scan(&count)
+	} else {
+		err = tx.QueryRow(`SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?`, table, column).Scan(&count)
+	}
+	return count > 0, err
+}
+
+func tableExists(tx *sql.Tx, d Dialect, table string) (bool, error) {
+	var count int
+	var err error
+	if d.IsPostgres() {
+		err = tx.QueryRow(`SELECT COUNT(*) FROM information_schema.tables WHERE table_name = $1`, table).Scan(&count)
+	} else {
+		err = tx.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?`, table).Scan(&count)
+	}
+	return count > 0, err
+}
+
+func addColumnIfMissing(tx *sql.Tx, d Dialect, table, column, definition string) error {
+	exists, err := columnExists(tx, d, table, column)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+	_, err = tx.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, table, column, definition))
+	return err
+}
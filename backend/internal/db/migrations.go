@@ -0,0 +1,800 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+var migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "baseline_tables",
+		Up:      baselineTables,
+		Down: func(d Dialect) []string {
+			return dropTables(
+				"content_labels", "mutes", "blocks", "cursors", "preferences", "profiles",
+				"api_keys", "notifications", "edit_history", "sessions",
+				"collection_items", "collections", "likes", "replies",
+				"bookmarks", "highlights", "annotations",
+			)
+		},
+	},
+	{
+		Version: 2,
+		Name:    "legacy_column_upgrades",
+		UpFunc:  upgradeLegacyColumns,
+		Down: func(d Dialect) []string {
+			return dropTables("moderation_actions", "moderation_reports")
+		},
+	},
+	{
+		Version: 3,
+		Name:    "baseline_indexes",
+		Up:      baselineIndexes,
+		Down: func(d Dialect) []string {
+			return dropIndexes(baselineIndexes(d))
+		},
+	},
+	{
+		Version: 4,
+		Name:    "search_index",
+		UpFunc:  createSearchIndex,
+		Down:    dropSearchIndex,
+	},
+	{
+		Version: 5,
+		Name:    "feed_keyset_indexes",
+		Up:      feedKeysetIndexes,
+		Down: func(d Dialect) []string {
+			return dropIndexes(feedKeysetIndexes(d))
+		},
+	},
+	{
+		Version: 6,
+		Name:    "record_tags",
+		Up: func(d Dialect) []string {
+			return []string{
+				`CREATE TABLE IF NOT EXISTS record_tags (
+					uri TEXT NOT NULL,
+					tag TEXT NOT NULL,
+					normalized_tag TEXT NOT NULL,
+					author_did TEXT NOT NULL,
+					created_at ` + d.DateType() + ` NOT NULL,
+					PRIMARY KEY (uri, normalized_tag)
+				)`,
+				`CREATE INDEX IF NOT EXISTS idx_record_tags_normalized ON record_tags(normalized_tag, created_at DESC)`,
+				`CREATE INDEX IF NOT EXISTS idx_record_tags_author ON record_tags(author_did, normalized_tag)`,
+			}
+		},
+		UpFunc: backfillRecordTags,
+		Down: func(d Dialect) []string {
+			return dropTables("record_tags")
+		},
+	},
+	{
+		Version: 7,
+		Name:    "target_domain",
+		Up: func(d Dialect) []string {
+			var stmts []string
+			for _, table := range domainTables {
+				stmts = append(stmts, `ALTER TABLE `+table+` ADD COLUMN target_domain TEXT`)
+			}
+			return append(stmts, targetDomainIndexes(d)...)
+		},
+		UpFunc: backfillTargetDomains,
+		Down: func(d Dialect) []string {
+			stmts := dropIndexes(targetDomainIndexes(d))
+			for _, table := range domainTables {
+				stmts = append(stmts, `ALTER TABLE `+table+` DROP COLUMN target_domain`)
+			}
+			return stmts
+		},
+	},
+	{
+		Version: 8,
+		Name:    "url_aliases",
+		Up: func(d Dialect) []string {
+			return []string{
+				`CREATE TABLE IF NOT EXISTS url_aliases (
+					alias_hash TEXT PRIMARY KEY,
+					alias_url TEXT NOT NULL,
+					canonical_hash TEXT NOT NULL,
+					canonical_url TEXT NOT NULL,
+					resolved_at ` + d.DateType() + ` NOT NULL
+				)`,
+				`CREATE INDEX IF NOT EXISTS idx_url_aliases_canonical ON url_aliases(canonical_hash)`,
+			}
+		},
+		Down: func(d Dialect) []string {
+			return dropTables("url_aliases")
+		},
+	},
+	{
+		Version: 9,
+		Name:    "page_metadata",
+		Up: func(d Dialect) []string {
+			dateType := d.DateType()
+			return []string{
+				`CREATE TABLE IF NOT EXISTS page_metadata (
+					url_hash TEXT PRIMARY KEY,
+					url TEXT NOT NULL,
+					title TEXT NOT NULL DEFAULT '',
+					description TEXT NOT NULL DEFAULT '',
+					image TEXT NOT NULL DEFAULT '',
+					favicon TEXT NOT NULL DEFAULT '',
+					site_name TEXT NOT NULL DEFAULT '',
+					canonical_url TEXT NOT NULL DEFAULT '',
+					language TEXT NOT NULL DEFAULT '',
+					etag TEXT NOT NULL DEFAULT '',
+					last_modified TEXT NOT NULL DEFAULT '',
+					fetched_at ` + dateType + `,
+					next_fetch_at ` + dateType + ` NOT NULL,
+					failure_count INTEGER NOT NULL DEFAULT 0,
+					last_error TEXT NOT NULL DEFAULT ''
+				)`,
+				`CREATE INDEX IF NOT EXISTS idx_page_metadata_next_fetch ON page_metadata(next_fetch_at)`,
+			}
+		},
+		Down: func(d Dialect) []string {
+			return dropTables("page_metadata")
+		},
+	},
+	{
+		Version: 10,
+		Name:    "page_metadata_details",
+		Up: func(d Dialect) []string {
+			var stmts []string
+			for _, c := range pageMetadataDetailColumns(d) {
+				stmts = append(stmts, `ALTER TABLE page_metadata ADD COLUMN `+c)
+			}
+			return stmts
+		},
+		Down: func(d Dialect) []string {
+			var stmts []string
+			for _, c := range pageMetadataDetailColumns(d) {
+				stmts = append(stmts, `ALTER TABLE page_metadata DROP COLUMN `+strings.Fields(c)[0])
+			}
+			return stmts
+		},
+	},
+	{
+		Version: 11,
+		Name:    "accounts",
+		Up: func(d Dialect) []string {
+			return []string{
+				`CREATE TABLE IF NOT EXISTS accounts (
+					did TEXT PRIMARY KEY,
+					handle TEXT NOT NULL DEFAULT '',
+					pds TEXT NOT NULL DEFAULT '',
+					active BOOLEAN NOT NULL DEFAULT TRUE,
+					status TEXT NOT NULL DEFAULT '',
+					updated_at ` + d.DateType() + ` NOT NULL
+				)`,
+			}
+		},
+		Down: func(d Dialect) []string {
+			return dropTables("accounts")
+		},
+	},
+	{
+		Version: 12,
+		Name:    "backfill",
+		Up: func(d Dialect) []string {
+			return []string{
+				`CREATE TABLE IF NOT EXISTS backfill_state (
+					relay TEXT PRIMARY KEY,
+					list_cursor TEXT NOT NULL DEFAULT '',
+					complete BOOLEAN NOT NULL DEFAULT FALSE,
+					started_at ` + d.DateType() + ` NOT NULL,
+					updated_at ` + d.DateType() + ` NOT NULL
+				)`,
+				`CREATE TABLE IF NOT EXISTS backfill_repos (
+					did TEXT PRIMARY KEY,
+					status TEXT NOT NULL,
+					error TEXT NOT NULL DEFAULT '',
+					updated_at ` + d.DateType() + ` NOT NULL
+				)`,
+			}
+		},
+		Down: func(d Dialect) []string {
+			return dropTables("backfill_repos", "backfill_state")
+		},
+	},
+	{
+		Version: 13,
+		Name:    "ingest_failures",
+		Up: func(d Dialect) []string {
+			return []string{
+				`CREATE TABLE IF NOT EXISTS ingest_failures (
+					id ` + d.AutoIncrement() + `,
+					uri TEXT NOT NULL UNIQUE,
+					collection TEXT NOT NULL,
+					record TEXT NOT NULL DEFAULT '',
+					cid TEXT NOT NULL DEFAULT '',
+					kind TEXT NOT NULL,
+					error TEXT NOT NULL,
+					attempts INTEGER NOT NULL DEFAULT 1,
+					first_failed_at ` + d.DateType() + ` NOT NULL,
+					last_failed_at ` + d.DateType() + ` NOT NULL,
+					next_attempt_at ` + d.DateType() + `
+				)`,
+				`CREATE INDEX IF NOT EXISTS idx_ingest_failures_next_attempt ON ingest_failures(next_attempt_at)`,
+				`CREATE INDEX IF NOT EXISTS idx_ingest_failures_collection ON ingest_failures(collection)`,
+			}
+		},
+		Down: func(d Dialect) []string {
+			return dropTables("ingest_failures")
+		},
+	},
+	{
+		Version: 14,
+		Name:    "repo_revs",
+		Up: func(d Dialect) []string {
+			return []string{
+				`CREATE TABLE IF NOT EXISTS repo_revs (
+					did TEXT PRIMARY KEY,
+					rev TEXT NOT NULL,
+					synced_at ` + d.DateType() + ` NOT NULL
+				)`,
+			}
+		},
+		Down: func(d Dialect) []string {
+			return dropTables("repo_revs")
+		},
+	},
+	{
+		Version: 15,
+		Name:    "sync_jobs",
+		Up: func(d Dialect) []string {
+			return []string{
+				`CREATE TABLE IF NOT EXISTS sync_jobs (
+					did TEXT PRIMARY KEY,
+					status TEXT NOT NULL,
+					attempts INTEGER NOT NULL DEFAULT 0,
+					collections TEXT NOT NULL DEFAULT '{}',
+					error TEXT NOT NULL DEFAULT '',
+					queued_at ` + d.DateType() + ` NOT NULL,
+					next_attempt_at ` + d.DateType() + ` NOT NULL,
+					started_at ` + d.DateType() + `,
+					finished_at ` + d.DateType() + `,
+					last_success_at ` + d.DateType() + `
+				)`,
+				`CREATE INDEX IF NOT EXISTS idx_sync_jobs_status_next_attempt ON sync_jobs(status, next_attempt_at)`,
+			}
+		},
+		Down: func(d Dialect) []string {
+			return dropTables("sync_jobs")
+		},
+	},
+	{
+		Version: 16,
+		Name:    "target_domain_rev",
+		Up: func(d Dialect) []string {
+			// Byte order on Postgres too, so the prefix range in
+			// FeedQuery.compile matches what the index is sorted by.
+			colType := "TEXT"
+			if d.IsPostgres() {
+				colType = `TEXT COLLATE "C"`
+			}
+			stmts := dropIndexes(targetDomainIndexes(d))
+			for _, table := range domainTables {
+				stmts = append(stmts, `ALTER TABLE `+table+` ADD COLUMN target_domain_rev `+colType)
+			}
+			return append(stmts, reversedDomainIndexes(d)...)
+		},
+		UpFunc: backfillReversedDomains,
+		Down: func(d Dialect) []string {
+			stmts := dropIndexes(reversedDomainIndexes(d))
+			for _, table := range domainTables {
+				stmts = append(stmts, `ALTER TABLE `+table+` DROP COLUMN target_domain_rev`)
+			}
+			return append(stmts, targetDomainIndexes(d)...)
+		},
+	},
+	{
+		Version: 17,
+		Name:    "ingest_failure_operation",
+		Up: func(d Dialect) []string {
+			return []string{`ALTER TABLE ingest_failures ADD COLUMN operation TEXT NOT NULL DEFAULT 'create'`}
+		},
+		Down: func(d Dialect) []string {
+			return []string{`ALTER TABLE ingest_failures DROP COLUMN operation`}
+		},
+	},
+	{
+		Version: 18,
+		Name:    "ingest_failure_frame",
+		Up: func(d Dialect) []string {
+			return []string{`ALTER TABLE ingest_failures ADD COLUMN frame TEXT NOT NULL DEFAULT ''`}
+		},
+		Down: func(d Dialect) []string {
+			return []string{`ALTER TABLE ingest_failures DROP COLUMN frame`}
+		},
+	},
+}
+
+func dropTables(tables ...string) []string {
+	stmts := make([]string, len(tables))
+	for i, t := range tables {
+		stmts[i] = `DROP TABLE IF EXISTS ` + t
+	}
+	return stmts
+}
+
+// dropIndexes derives DROP INDEX statements from CREATE INDEX IF NOT EXISTS
+// statements.
+func dropIndexes(creates []string) []string {
+	stmts := make([]string, len(creates))
+	for i, stmt := range creates {
+		stmts[i] = `DROP INDEX IF EXISTS ` + strings.Fields(stmt)[5]
+	}
+	return stmts
+}
+
+func pageMetadataDetailColumns(d Dialect) []string {
+	return []string{
+		`author TEXT NOT NULL DEFAULT ''`,
+		`published_at ` + d.DateType(),
+		`page_type TEXT NOT NULL DEFAULT ''`,
+		`reading_time INTEGER NOT NULL DEFAULT 0`,
+	}
+}
+
+func feedKeysetIndexes(d Dialect) []string {
+	var stmts []string
+	for _, table := range []string{"annotations", "highlights", "bookmarks", "collection_items"} {
+		stmts = append(stmts,
+			`CREATE INDEX IF NOT EXISTS idx_`+table+`_created_uri ON `+table+`(created_at DESC, uri DESC)`,
+			`CREATE INDEX IF NOT EXISTS idx_`+table+`_author_created_uri ON `+table+`(author_did, created_at DESC, uri DESC)`,
+		)
+	}
+	return stmts
+}
+
+var domainTables = []string{"annotations", "highlights", "bookmarks"}
+
+func targetDomainIndexes(d Dialect) []string {
+	var stmts []string
+	for _, table := range domainTables {
+		stmts = append(stmts, `CREATE INDEX IF NOT EXISTS idx_`+table+`_target_domain ON `+table+`(target_domain, created_at DESC)`)
+	}
+	return stmts
+}
+
+// backfillTargetDomains derives target_domain for rows written before the
+// column existed. URL parsing happens in Go so the result is the same on both
+// drivers; margin rehash later derives it from the canonical URL instead.
+func backfillTargetDomains(tx *sql.Tx, d Dialect) error {
+	sources := map[string]string{"annotations": "target_source", "highlights": "target_source", "bookmarks": "source"}
+	for _, table := range domainTables {
+		rows, err := tx.Query(`SELECT uri, ` + sources[table] + ` FROM ` + table)
+		if err != nil {
+			return err
+		}
+		domains := make(map[string]string)
+		for rows.Next() {
+			var uri, source string
+			if err := rows.Scan(&uri, &source); err != nil {
+				rows.Close()
+				return err
+			}
+			domains[uri] = hostDomain(source)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for uri, domain := range domains {
+			if _, err := tx.Exec(d.Rebind(`UPDATE `+table+` SET target_domain = ? WHERE uri = ?`), domain, uri); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func reversedDomainIndexes(d Dialect) []string {
+	var stmts []string
+	for _, table := range domainTables {
+		stmts = append(stmts, `CREATE INDEX IF NOT EXISTS idx_`+table+`_target_domain_rev ON `+table+`(target_domain_rev, created_at DESC)`)
+	}
+	return stmts
+}
+
+func backfillReversedDomains(tx *sql.Tx, d Dialect) error {
+	for _, table := range domainTables {
+		rows, err := tx.Query(`SELECT DISTINCT target_domain FROM ` + table + ` WHERE target_domain IS NOT NULL`)
+		if err != nil {
+			return err
+		}
+		var domains []string
+		for rows.Next() {
+			var domain string
+			if err := rows.Scan(&domain); err != nil {
+				rows.Close()
+				return err
+			}
+			domains = append(domains, domain)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for _, domain := range domains {
+			if _, err := tx.Exec(d.Rebind(`UPDATE `+table+` SET target_domain_rev = ? WHERE target_domain = ?`), ReverseDomain(domain), domain); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func baselineTables(d Dialect) []string {
+	dateType := d.DateType()
+	autoInc := d.AutoIncrement()
+
+	return []string{
+		`CREATE TABLE IF NOT EXISTS annotations (
+			uri TEXT PRIMARY KEY,
+			author_did TEXT NOT NULL,
+			motivation TEXT,
+			body_value TEXT,
+			body_format TEXT DEFAULT 'text/plain',
+			body_uri TEXT,
+			target_source TEXT NOT NULL,
+			target_hash TEXT NOT NULL,
+			target_title TEXT,
+			selector_json TEXT,
+			tags_json TEXT,
+			created_at ` + dateType + ` NOT NULL,
+			indexed_at ` + dateType + ` NOT NULL,
+			cid TEXT
+		)`,
+
+		`CREATE TABLE IF NOT EXISTS highlights (
+			uri TEXT PRIMARY KEY,
+			author_did TEXT NOT NULL,
+			target_source TEXT NOT NULL,
+			target_hash TEXT NOT NULL,
+			target_title TEXT,
+			selector_json TEXT,
+			color TEXT,
+			tags_json TEXT,
+			created_at ` + dateType + ` NOT NULL,
+			indexed_at ` + dateType + ` NOT NULL,
+			cid TEXT
+		)`,
+
+		`CREATE TABLE IF NOT EXISTS bookmarks (
+			uri TEXT PRIMARY KEY,
+			author_did TEXT NOT NULL,
+			source TEXT NOT NULL,
+			source_hash TEXT NOT NULL,
+			title TEXT,
+			description TEXT,
+			tags_json TEXT,
+			created_at ` + dateType + ` NOT NULL,
+			indexed_at ` + dateType + ` NOT NULL,
+			cid TEXT
+		)`,
+
+		`CREATE TABLE IF NOT EXISTS replies (
+			uri TEXT PRIMARY KEY,
+			author_did TEXT NOT NULL,
+			parent_uri TEXT NOT NULL,
+			root_uri TEXT NOT NULL,
+			text TEXT NOT NULL,
+			format TEXT DEFAULT 'text/plain',
+			created_at ` + dateType + ` NOT NULL,
+			indexed_at ` + dateType + ` NOT NULL,
+			cid TEXT
+		)`,
+
+		`CREATE TABLE IF NOT EXISTS likes (
+			uri TEXT PRIMARY KEY,
+			author_did TEXT NOT NULL,
+			subject_uri TEXT NOT NULL,
+			created_at ` + dateType + ` NOT NULL,
+			indexed_at ` + dateType + ` NOT NULL
+		)`,
+
+		`CREATE TABLE IF NOT EXISTS collections (
+			uri TEXT PRIMARY KEY,
+			author_did TEXT NOT NULL,
+			name TEXT NOT NULL,
+			description TEXT,
+			icon TEXT,
+			created_at ` + dateType + ` NOT NULL,
+			indexed_at ` + dateType + ` NOT NULL
+		)`,
+
+		`CREATE TABLE IF NOT EXISTS collection_items (
+			uri TEXT PRIMARY KEY,
+			author_did TEXT NOT NULL,
+			collection_uri TEXT NOT NULL,
+			annotation_uri TEXT NOT NULL,
+			position INTEGER DEFAULT 0,
+			created_at ` + dateType + ` NOT NULL,
+			indexed_at ` + dateType + ` NOT NULL
+		)`,
+
+		`CREATE TABLE IF NOT EXISTS sessions (
+			id TEXT PRIMARY KEY,
+			did TEXT NOT NULL,
+			handle TEXT NOT NULL,
+			access_token TEXT NOT NULL,
+			refresh_token TEXT NOT NULL,
+			dpop_key TEXT,
+			created_at ` + dateType + ` NOT NULL,
+			expires_at ` + dateType + ` NOT NULL
+		)`,
+
+		`CREATE TABLE IF NOT EXISTS edit_history (
+			id ` + autoInc + `,
+			uri TEXT NOT NULL,
+			record_type TEXT NOT NULL,
+			previous_content TEXT NOT NULL,
+			previous_cid TEXT,
+			edited_at ` + dateType + ` NOT NULL
+		)`,
+
+		`CREATE TABLE IF NOT EXISTS notifications (
+			id ` + autoInc + `,
+			recipient_did TEXT NOT NULL,
+			actor_did TEXT NOT NULL,
+			type TEXT NOT NULL,
+			subject_uri TEXT NOT NULL,
+			created_at ` + dateType + ` NOT NULL,
+			read_at ` + dateType + `
+		)`,
+
+		`CREATE TABLE IF NOT EXISTS api_keys (
+			id TEXT PRIMARY KEY,
+			owner_did TEXT NOT NULL,
+			name TEXT NOT NULL,
+			key_hash TEXT NOT NULL,
+			created_at ` + dateType + ` NOT NULL,
+			last_used_at ` + dateType + `,
+			uri TEXT,
+			cid TEXT,
+			indexed_at ` + dateType + ` DEFAULT CURRENT_TIMESTAMP
+		)`,
+
+		`CREATE TABLE IF NOT EXISTS profiles (
+			uri TEXT PRIMARY KEY,
+			author_did TEXT NOT NULL,
+			display_name TEXT,
+			avatar TEXT,
+			bio TEXT,
+			website TEXT,
+			links_json TEXT,
+			created_at ` + dateType + ` NOT NULL,
+			indexed_at ` + dateType + ` NOT NULL,
+			cid TEXT
+		)`,
+
+		`CREATE TABLE IF NOT EXISTS preferences (
+			uri TEXT PRIMARY KEY,
+			author_did TEXT NOT NULL,
+			external_link_skipped_hostnames TEXT,
+			subscribed_labelers TEXT,
+			label_preferences TEXT,
+			disable_external_link_warning BOOLEAN,
+			created_at ` + dateType + ` NOT NULL,
+			indexed_at ` + dateType + ` NOT NULL,
+			cid TEXT
+		)`,
+
+		`CREATE TABLE IF NOT EXISTS cursors (
+			id TEXT PRIMARY KEY,
+			last_cursor BIGINT NOT NULL,
+			updated_at ` + dateType + ` NOT NULL
+		)`,
+
+		`CREATE TABLE IF NOT EXISTS blocks (
+			id ` + autoInc + `,
+			actor_did TEXT NOT NULL,
+			subject_did TEXT NOT NULL,
+			created_at ` + dateType + ` NOT NULL,
+			UNIQUE(actor_did, subject_did)
+		)`,
+
+		`CREATE TABLE IF NOT EXISTS mutes (
+			id ` + autoInc + `,
+			actor_did TEXT NOT NULL,
+			subject_did TEXT NOT NULL,
+			created_at ` + dateType + ` NOT NULL,
+			UNIQUE(actor_did, subject_did)
+		)`,
+
+		`CREATE TABLE IF NOT EXISTS content_labels (
+			id ` + autoInc + `,
+			src TEXT NOT NULL,
+			uri TEXT NOT NULL,
+			val TEXT NOT NULL,
+			neg INTEGER NOT NULL DEFAULT 0,
+			created_by TEXT NOT NULL,
+			created_at ` + dateType + ` NOT NULL
+		)`,
+	}
+}
+func baselineIndexes(d Dialect) []string {
+	return []string{
+		`CREATE INDEX IF NOT EXISTS idx_annotations_target_hash ON annotations(target_hash)`,
+		`CREATE INDEX IF NOT EXISTS idx_annotations_author_did ON annotations(author_did)`,
+		`CREATE INDEX IF NOT EXISTS idx_annotations_motivation ON annotations(motivation)`,
+		`CREATE INDEX IF NOT EXISTS idx_annotations_created_at ON annotations(created_at DESC)`,
+		`CREATE INDEX IF NOT EXISTS idx_highlights_target_hash ON highlights(target_hash)`,
+		`CREATE INDEX IF NOT EXISTS idx_highlights_author_did ON highlights(author_did)`,
+		`CREATE INDEX IF NOT EXISTS idx_bookmarks_source_hash ON bookmarks(source_hash)`,
+		`CREATE INDEX IF NOT EXISTS idx_bookmarks_author_did ON bookmarks(author_did)`,
+		`CREATE INDEX IF NOT EXISTS idx_replies_parent_uri ON replies(parent_uri)`,
+		`CREATE INDEX IF NOT EXISTS idx_replies_root_uri ON replies(root_uri)`,
+		`CREATE INDEX IF NOT EXISTS idx_likes_subject_uri ON likes(subject_uri)`,
+		`CREATE INDEX IF NOT EXISTS idx_likes_author_did ON likes(author_did)`,
+		`CREATE INDEX IF NOT EXISTS idx_likes_author_subject ON likes(author_did, subject_uri)`,
+		`CREATE INDEX IF NOT EXISTS idx_collections_author_did ON collections(author_did)`,
+		`CREATE INDEX IF NOT EXISTS idx_collection_items_collection ON collection_items(collection_uri)`,
+		`CREATE INDEX IF NOT EXISTS idx_collection_items_annotation ON collection_items(annotation_uri)`,
+		`CREATE INDEX IF NOT EXISTS idx_sessions_did ON sessions(did)`,
+		`CREATE INDEX IF NOT EXISTS idx_edit_history_uri ON edit_history(uri)`,
+		`CREATE INDEX IF NOT EXISTS idx_edit_history_edited_at ON edit_history(edited_at DESC)`,
+		`CREATE INDEX IF NOT EXISTS idx_notifications_recipient ON notifications(recipient_did)`,
+		`CREATE INDEX IF NOT EXISTS idx_notifications_created_at ON notifications(created_at DESC)`,
+		`CREATE INDEX IF NOT EXISTS idx_api_keys_owner ON api_keys(owner_did)`,
+		`CREATE INDEX IF NOT EXISTS idx_api_keys_hash ON api_keys(key_hash)`,
+		`CREATE INDEX IF NOT EXISTS idx_profiles_author_did ON profiles(author_did)`,
+		`CREATE INDEX IF NOT EXISTS idx_preferences_author_did ON preferences(author_did)`,
+		`CREATE INDEX IF NOT EXISTS idx_blocks_actor ON blocks(actor_did)`,
+		`CREATE INDEX IF NOT EXISTS idx_blocks_subject ON blocks(subject_did)`,
+		`CREATE INDEX IF NOT EXISTS idx_mutes_actor ON mutes(actor_did)`,
+		`CREATE INDEX IF NOT EXISTS idx_mutes_subject ON mutes(subject_did)`,
+		`CREATE INDEX IF NOT EXISTS idx_content_labels_uri ON content_labels(uri)`,
+		`CREATE INDEX IF NOT EXISTS idx_content_labels_src ON content_labels(src)`,
+	}
+}
+
+func moderationSchema(d Dialect) []string {
+	dateType := d.DateType()
+	autoInc := d.AutoIncrement()
+
+	return []string{
+		`CREATE TABLE IF NOT EXISTS moderation_reports (
+			id ` + autoInc + `,
+			reporter_did TEXT NOT NULL,
+			subject_did TEXT NOT NULL,
+			subject_uri TEXT,
+			reason_type TEXT NOT NULL,
+			reason_text TEXT,
+			status TEXT NOT NULL DEFAULT 'pending',
+			created_at ` + dateType + ` NOT NULL,
+			resolved_at ` + dateType + `,
+			resolved_by TEXT
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_mod_reports_status ON moderation_reports(status)`,
+		`CREATE INDEX IF NOT EXISTS idx_mod_reports_subject ON moderation_reports(subject_did)`,
+		`CREATE INDEX IF NOT EXISTS idx_mod_reports_reporter ON moderation_reports(reporter_did)`,
+
+		`CREATE TABLE IF NOT EXISTS moderation_actions (
+			id ` + autoInc + `,
+			report_id INTEGER NOT NULL,
+			actor_did TEXT NOT NULL,
+			action TEXT NOT NULL,
+			comment TEXT,
+			created_at ` + dateType + ` NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_mod_actions_report ON moderation_actions(report_id)`,
+	}
+}
+
+// upgradeLegacyColumns brings databases created before versioned migrations
+// up to the baseline schema. On a fresh database every check is a no-op.
+func upgradeLegacyColumns(tx *sql.Tx, d Dialect) error {
+	dateType := d.DateType()
+
+	columns := []struct {
+		table, column, definition string
+	}{
+		{"sessions", "dpop_key", "TEXT"},
+		{"annotations", "motivation", "TEXT"},
+		{"annotations", "body_value", "TEXT"},
+		{"annotations", "body_format", "TEXT DEFAULT 'text/plain'"},
+		{"annotations", "body_uri", "TEXT"},
+		{"annotations", "target_source", "TEXT"},
+		{"annotations", "target_hash", "TEXT"},
+		{"annotations", "target_title", "TEXT"},
+		{"annotations", "selector_json", "TEXT"},
+		{"annotations", "tags_json", "TEXT"},
+		{"annotations", "cid", "TEXT"},
+		{"profiles", "website", "TEXT"},
+		{"profiles", "display_name", "TEXT"},
+		{"profiles", "avatar", "TEXT"},
+		{"api_keys", "uri", "TEXT"},
+		{"api_keys", "cid", "TEXT"},
+		{"api_keys", "indexed_at", dateType + " DEFAULT CURRENT_TIMESTAMP"},
+		{"preferences", "subscribed_labelers", "TEXT"},
+		{"preferences", "label_preferences", "TEXT"},
+		{"preferences", "disable_external_link_warning", "BOOLEAN"},
+	}
+	for _, c := range columns {
+		if err := addColumnIfMissing(tx, d, c.table, c.column, c.definition); err != nil {
+			return fmt.Errorf("add %s.%s: %w", c.table, c.column, err)
+		}
+	}
+
+	legacyCopies := []struct {
+		legacyColumn, stmt string
+	}{
+		{"url", `UPDATE annotations SET target_source = url WHERE target_source IS NULL AND url IS NOT NULL`},
+		{"url_hash", `UPDATE annotations SET target_hash = url_hash WHERE target_hash IS NULL AND url_hash IS NOT NULL`},
+		{"text", `UPDATE annotations SET body_value = text WHERE body_value IS NULL AND text IS NOT NULL`},
+		{"title", `UPDATE annotations SET target_title = title WHERE target_title IS NULL AND title IS NOT NULL`},
+	}
+	for _, c := range legacyCopies {
+		exists, err := columnExists(tx, d, "annotations", c.legacyColumn)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			continue
+		}
+		if _, err := tx.Exec(c.stmt); err != nil {
+			return fmt.Errorf("copy legacy annotations.%s: %w", c.legacyColumn, err)
+		}
+	}
+	if _, err := tx.Exec(`UPDATE annotations SET motivation = 'commenting' WHERE motivation IS NULL`); err != nil {
+		return err
+	}
+
+	if d.IsPostgres() {
+		if _, err := tx.Exec(`ALTER TABLE cursors ALTER COLUMN last_cursor TYPE BIGINT`); err != nil {
+			return err
+		}
+	}
+
+	// Early moderation_reports tables predate subject_did. Rather than
+	// dropping them, keep the old rows around under a legacy name.
+	hasReports, err := tableExists(tx, d, "moderation_reports")
+	if err != nil {
+		return err
+	}
+	if hasReports {
+		hasSubject, err := columnExists(tx, d, "moderation_reports", "subject_did")
+		if err != nil {
+			return err
+		}
+		if !hasSubject {
+			if _, err := tx.Exec(`ALTER TABLE moderation_reports RENAME TO moderation_reports_legacy`); err != nil {
+				return err
+			}
+			for _, idx := range []string{"idx_mod_reports_status", "idx_mod_reports_subject", "idx_mod_reports_reporter"} {
+				if _, err := tx.Exec(`DROP INDEX IF EXISTS ` + idx); err != nil {
+					return err
+				}
+			}
+			hasActions, err := tableExists(tx, d, "moderation_actions")
+			if err != nil {
+				return err
+			}
+			if hasActions {
+				if _, err := tx.Exec(`ALTER TABLE moderation_actions RENAME TO moderation_actions_legacy`); err != nil {
+					return err
+				}
+				if _, err := tx.Exec(`DROP INDEX IF EXISTS idx_mod_actions_report`); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	for _, stmt := range moderationSchema(d) {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
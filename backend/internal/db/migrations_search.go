@@ -0,0 +1,237 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// searchSource describes how rows of a content table map onto
+// search_documents, which triggers keep in sync on both drivers.
+type searchSource struct {
+	table string
+	kind  string
+	title string
+	body  string
+}
+
+func searchSources(d Dialect) []searchSource {
+	exact := `CASE WHEN json_valid({row}.selector_json) THEN json_extract({row}.selector_json, '$.exact') END`
+	if d.IsPostgres() {
+		exact = `search_selector_exact({row}.selector_json)`
+	}
+
+	return []searchSource{
+		{"annotations", "annotation", "{row}.target_title", "{row}.body_value"},
+		{"highlights", "highlight", "{row}.target_title", exact},
+		{"bookmarks", "bookmark", "{row}.title", "{row}.description"},
+		{"replies", "reply", "NULL", "{row}.text"},
+	}
+}
+
+func rowExpr(tmpl, row string) string {
+	return strings.ReplaceAll(tmpl, "{row}", row)
+}
+
+const noFTS5Warning = "SQLite was built without FTS5, so search falls back to unranked LIKE matching; rebuild the server with `-tags sqlite_fts5` for full-text search"
+
+// fts5Enabled reports whether SQLite was built with FTS5, which the
+// sqlite_fts5 build tag turns on.
+func fts5Enabled(tx *sql.Tx) (bool, error) {
+	var enabled bool
+	err := tx.QueryRow(`SELECT sqlite_compileoption_used('ENABLE_FTS5')`).Scan(&enabled)
+	return enabled, err
+}
+
+// createSearchIndex builds search_documents and, where the database supports
+// it, the full-text index over it. Without FTS5 SQLite keeps only the
+// documents, which Search then matches with LIKE, and ensureSearchFTS adds
+// the index once the server is rebuilt with FTS5.
+func createSearchIndex(tx *sql.Tx, d Dialect) error {
+	fts := true
+	if !d.IsPostgres() {
+		enabled, err := fts5Enabled(tx)
+		if err != nil {
+			return err
+		}
+		fts = enabled
+	}
+
+	for _, stmt := range searchIndexSchema(d, fts) {
+		if _, err := tx.Exec(stmt); err != nil {
+			return fmt.Errorf("%w\n%s", err, stmt)
+		}
+	}
+	return nil
+}
+
+// ensureSearchFTS adds the FTS5 index to a SQLite database whose search
+// index was created without it, once FTS5 is available, and fills it from
+// search_documents.
+func (db *DB) ensureSearchFTS() error {
+	d := db.Dialect()
+	if d.IsPostgres() {
+		return nil
+	}
+	return db.inTx(func(tx *sql.Tx) error {
+		if docs, err := tableExists(tx, d, "search_documents"); err != nil || !docs {
+			return err
+		}
+		if fts, err := tableExists(tx, d, "search_fts"); err != nil || fts {
+			return err
+		}
+		enabled, err := fts5Enabled(tx)
+		if err != nil {
+			return err
+		}
+		if !enabled {
+			log.Print(noFTS5Warning)
+			return nil
+		}
+		for _, stmt := range ftsIndexSchema() {
+			if _, err := tx.Exec(stmt); err != nil {
+				return fmt.Errorf("%w\n%s", err, stmt)
+			}
+		}
+		if _, err := tx.Exec(`INSERT INTO search_fts (search_fts) VALUES ('rebuild')`); err != nil {
+			return err
+		}
+		log.Printf("Built the full-text search index")
+		return nil
+	})
+}
+
+// ftsIndexSchema is the SQLite FTS5 index over search_documents.
+func ftsIndexSchema() []string {
+	return []string{
+		`CREATE VIRTUAL TABLE IF NOT EXISTS search_fts USING fts5(
+			title, body,
+			content='search_documents', content_rowid='id',
+			tokenize='porter unicode61 remove_diacritics 2'
+		)`,
+		`CREATE TRIGGER IF NOT EXISTS search_documents_ai AFTER INSERT ON search_documents BEGIN
+			INSERT INTO search_fts (rowid, title, body) VALUES (NEW.id, NEW.title, NEW.body);
+		END`,
+		`CREATE TRIGGER IF NOT EXISTS search_documents_ad AFTER DELETE ON search_documents BEGIN
+			INSERT INTO search_fts (search_fts, rowid, title, body) VALUES ('delete', OLD.id, OLD.title, OLD.body);
+		END`,
+		`CREATE TRIGGER IF NOT EXISTS search_documents_au AFTER UPDATE ON search_documents BEGIN
+			INSERT INTO search_fts (search_fts, rowid, title, body) VALUES ('delete', OLD.id, OLD.title, OLD.body);
+			INSERT INTO search_fts (rowid, title, body) VALUES (NEW.id, NEW.title, NEW.body);
+		END`,
+	}
+}
+
+func searchIndexSchema(d Dialect, fts bool) []string {
+	var stmts []string
+
+	if d.IsPostgres() {
+		stmts = append(stmts,
+			`CREATE TABLE IF NOT EXISTS search_documents (
+				uri TEXT PRIMARY KEY,
+				kind TEXT NOT NULL,
+				author_did TEXT NOT NULL,
+				created_at TIMESTAMP NOT NULL,
+				title TEXT,
+				body TEXT,
+				document tsvector GENERATED ALWAYS AS (
+					setweight(to_tsvector('english', coalesce(title, '')), 'A') ||
+					setweight(to_tsvector('english', coalesce(body, '')), 'B')
+				) STORED
+			)`,
+			`CREATE INDEX IF NOT EXISTS idx_search_documents_document ON search_documents USING GIN (document)`,
+			`CREATE OR REPLACE FUNCTION search_selector_exact(selector TEXT) RETURNS TEXT AS $$
+			BEGIN
+				RETURN (selector::json)->>'exact';
+			EXCEPTION WHEN others THEN
+				RETURN NULL;
+			END;
+			$$ LANGUAGE plpgsql IMMUTABLE`,
+		)
+	} else {
+		stmts = append(stmts,
+			`CREATE TABLE IF NOT EXISTS search_documents (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				uri TEXT NOT NULL UNIQUE,
+				kind TEXT NOT NULL,
+				author_did TEXT NOT NULL,
+				created_at DATETIME NOT NULL,
+				title TEXT,
+				body TEXT
+			)`,
+		)
+		if fts {
+			stmts = append(stmts, ftsIndexSchema()...)
+		}
+	}
+
+	stmts = append(stmts, `CREATE INDEX IF NOT EXISTS idx_search_documents_author ON search_documents(author_did)`)
+
+	for _, src := range searchSources(d) {
+		upsert := fmt.Sprintf(`INSERT INTO search_documents (uri, kind, author_did, created_at, title, body)
+			VALUES (NEW.uri, '%s', NEW.author_did, NEW.created_at, %s, %s)
+			ON CONFLICT(uri) DO UPDATE SET
+				kind = excluded.kind,
+				author_did = excluded.author_did,
+				created_at = excluded.created_at,
+				title = excluded.title,
+				body = excluded.body`,
+			src.kind, rowExpr(src.title, "NEW"), rowExpr(src.body, "NEW"))
+		remove := `DELETE FROM search_documents WHERE uri = OLD.uri`
+
+		if d.IsPostgres() {
+			stmts = append(stmts,
+				fmt.Sprintf(`CREATE OR REPLACE FUNCTION search_sync_%s() RETURNS trigger AS $$
+				BEGIN
+					IF TG_OP = 'DELETE' THEN
+						%s;
+						RETURN OLD;
+					END IF;
+					%s;
+					RETURN NEW;
+				END;
+				$$ LANGUAGE plpgsql`, src.table, remove, upsert),
+				fmt.Sprintf(`DROP TRIGGER IF EXISTS search_sync_%s ON %s`, src.table, src.table),
+				fmt.Sprintf(`CREATE TRIGGER search_sync_%s AFTER INSERT OR UPDATE OR DELETE ON %s
+					FOR EACH ROW EXECUTE FUNCTION search_sync_%s()`, src.table, src.table, src.table),
+			)
+		} else {
+			stmts = append(stmts,
+				fmt.Sprintf(`CREATE TRIGGER IF NOT EXISTS search_%s_ai AFTER INSERT ON %s BEGIN %s; END`, src.table, src.table, upsert),
+				fmt.Sprintf(`CREATE TRIGGER IF NOT EXISTS search_%s_au AFTER UPDATE ON %s BEGIN %s; END`, src.table, src.table, upsert),
+				fmt.Sprintf(`CREATE TRIGGER IF NOT EXISTS search_%s_ad AFTER DELETE ON %s BEGIN %s; END`, src.table, src.table, remove),
+			)
+		}
+
+		stmts = append(stmts, fmt.Sprintf(`INSERT INTO search_documents (uri, kind, author_did, created_at, title, body)
+			SELECT src.uri, '%s', src.author_did, src.created_at, %s, %s FROM %s src
+			WHERE true ON CONFLICT(uri) DO NOTHING`,
+			src.kind, rowExpr(src.title, "src"), rowExpr(src.body, "src"), src.table))
+	}
+
+	return stmts
+}
+
+func dropSearchIndex(d Dialect) []string {
+	var stmts []string
+	for _, src := range searchSources(d) {
+		if d.IsPostgres() {
+			stmts = append(stmts,
+				fmt.Sprintf(`DROP TRIGGER IF EXISTS search_sync_%s ON %s`, src.table, src.table),
+				fmt.Sprintf(`DROP FUNCTION IF EXISTS search_sync_%s()`, src.table),
+			)
+		} else {
+			for _, suffix := range []string{"ai", "au", "ad"} {
+				stmts = append(stmts, fmt.Sprintf(`DROP TRIGGER IF EXISTS search_%s_%s`, src.table, suffix))
+			}
+		}
+	}
+
+	if d.IsPostgres() {
+		stmts = append(stmts, `DROP FUNCTION IF EXISTS search_selector_exact(TEXT)`)
+	} else {
+		stmts = append(stmts, `DROP TABLE IF EXISTS search_fts`)
+	}
+	return append(stmts, `DROP TABLE IF EXISTS search_documents`)
+}
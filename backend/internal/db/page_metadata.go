@@ -0,0 +1,174 @@
+package db
+
+import (
+	"database/sql"
+	"log"
+	"strings"
+	"time"
+)
+
+// PageMetadata is the cached description of a target page, keyed by the same
+// hash records use for their target.
+type PageMetadata struct {
+	URLHash      string     `json:"-"`
+	URL          string     `json:"url"`
+	Title        string     `json:"title"`
+	Description  string     `json:"description"`
+	Image        string     `json:"image"`
+	Favicon      string     `json:"icon"`
+	SiteName     string     `json:"siteName,omitempty"`
+	CanonicalURL string     `json:"canonicalUrl,omitempty"`
+	Language     string     `json:"language,omitempty"`
+	Author       string     `json:"author,omitempty"`
+	PublishedAt  *time.Time `json:"publishedAt,omitempty"`
+	Type         string     `json:"type,omitempty"`
+	ReadingTime  int        `json:"readingTime,omitempty"`
+	ETag         string     `json:"-"`
+	LastModified string     `json:"-"`
+	FetchedAt    *time.Time `json:"fetchedAt,omitempty"`
+	NextFetchAt  time.Time  `json:"-"`
+	FailureCount int        `json:"-"`
+	LastError    string     `json:"-"`
+}
+
+const pageMetadataColumns = "url_hash, url, title, description, image, favicon, site_name, canonical_url, language, author, published_at, page_type, reading_time, etag, last_modified, fetched_at, next_fetch_at, failure_count, last_error"
+
+func scanPageMetadata(row interface{ Scan(...interface{}) error }) (*PageMetadata, error) {
+	var m PageMetadata
+	err := row.Scan(&m.URLHash, &m.URL, &m.Title, &m.Description, &m.Image, &m.Favicon, &m.SiteName, &m.CanonicalURL, &m.Language, &m.Author, &m.PublishedAt, &m.Type, &m.ReadingTime, &m.ETag, &m.LastModified, &m.FetchedAt, &m.NextFetchAt, &m.FailureCount, &m.LastError)
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func (db *DB) GetPageMetadata(urlHash string) (*PageMetadata, error) {
+	m, err := scanPageMetadata(db.QueryRow(db.Rebind(`SELECT `+pageMetadataColumns+` FROM page_metadata WHERE url_hash = ?`), urlHash))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return m, err
+}
+
+// SavePageMetadata stores a successful fetch and copies the title onto any
+// records of the page that arrived without one.
+func (db *DB) SavePageMetadata(m *PageMetadata) error {
+	_, err := db.Exec(db.Rebind(`
+		INSERT INTO page_metadata (`+pageMetadataColumns+`)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, 0, '')
+		ON CONFLICT(url_hash) DO UPDATE SET
+			url = excluded.url,
+			title = excluded.title,
+			description = excluded.description,
+			image = excluded.image,
+			favicon = excluded.favicon,
+			site_name = excluded.site_name,
+			canonical_url = excluded.canonical_url,
+			language = excluded.language,
+			author = excluded.author,
+			published_at = excluded.published_at,
+			page_type = excluded.page_type,
+			reading_time = excluded.reading_time,
+			etag = excluded.etag,
+			last_modified = excluded.last_modified,
+			fetched_at = excluded.fetched_at,
+			next_fetch_at = excluded.next_fetch_at,
+			failure_count = 0,
+			last_error = ''
+	`), m.URLHash, m.URL, m.Title, m.Description, m.Image, m.Favicon, m.SiteName, m.CanonicalURL, m.Language, m.Author, m.PublishedAt, m.Type, m.ReadingTime, m.ETag, m.LastModified, m.FetchedAt, m.NextFetchAt)
+	if err != nil {
+		return err
+	}
+	return db.fillMissingTitles(m.URLHash, m.Title)
+}
+
+// MarkPageMetadataUnchanged records a 304 response: the cached fields stay
+// valid until next.
+func (db *DB) MarkPageMetadataUnchanged(urlHash string, fetchedAt, next time.Time) error {
+	_, err := db.Exec(db.Rebind(`
+		UPDATE page_metadata SET fetched_at = ?, next_fetch_at = ?, failure_count = 0, last_error = ''
+		WHERE url_hash = ?
+	`), fetchedAt, next, urlHash)
+	return err
+}
+
+func (db *DB) MarkPageMetadataFailed(urlHash, url, reason string, next time.Time) error {
+	_, err := db.Exec(db.Rebind(`
+		INSERT INTO page_metadata (url_hash, url, next_fetch_at, failure_count, last_error)
+		VALUES (?, ?, ?, 1, ?)
+		ON CONFLICT(url_hash) DO UPDATE SET
+			next_fetch_at = excluded.next_fetch_at,
+			failure_count = page_metadata.failure_count + 1,
+			last_error = excluded.last_error
+	`), urlHash, url, next, reason)
+	return err
+}
+
+// QueuePageMetadata schedules a fetch for a page that has never been seen.
+// Known pages keep their existing schedule.
+func (db *DB) QueuePageMetadata(urlHash, url string) error {
+	_, err := db.Exec(db.Rebind(`
+		INSERT INTO page_metadata (url_hash, url, next_fetch_at)
+		VALUES (?, ?, ?)
+		ON CONFLICT(url_hash) DO NOTHING
+	`), urlHash, url, time.Now())
+	return err
+}
+
+func (db *DB) DuePageMetadata(limit int) ([]PageMetadata, error) {
+	rows, err := db.Query(db.Rebind(`
+		SELECT `+pageMetadataColumns+` FROM page_metadata
+		WHERE next_fetch_at <= ?
+		ORDER BY next_fetch_at
+		LIMIT ?
+	`), time.Now(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var pages []PageMetadata
+	for rows.Next() {
+		m, err := scanPageMetadata(rows)
+		if err != nil {
+			return nil, err
+		}
+		pages = append(pages, *m)
+	}
+	return pages, rows.Err()
+}
+
+// notePageTitle is called after a record is written. Records that arrive
+// without a title take the cached one, or queue the page for a fetch.
+func (db *DB) notePageTitle(urlHash, url string, title *string) {
+	if urlHash == "" || (title != nil && *title != "") || !strings.HasPrefix(url, "http") {
+		return
+	}
+	if err := db.QueuePageMetadata(urlHash, url); err != nil {
+		log.Printf("Failed to queue page metadata for %s: %v", url, err)
+		return
+	}
+	m, err := db.GetPageMetadata(urlHash)
+	if err != nil || m == nil || m.Title == "" {
+		return
+	}
+	if err := db.fillMissingTitles(urlHash, m.Title); err != nil {
+		log.Printf("Failed to fill titles for %s: %v", url, err)
+	}
+}
+
+func (db *DB) fillMissingTitles(urlHash, title string) error {
+	if title == "" {
+		return nil
+	}
+	for _, stmt := range []string{
+		`UPDATE annotations SET target_title = ? WHERE target_hash = ? AND (target_title IS NULL OR target_title = '')`,
+		`UPDATE highlights SET target_title = ? WHERE target_hash = ? AND (target_title IS NULL OR target_title = '')`,
+		`UPDATE bookmarks SET title = ? WHERE source_hash = ? AND (title IS NULL OR title = '')`,
+	} {
+		if _, err := db.Exec(db.Rebind(stmt), title, urlHash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -40,22 +40,69 @@ func (db *DB) AnnotationExists(uri string) bool {
 	return count > 0
 }
 
-func HashURL(rawURL string) string {
-	parsed, err := url.Parse(rawURL)
-	if err != nil || parsed.Host == "" {
+// HashURL returns the hash a page's records are stored under: that of the
+// canonical key of rawURL, or of rawURL itself when it is not absolute.
+func (db *DB) HashURL(rawURL string) string {
+	key, ok := db.canon.Key(rawURL)
+	if !ok {
 		return HashString(rawURL)
 	}
+	return HashString(key)
+}
 
-	host := strings.ToLower(parsed.Host)
-	host = strings.TrimPrefix(host, "www.")
+// URLDomain returns the host of the canonical key of rawURL without its
+// port, so the www., m. and amp. hosts of a site share one domain, or ""
+// when rawURL has no host.
+func (db *DB) URLDomain(rawURL string) string {
+	key, ok := db.canon.Key(rawURL)
+	if !ok {
+		return ""
+	}
+	host, _, _ := strings.Cut(key, "/")
+	host, _, _ = strings.Cut(host, "?")
+	return (&url.URL{Host: host}).Hostname()
+}
+
+// hostDomain is how domains were derived before canonicalization: the
+// lowercased host without its port or a leading "www.".
+func hostDomain(rawURL string) string {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimPrefix(strings.ToLower(parsed.Hostname()), "www.")
+}
 
-	normalized := host + parsed.Path
+// legacyURLHashes are the hashes records were stored under before URL
+// canonicalization: the URL with its host lowercased and "www." and a
+// trailing slash dropped, and before that the URL as given.
+func legacyURLHashes(rawURL string) []string {
+	hashes := []string{HashString(rawURL)}
+	parsed, err := url.Parse(rawURL)
+	if err != nil || parsed.Host == "" {
+		return hashes
+	}
+	normalized := strings.TrimPrefix(strings.ToLower(parsed.Host), "www.") + parsed.Path
 	if parsed.RawQuery != "" {
 		normalized += "?" + parsed.RawQuery
 	}
-	normalized = strings.TrimSuffix(normalized, "/")
+	return append(hashes, HashString(strings.TrimSuffix(normalized, "/")))
+}
 
-	return HashString(normalized)
+// ReverseDomain writes a domain's labels in reverse, each followed by a dot,
+// so "blog.example.com" becomes "com.example.blog.". A domain and all its
+// subdomains then share the prefix of the domain's reversed form.
+func ReverseDomain(domain string) string {
+	if domain == "" {
+		return ""
+	}
+	labels := strings.Split(domain, ".")
+	var b strings.Builder
+	for i := len(labels) - 1; i >= 0; i-- {
+		b.WriteString(labels[i])
+		b.WriteByte('.')
+	}
+	return b.String()
 }
 
 func HashString(s string) string {
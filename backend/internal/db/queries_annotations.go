@@ -5,9 +5,9 @@ import (
 )
 
 func (db *DB) CreateAnnotation(a *Annotation) error {
-	_, err := db.Exec(db.Rebind(`
-		INSERT INTO annotations (uri, author_did, motivation, body_value, body_format, body_uri, target_source, target_hash, target_title, selector_json, tags_json, created_at, indexed_at, cid)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	err := db.execWithTags("annotations", a.URI, a.TagsJSON, `
+		INSERT INTO annotations (uri, author_did, motivation, body_value, body_format, body_uri, target_source, target_hash, target_domain, target_domain_rev, target_title, selector_json, tags_json, created_at, indexed_at, cid)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 		ON CONFLICT(uri) DO UPDATE SET
 			motivation = excluded.motivation,
 			body_value = excluded.body_value,
@@ -15,13 +15,19 @@ func (db *DB) CreateAnnotation(a *Annotation) error {
 			body_uri = excluded.body_uri,
 			target_source = excluded.target_source,
 			target_hash = excluded.target_hash,
+			target_domain = excluded.target_domain,
+			target_domain_rev = excluded.target_domain_rev,
 			target_title = excluded.target_title,
 			selector_json = excluded.selector_json,
 			tags_json = excluded.tags_json,
 			indexed_at = excluded.indexed_at,
 			cid = excluded.cid
-	`), a.URI, a.AuthorDID, a.Motivation, a.BodyValue, a.BodyFormat, a.BodyURI, a.TargetSource, a.TargetHash, a.TargetTitle, a.SelectorJSON, a.TagsJSON, a.CreatedAt, a.IndexedAt, a.CID)
-	return err
+	`, a.URI, a.AuthorDID, a.Motivation, a.BodyValue, a.BodyFormat, a.BodyURI, a.TargetSource, a.TargetHash, a.TargetDomain, ReverseDomain(a.TargetDomain), a.TargetTitle, a.SelectorJSON, a.TagsJSON, a.CreatedAt, a.IndexedAt, a.CID)
+	if err != nil {
+		return err
+	}
+	db.notePageTitle(a.TargetHash, a.TargetSource, a.TargetTitle)
+	return nil
 }
 
 func (db *DB) GetAnnotationByURI(uri string) (*Annotation, error) {
@@ -37,220 +43,15 @@ func (db *DB) GetAnnotationByURI(uri string) (*Annotation, error) {
 	return &a, nil
 }
 
-func (db *DB) GetAnnotationsByTargetHash(targetHash string, limit, offset int) ([]Annotation, error) {
-	rows, err := db.Query(db.Rebind(`
-		SELECT uri, author_did, motivation, body_value, body_format, body_uri, target_source, target_hash, target_title, selector_json, tags_json, created_at, indexed_at, cid
-		FROM annotations
-		WHERE target_hash = ?
-		ORDER BY created_at DESC
-		LIMIT ? OFFSET ?
-	`), targetHash, limit, offset)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	return scanAnnotations(rows)
-}
-
-func (db *DB) GetAnnotationsByAuthor(authorDID string, limit, offset int) ([]Annotation, error) {
-	rows, err := db.Query(db.Rebind(`
-		SELECT uri, author_did, motivation, body_value, body_format, body_uri, target_source, target_hash, target_title, selector_json, tags_json, created_at, indexed_at, cid
-		FROM annotations
-		WHERE author_did = ?
-		ORDER BY created_at DESC
-		LIMIT ? OFFSET ?
-	`), authorDID, limit, offset)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	return scanAnnotations(rows)
-}
-
-func (db *DB) GetMarginAnnotationsByAuthor(authorDID string, limit, offset int) ([]Annotation, error) {
-	rows, err := db.Query(db.Rebind(`
-		SELECT uri, author_did, motivation, body_value, body_format, body_uri, target_source, target_hash, target_title, selector_json, tags_json, created_at, indexed_at, cid
-		FROM annotations
-		WHERE author_did = ? AND uri NOT LIKE '%network.cosmik%'
-		ORDER BY created_at DESC
-		LIMIT ? OFFSET ?
-	`), authorDID, limit, offset)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	return scanAnnotations(rows)
-}
-
-func (db *DB) GetSembleAnnotationsByAuthor(authorDID string, limit, offset int) ([]Annotation, error) {
-	rows, err := db.Query(db.Rebind(`
-		SELECT uri, author_did, motivation, body_value, body_format, body_uri, target_source, target_hash, target_title, selector_json, tags_json, created_at, indexed_at, cid
-		FROM annotations
-		WHERE author_did = ? AND uri LIKE '%network.cosmik%'
-		ORDER BY created_at DESC
-		LIMIT ? OFFSET ?
-	`), authorDID, limit, offset)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	return scanAnnotations(rows)
-}
-
 func (db *DB) GetAnnotationsByMotivation(motivation string, limit, offset int) ([]Annotation, error) {
 	rows, err := db.Query(db.Rebind(`
 		SELECT uri, author_did, motivation, body_value, body_format, body_uri, target_source, target_hash, target_title, selector_json, tags_json, created_at, indexed_at, cid
 		FROM annotations
 		WHERE motivation = ?
+		AND `+activeAuthor("annotations.author_did")+`
 		ORDER BY created_at DESC
 		LIMIT ? OFFSET ?
-	`), motivation, limit, offset)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	return scanAnnotations(rows)
-}
-
-func (db *DB) GetRecentAnnotations(limit, offset int) ([]Annotation, error) {
-	rows, err := db.Query(db.Rebind(`
-		SELECT uri, author_did, motivation, body_value, body_format, body_uri, target_source, target_hash, target_title, selector_json, tags_json, created_at, indexed_at, cid
-		FROM annotations
-		ORDER BY created_at DESC
-		LIMIT ? OFFSET ?
-	`), limit, offset)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	return scanAnnotations(rows)
-}
-
-func (db *DB) GetPopularAnnotations(limit, offset int) ([]Annotation, error) {
-	since := time.Now().AddDate(0, 0, -14)
-	rows, err := db.Query(db.Rebind(`
-		SELECT uri, author_did, motivation, body_value, body_format, body_uri, target_source, target_hash, target_title, selector_json, tags_json, created_at, indexed_at, cid
-		FROM annotations
-		WHERE created_at > ? AND (
-			(SELECT COUNT(*) FROM likes WHERE subject_uri = annotations.uri) +
-			(SELECT COUNT(*) FROM replies WHERE root_uri = annotations.uri)
-		) > 0
-		ORDER BY (
-			(SELECT COUNT(*) FROM likes WHERE subject_uri = annotations.uri) +
-			(SELECT COUNT(*) FROM replies WHERE root_uri = annotations.uri)
-		) DESC, created_at DESC
-		LIMIT ? OFFSET ?
-	`), since, limit, offset)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	return scanAnnotations(rows)
-}
-
-func (db *DB) GetShelvedAnnotations(limit, offset int) ([]Annotation, error) {
-	olderThan := time.Now().AddDate(0, 0, -1)
-	since := time.Now().AddDate(0, 0, -14)
-	rows, err := db.Query(db.Rebind(`
-		SELECT uri, author_did, motivation, body_value, body_format, body_uri, target_source, target_hash, target_title, selector_json, tags_json, created_at, indexed_at, cid
-		FROM annotations
-		WHERE created_at < ? AND created_at > ? AND (
-			(SELECT COUNT(*) FROM likes WHERE subject_uri = annotations.uri) +
-			(SELECT COUNT(*) FROM replies WHERE root_uri = annotations.uri)
-		) = 0
-		ORDER BY RANDOM()
-		LIMIT ? OFFSET ?
-	`), olderThan, since, limit, offset)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	return scanAnnotations(rows)
-}
-
-func (db *DB) GetMarginAnnotations(limit, offset int) ([]Annotation, error) {
-	rows, err := db.Query(db.Rebind(`
-		SELECT uri, author_did, motivation, body_value, body_format, body_uri, target_source, target_hash, target_title, selector_json, tags_json, created_at, indexed_at, cid
-		FROM annotations
-		WHERE uri NOT LIKE '%network.cosmik%'
-		ORDER BY created_at DESC
-		LIMIT ? OFFSET ?
-	`), limit, offset)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	return scanAnnotations(rows)
-}
-
-func (db *DB) GetSembleAnnotations(limit, offset int) ([]Annotation, error) {
-	rows, err := db.Query(db.Rebind(`
-		SELECT uri, author_did, motivation, body_value, body_format, body_uri, target_source, target_hash, target_title, selector_json, tags_json, created_at, indexed_at, cid
-		FROM annotations
-		WHERE uri LIKE '%network.cosmik%'
-		ORDER BY created_at DESC
-		LIMIT ? OFFSET ?
-	`), limit, offset)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	return scanAnnotations(rows)
-}
-
-func (db *DB) GetAnnotationsByTag(tag string, limit, offset int) ([]Annotation, error) {
-	pattern := "%\"" + tag + "\"%"
-	rows, err := db.Query(db.Rebind(`
-		SELECT uri, author_did, motivation, body_value, body_format, body_uri, target_source, target_hash, target_title, selector_json, tags_json, created_at, indexed_at, cid
-		FROM annotations
-		WHERE tags_json LIKE ?
-		ORDER BY created_at DESC
-		LIMIT ? OFFSET ?
-	`), pattern, limit, offset)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	return scanAnnotations(rows)
-}
-
-func (db *DB) GetMarginAnnotationsByTag(tag string, limit, offset int) ([]Annotation, error) {
-	pattern := "%\"" + tag + "\"%"
-	rows, err := db.Query(db.Rebind(`
-		SELECT uri, author_did, motivation, body_value, body_format, body_uri, target_source, target_hash, target_title, selector_json, tags_json, created_at, indexed_at, cid
-		FROM annotations
-		WHERE tags_json LIKE ? AND uri NOT LIKE '%network.cosmik%'
-		ORDER BY created_at DESC
-		LIMIT ? OFFSET ?
-	`), pattern, limit, offset)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	return scanAnnotations(rows)
-}
-
-func (db *DB) GetSembleAnnotationsByTag(tag string, limit, offset int) ([]Annotation, error) {
-	pattern := "%\"" + tag + "\"%"
-	rows, err := db.Query(db.Rebind(`
-		SELECT uri, author_did, motivation, body_value, body_format, body_uri, target_source, target_hash, target_title, selector_json, tags_json, created_at, indexed_at, cid
-		FROM annotations
-		WHERE tags_json LIKE ? AND uri LIKE '%network.cosmik%'
-		ORDER BY created_at DESC
-		LIMIT ? OFFSET ?
-	`), pattern, limit, offset)
+	`), motivation, false, limit, offset)
 	if err != nil {
 		return nil, err
 	}
@@ -260,84 +61,15 @@ func (db *DB) GetSembleAnnotationsByTag(tag string, limit, offset int) ([]Annota
 }
 
 func (db *DB) DeleteAnnotation(uri string) error {
-	_, err := db.Exec(db.Rebind(`DELETE FROM annotations WHERE uri = ?`), uri)
-	return err
+	return db.execWithTags("annotations", uri, nil, `DELETE FROM annotations WHERE uri = ?`, uri)
 }
 
 func (db *DB) UpdateAnnotation(uri, bodyValue, tagsJSON, cid string) error {
-	_, err := db.Exec(db.Rebind(`
+	return db.execWithTags("annotations", uri, &tagsJSON, `
 		UPDATE annotations 
 		SET body_value = ?, tags_json = ?, cid = ?, indexed_at = ?
 		WHERE uri = ?
-	`), bodyValue, tagsJSON, cid, time.Now(), uri)
-	return err
-}
-
-func (db *DB) GetAnnotationsByTagAndAuthor(tag, authorDID string, limit, offset int) ([]Annotation, error) {
-	pattern := "%\"" + tag + "\"%"
-	rows, err := db.Query(db.Rebind(`
-		SELECT uri, author_did, motivation, body_value, body_format, body_uri, target_source, target_hash, target_title, selector_json, tags_json, created_at, indexed_at, cid
-		FROM annotations
-		WHERE author_did = ? AND tags_json LIKE ?
-		ORDER BY created_at DESC
-		LIMIT ? OFFSET ?
-	`), authorDID, pattern, limit, offset)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	return scanAnnotations(rows)
-}
-
-func (db *DB) GetMarginAnnotationsByTagAndAuthor(tag, authorDID string, limit, offset int) ([]Annotation, error) {
-	pattern := "%\"" + tag + "\"%"
-	rows, err := db.Query(db.Rebind(`
-		SELECT uri, author_did, motivation, body_value, body_format, body_uri, target_source, target_hash, target_title, selector_json, tags_json, created_at, indexed_at, cid
-		FROM annotations
-		WHERE author_did = ? AND tags_json LIKE ? AND uri NOT LIKE '%network.cosmik%'
-		ORDER BY created_at DESC
-		LIMIT ? OFFSET ?
-	`), authorDID, pattern, limit, offset)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	return scanAnnotations(rows)
-}
-
-func (db *DB) GetSembleAnnotationsByTagAndAuthor(tag, authorDID string, limit, offset int) ([]Annotation, error) {
-	pattern := "%\"" + tag + "\"%"
-	rows, err := db.Query(db.Rebind(`
-		SELECT uri, author_did, motivation, body_value, body_format, body_uri, target_source, target_hash, target_title, selector_json, tags_json, created_at, indexed_at, cid
-		FROM annotations
-		WHERE author_did = ? AND tags_json LIKE ? AND uri LIKE '%network.cosmik%'
-		ORDER BY created_at DESC
-		LIMIT ? OFFSET ?
-	`), authorDID, pattern, limit, offset)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	return scanAnnotations(rows)
-}
-
-func (db *DB) GetAnnotationsByAuthorAndTargetHash(authorDID, targetHash string, limit, offset int) ([]Annotation, error) {
-	rows, err := db.Query(db.Rebind(`
-		SELECT uri, author_did, motivation, body_value, body_format, body_uri, target_source, target_hash, target_title, selector_json, tags_json, created_at, indexed_at, cid
-		FROM annotations
-		WHERE author_did = ? AND target_hash = ?
-		ORDER BY created_at DESC
-		LIMIT ? OFFSET ?
-	`), authorDID, targetHash, limit, offset)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	return scanAnnotations(rows)
+	`, bodyValue, tagsJSON, cid, time.Now(), uri)
 }
 
 func (db *DB) GetAnnotationsByURIs(uris []string) ([]Annotation, error) {
@@ -18,8 +18,9 @@ func (db *DB) GetRepliesByRoot(rootURI string) ([]Reply, error) {
 		SELECT uri, author_did, parent_uri, root_uri, text, format, created_at, indexed_at, cid
 		FROM replies
 		WHERE root_uri = ?
+		AND `+activeAuthor("replies.author_did")+`
 		ORDER BY created_at ASC
-	`), rootURI)
+	`), rootURI, false)
 	if err != nil {
 		return nil, err
 	}
@@ -102,7 +103,7 @@ func (db *DB) GetOrphanedRepliesByAuthor(authorDID string) ([]Reply, error) {
 
 func (db *DB) GetReplyCount(rootURI string) (int, error) {
 	var count int
-	err := db.QueryRow(db.Rebind(`SELECT COUNT(*) FROM replies WHERE root_uri = ?`), rootURI).Scan(&count)
+	err := db.QueryRow(db.Rebind(`SELECT COUNT(*) FROM replies WHERE root_uri = ? AND `+activeAuthor("replies.author_did")), rootURI, false).Scan(&count)
 	return count, err
 }
 
@@ -115,13 +116,15 @@ func (db *DB) GetReplyCounts(rootURIs []string) (map[string]int, error) {
 		SELECT root_uri, COUNT(*) 
 		FROM replies 
 		WHERE root_uri IN (` + buildPlaceholders(len(rootURIs)) + `) 
+		AND ` + activeAuthor("replies.author_did") + `
 		GROUP BY root_uri
 	`)
 
-	args := make([]interface{}, len(rootURIs))
+	args := make([]interface{}, len(rootURIs), len(rootURIs)+1)
 	for i, uri := range rootURIs {
 		args[i] = uri
 	}
+	args = append(args, false)
 
 	rows, err := db.Query(query, args...)
 	if err != nil {
@@ -0,0 +1,174 @@
+package db
+
+import (
+	"html"
+	"strings"
+	"time"
+	"unicode"
+)
+
+type SearchQuery struct {
+	Text           string
+	Kinds          []string
+	AuthorDID      string
+	ExcludeAuthors []string
+	Limit          int
+	Offset         int
+}
+
+type SearchResult struct {
+	URI       string    `json:"uri"`
+	Kind      string    `json:"kind"`
+	AuthorDID string    `json:"authorDid"`
+	CreatedAt time.Time `json:"createdAt"`
+	Snippet   string    `json:"snippet"`
+	Score     float64   `json:"score"`
+}
+
+const (
+	snippetStart = "\x02"
+	snippetEnd   = "\x03"
+)
+
+// Search returns one page of the records matching q.Text, best match first,
+// and how many records match in all.
+func (db *DB) Search(q SearchQuery) ([]SearchResult, int, error) {
+	var columns, from string
+	var columnArgs, args []interface{}
+	plain := false
+
+	switch {
+	case db.driver == "postgres":
+		columns = `d.uri, d.kind, d.author_did, d.created_at,
+			ts_headline('english', concat_ws(' ', d.title, d.body), q, ?),
+			ts_rank_cd(d.document, q) AS score`
+		columnArgs = append(columnArgs, "StartSel="+snippetStart+", StopSel="+snippetEnd+", MaxWords=32, MinWords=12, MaxFragments=2, FragmentDelimiter=\" … \"")
+		from = `
+			FROM search_documents d, websearch_to_tsquery('english', ?) q
+			WHERE d.document @@ q`
+		args = append(args, q.Text)
+	case db.hasSearchFTS():
+		match := ftsMatchQuery(q.Text)
+		if match == "" {
+			return nil, 0, nil
+		}
+		columns = `d.uri, d.kind, d.author_did, d.created_at,
+			snippet(search_fts, -1, '` + snippetStart + `', '` + snippetEnd + `', '…', 24),
+			-bm25(search_fts, 2.0, 1.0) AS score`
+		from = `
+			FROM search_fts
+			JOIN search_documents d ON d.id = search_fts.rowid
+			WHERE search_fts MATCH ?`
+		args = append(args, match)
+	default:
+		// SQLite without FTS5: every word must appear in the title or body.
+		// Words are only letters and digits, so need no LIKE escaping.
+		words := searchWords(q.Text)
+		if len(words) == 0 {
+			return nil, 0, nil
+		}
+		columns = `d.uri, d.kind, d.author_did, d.created_at, COALESCE(d.body, d.title, ''), 0 AS score`
+		plain = true
+		from = `
+			FROM search_documents d
+			WHERE 1 = 1`
+		for _, w := range words {
+			from += ` AND (COALESCE(d.title, '') || ' ' || COALESCE(d.body, '')) LIKE ?`
+			args = append(args, "%"+w+"%")
+		}
+	}
+
+	from += ` AND ` + activeAuthor("d.author_did")
+	args = append(args, false)
+	if len(q.Kinds) > 0 {
+		from += ` AND d.kind IN (` + buildPlaceholders(len(q.Kinds)) + `)`
+		for _, k := range q.Kinds {
+			args = append(args, k)
+		}
+	}
+	if q.AuthorDID != "" {
+		from += ` AND d.author_did = ?`
+		args = append(args, q.AuthorDID)
+	}
+	if len(q.ExcludeAuthors) > 0 {
+		from += ` AND d.author_did NOT IN (` + buildPlaceholders(len(q.ExcludeAuthors)) + `)`
+		for _, did := range q.ExcludeAuthors {
+			args = append(args, did)
+		}
+	}
+
+	var total int
+	if err := db.QueryRow(db.Rebind(`SELECT COUNT(*)`+from), args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	query := `SELECT ` + columns + from + ` ORDER BY score DESC, d.created_at DESC LIMIT ? OFFSET ?`
+	queryArgs := append(append(columnArgs, args...), q.Limit, q.Offset)
+
+	rows, err := db.Query(db.Rebind(query), queryArgs...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var results []SearchResult
+	for rows.Next() {
+		var r SearchResult
+		if err := rows.Scan(&r.URI, &r.Kind, &r.AuthorDID, &r.CreatedAt, &r.Snippet, &r.Score); err != nil {
+			return nil, 0, err
+		}
+		if plain {
+			r.Snippet = truncateRunes(r.Snippet, maxPlainSnippet)
+		}
+		r.Snippet = formatSnippet(r.Snippet)
+		results = append(results, r)
+	}
+	return results, total, rows.Err()
+}
+
+// hasSearchFTS reports whether the SQLite FTS5 index exists.
+func (db *DB) hasSearchFTS() bool {
+	var count int
+	err := db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'search_fts'`).Scan(&count)
+	return err == nil && count > 0
+}
+
+// maxPlainSnippet bounds the snippet of a LIKE match, which is the whole
+// document rather than a fragment around the match.
+const maxPlainSnippet = 200
+
+func truncateRunes(s string, n int) string {
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+	return strings.TrimSpace(string(runes[:n])) + "…"
+}
+
+func searchWords(text string) []string {
+	return strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// ftsMatchQuery turns free text into an FTS5 query of quoted terms so user
+// input can never be parsed as FTS5 syntax. The last term matches as a prefix.
+func ftsMatchQuery(text string) string {
+	words := searchWords(text)
+	if len(words) == 0 {
+		return ""
+	}
+
+	terms := make([]string, len(words))
+	for i, w := range words {
+		terms[i] = `"` + w + `"`
+	}
+	terms[len(terms)-1] += "*"
+	return strings.Join(terms, " ")
+}
+
+func formatSnippet(s string) string {
+	s = html.EscapeString(s)
+	s = strings.ReplaceAll(s, snippetStart, "<mark>")
+	return strings.ReplaceAll(s, snippetEnd, "</mark>")
+}
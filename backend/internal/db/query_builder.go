@@ -0,0 +1,153 @@
+package db
+
+import (
+	"strconv"
+	"strings"
+)
+
+// selectQuery composes a SELECT over one of the record tables from
+// independent filters, so callers combine conditions instead of picking one
+// of many hand-written query variants.
+type selectQuery struct {
+	columns string
+	from    string
+	conds   []string
+	args    []interface{}
+	orderBy string
+	limit   int
+	offset  int
+}
+
+func newSelectQuery(columns, from string) *selectQuery {
+	return &selectQuery{columns: columns, from: from}
+}
+
+func (q *selectQuery) where(cond string, args ...interface{}) *selectQuery {
+	q.conds = append(q.conds, cond)
+	q.args = append(q.args, args...)
+	return q
+}
+
+func (q *selectQuery) whereIn(column string, values []string) *selectQuery {
+	if len(values) == 0 {
+		return q
+	}
+	return q.where(column+" IN ("+buildPlaceholders(len(values))+")", stringArgs(values)...)
+}
+
+func (q *selectQuery) order(orderBy string) *selectQuery {
+	q.orderBy = orderBy
+	return q
+}
+
+func (q *selectQuery) limitTo(limit int) *selectQuery {
+	q.limit = limit
+	return q
+}
+
+func (q *selectQuery) offsetBy(offset int) *selectQuery {
+	q.offset = offset
+	return q
+}
+
+func (q *selectQuery) build() (string, []interface{}) {
+	var sb strings.Builder
+	sb.WriteString("SELECT " + q.columns + " FROM " + q.from)
+	if len(q.conds) > 0 {
+		sb.WriteString(" WHERE " + strings.Join(q.conds, " AND "))
+	}
+	if q.orderBy != "" {
+		sb.WriteString(" ORDER BY " + q.orderBy)
+	}
+	args := q.args
+	if q.limit > 0 {
+		sb.WriteString(" LIMIT ?")
+		args = append(args, q.limit)
+		if q.offset > 0 {
+			sb.WriteString(" OFFSET ?")
+			args = append(args, q.offset)
+		}
+	}
+	return sb.String(), args
+}
+
+// TagFilter combines tag conditions: a record must carry every tag in All,
+// at least one tag in Any, and none of the tags in None. Tags are compared
+// in their normalized form.
+type TagFilter struct {
+	All  []string
+	Any  []string
+	None []string
+}
+
+func (f TagFilter) IsZero() bool {
+	return len(f.All) == 0 && len(f.Any) == 0 && len(f.None) == 0
+}
+
+func (f TagFilter) apply(q *selectQuery) {
+	if all := normalizeTags(f.All); len(all) > 0 {
+		q.where("uri IN (SELECT uri FROM record_tags WHERE normalized_tag IN ("+buildPlaceholders(len(all))+") GROUP BY uri HAVING COUNT(*) = "+strconv.Itoa(len(all))+")", stringArgs(all)...)
+	}
+	if anyOf := normalizeTags(f.Any); len(anyOf) > 0 {
+		q.where("uri IN (SELECT uri FROM record_tags WHERE normalized_tag IN ("+buildPlaceholders(len(anyOf))+"))", stringArgs(anyOf)...)
+	}
+	if none := normalizeTags(f.None); len(none) > 0 {
+		q.where("uri NOT IN (SELECT uri FROM record_tags WHERE normalized_tag IN ("+buildPlaceholders(len(none))+"))", stringArgs(none)...)
+	}
+}
+
+// Matches evaluates the filter against a record's raw tags_json, for records
+// that were fetched from a PDS rather than the database.
+func (f TagFilter) Matches(tagsJSON *string) bool {
+	tags, _ := ParseTags(tagsJSON)
+	has := make(map[string]bool, len(tags))
+	for _, t := range tags {
+		has[NormalizeTag(t)] = true
+	}
+
+	for _, t := range normalizeTags(f.All) {
+		if !has[t] {
+			return false
+		}
+	}
+	if anyOf := normalizeTags(f.Any); len(anyOf) > 0 {
+		found := false
+		for _, t := range anyOf {
+			if has[t] {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	for _, t := range normalizeTags(f.None) {
+		if has[t] {
+			return false
+		}
+	}
+	return true
+}
+
+func normalizeTags(tags []string) []string {
+	seen := make(map[string]bool, len(tags))
+	var out []string
+	for _, t := range tags {
+		n := NormalizeTag(t)
+		if n == "" || seen[n] {
+			continue
+		}
+		seen[n] = true
+		out = append(out, n)
+	}
+	return out
+}
+
+func stringArgs(values []string) []interface{} {
+	args := make([]interface{}, len(values))
+	for i, v := range values {
+		args[i] = v
+	}
+	return args
+}
@@ -0,0 +1,184 @@
+package db
+
+import (
+	"database/sql"
+	"time"
+)
+
+const rehashBatchSize = 1000
+
+// rehashCursorID is the cursor row recording when RehashTargets last
+// completed, after which records no longer need matching by the hashes
+// they had before URL canonicalization.
+const rehashCursorID = "url_rehash"
+
+type RehashResult struct {
+	Table   string
+	Scanned int
+	Changed int
+}
+
+var rehashTargets = []struct {
+	table, sourceColumn, hashColumn string
+}{
+	{"annotations", "target_source", "target_hash"},
+	{"highlights", "target_source", "target_hash"},
+	{"bookmarks", "source", "source_hash"},
+}
+
+// RehashTargets recomputes every stored target and source hash, and the
+// domain, with the current URL canonicalizer, so existing records join the
+// buckets that new records are written to. Each batch commits on its own,
+// which makes the command safe to interrupt and re-run.
+func (db *DB) RehashTargets(dryRun bool) ([]RehashResult, error) {
+	var results []RehashResult
+	for _, t := range rehashTargets {
+		result, err := db.rehashTable(t.table, t.sourceColumn, t.hashColumn, dryRun)
+		if err != nil {
+			return results, err
+		}
+		results = append(results, result)
+	}
+
+	result, err := db.rehashURLAliases(dryRun)
+	if err != nil {
+		return results, err
+	}
+	results = append(results, result)
+	if dryRun {
+		return results, nil
+	}
+	return results, db.SetCursor(rehashCursorID, time.Now().Unix())
+}
+
+func (db *DB) targetsRehashed() bool {
+	done, err := db.GetCursor(rehashCursorID)
+	return err == nil && done > 0
+}
+
+type rehashedTarget struct {
+	hash, domain string
+}
+
+func (db *DB) rehashTable(table, sourceColumn, hashColumn string, dryRun bool) (RehashResult, error) {
+	result := RehashResult{Table: table}
+	after := ""
+	for {
+		rows, err := db.Query(db.Rebind(`
+			SELECT uri, COALESCE(`+sourceColumn+`, ''), COALESCE(`+hashColumn+`, ''), COALESCE(target_domain, '') FROM `+table+`
+			WHERE uri > ?
+			ORDER BY uri
+			LIMIT ?
+		`), after, rehashBatchSize)
+		if err != nil {
+			return result, err
+		}
+
+		changed := make(map[string]rehashedTarget)
+		n := 0
+		for rows.Next() {
+			var uri, source, hash, domain string
+			if err := rows.Scan(&uri, &source, &hash, &domain); err != nil {
+				rows.Close()
+				return result, err
+			}
+			n++
+			after = uri
+			target := rehashedTarget{hash: db.HashURL(source), domain: db.URLDomain(source)}
+			if target.hash != hash || target.domain != domain {
+				changed[uri] = target
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return result, err
+		}
+
+		result.Scanned += n
+		result.Changed += len(changed)
+		if !dryRun && len(changed) > 0 {
+			if err := db.updateHashes(table, hashColumn, changed); err != nil {
+				return result, err
+			}
+		}
+		if n < rehashBatchSize {
+			return result, nil
+		}
+	}
+}
+
+func (db *DB) updateHashes(table, hashColumn string, targets map[string]rehashedTarget) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt := db.Rebind(`UPDATE ` + table + ` SET ` + hashColumn + ` = ?, target_domain = ?, target_domain_rev = ? WHERE uri = ?`)
+	for uri, t := range targets {
+		if _, err := tx.Exec(stmt, t.hash, t.domain, ReverseDomain(t.domain), uri); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// rehashURLAliases rewrites the alias table in one transaction, since two
+// aliases may collapse onto the same hash under the new rules.
+func (db *DB) rehashURLAliases(dryRun bool) (RehashResult, error) {
+	result := RehashResult{Table: "url_aliases"}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return result, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT alias_hash, alias_url, canonical_hash, canonical_url, resolved_at FROM url_aliases`)
+	if err != nil {
+		return result, err
+	}
+	var aliases []URLAlias
+	for rows.Next() {
+		var a URLAlias
+		if err := rows.Scan(&a.AliasHash, &a.AliasURL, &a.CanonicalHash, &a.CanonicalURL, &a.ResolvedAt); err != nil {
+			rows.Close()
+			return result, err
+		}
+		aliases = append(aliases, a)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return result, err
+	}
+
+	result.Scanned = len(aliases)
+	for i, a := range aliases {
+		aliases[i].AliasHash, aliases[i].CanonicalHash = db.HashURL(a.AliasURL), db.HashURL(a.CanonicalURL)
+		if aliases[i].AliasHash != a.AliasHash || aliases[i].CanonicalHash != a.CanonicalHash {
+			result.Changed++
+		}
+	}
+	if dryRun || result.Changed == 0 {
+		return result, nil
+	}
+
+	if _, err := tx.Exec(`DELETE FROM url_aliases`); err != nil {
+		return result, err
+	}
+	for _, a := range aliases {
+		if err := insertURLAlias(tx, db.Dialect(), a); err != nil {
+			return result, err
+		}
+	}
+	return result, tx.Commit()
+}
+
+func insertURLAlias(tx *sql.Tx, d Dialect, a URLAlias) error {
+	_, err := tx.Exec(d.Rebind(`
+		INSERT INTO url_aliases (alias_hash, alias_url, canonical_hash, canonical_url, resolved_at)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(alias_hash) DO NOTHING
+	`), a.AliasHash, a.AliasURL, a.CanonicalHash, a.CanonicalURL, a.ResolvedAt)
+	return err
+}
@@ -0,0 +1,28 @@
+package db
+
+import (
+	"database/sql"
+	"time"
+)
+
+// GetRepoRev returns the repo revision did was last synced at, or "" if it
+// has not been.
+func (db *DB) GetRepoRev(did string) (string, error) {
+	var rev string
+	err := db.QueryRow(db.Rebind(`SELECT rev FROM repo_revs WHERE did = ?`), did).Scan(&rev)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return rev, err
+}
+
+func (db *DB) SetRepoRev(did, rev string) error {
+	_, err := db.Exec(db.Rebind(`
+		INSERT INTO repo_revs (did, rev, synced_at)
+		VALUES (?, ?, ?)
+		ON CONFLICT(did) DO UPDATE SET
+			rev = excluded.rev,
+			synced_at = excluded.synced_at
+	`), did, rev, time.Now())
+	return err
+}
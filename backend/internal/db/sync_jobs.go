@@ -0,0 +1,134 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+const (
+	SyncJobQueued  = "queued"
+	SyncJobRunning = "running"
+	SyncJobDone    = "done"
+	SyncJobFailed  = "failed"
+	// SyncJobIdle is reported for a repo that has never been queued.
+	SyncJobIdle = "idle"
+)
+
+// SyncJob is the queued, running or last finished sync of one repo.
+// Collections holds the result of each collection synced so far.
+type SyncJob struct {
+	DID           string            `json:"did"`
+	Status        string            `json:"status"`
+	Attempts      int               `json:"attempts"`
+	Collections   map[string]string `json:"collections"`
+	Error         string            `json:"error,omitempty"`
+	QueuedAt      time.Time         `json:"queuedAt"`
+	NextAttemptAt time.Time         `json:"nextAttemptAt"`
+	StartedAt     *time.Time        `json:"startedAt,omitempty"`
+	FinishedAt    *time.Time        `json:"finishedAt,omitempty"`
+	LastSuccessAt *time.Time        `json:"lastSuccessAt,omitempty"`
+}
+
+func (db *DB) GetSyncJob(did string) (*SyncJob, error) {
+	var j SyncJob
+	var collections string
+	err := db.QueryRow(db.Rebind(`
+		SELECT did, status, attempts, collections, error, queued_at, next_attempt_at, started_at, finished_at, last_success_at
+		FROM sync_jobs WHERE did = ?
+	`), did).Scan(&j.DID, &j.Status, &j.Attempts, &collections, &j.Error, &j.QueuedAt, &j.NextAttemptAt, &j.StartedAt, &j.FinishedAt, &j.LastSuccessAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(collections), &j.Collections); err != nil {
+		return nil, err
+	}
+	return &j, nil
+}
+
+// EnqueueSyncJob queues a sync of did unless one is already queued or
+// running, and reports whether it did.
+func (db *DB) EnqueueSyncJob(did string) (bool, error) {
+	now := time.Now()
+	res, err := db.Exec(db.Rebind(`
+		INSERT INTO sync_jobs (did, status, attempts, collections, error, queued_at, next_attempt_at)
+		VALUES (?, ?, 0, '{}', '', ?, ?)
+		ON CONFLICT(did) DO UPDATE SET
+			status = excluded.status,
+			attempts = 0,
+			collections = '{}',
+			error = '',
+			queued_at = excluded.queued_at,
+			next_attempt_at = excluded.next_attempt_at
+		WHERE sync_jobs.status NOT IN (?, ?)
+	`), did, SyncJobQueued, now, now, SyncJobQueued, SyncJobRunning)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// ClaimSyncJob marks the queued job that has been due longest as running
+// and returns it, or nil if none is due. Callers claiming concurrently must
+// serialize.
+func (db *DB) ClaimSyncJob() (*SyncJob, error) {
+	now := time.Now()
+	var did string
+	err := db.QueryRow(db.Rebind(`
+		SELECT did FROM sync_jobs WHERE status = ? AND next_attempt_at <= ? ORDER BY next_attempt_at LIMIT 1
+	`), SyncJobQueued, now).Scan(&did)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(db.Rebind(`
+		UPDATE sync_jobs SET status = ?, collections = '{}', started_at = ?, finished_at = NULL WHERE did = ? AND status = ?
+	`), SyncJobRunning, now, did, SyncJobQueued); err != nil {
+		return nil, err
+	}
+	return db.GetSyncJob(did)
+}
+
+func (db *DB) SetSyncJobProgress(did string, collections map[string]string) error {
+	_, err := db.Exec(db.Rebind(`UPDATE sync_jobs SET collections = ? WHERE did = ?`), ToJSON(collections), did)
+	return err
+}
+
+func (db *DB) CompleteSyncJob(did string, collections map[string]string) error {
+	now := time.Now()
+	_, err := db.Exec(db.Rebind(`
+		UPDATE sync_jobs SET status = ?, attempts = attempts + 1, collections = ?, error = '', finished_at = ?, last_success_at = ?
+		WHERE did = ?
+	`), SyncJobDone, ToJSON(collections), now, now, did)
+	return err
+}
+
+// FailSyncJob records a failed attempt. The job is queued again at retryAt,
+// or given up on when retryAt is nil.
+func (db *DB) FailSyncJob(did string, collections map[string]string, errMsg string, retryAt *time.Time) error {
+	status, next := SyncJobFailed, time.Now()
+	if retryAt != nil {
+		status, next = SyncJobQueued, *retryAt
+	}
+	_, err := db.Exec(db.Rebind(`
+		UPDATE sync_jobs SET status = ?, attempts = attempts + 1, collections = ?, error = ?, finished_at = ?, next_attempt_at = ?
+		WHERE did = ?
+	`), status, ToJSON(collections), errMsg, time.Now(), next, did)
+	return err
+}
+
+// RequeueRunningSyncJobs queues again the jobs a previous process was
+// running when it stopped.
+func (db *DB) RequeueRunningSyncJobs() (int64, error) {
+	res, err := db.Exec(db.Rebind(`UPDATE sync_jobs SET status = ? WHERE status = ?`), SyncJobQueued, SyncJobRunning)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
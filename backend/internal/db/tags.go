@@ -1,154 +1,138 @@
 package db
 
-import "database/sql"
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
 
 type TrendingTag struct {
 	Tag   string `json:"tag"`
 	Count int    `json:"count"`
 }
 
-func (db *DB) GetTrendingTags(limit int) ([]TrendingTag, error) {
-	var query string
-	if db.driver == "postgres" {
-		query = `
-			SELECT tag, COUNT(*) as count FROM (
-				SELECT value as tag, author_did
-				FROM annotations, json_array_elements_text(tags_json::json) as value
-				WHERE tags_json IS NOT NULL AND tags_json != '' AND tags_json != '[]'
-					AND created_at > NOW() - INTERVAL '14 days'
-				UNION ALL
-				SELECT value as tag, author_did
-				FROM highlights, json_array_elements_text(tags_json::json) as value
-				WHERE tags_json IS NOT NULL AND tags_json != '' AND tags_json != '[]'
-					AND created_at > NOW() - INTERVAL '14 days'
-				UNION ALL
-				SELECT value as tag, author_did
-				FROM bookmarks, json_array_elements_text(tags_json::json) as value
-				WHERE tags_json IS NOT NULL AND tags_json != '' AND tags_json != '[]'
-					AND created_at > NOW() - INTERVAL '14 days'
-			) combined
-			GROUP BY tag
-			HAVING COUNT(DISTINCT author_did) >= 3
-			ORDER BY count DESC
-			LIMIT $1
-		`
-	} else {
-		query = `
-			SELECT tag, COUNT(*) as count FROM (
-				SELECT json_each.value as tag, author_did
-				FROM annotations, json_each(annotations.tags_json)
-				WHERE tags_json IS NOT NULL AND tags_json != '' AND tags_json != '[]'
-					AND created_at > datetime('now', '-14 days')
-				UNION ALL
-				SELECT json_each.value as tag, author_did
-				FROM highlights, json_each(highlights.tags_json)
-				WHERE tags_json IS NOT NULL AND tags_json != '' AND tags_json != '[]'
-					AND created_at > datetime('now', '-14 days')
-				UNION ALL
-				SELECT json_each.value as tag, author_did
-				FROM bookmarks, json_each(bookmarks.tags_json)
-				WHERE tags_json IS NOT NULL AND tags_json != '' AND tags_json != '[]'
-					AND created_at > datetime('now', '-14 days')
-			) combined
-			GROUP BY tag
-			HAVING COUNT(DISTINCT author_did) >= 3
-			ORDER BY count DESC
-			LIMIT ?
-		`
-	}
+var tagFolder = cases.Fold()
+
+// NormalizeTag maps a tag to the form used for matching: NFKC-normalized and
+// case-folded, so "Café", "CAFÉ" and "café" all compare equal.
+func NormalizeTag(tag string) string {
+	tag = strings.TrimSpace(norm.NFKC.String(tag))
+	return norm.NFKC.String(tagFolder.String(tag))
+}
 
-	var rows *sql.Rows
-	var err error
-	if db.driver == "postgres" {
-		rows, err = db.Query(query, limit)
-	} else {
-		rows, err = db.Query(db.Rebind(query), limit)
+// execWithTags runs a write against one of the tagged record tables and
+// rebuilds that record's record_tags rows in the same transaction. A nil
+// tagsJSON clears them, which is what deletes want.
+func (db *DB) execWithTags(table, uri string, tagsJSON *string, query string, args ...interface{}) error {
+	return db.inTx(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(db.Rebind(query), args...); err != nil {
+			return err
+		}
+		return syncRecordTags(tx, db.Dialect(), table, uri, tagsJSON)
+	})
+}
+
+func syncRecordTags(tx *sql.Tx, d Dialect, table, uri string, tagsJSON *string) error {
+	if _, err := tx.Exec(d.Rebind(`DELETE FROM record_tags WHERE uri = ?`), uri); err != nil {
+		return err
 	}
+
+	tags, err := ParseTags(tagsJSON)
 	if err != nil {
-		return nil, err
+		return nil
 	}
-	defer rows.Close()
 
-	var tags []TrendingTag
-	for rows.Next() {
-		var t TrendingTag
-		if err := rows.Scan(&t.Tag, &t.Count); err != nil {
-			return nil, err
+	seen := make(map[string]bool)
+	for _, tag := range tags {
+		normalized := NormalizeTag(tag)
+		if normalized == "" || seen[normalized] {
+			continue
+		}
+		seen[normalized] = true
+
+		_, err := tx.Exec(d.Rebind(`
+			INSERT INTO record_tags (uri, tag, normalized_tag, author_did, created_at)
+			SELECT uri, ?, ?, author_did, created_at FROM `+table+` WHERE uri = ?
+			ON CONFLICT DO NOTHING
+		`), strings.TrimSpace(tag), normalized, uri)
+		if err != nil {
+			return err
 		}
-		tags = append(tags, t)
 	}
+	return nil
+}
 
-	if err = rows.Err(); err != nil {
-		return nil, err
+// backfillRecordTags indexes the tags of every existing annotation, highlight
+// and bookmark.
+func backfillRecordTags(tx *sql.Tx, d Dialect) error {
+	for _, table := range []string{"annotations", "highlights", "bookmarks"} {
+		rows, err := tx.Query(`SELECT uri, tags_json FROM ` + table + ` WHERE tags_json IS NOT NULL AND tags_json != '' AND tags_json != '[]'`)
+		if err != nil {
+			return err
+		}
+		tagged := make(map[string]string)
+		for rows.Next() {
+			var uri, tagsJSON string
+			if err := rows.Scan(&uri, &tagsJSON); err != nil {
+				rows.Close()
+				return err
+			}
+			tagged[uri] = tagsJSON
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for uri, tagsJSON := range tagged {
+			if err := syncRecordTags(tx, d, table, uri, &tagsJSON); err != nil {
+				return err
+			}
+		}
 	}
+	return nil
+}
 
-	if tags == nil {
-		return []TrendingTag{}, nil
+func (db *DB) GetTrendingTags(limit int) ([]TrendingTag, error) {
+	rows, err := db.Query(db.Rebind(`
+		SELECT MIN(tag), COUNT(*) as count
+		FROM record_tags
+		WHERE created_at > ?
+		AND `+activeAuthor("record_tags.author_did")+`
+		GROUP BY normalized_tag
+		HAVING COUNT(DISTINCT author_did) >= 3
+		ORDER BY count DESC
+		LIMIT ?
+	`), time.Now().UTC().AddDate(0, 0, -14), false, limit)
+	if err != nil {
+		return nil, err
 	}
+	defer rows.Close()
 
-	return tags, nil
+	return scanTags(rows)
 }
 
 func (db *DB) GetUserTags(did string, limit int) ([]TrendingTag, error) {
-	var query string
-	if db.driver == "postgres" {
-		query = `
-			SELECT tag, SUM(cnt) as count FROM (
-				SELECT value as tag, COUNT(*) as cnt
-				FROM annotations, json_array_elements_text(tags_json::json) as value
-				WHERE author_did = $1 AND tags_json IS NOT NULL AND tags_json != '' AND tags_json != '[]'
-				GROUP BY tag
-				UNION ALL
-				SELECT value as tag, COUNT(*) as cnt
-				FROM highlights, json_array_elements_text(tags_json::json) as value
-				WHERE author_did = $1 AND tags_json IS NOT NULL AND tags_json != '' AND tags_json != '[]'
-				GROUP BY tag
-				UNION ALL
-				SELECT value as tag, COUNT(*) as cnt
-				FROM bookmarks, json_array_elements_text(tags_json::json) as value
-				WHERE author_did = $1 AND tags_json IS NOT NULL AND tags_json != '' AND tags_json != '[]'
-				GROUP BY tag
-			) combined
-			GROUP BY tag
-			ORDER BY count DESC
-			LIMIT $2
-		`
-	} else {
-		query = `
-			SELECT tag, SUM(cnt) as count FROM (
-				SELECT json_each.value as tag, COUNT(*) as cnt
-				FROM annotations, json_each(annotations.tags_json)
-				WHERE author_did = ? AND tags_json IS NOT NULL AND tags_json != '' AND tags_json != '[]'
-				GROUP BY tag
-				UNION ALL
-				SELECT json_each.value as tag, COUNT(*) as cnt
-				FROM highlights, json_each(highlights.tags_json)
-				WHERE author_did = ? AND tags_json IS NOT NULL AND tags_json != '' AND tags_json != '[]'
-				GROUP BY tag
-				UNION ALL
-				SELECT json_each.value as tag, COUNT(*) as cnt
-				FROM bookmarks, json_each(bookmarks.tags_json)
-				WHERE author_did = ? AND tags_json IS NOT NULL AND tags_json != '' AND tags_json != '[]'
-				GROUP BY tag
-			) combined
-			GROUP BY tag
-			ORDER BY count DESC
-			LIMIT ?
-		`
-	}
-
-	var rows *sql.Rows
-	var err error
-	if db.driver == "postgres" {
-		rows, err = db.Query(query, did, limit)
-	} else {
-		rows, err = db.Query(db.Rebind(query), did, did, did, limit)
-	}
+	rows, err := db.Query(db.Rebind(`
+		SELECT MIN(tag), COUNT(*) as count
+		FROM record_tags
+		WHERE author_did = ?
+		GROUP BY normalized_tag
+		ORDER BY count DESC
+		LIMIT ?
+	`), did, limit)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
+	return scanTags(rows)
+}
+
+func scanTags(rows *sql.Rows) ([]TrendingTag, error) {
 	var tags []TrendingTag
 	for rows.Next() {
 		var t TrendingTag
@@ -158,7 +142,7 @@ func (db *DB) GetUserTags(did string, limit int) ([]TrendingTag, error) {
 		tags = append(tags, t)
 	}
 
-	if err = rows.Err(); err != nil {
+	if err := rows.Err(); err != nil {
 		return nil, err
 	}
 
@@ -0,0 +1,85 @@
+package db
+
+import (
+	"database/sql"
+	"time"
+)
+
+type URLAlias struct {
+	AliasHash     string
+	AliasURL      string
+	CanonicalHash string
+	CanonicalURL  string
+	ResolvedAt    time.Time
+}
+
+// SaveURLAlias records that aliasURL declares canonicalURL as its canonical
+// page.
+func (db *DB) SaveURLAlias(aliasURL, canonicalURL string) error {
+	_, err := db.Exec(db.Rebind(`
+		INSERT INTO url_aliases (alias_hash, alias_url, canonical_hash, canonical_url, resolved_at)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(alias_hash) DO UPDATE SET
+			alias_url = excluded.alias_url,
+			canonical_hash = excluded.canonical_hash,
+			canonical_url = excluded.canonical_url,
+			resolved_at = excluded.resolved_at
+	`), db.HashURL(aliasURL), aliasURL, db.HashURL(canonicalURL), canonicalURL, time.Now())
+	return err
+}
+
+func (db *DB) GetURLAlias(aliasHash string) (*URLAlias, error) {
+	var a URLAlias
+	err := db.QueryRow(db.Rebind(`
+		SELECT alias_hash, alias_url, canonical_hash, canonical_url, resolved_at
+		FROM url_aliases
+		WHERE alias_hash = ?
+	`), aliasHash).Scan(&a.AliasHash, &a.AliasURL, &a.CanonicalHash, &a.CanonicalURL, &a.ResolvedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// TargetHashes returns every hash a page's records may be stored under: the
+// URL's own hash plus any hash linked to it through a canonical-link alias,
+// in either direction. Until margin rehash has run, records stored before
+// URL canonicalization are matched by their old hashes too.
+func (db *DB) TargetHashes(rawURL string) []string {
+	hash := db.HashURL(rawURL)
+	hashes := []string{hash}
+	seen := map[string]bool{hash: true}
+	if !db.targetsRehashed() {
+		for _, h := range legacyURLHashes(rawURL) {
+			if !seen[h] {
+				seen[h] = true
+				hashes = append(hashes, h)
+			}
+		}
+	}
+
+	rows, err := db.Query(db.Rebind(`
+		SELECT canonical_hash FROM url_aliases WHERE alias_hash = ?
+		UNION
+		SELECT alias_hash FROM url_aliases WHERE canonical_hash IN (
+			SELECT canonical_hash FROM url_aliases WHERE alias_hash = ?
+			UNION SELECT ?
+		)
+	`), hash, hash, hash)
+	if err != nil {
+		return hashes
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var h string
+		if err := rows.Scan(&h); err == nil && !seen[h] {
+			seen[h] = true
+			hashes = append(hashes, h)
+		}
+	}
+	return hashes
+}
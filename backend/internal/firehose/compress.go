@@ -0,0 +1,56 @@
+package firehose
+
+import (
+	_ "embed"
+	"errors"
+	"fmt"
+
+	"github.com/gorilla/websocket"
+	"github.com/klauspost/compress/zstd"
+)
+
+// zstdDictionary is the dictionary Jetstream compresses every frame with
+// (dict ID 1612007021), copied from the Jetstream repository.
+//
+//go:embed zstd_dictionary
+var zstdDictionary []byte
+
+// maxDecodedFrame caps how much memory one frame may decode to. Jetstream
+// events carry a single record, which the PDS limits to 1 MiB, so anything
+// near this is a decompression bomb rather than an event.
+const maxDecodedFrame = 8 << 20
+
+var zstdDecoder = mustNewZstdDecoder()
+
+func mustNewZstdDecoder() *zstd.Decoder {
+	dec, err := zstd.NewReader(nil,
+		zstd.WithDecoderDicts(zstdDictionary),
+		zstd.WithDecoderConcurrency(0),
+		zstd.WithDecoderMaxMemory(maxDecodedFrame),
+		zstd.WithDecoderMaxWindow(maxDecodedFrame),
+	)
+	if err != nil {
+		panic(fmt.Sprintf("firehose: zstd decoder: %v", err))
+	}
+	return dec
+}
+
+var errDecompress = errors.New("zstd decompression failed")
+
+// readJetstreamMessage returns the next frame's JSON. Compressed
+// connections send binary frames, but text frames are always accepted, so
+// a server that ignores compress=true still works.
+func readJetstreamMessage(conn *websocket.Conn) ([]byte, error) {
+	messageType, message, err := conn.ReadMessage()
+	if err != nil {
+		return nil, fmt.Errorf("websocket read failed: %w", err)
+	}
+	if messageType != websocket.BinaryMessage {
+		return message, nil
+	}
+	decoded, err := zstdDecoder.DecodeAll(message, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errDecompress, err)
+	}
+	return decoded, nil
+}
@@ -0,0 +1,208 @@
+package firehose
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"margin.at/internal/crypto"
+	"margin.at/internal/db"
+	"margin.at/internal/records"
+	"margin.at/internal/xrpc"
+)
+
+// Database failures are retried automatically, waiting FailureRetryBase after
+// the first and doubling up to FailureRetryMax, for FailureMaxAttempts in all.
+// After that a failure stays listed until it is retried by hand.
+var (
+	FailureRetryBase   = time.Minute
+	FailureRetryMax    = 6 * time.Hour
+	FailureMaxAttempts = 8
+)
+
+// indexRecord runs the handler for event and records it in ingest_failures
+// if it fails, so one bad record is neither lost nor able to stall the batch.
+func (i *Ingester) indexRecord(tx *db.DB, event *FirehoseEvent) {
+	uri := fmt.Sprintf("at://%s/%s/%s", event.Repo, event.Collection, event.Rkey)
+	kind, err := i.tryIndex(tx, event, uri)
+	if err != nil {
+		log.Printf("Failed to index %s: %v", uri, err)
+		i.recordFailure(tx, event, uri, kind, err)
+		return
+	}
+	tx.ClearIngestFailure(uri)
+}
+
+func (i *Ingester) tryIndex(tx *db.DB, event *FirehoseEvent, uri string) (string, error) {
+	handler, ok := i.handlers[event.Collection]
+	if !ok {
+		return "", nil
+	}
+	if i.cfg.VerifyCIDs && event.CID != "" {
+		if err := crypto.VerifyRecordCID(event.Record, event.CID, uri); err != nil {
+			return db.IngestFailureCID, err
+		}
+	}
+	if err := i.cfg.Lexicons.ValidateRecord(event.Collection, event.Record); err != nil {
+		return db.IngestFailureSchema, err
+	}
+	err := tx.Isolate(func() error { return handler(tx, event) })
+	if errors.Is(err, records.ErrMalformed) {
+		return db.IngestFailureParse, err
+	}
+	return db.IngestFailureDatabase, err
+}
+
+func (i *Ingester) recordFailure(tx *db.DB, event *FirehoseEvent, uri, kind string, cause error) {
+	failure := &db.IngestFailure{
+		URI:        uri,
+		Collection: event.Collection,
+		Operation:  event.Operation,
+		Record:     string(event.Record),
+		CID:        event.CID,
+		Frame:      event.frame,
+		Kind:       kind,
+		Error:      cause.Error(),
+	}
+	if kind == db.IngestFailureDatabase {
+		attempts := 1
+		if previous, err := tx.GetIngestFailureByURI(uri); err == nil && previous != nil {
+			attempts = previous.Attempts + 1
+		}
+		if attempts < FailureMaxAttempts {
+			next := time.Now().Add(retryBackoff(attempts))
+			failure.NextAttemptAt = &next
+		}
+	}
+	if err := tx.RecordIngestFailure(failure); err != nil {
+		log.Printf("Failed to record ingest failure for %s: %v", uri, err)
+	}
+}
+
+func retryBackoff(attempts int) time.Duration {
+	wait := FailureRetryBase
+	for n := 1; n < attempts && wait < FailureRetryMax; n++ {
+		wait *= 2
+	}
+	return min(wait, FailureRetryMax)
+}
+
+// RetryIngestFailure indexes a failed record again from its stored copy, or
+// deletes it again if the delete failed. A rejected relay commit is verified
+// again first, with the repo's signing key resolved afresh. The failure is
+// cleared if it succeeds and updated if it does not.
+func (i *Ingester) RetryIngestFailure(id int64) error {
+	failure, err := i.db.GetIngestFailure(id)
+	if err != nil {
+		return err
+	}
+	if failure == nil {
+		return fmt.Errorf("ingest failure %d not found", id)
+	}
+	parsed, err := xrpc.ParseATURI(failure.URI)
+	if err != nil {
+		return err
+	}
+	event := &FirehoseEvent{
+		Repo:       parsed.DID,
+		Collection: parsed.Collection,
+		Rkey:       parsed.RKey,
+		Record:     []byte(failure.Record),
+		Operation:  failure.Operation,
+		CID:        failure.CID,
+		frame:      failure.Frame,
+	}
+
+	var indexErr error
+	if failure.Kind == db.IngestFailureCommit {
+		var verified *FirehoseEvent
+		if verified, indexErr = i.reverifyCommit(failure); indexErr == nil {
+			event = verified
+		}
+	}
+	err = i.db.Batch(func(tx *db.DB) error {
+		kind := db.IngestFailureDatabase
+		switch {
+		case indexErr != nil:
+			kind = db.IngestFailureCommit
+		case event.Operation == "delete":
+			indexErr = tryDelete(tx, event.Collection, failure.URI)
+		default:
+			kind, indexErr = i.tryIndex(tx, event, failure.URI)
+		}
+		if indexErr != nil {
+			i.recordFailure(tx, event, failure.URI, kind, indexErr)
+			return nil
+		}
+		return tx.ClearIngestFailure(failure.URI)
+	})
+	if err != nil {
+		return err
+	}
+	return indexErr
+}
+
+// reverifyCommit verifies the relay commit a commit failure was rejected
+// from and returns its operation on the failed record.
+func (i *Ingester) reverifyCommit(failure *db.IngestFailure) (*FirehoseEvent, error) {
+	frame, err := base64.StdEncoding.DecodeString(failure.Frame)
+	if err != nil {
+		return nil, fmt.Errorf("stored commit: %w", err)
+	}
+	var commit repoCommitEvent
+	if err := cbor.Unmarshal(frame, &commit); err != nil {
+		return nil, fmt.Errorf("stored commit: %w", err)
+	}
+	signingKeys.forget(commit.Repo)
+	events, err := i.commitEvents(&commit, parseEventTime(commit.Time))
+	if err != nil {
+		return nil, err
+	}
+	for _, event := range events {
+		c := event.Commit
+		if fmt.Sprintf("at://%s/%s/%s", event.Did, c.Collection, c.Rkey) != failure.URI {
+			continue
+		}
+		return &FirehoseEvent{
+			Repo:       event.Did,
+			Collection: c.Collection,
+			Rkey:       c.Rkey,
+			Record:     c.Record,
+			Operation:  c.Operation,
+			Cursor:     event.Time,
+			CID:        c.Cid,
+		}, nil
+	}
+	return nil, fmt.Errorf("stored commit has no operation on %s", failure.URI)
+}
+
+// retryFailures retries database failures as their backoff expires.
+func (i *Ingester) retryFailures(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		due, err := i.db.DueIngestFailures(50)
+		if err != nil {
+			log.Printf("Failed to load due ingest failures: %v", err)
+			continue
+		}
+		for _, failure := range due {
+			if err := i.RetryIngestFailure(failure.ID); err != nil {
+				log.Printf("Retry of %s failed: %v", failure.URI, err)
+			} else {
+				log.Printf("Retry of %s succeeded", failure.URI)
+			}
+		}
+	}
+}
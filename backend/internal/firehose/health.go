@@ -0,0 +1,169 @@
+package firehose
+
+import (
+	"errors"
+	"log"
+	"time"
+)
+
+// maxRelayFailures consecutive connections that deliver nothing move the
+// ingester to another relay. A stall moves it at once.
+const maxRelayFailures = 3
+
+var errStalled = errors.New("relay stalled")
+
+type relayHealth struct {
+	url string
+
+	// pool is set while connected; the fields below it are the state as of
+	// the last disconnect.
+	pool        *shardedPool
+	connectedAt time.Time
+	lastEventAt time.Time
+	lastTimeUS  int64
+	lag         time.Duration
+	reconnects  int
+	failures    int
+	lastError   string
+	delivered   bool
+}
+
+// RelayStatus is the health of one relay.
+type RelayStatus struct {
+	URL                 string     `json:"url"`
+	Active              bool       `json:"active"`
+	Connected           bool       `json:"connected"`
+	ConnectedAt         *time.Time `json:"connectedAt,omitempty"`
+	LastEventAt         *time.Time `json:"lastEventAt,omitempty"`
+	LastEventTimeUS     int64      `json:"lastEventTimeUs,omitempty"`
+	LagSeconds          float64    `json:"lagSeconds"`
+	Reconnects          int        `json:"reconnects"`
+	ConsecutiveFailures int        `json:"consecutiveFailures"`
+	LastError           string     `json:"lastError,omitempty"`
+}
+
+// Status describes the firehose connection for the status endpoint.
+type Status struct {
+	Source      string        `json:"source"`
+	ActiveRelay string        `json:"activeRelay"`
+	Compressed  bool          `json:"compressed"`
+	Relays      []RelayStatus `json:"relays"`
+}
+
+func (i *Ingester) initRelays() {
+	urls := RelayURLs
+	if i.cfg.Source == SourceRelay {
+		urls = []string{i.cfg.RelayHost}
+	}
+	i.healthMu.Lock()
+	defer i.healthMu.Unlock()
+	i.relays = make([]*relayHealth, len(urls))
+	for n, url := range urls {
+		i.relays[n] = &relayHealth{url: url}
+	}
+	i.currentRelayIdx = 0
+	i.cursorRelay = -1
+}
+
+func (i *Ingester) activeRelay() (int, string) {
+	i.healthMu.Lock()
+	defer i.healthMu.Unlock()
+	return i.currentRelayIdx, i.relays[i.currentRelayIdx].url
+}
+
+func (i *Ingester) relayConnected(h *relayHealth, pool *shardedPool) {
+	i.healthMu.Lock()
+	defer i.healthMu.Unlock()
+	h.pool = pool
+	h.connectedAt = time.Now()
+}
+
+func (i *Ingester) relayDisconnected(h *relayHealth, pool *shardedPool) {
+	i.healthMu.Lock()
+	defer i.healthMu.Unlock()
+	h.pool = nil
+	if timeUS := pool.lastTimeUS.Load(); timeUS > 0 {
+		h.delivered = true
+		h.lastTimeUS = timeUS
+		h.lastEventAt = time.Unix(0, pool.lastRead.Load())
+		h.lag = h.lastEventAt.Sub(time.UnixMicro(timeUS))
+		h.failures = 0
+		i.cursorRelay = i.currentRelayIdx
+	}
+}
+
+// relayDown records that the active relay's connection ended with err and
+// moves to the healthiest other relay when this one has failed too often.
+func (i *Ingester) relayDown(err error) {
+	i.healthMu.Lock()
+	defer i.healthMu.Unlock()
+	h := i.relays[i.currentRelayIdx]
+	h.reconnects++
+	h.lastError = err.Error()
+	if !h.delivered || errors.Is(err, errStalled) {
+		h.failures++
+	}
+	h.delivered = false
+
+	if len(i.relays) < 2 || (h.failures < maxRelayFailures && !errors.Is(err, errStalled)) {
+		return
+	}
+	next := -1
+	for n := 1; n < len(i.relays); n++ {
+		idx := (i.currentRelayIdx + n) % len(i.relays)
+		if next < 0 || healthier(i.relays[idx], i.relays[next]) {
+			next = idx
+		}
+	}
+	i.currentRelayIdx = next
+	log.Printf("Switching to relay %d: %s", next, i.relays[next].url)
+}
+
+func healthier(a, b *relayHealth) bool {
+	if a.failures != b.failures {
+		return a.failures < b.failures
+	}
+	return a.lastTimeUS > 0 && (b.lastTimeUS == 0 || a.lag < b.lag)
+}
+
+// Status reports the health of each relay and which one is in use.
+func (i *Ingester) Status() Status {
+	i.healthMu.Lock()
+	defer i.healthMu.Unlock()
+
+	status := Status{
+		Source:     i.cfg.Source,
+		Compressed: i.cfg.Source != SourceRelay && i.cfg.Compress && !i.uncompressed.Load(),
+		Relays:     make([]RelayStatus, len(i.relays)),
+	}
+	for n, h := range i.relays {
+		rs := RelayStatus{
+			URL:                 h.url,
+			Active:              n == i.currentRelayIdx,
+			Connected:           h.pool != nil,
+			LastEventTimeUS:     h.lastTimeUS,
+			LagSeconds:          h.lag.Seconds(),
+			Reconnects:          h.reconnects,
+			ConsecutiveFailures: h.failures,
+			LastError:           h.lastError,
+		}
+		lastEventAt := h.lastEventAt
+		if h.pool != nil {
+			connectedAt := h.connectedAt
+			rs.ConnectedAt = &connectedAt
+			if timeUS := h.pool.lastTimeUS.Load(); timeUS > 0 {
+				rs.LastEventTimeUS = timeUS
+				rs.LagSeconds = time.Since(time.UnixMicro(timeUS)).Seconds()
+				lastEventAt = time.Unix(0, h.pool.lastRead.Load())
+			}
+		}
+		if !lastEventAt.IsZero() {
+			rs.LastEventAt = &lastEventAt
+		}
+		if rs.Active {
+			status.ActiveRelay = h.url
+		}
+		status.Relays[n] = rs
+	}
+	return status
+}
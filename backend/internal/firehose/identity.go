@@ -0,0 +1,102 @@
+package firehose
+
+import (
+	"log"
+	"time"
+
+	"margin.at/internal/db"
+	"margin.at/internal/xrpc"
+)
+
+type JetstreamIdentity struct {
+	Did    string `json:"did"`
+	Handle string `json:"handle"`
+	Seq    int64  `json:"seq"`
+	Time   string `json:"time"`
+}
+
+type JetstreamAccount struct {
+	Did    string `json:"did"`
+	Active bool   `json:"active"`
+	Status string `json:"status,omitempty"`
+	Seq    int64  `json:"seq"`
+	Time   string `json:"time"`
+}
+
+// OnIdentityChange registers fn to be called with the DID of every account
+// whose handle, PDS or status changes, so in-memory caches can drop it. It
+// is called once the change is committed.
+func (i *Ingester) OnIdentityChange(fn func(did string)) {
+	i.identityHooks = append(i.identityHooks, fn)
+}
+
+func (i *Ingester) identityChanged(did string) {
+	lastSyncAttempts.Delete(did)
+	for _, fn := range i.identityHooks {
+		fn(did)
+	}
+}
+
+func (i *Ingester) handleIdentity(tx *db.DB, event JetstreamEvent) {
+	did := event.Did
+	at := time.UnixMicro(event.Time).UTC()
+	if err := tx.SetAccountIdentity(did, event.Identity.Handle, "", at); err != nil {
+		log.Printf("Failed to save identity for %s: %v", did, err)
+		return
+	}
+	tx.AfterCommit(func() {
+		i.identityChanged(did)
+		go i.refreshPDS(did)
+	})
+}
+
+// refreshPDS stores the PDS in the DID document of did. Identity events also
+// announce PDS migrations, which are only visible there, so the document is
+// read directly rather than through a cache that may still hold the old one.
+func (i *Ingester) refreshPDS(did string) {
+	pds, err := xrpc.ResolveDIDToPDSFresh(did)
+	if err != nil || pds == "" {
+		return
+	}
+	if err := i.db.SetAccountPDS(did, pds); err != nil {
+		log.Printf("Failed to save PDS for %s: %v", did, err)
+		return
+	}
+	i.identityChanged(did)
+}
+
+func (i *Ingester) handleAccount(tx *db.DB, event JetstreamEvent) {
+	did := event.Did
+	account := event.Account
+	at := time.UnixMicro(event.Time).UTC()
+
+	if err := tx.SetAccountStatus(did, account.Active, account.Status, at); err != nil {
+		log.Printf("Failed to save account status for %s: %v", did, err)
+		return
+	}
+	tx.AfterCommit(func() { i.identityChanged(did) })
+
+	if !account.Active && account.Status == db.AccountStatusDeleted {
+		if err := tx.PurgeAccount(did); err != nil {
+			log.Printf("Failed to purge deleted account %s: %v", did, err)
+			return
+		}
+		log.Printf("Purged records of deleted account %s", did)
+	}
+}
+
+// accountPDS returns the PDS last announced for did, resolving and storing it
+// when the firehose has not told us yet.
+func (i *Ingester) accountPDS(did string) string {
+	if account, err := i.db.GetAccount(did); err == nil && account != nil && account.PDS != "" {
+		return account.PDS
+	}
+	pds, err := xrpc.ResolveDIDToPDS(did)
+	if err != nil || pds == "" {
+		return ""
+	}
+	if err := i.db.SetAccountPDS(did, pds); err != nil {
+		log.Printf("Failed to save PDS for %s: %v", did, err)
+	}
+	return pds
+}
@@ -3,34 +3,19 @@ package firehose
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
-	"margin.at/internal/crypto"
 	"margin.at/internal/db"
+	"margin.at/internal/lexicon"
+	"margin.at/internal/records"
 	internal_sync "margin.at/internal/sync"
-	"margin.at/internal/xrpc"
-)
-
-var CIDVerificationEnabled = true
-
-const (
-	CollectionAnnotation       = "at.margin.annotation"
-	CollectionHighlight        = "at.margin.highlight"
-	CollectionBookmark         = "at.margin.bookmark"
-	CollectionReply            = "at.margin.reply"
-	CollectionLike             = "at.margin.like"
-	CollectionCollection       = "at.margin.collection"
-	CollectionCollectionItem   = "at.margin.collectionItem"
-	CollectionProfile          = "at.margin.profile"
-	CollectionAPIKey           = "at.margin.apikey"
-	CollectionPreferences      = "at.margin.preferences"
-	CollectionSembleCard       = "network.cosmik.card"
-	CollectionSembleCollection = "network.cosmik.collection"
 )
 
 var RelayURLs = []string{
@@ -41,36 +26,99 @@ var RelayURLs = []string{
 
 var RelayURL = RelayURLs[0]
 
+// Config holds the ingester's settings. Start from DefaultConfig and
+// override what the server is configured with.
+type Config struct {
+	// Source picks the event stream: Jetstream's JSON feed from RelayURLs,
+	// or the raw com.atproto.sync.subscribeRepos firehose of RelayHost,
+	// whose commits are checked against each repo's signing key before
+	// they are applied.
+	Source    string
+	RelayHost string
+
+	// Compress asks Jetstream for zstd-compressed frames, which are several
+	// times smaller than the JSON they carry. If they cannot be decoded the
+	// ingester falls back to plain JSON for the rest of the process.
+	Compress bool
+
+	// Each worker commits its events in batches of up to BatchSize, or
+	// whatever arrived within BatchInterval.
+	BatchSize     int
+	BatchInterval time.Duration
+
+	// Events are applied by Workers goroutines, each owning the repos whose
+	// DID hashes to it, so events of one repo keep their order while
+	// different repos proceed in parallel. Each worker buffers at most
+	// WorkerQueueSize events; when one is full the websocket reader blocks
+	// until it drains.
+	Workers         int
+	WorkerQueueSize int
+
+	// A connection that delivers nothing for StallTimeout is dropped as
+	// stalled. Jetstream sends identity and account events whatever the
+	// collection filter, so a live stream is never quiet for that long.
+	//
+	// Jetstream instances stamp time_us themselves and drift slightly
+	// apart, so the cursor is rewound by RelayRewind when resuming on a
+	// different instance than the one that last delivered events. Replayed
+	// events are upserts.
+	StallTimeout time.Duration
+	RelayRewind  time.Duration
+
+	// Lexicons, when set, is the schema every record must match to be
+	// indexed.
+	Lexicons *lexicon.Catalog
+	// VerifyCIDs rejects records whose content does not hash to their CID.
+	VerifyCIDs bool
+}
+
+// DefaultConfig is the configuration the ingester runs with when nothing
+// is overridden.
+func DefaultConfig() Config {
+	return Config{
+		Source:          SourceJetstream,
+		RelayHost:       "wss://bsky.network",
+		Compress:        true,
+		BatchSize:       100,
+		BatchInterval:   250 * time.Millisecond,
+		Workers:         8,
+		WorkerQueueSize: 256,
+		StallTimeout:    2 * time.Minute,
+		RelayRewind:     10 * time.Second,
+		VerifyCIDs:      true,
+	}
+}
+
 type Ingester struct {
-	db              *db.DB
-	sync            *internal_sync.Service
-	cancel          context.CancelFunc
-	handlers        map[string]RecordHandler
+	db            *db.DB
+	cfg           Config
+	sync          *internal_sync.Service
+	cancel        context.CancelFunc
+	handlers      map[string]RecordHandler
+	identityHooks []func(did string)
+	uncompressed  atomic.Bool
+
+	// Relay health is read by Status while run updates it. cursorRelay is
+	// the relay that delivered the stored cursor, or -1 if not known.
+	healthMu        sync.Mutex
+	relays          []*relayHealth
 	currentRelayIdx int
+	cursorRelay     int
 }
 
-type RecordHandler func(event *FirehoseEvent)
+type RecordHandler func(tx *db.DB, event *FirehoseEvent) error
 
-func NewIngester(database *db.DB, syncService *internal_sync.Service) *Ingester {
+func NewIngester(database *db.DB, syncService *internal_sync.Service, cfg Config) *Ingester {
 	i := &Ingester{
 		db:       database,
+		cfg:      cfg,
 		sync:     syncService,
 		handlers: make(map[string]RecordHandler),
 	}
 
-	i.RegisterHandler(CollectionAnnotation, i.handleAnnotation)
-	i.RegisterHandler(CollectionHighlight, i.handleHighlight)
-	i.RegisterHandler(CollectionBookmark, i.handleBookmark)
-	i.RegisterHandler(CollectionReply, i.handleReply)
-	i.RegisterHandler(CollectionLike, i.handleLike)
-	i.RegisterHandler(CollectionCollection, i.handleCollection)
-	i.RegisterHandler(CollectionCollectionItem, i.handleCollectionItem)
-	i.RegisterHandler(CollectionProfile, i.handleProfile)
-	i.RegisterHandler(CollectionAPIKey, i.handleAPIKey)
-	i.RegisterHandler(CollectionPreferences, i.handlePreferences)
-	i.RegisterHandler(CollectionSembleCard, i.handleSembleCard)
-	i.RegisterHandler(CollectionSembleCollection, i.handleSembleCollection)
-	i.RegisterHandler(xrpc.CollectionSembleCollectionLink, i.handleSembleCollectionLink)
+	for _, nsid := range records.NSIDs() {
+		i.RegisterHandler(nsid, i.handleRecord)
+	}
 
 	return i
 }
@@ -83,7 +131,9 @@ func (i *Ingester) Start(ctx context.Context) error {
 	ctx, cancel := context.WithCancel(ctx)
 	i.cancel = cancel
 
+	i.initRelays()
 	go i.run(ctx)
+	go i.retryFailures(ctx)
 	return nil
 }
 
@@ -94,40 +144,35 @@ func (i *Ingester) Stop() {
 }
 
 func (i *Ingester) run(ctx context.Context) {
-	consecutiveFailures := 0
-	maxFailuresBeforeSwitch := 3
-
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		default:
 			if err := i.subscribe(ctx); err != nil {
-				consecutiveFailures++
-				log.Printf("Jetstream error (relay %d): %v, reconnecting in 5s...", i.currentRelayIdx, err)
-
-				if consecutiveFailures >= maxFailuresBeforeSwitch {
-					i.currentRelayIdx = (i.currentRelayIdx + 1) % len(RelayURLs)
-					log.Printf("Switching to relay %d: %s", i.currentRelayIdx, RelayURLs[i.currentRelayIdx])
-					consecutiveFailures = 0
-				}
+				log.Printf("Firehose error (relay %d): %v, reconnecting in 5s...", i.currentRelayIdx, err)
+				i.relayDown(err)
 
 				if ctx.Err() != nil {
 					return
 				}
 				time.Sleep(5 * time.Second)
-			} else {
-				consecutiveFailures = 0
 			}
 		}
 	}
 }
 
 type JetstreamEvent struct {
-	Did    string           `json:"did"`
-	Time   int64            `json:"time_us"`
-	Kind   string           `json:"kind"`
-	Commit *JetstreamCommit `json:"commit,omitempty"`
+	Did      string             `json:"did"`
+	Time     int64              `json:"time_us"`
+	Kind     string             `json:"kind"`
+	Commit   *JetstreamCommit   `json:"commit,omitempty"`
+	Identity *JetstreamIdentity `json:"identity,omitempty"`
+	Account  *JetstreamAccount  `json:"account,omitempty"`
+
+	// relayCommit is set instead of Commit for a subscribeRepos commit
+	// that has yet to be verified.
+	relayCommit *relayCommit
 }
 
 type JetstreamCommit struct {
@@ -140,72 +185,141 @@ type JetstreamCommit struct {
 }
 
 func (i *Ingester) subscribe(ctx context.Context) error {
+	if i.cfg.Source == SourceRelay {
+		return i.subscribeRepos(ctx)
+	}
+
+	idx, relayURL := i.activeRelay()
 	cursor := i.getLastCursor()
+	if cursor > 0 && idx != i.cursorRelay {
+		cursor = max(cursor-i.cfg.RelayRewind.Microseconds(), 1)
+		log.Printf("Rewinding cursor by %s for relay %d", i.cfg.RelayRewind, idx)
+	}
+	url := jetstreamURL(relayURL, i.collections(), cursor, i.cfg.Compress && !i.uncompressed.Load())
+	log.Printf("Connecting to Jetstream: %s", url)
+	err := i.consume(ctx, url, "firehose_cursor", i.relays[idx], i.readJetstream)
+	if errors.Is(err, errDecompress) {
+		log.Printf("Falling back to uncompressed Jetstream: %v", err)
+		i.uncompressed.Store(true)
+	}
+	return err
+}
 
+func (i *Ingester) collections() []string {
 	var collections []string
 	for collection := range i.handlers {
 		collections = append(collections, collection)
 	}
+	return collections
+}
 
-	relayURL := RelayURLs[i.currentRelayIdx]
+func jetstreamURL(relayURL string, collections []string, cursor int64, compress bool) string {
 	url := fmt.Sprintf("%s?wantedCollections=%s", relayURL, strings.Join(collections, "&wantedCollections="))
 	if cursor > 0 {
 		url = fmt.Sprintf("%s&cursor=%d", url, cursor)
 	}
+	if compress {
+		url += "&compress=true"
+	}
+	return url
+}
 
-	log.Printf("Connecting to Jetstream: %s", url)
-
+// consume streams url into a worker pool with read until the connection
+// drops, stalls or ctx is cancelled, then lets the pool finish what it has
+// queued. health, when set, is kept up to date for the relay behind url.
+func (i *Ingester) consume(ctx context.Context, url, cursorID string, health *relayHealth, read func(context.Context, *websocket.Conn, *shardedPool) error) error {
 	conn, _, err := websocket.DefaultDialer.DialContext(ctx, url, nil)
 	if err != nil {
 		return fmt.Errorf("websocket dial failed: %w", err)
 	}
 	defer conn.Close()
 
-	log.Printf("Connected to Jetstream")
+	log.Printf("Connected to %s", url)
 
-	for {
-		select {
-		case <-ctx.Done():
-			return nil
-		default:
+	pool := newShardedPool(i, cursorID, i.cfg.Workers, i.cfg.WorkerQueueSize)
+	if health != nil {
+		i.relayConnected(health, pool)
+		defer i.relayDisconnected(health, pool)
+	}
+
+	// Closing the connection is the only way to interrupt a blocked read.
+	var stalled atomic.Bool
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		var watchdog <-chan time.Time
+		if i.cfg.StallTimeout > 0 {
+			ticker := time.NewTicker(i.cfg.StallTimeout / 4)
+			defer ticker.Stop()
+			watchdog = ticker.C
 		}
+		for {
+			select {
+			case <-ctx.Done():
+				conn.Close()
+				return
+			case <-watchdog:
+				if pool.idle() > i.cfg.StallTimeout {
+					stalled.Store(true)
+					conn.Close()
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
 
-		_, message, err := conn.ReadMessage()
+	err = read(ctx, conn, pool)
+	if poolErr := pool.close(); poolErr != nil {
+		return poolErr
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	if stalled.Load() {
+		return fmt.Errorf("%w: no events for %s", errStalled, i.cfg.StallTimeout)
+	}
+	return err
+}
+
+func (i *Ingester) readJetstream(ctx context.Context, conn *websocket.Conn, pool *shardedPool) error {
+	for {
+		message, err := readJetstreamMessage(conn)
 		if err != nil {
-			return fmt.Errorf("websocket read failed: %w", err)
+			return err
 		}
 
 		var event JetstreamEvent
 		if err := json.Unmarshal(message, &event); err != nil {
 			continue
 		}
-
-		if event.Kind == "commit" && event.Commit != nil {
-			i.handleCommit(event)
-
-			if event.Time > 0 {
-				if err := i.db.SetCursor("firehose_cursor", event.Time); err != nil {
-					log.Printf("Failed to save cursor: %v", err)
-				}
-			}
+		if err := pool.submit(ctx, event, event.Time); err != nil {
+			return err
 		}
 	}
 }
 
-func (i *Ingester) handleCommit(event JetstreamEvent) {
+func (i *Ingester) applyEvent(tx *db.DB, event JetstreamEvent) {
+	switch {
+	case event.relayCommit != nil:
+		i.applyRelayCommit(tx, event.relayCommit)
+	case event.Kind == "commit" && event.Commit != nil:
+		i.handleCommit(tx, event)
+	case event.Kind == "identity" && event.Identity != nil:
+		i.handleIdentity(tx, event)
+	case event.Kind == "account" && event.Account != nil:
+		i.handleAccount(tx, event)
+	}
+}
+
+func (i *Ingester) handleCommit(tx *db.DB, event JetstreamEvent) {
 	commit := event.Commit
 	uri := fmt.Sprintf("at://%s/%s/%s", event.Did, commit.Collection, commit.Rkey)
 
 	switch commit.Operation {
 	case "create", "update":
 		if len(commit.Record) > 0 {
-			if CIDVerificationEnabled && commit.Cid != "" {
-				if err := crypto.VerifyRecordCID(commit.Record, commit.Cid, uri); err != nil {
-					log.Printf("CID verification failed for %s: %v (skipping)", uri, err)
-					return
-				}
-			}
-
 			firehoseEvent := &FirehoseEvent{
 				Repo:       event.Did,
 				Collection: commit.Collection,
@@ -216,24 +330,21 @@ func (i *Ingester) handleCommit(event JetstreamEvent) {
 				CID:        commit.Cid,
 			}
 
-			i.dispatchToHandler(firehoseEvent)
+			i.indexRecord(tx, firehoseEvent)
 
 			go i.triggerLazySync(event.Did)
 		}
 	case "delete":
-		i.handleDelete(commit.Collection, uri)
-	}
-}
-
-func (i *Ingester) dispatchToHandler(event *FirehoseEvent) {
-	if handler, ok := i.handlers[event.Collection]; ok {
-		handler(event)
+		i.handleDelete(tx, commit.Collection, uri)
 	}
 }
 
 var lastSyncAttempts sync.Map
 
 func (i *Ingester) triggerLazySync(did string) {
+	if i.sync == nil {
+		return
+	}
 	lastSync, ok := lastSyncAttempts.Load(did)
 	if ok {
 		if time.Since(lastSync.(time.Time)) < 5*time.Minute {
@@ -242,53 +353,25 @@ func (i *Ingester) triggerLazySync(did string) {
 	}
 	lastSyncAttempts.Store(did, time.Now())
 
-	pds, err := xrpc.ResolveDIDToPDS(did)
-	if err != nil || pds == "" {
-		return
+	if err := i.sync.Enqueue(did); err != nil {
+		log.Printf("Failed to queue sync for active user %s: %v", did, err)
 	}
+}
 
-	_, err = i.sync.PerformSync(context.Background(), did, func(ctx context.Context, _ string) (*xrpc.Client, error) {
-		return &xrpc.Client{
-			PDS: pds,
-		}, nil
-	})
-
-	if err == nil {
-		log.Printf("Auto-synced repo for active user: %s", did)
+// handleDelete removes a record from the index. A failed delete is recorded
+// in ingest_failures and retried like a failed index.
+func (i *Ingester) handleDelete(tx *db.DB, collection, uri string) {
+	if err := tryDelete(tx, collection, uri); err != nil {
+		log.Printf("Failed to delete %s: %v", uri, err)
+		event := &FirehoseEvent{Collection: collection, Operation: "delete"}
+		i.recordFailure(tx, event, uri, db.IngestFailureDatabase, err)
+		return
 	}
+	tx.ClearIngestFailure(uri)
 }
 
-func (i *Ingester) handleDelete(collection, uri string) {
-	switch collection {
-	case CollectionAnnotation:
-		i.db.DeleteAnnotation(uri)
-	case CollectionHighlight:
-		i.db.DeleteHighlight(uri)
-	case CollectionBookmark:
-		i.db.DeleteBookmark(uri)
-	case CollectionReply:
-		i.db.DeleteReply(uri)
-	case CollectionLike:
-		i.db.DeleteLike(uri)
-	case CollectionCollection:
-		i.db.DeleteCollection(uri)
-	case CollectionCollectionItem:
-		i.db.RemoveFromCollection(uri)
-	case CollectionProfile:
-		i.db.DeleteProfile(uri)
-	case CollectionAPIKey:
-		i.db.DeleteAPIKeyByURI(uri)
-	case CollectionPreferences:
-		i.db.DeletePreferences(uri)
-	case CollectionSembleCard:
-		i.db.DeleteAnnotation(uri)
-		i.db.DeleteBookmark(uri)
-	case CollectionSembleCollection:
-		i.db.DeleteCollection(uri)
-	case xrpc.CollectionSembleCollectionLink:
-		i.db.RemoveFromCollection(uri)
-
-	}
+func tryDelete(tx *db.DB, collection, uri string) error {
+	return tx.Isolate(func() error { return records.Delete(tx, collection, uri) })
 }
 
 func (i *Ingester) getLastCursor() int64 {
@@ -308,716 +391,18 @@ type FirehoseEvent struct {
 	Operation  string          `json:"operation"`
 	Cursor     int64           `json:"cursor"`
 	CID        string          `json:"cid"`
-}
-
-func (i *Ingester) handleAnnotation(event *FirehoseEvent) {
-	var record struct {
-		Motivation string `json:"motivation"`
-		Body       struct {
-			Value  string `json:"value"`
-			Format string `json:"format"`
-			URI    string `json:"uri"`
-		} `json:"body"`
-		Target struct {
-			Source     string          `json:"source"`
-			SourceHash string          `json:"sourceHash"`
-			Title      string          `json:"title"`
-			Selector   json.RawMessage `json:"selector"`
-		} `json:"target"`
-		Tags      []string `json:"tags"`
-		CreatedAt string   `json:"createdAt"`
-
-		URL     string `json:"url"`
-		URLHash string `json:"urlHash"`
-		Text    string `json:"text"`
-		Quote   string `json:"quote"`
-		Title   string `json:"title"`
-	}
-
-	if err := json.Unmarshal(event.Record, &record); err != nil {
-		return
-	}
-
-	uri := fmt.Sprintf("at://%s/%s/%s", event.Repo, event.Collection, event.Rkey)
-
-	createdAt, err := time.Parse(time.RFC3339, record.CreatedAt)
-	if err != nil {
-		createdAt = time.Now()
-	}
-
-	targetSource := record.Target.Source
-	if targetSource == "" {
-		targetSource = record.URL
-	}
-
-	var targetHash string
-	if targetSource != "" {
-		targetHash = db.HashURL(targetSource)
-	}
-
-	bodyValue := record.Body.Value
-	if bodyValue == "" {
-		bodyValue = record.Text
-	}
-
-	targetTitle := record.Target.Title
-	if targetTitle == "" {
-		targetTitle = record.Title
-	}
 
-	motivation := record.Motivation
-	if motivation == "" {
-		motivation = "commenting"
-	}
-
-	var bodyValuePtr, bodyFormatPtr, bodyURIPtr, targetTitlePtr, selectorJSONPtr, tagsJSONPtr *string
-	if bodyValue != "" {
-		bodyValuePtr = &bodyValue
-	}
-	if record.Body.Format != "" {
-		bodyFormatPtr = &record.Body.Format
-	}
-	if record.Body.URI != "" {
-		bodyURIPtr = &record.Body.URI
-	}
-	if targetTitle != "" {
-		targetTitlePtr = &targetTitle
-	}
-	if len(record.Target.Selector) > 0 && string(record.Target.Selector) != "null" {
-		selectorStr := string(record.Target.Selector)
-		selectorJSONPtr = &selectorStr
-	}
-	if len(record.Tags) > 0 {
-		tagsBytes, _ := json.Marshal(record.Tags)
-		tagsStr := string(tagsBytes)
-		tagsJSONPtr = &tagsStr
-	}
-
-	annotation := &db.Annotation{
-		URI:          uri,
-		AuthorDID:    event.Repo,
-		Motivation:   motivation,
-		BodyValue:    bodyValuePtr,
-		BodyFormat:   bodyFormatPtr,
-		BodyURI:      bodyURIPtr,
-		TargetSource: targetSource,
-		TargetHash:   targetHash,
-		TargetTitle:  targetTitlePtr,
-		SelectorJSON: selectorJSONPtr,
-		TagsJSON:     tagsJSONPtr,
-		CreatedAt:    createdAt,
-		IndexedAt:    time.Now(),
-	}
-
-	if err := i.db.CreateAnnotation(annotation); err != nil {
-		log.Printf("Failed to index annotation: %v", err)
-	} else {
-		log.Printf("Indexed annotation from %s on %s", event.Repo, targetSource)
-	}
-}
-
-func (i *Ingester) handleReply(event *FirehoseEvent) {
-	var record struct {
-		Parent struct {
-			URI string `json:"uri"`
-		} `json:"parent"`
-		Root struct {
-			URI string `json:"uri"`
-		} `json:"root"`
-		Text      string `json:"text"`
-		CreatedAt string `json:"createdAt"`
-	}
-
-	if err := json.Unmarshal(event.Record, &record); err != nil {
-		return
-	}
-
-	uri := fmt.Sprintf("at://%s/%s/%s", event.Repo, event.Collection, event.Rkey)
-
-	createdAt, err := time.Parse(time.RFC3339, record.CreatedAt)
-	if err != nil {
-		createdAt = time.Now()
-	}
-
-	reply := &db.Reply{
-		URI:       uri,
-		AuthorDID: event.Repo,
-		ParentURI: record.Parent.URI,
-		RootURI:   record.Root.URI,
-		Text:      record.Text,
-		CreatedAt: createdAt,
-		IndexedAt: time.Now(),
-	}
-
-	i.db.CreateReply(reply)
-}
-
-func (i *Ingester) handleLike(event *FirehoseEvent) {
-	var record struct {
-		Subject struct {
-			URI string `json:"uri"`
-		} `json:"subject"`
-		CreatedAt string `json:"createdAt"`
-	}
-
-	if err := json.Unmarshal(event.Record, &record); err != nil {
-		return
-	}
-
-	uri := fmt.Sprintf("at://%s/%s/%s", event.Repo, event.Collection, event.Rkey)
-
-	createdAt, err := time.Parse(time.RFC3339, record.CreatedAt)
-	if err != nil {
-		createdAt = time.Now()
-	}
-
-	like := &db.Like{
-		URI:        uri,
-		AuthorDID:  event.Repo,
-		SubjectURI: record.Subject.URI,
-		CreatedAt:  createdAt,
-		IndexedAt:  time.Now(),
-	}
-
-	i.db.CreateLike(like)
-}
-
-func (i *Ingester) handleHighlight(event *FirehoseEvent) {
-	var record struct {
-		Target struct {
-			Source     string          `json:"source"`
-			SourceHash string          `json:"sourceHash"`
-			Title      string          `json:"title"`
-			Selector   json.RawMessage `json:"selector"`
-		} `json:"target"`
-		Color     string   `json:"color"`
-		Tags      []string `json:"tags"`
-		CreatedAt string   `json:"createdAt"`
-	}
-
-	if err := json.Unmarshal(event.Record, &record); err != nil {
-		return
-	}
-
-	uri := fmt.Sprintf("at://%s/%s/%s", event.Repo, event.Collection, event.Rkey)
-
-	createdAt, err := time.Parse(time.RFC3339, record.CreatedAt)
-	if err != nil {
-		createdAt = time.Now()
-	}
-
-	var targetHash string
-	if record.Target.Source != "" {
-		targetHash = db.HashURL(record.Target.Source)
-	}
-
-	var titlePtr, selectorJSONPtr, colorPtr, tagsJSONPtr *string
-	if record.Target.Title != "" {
-		titlePtr = &record.Target.Title
-	}
-	if len(record.Target.Selector) > 0 && string(record.Target.Selector) != "null" {
-		selectorStr := string(record.Target.Selector)
-		selectorJSONPtr = &selectorStr
-	}
-	if record.Color != "" {
-		colorPtr = &record.Color
-	}
-	if len(record.Tags) > 0 {
-		tagsBytes, _ := json.Marshal(record.Tags)
-		tagsStr := string(tagsBytes)
-		tagsJSONPtr = &tagsStr
-	}
-
-	highlight := &db.Highlight{
-		URI:          uri,
-		AuthorDID:    event.Repo,
-		TargetSource: record.Target.Source,
-		TargetHash:   targetHash,
-		TargetTitle:  titlePtr,
-		SelectorJSON: selectorJSONPtr,
-		Color:        colorPtr,
-		TagsJSON:     tagsJSONPtr,
-		CreatedAt:    createdAt,
-		IndexedAt:    time.Now(),
-	}
-
-	if err := i.db.CreateHighlight(highlight); err != nil {
-		log.Printf("Failed to index highlight: %v", err)
-	} else {
-		log.Printf("Indexed highlight from %s on %s", event.Repo, record.Target.Source)
-	}
+	// frame is the relay commit a commit failure came from, as stored in
+	// ingest_failures.
+	frame string
 }
 
-func (i *Ingester) handleBookmark(event *FirehoseEvent) {
-	var record struct {
-		Source      string   `json:"source"`
-		SourceHash  string   `json:"sourceHash"`
-		Title       string   `json:"title"`
-		Description string   `json:"description"`
-		Tags        []string `json:"tags"`
-		CreatedAt   string   `json:"createdAt"`
-	}
-
-	if err := json.Unmarshal(event.Record, &record); err != nil {
-		return
-	}
-
-	uri := fmt.Sprintf("at://%s/%s/%s", event.Repo, event.Collection, event.Rkey)
-
-	createdAt, err := time.Parse(time.RFC3339, record.CreatedAt)
-	if err != nil {
-		createdAt = time.Now()
-	}
-
-	var sourceHash string
-	if record.Source != "" {
-		sourceHash = db.HashURL(record.Source)
-	}
-
-	var titlePtr, descPtr, tagsJSONPtr *string
-	if record.Title != "" {
-		titlePtr = &record.Title
-	}
-	if record.Description != "" {
-		descPtr = &record.Description
-	}
-	if len(record.Tags) > 0 {
-		tagsBytes, _ := json.Marshal(record.Tags)
-		tagsStr := string(tagsBytes)
-		tagsJSONPtr = &tagsStr
-	}
-
-	bookmark := &db.Bookmark{
-		URI:         uri,
-		AuthorDID:   event.Repo,
-		Source:      record.Source,
-		SourceHash:  sourceHash,
-		Title:       titlePtr,
-		Description: descPtr,
-		TagsJSON:    tagsJSONPtr,
-		CreatedAt:   createdAt,
-		IndexedAt:   time.Now(),
-	}
-
-	if err := i.db.CreateBookmark(bookmark); err != nil {
-		log.Printf("Failed to index bookmark: %v", err)
-	} else {
-		log.Printf("Indexed bookmark from %s: %s", event.Repo, record.Source)
-	}
-}
-
-func (i *Ingester) handleCollection(event *FirehoseEvent) {
-	var record struct {
-		Name        string `json:"name"`
-		Description string `json:"description"`
-		Icon        string `json:"icon"`
-		CreatedAt   string `json:"createdAt"`
-	}
-
-	if err := json.Unmarshal(event.Record, &record); err != nil {
-		return
-	}
-
-	uri := fmt.Sprintf("at://%s/%s/%s", event.Repo, event.Collection, event.Rkey)
-
-	createdAt, err := time.Parse(time.RFC3339, record.CreatedAt)
-	if err != nil {
-		createdAt = time.Now()
-	}
-
-	var descPtr, iconPtr *string
-	if record.Description != "" {
-		descPtr = &record.Description
-	}
-	if record.Icon != "" {
-		iconPtr = &record.Icon
-	}
-
-	collection := &db.Collection{
-		URI:         uri,
-		AuthorDID:   event.Repo,
-		Name:        record.Name,
-		Description: descPtr,
-		Icon:        iconPtr,
-		CreatedAt:   createdAt,
-		IndexedAt:   time.Now(),
-	}
-
-	if err := i.db.CreateCollection(collection); err != nil {
-		log.Printf("Failed to index collection: %v", err)
-	} else {
-		log.Printf("Indexed collection from %s: %s", event.Repo, record.Name)
-	}
-}
-
-func (i *Ingester) handleCollectionItem(event *FirehoseEvent) {
-	var record struct {
-		Collection string `json:"collection"`
-		Annotation string `json:"annotation"`
-		Position   int    `json:"position"`
-		CreatedAt  string `json:"createdAt"`
-	}
-
-	if err := json.Unmarshal(event.Record, &record); err != nil {
-		return
-	}
-
-	uri := fmt.Sprintf("at://%s/%s/%s", event.Repo, event.Collection, event.Rkey)
-
-	createdAt, err := time.Parse(time.RFC3339, record.CreatedAt)
-	if err != nil {
-		createdAt = time.Now()
-	}
-
-	item := &db.CollectionItem{
-		URI:           uri,
-		AuthorDID:     event.Repo,
-		CollectionURI: record.Collection,
-		AnnotationURI: record.Annotation,
-		Position:      record.Position,
-		CreatedAt:     createdAt,
-		IndexedAt:     time.Now(),
-	}
-
-	if err := i.db.AddToCollection(item); err != nil {
-		log.Printf("Failed to index collection item: %v", err)
-	} else {
-		log.Printf("Indexed collection item from %s", event.Repo)
-	}
-}
-
-func (i *Ingester) handleProfile(event *FirehoseEvent) {
-	if event.Rkey != "self" {
-		return
-	}
-
-	var record struct {
-		DisplayName string   `json:"displayName"`
-		Bio         string   `json:"bio"`
-		Website     string   `json:"website"`
-		Links       []string `json:"links"`
-		CreatedAt   string   `json:"createdAt"`
-	}
-
-	if err := json.Unmarshal(event.Record, &record); err != nil {
-		return
-	}
-
-	uri := fmt.Sprintf("at://%s/%s/%s", event.Repo, event.Collection, event.Rkey)
-
-	createdAt, err := time.Parse(time.RFC3339, record.CreatedAt)
-	if err != nil {
-		createdAt = time.Now()
-	}
-
-	var displayNamePtr, bioPtr, websitePtr, linksJSONPtr *string
-	if record.DisplayName != "" {
-		displayNamePtr = &record.DisplayName
-	}
-	if record.Bio != "" {
-		bioPtr = &record.Bio
-	}
-	if record.Website != "" {
-		websitePtr = &record.Website
-	}
-	if len(record.Links) > 0 {
-		linksBytes, _ := json.Marshal(record.Links)
-		linksStr := string(linksBytes)
-		linksJSONPtr = &linksStr
-	}
-
-	profile := &db.Profile{
-		URI:         uri,
-		AuthorDID:   event.Repo,
-		DisplayName: displayNamePtr,
-		Bio:         bioPtr,
-		Website:     websitePtr,
-		LinksJSON:   linksJSONPtr,
-		CreatedAt:   createdAt,
-		IndexedAt:   time.Now(),
-	}
-
-	if err := i.db.UpsertProfile(profile); err != nil {
-		log.Printf("Failed to index profile: %v", err)
-	} else {
-		log.Printf("Indexed profile from %s", event.Repo)
-	}
-}
-
-func (i *Ingester) handleAPIKey(event *FirehoseEvent) {
-	var record struct {
-		Name      string `json:"name"`
-		KeyHash   string `json:"keyHash"`
-		CreatedAt string `json:"createdAt"`
-	}
-
-	if err := json.Unmarshal(event.Record, &record); err != nil {
-		return
-	}
-
-	uri := fmt.Sprintf("at://%s/%s/%s", event.Repo, event.Collection, event.Rkey)
-
-	createdAt, err := time.Parse(time.RFC3339, record.CreatedAt)
-	if err != nil {
-		createdAt = time.Now()
-	}
-
-	var cidPtr *string
-	if event.CID != "" {
-		cidPtr = &event.CID
-	}
-
-	apiKey := &db.APIKey{
-		ID:        event.Rkey,
-		OwnerDID:  event.Repo,
-		Name:      record.Name,
-		KeyHash:   record.KeyHash,
-		CreatedAt: createdAt,
-		URI:       uri,
-		CID:       cidPtr,
-		IndexedAt: time.Now(),
-	}
-
-	if err := i.db.CreateAPIKey(apiKey); err != nil {
-		log.Printf("Failed to index API key: %v", err)
-	} else {
-		log.Printf("Indexed API key from %s: %s", event.Repo, record.Name)
-	}
-}
-
-func (i *Ingester) handlePreferences(event *FirehoseEvent) {
-	if event.Rkey != "self" {
-		return
-	}
-
-	var record struct {
-		ExternalLinkSkippedHostnames []string        `json:"externalLinkSkippedHostnames"`
-		SubscribedLabelers           json.RawMessage `json:"subscribedLabelers"`
-		LabelPreferences             json.RawMessage `json:"labelPreferences"`
-		CreatedAt                    string          `json:"createdAt"`
-	}
-
-	if err := json.Unmarshal(event.Record, &record); err != nil {
-		return
-	}
-
-	uri := fmt.Sprintf("at://%s/%s/%s", event.Repo, event.Collection, event.Rkey)
-
-	createdAt, err := time.Parse(time.RFC3339, record.CreatedAt)
-	if err != nil {
-		createdAt = time.Now()
-	}
-
-	var cidPtr *string
-	if event.CID != "" {
-		cidPtr = &event.CID
-	}
-
-	var skippedHostnamesPtr *string
-	if len(record.ExternalLinkSkippedHostnames) > 0 {
-		hostnamesBytes, _ := json.Marshal(record.ExternalLinkSkippedHostnames)
-		hostnamesStr := string(hostnamesBytes)
-		skippedHostnamesPtr = &hostnamesStr
-	}
-
-	var subscribedLabelersPtr *string
-	if len(record.SubscribedLabelers) > 0 && string(record.SubscribedLabelers) != "null" {
-		s := string(record.SubscribedLabelers)
-		subscribedLabelersPtr = &s
-	}
-
-	var labelPrefsPtr *string
-	if len(record.LabelPreferences) > 0 && string(record.LabelPreferences) != "null" {
-		s := string(record.LabelPreferences)
-		labelPrefsPtr = &s
-	}
-
-	prefs := &db.Preferences{
-		URI:                          uri,
-		AuthorDID:                    event.Repo,
-		ExternalLinkSkippedHostnames: skippedHostnamesPtr,
-		SubscribedLabelers:           subscribedLabelersPtr,
-		LabelPreferences:             labelPrefsPtr,
-		CreatedAt:                    createdAt,
-		IndexedAt:                    time.Now(),
-		CID:                          cidPtr,
-	}
-
-	if err := i.db.UpsertPreferences(prefs); err != nil {
-		log.Printf("Failed to index preferences: %v", err)
-	} else {
-		log.Printf("Indexed preferences from %s", event.Repo)
-	}
-}
-
-func (i *Ingester) handleSembleCard(event *FirehoseEvent) {
-	var card xrpc.SembleCard
-	if err := json.Unmarshal(event.Record, &card); err != nil {
-		return
-	}
-
-	uri := fmt.Sprintf("at://%s/%s/%s", event.Repo, event.Collection, event.Rkey)
-	createdAt := card.GetCreatedAtTime()
-
-	content, err := card.ParseContent()
-	if err != nil {
-		return
-	}
-
-	switch card.Type {
-	case "NOTE":
-		note, ok := content.(*xrpc.SembleNoteContent)
-		if !ok {
-			return
-		}
-
-		targetSource := card.URL
-		if targetSource == "" {
-			return
-		}
-
-		targetHash := db.HashURL(targetSource)
-		motivation := "commenting"
-		bodyValue := note.Text
-
-		var selectorJSONPtr *string
-
-		if strings.HasPrefix(bodyValue, "\"") && strings.Contains(bodyValue, "\"\n") {
-			parts := strings.SplitN(bodyValue, "\"\n", 2)
-			if len(parts) == 2 {
-				quoteText := strings.TrimPrefix(parts[0], "\"")
-				noteText := parts[1]
-
-				bodyValue = noteText
-				motivation = "highlighting"
-
-				selector := xrpc.TextQuoteSelector{
-					Type:  xrpc.SelectorTypeQuote,
-					Exact: quoteText,
-				}
-				selectorBytes, _ := json.Marshal(selector)
-				selectorStr := string(selectorBytes)
-				selectorJSONPtr = &selectorStr
-			}
-		}
-
-		annotation := &db.Annotation{
-			URI:          uri,
-			AuthorDID:    event.Repo,
-			Motivation:   motivation,
-			BodyValue:    &bodyValue,
-			TargetSource: targetSource,
-			TargetHash:   targetHash,
-			SelectorJSON: selectorJSONPtr,
-			CreatedAt:    createdAt,
-			IndexedAt:    time.Now(),
-		}
-		if err := i.db.CreateAnnotation(annotation); err != nil {
-			log.Printf("Failed to index Semble NOTE as annotation: %v", err)
-		} else {
-			if card.ParentCard != nil {
-				log.Printf("Indexed Semble NOTE from %s on %s (Parent: %s)", event.Repo, targetSource, card.ParentCard.URI)
-			} else {
-				log.Printf("Indexed Semble NOTE from %s on %s", event.Repo, targetSource)
-			}
-		}
-
-	case "URL":
-		urlContent, ok := content.(*xrpc.SembleURLContent)
-		if !ok {
-			return
-		}
-
-		source := urlContent.URL
-		if source == "" {
-			return
-		}
-		sourceHash := db.HashURL(source)
-
-		var titlePtr *string
-		if urlContent.Metadata != nil && urlContent.Metadata.Title != "" {
-			t := urlContent.Metadata.Title
-			titlePtr = &t
-		}
-
-		bookmark := &db.Bookmark{
-			URI:        uri,
-			AuthorDID:  event.Repo,
-			Source:     source,
-			SourceHash: sourceHash,
-			Title:      titlePtr,
-			CreatedAt:  createdAt,
-			IndexedAt:  time.Now(),
-		}
-		if err := i.db.CreateBookmark(bookmark); err != nil {
-			log.Printf("Failed to index Semble URL as bookmark: %v", err)
-		} else {
-			log.Printf("Indexed Semble URL from %s: %s", event.Repo, source)
-		}
-	}
-}
-
-func (i *Ingester) handleSembleCollection(event *FirehoseEvent) {
-	var record xrpc.SembleCollection
-	if err := json.Unmarshal(event.Record, &record); err != nil {
-		return
-	}
-
-	uri := fmt.Sprintf("at://%s/%s/%s", event.Repo, event.Collection, event.Rkey)
-	createdAt, err := time.Parse(time.RFC3339, record.CreatedAt)
-	if err != nil {
-		createdAt = time.Now()
-	}
-
-	var descPtr, iconPtr *string
-	if record.Description != "" {
-		descPtr = &record.Description
-	}
-	icon := "icon:semble"
-	iconPtr = &icon
-
-	collection := &db.Collection{
-		URI:         uri,
-		AuthorDID:   event.Repo,
-		Name:        record.Name,
-		Description: descPtr,
-		Icon:        iconPtr,
-		CreatedAt:   createdAt,
-		IndexedAt:   time.Now(),
-	}
-
-	if err := i.db.CreateCollection(collection); err != nil {
-		log.Printf("Failed to index Semble collection: %v", err)
-	} else {
-		log.Printf("Indexed Semble collection from %s: %s", event.Repo, record.Name)
-	}
-}
-
-func (i *Ingester) handleSembleCollectionLink(event *FirehoseEvent) {
-	var record xrpc.SembleCollectionLink
-	if err := json.Unmarshal(event.Record, &record); err != nil {
-		return
-	}
-
-	uri := fmt.Sprintf("at://%s/%s/%s", event.Repo, event.Collection, event.Rkey)
-	createdAt, err := time.Parse(time.RFC3339, record.CreatedAt)
-	if err != nil {
-		createdAt = time.Now()
-	}
-
-	item := &db.CollectionItem{
-		URI:           uri,
-		AuthorDID:     event.Repo,
-		CollectionURI: record.Collection.URI,
-		AnnotationURI: record.Card.URI,
-		Position:      0,
-		CreatedAt:     createdAt,
-		IndexedAt:     time.Now(),
-	}
-
-	if err := i.db.AddToCollection(item); err != nil {
-		log.Printf("Failed to index Semble collection link: %v", err)
-	} else {
-		log.Printf("Indexed Semble collection link from %s", event.Repo)
+// handleRecord indexes a record of any collection in the registry.
+func (i *Ingester) handleRecord(tx *db.DB, event *FirehoseEvent) error {
+	ref := records.Ref{DID: event.Repo, Collection: event.Collection, Rkey: event.Rkey, CID: event.CID}
+	if err := records.Index(tx, ref, event.Record); err != nil {
+		return err
 	}
+	log.Printf("Indexed %s", ref.URI())
+	return nil
 }
@@ -0,0 +1,346 @@
+package firehose
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"margin.at/internal/db"
+)
+
+// metrics is published at /debug/vars under "firehose".
+var metrics = expvar.NewMap("firehose")
+
+// livePool is the pool of the current connection, read by the metrics.
+var livePool atomic.Pointer[shardedPool]
+
+func init() {
+	metrics.Set("queue_depth", expvar.Func(func() any {
+		if p := livePool.Load(); p != nil {
+			return p.queueDepth()
+		}
+		return 0
+	}))
+	metrics.Set("in_flight", expvar.Func(func() any {
+		if p := livePool.Load(); p != nil {
+			return p.marks.pendingCount()
+		}
+		return 0
+	}))
+	metrics.Set("lag_seconds", expvar.Func(func() any {
+		if p := livePool.Load(); p != nil {
+			return p.marks.lag().Seconds()
+		}
+		return 0
+	}))
+}
+
+// A batch that finds the database busy is retried batchBusyRetries times,
+// waiting batchBusyBackoff and doubling between attempts.
+const (
+	batchBusyRetries = 5
+	batchBusyBackoff = 100 * time.Millisecond
+)
+
+type queuedEvent struct {
+	seq   uint64
+	event JetstreamEvent
+}
+
+type shardedPool struct {
+	ingester *Ingester
+	cursorID string
+	queues   []chan queuedEvent
+	marks    *watermark
+	wg       sync.WaitGroup
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	err      error
+
+	// When the last event was read, and its time_us, for the stall
+	// watchdog and relay health.
+	lastRead   atomic.Int64
+	lastTimeUS atomic.Int64
+}
+
+func newShardedPool(i *Ingester, cursorID string, workers, queueSize int) *shardedPool {
+	if workers < 1 {
+		workers = 1
+	}
+	p := &shardedPool{
+		ingester: i,
+		cursorID: cursorID,
+		queues:   make([]chan queuedEvent, workers),
+		marks:    &watermark{},
+		stop:     make(chan struct{}),
+	}
+	p.lastRead.Store(time.Now().UnixNano())
+	for n := range p.queues {
+		p.queues[n] = make(chan queuedEvent, queueSize)
+		p.wg.Add(1)
+		go p.work(p.queues[n])
+	}
+	livePool.Store(p)
+	return p
+}
+
+// submit hands event to the worker owning its repo, blocking while that
+// worker's queue is full. cursor is the stream position to resume after it.
+func (p *shardedPool) submit(ctx context.Context, event JetstreamEvent, cursor int64) error {
+	p.observe(event.Time)
+	item := queuedEvent{seq: p.marks.add(cursor, event.Time), event: event}
+	select {
+	case p.queues[p.shard(event.Did)] <- item:
+		return nil
+	case <-p.stop:
+		return p.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// skip records a stream position that carried nothing to apply, so the
+// cursor can still move past it.
+func (p *shardedPool) skip(cursor, timeUS int64) {
+	p.observe(timeUS)
+	p.marks.skip(cursor, timeUS)
+}
+
+func (p *shardedPool) observe(timeUS int64) {
+	p.lastRead.Store(time.Now().UnixNano())
+	if timeUS > 0 {
+		p.lastTimeUS.Store(timeUS)
+	}
+}
+
+// idle is how long ago the last event was read.
+func (p *shardedPool) idle() time.Duration {
+	return time.Since(time.Unix(0, p.lastRead.Load()))
+}
+
+func (p *shardedPool) shard(did string) int {
+	h := fnv.New32a()
+	h.Write([]byte(did))
+	return int(h.Sum32() % uint32(len(p.queues)))
+}
+
+// close waits for the workers to apply what they have queued and stores the
+// final cursor. It returns the error that stopped a worker, if any.
+func (p *shardedPool) close() error {
+	for _, q := range p.queues {
+		close(q)
+	}
+	p.wg.Wait()
+	livePool.CompareAndSwap(p, nil)
+
+	if cursor := p.marks.appliedCursor(); cursor > 0 {
+		if err := p.ingester.db.AdvanceCursor(p.cursorID, cursor); err != nil {
+			log.Printf("Failed to save firehose cursor: %v", err)
+		}
+	}
+	return p.err
+}
+
+func (p *shardedPool) fail(err error) {
+	p.stopOnce.Do(func() {
+		p.err = err
+		close(p.stop)
+	})
+}
+
+func (p *shardedPool) queueDepth() int {
+	depth := 0
+	for _, q := range p.queues {
+		depth += len(q)
+	}
+	return depth
+}
+
+func (p *shardedPool) work(queue chan queuedEvent) {
+	defer p.wg.Done()
+
+	cfg := &p.ingester.cfg
+	ticker := time.NewTicker(cfg.BatchInterval)
+	defer ticker.Stop()
+
+	var batch []queuedEvent
+	for {
+		select {
+		case item, ok := <-queue:
+			if !ok {
+				if err := p.apply(batch); err != nil {
+					p.fail(err)
+				}
+				return
+			}
+			if rc := item.event.relayCommit; rc != nil {
+				p.ingester.verifyRelayCommit(rc)
+			}
+			batch = append(batch, item)
+			if len(batch) < cfg.BatchSize {
+				continue
+			}
+		case <-ticker.C:
+		}
+
+		if err := p.apply(batch); err != nil {
+			p.fail(err)
+			return
+		}
+		batch = batch[:0]
+	}
+}
+
+// apply writes a batch of one worker's events in a single transaction. The
+// cursor saved with it only moves past events every worker has committed, so
+// reconnecting after a failure replays whatever is not yet stored. A batch
+// that finds SQLite locked by another worker is retried rather than failing
+// the pool.
+func (p *shardedPool) apply(batch []queuedEvent) error {
+	if len(batch) == 0 {
+		return nil
+	}
+	seqs := make([]uint64, len(batch))
+	for n, item := range batch {
+		seqs[n] = item.seq
+	}
+
+	var err error
+	for attempt := 0; ; attempt++ {
+		err = p.applyOnce(batch, seqs)
+		if !db.IsBusy(err) || attempt == batchBusyRetries {
+			break
+		}
+		metrics.Add("batch_busy_retries", 1)
+		wait := batchBusyBackoff << attempt
+		select {
+		case <-time.After(wait):
+		case <-p.stop:
+			return err
+		}
+	}
+	if err != nil {
+		metrics.Add("batch_failures", 1)
+		return fmt.Errorf("apply batch of %d events: %w", len(batch), err)
+	}
+	p.marks.done(seqs)
+	metrics.Add("batches_committed", 1)
+	metrics.Add("events_applied", int64(len(batch)))
+	return nil
+}
+
+func (p *shardedPool) applyOnce(batch []queuedEvent, seqs []uint64) error {
+	i := p.ingester
+	return i.db.Batch(func(tx *db.DB) error {
+		for _, item := range batch {
+			err := tx.Isolate(func() error {
+				i.applyEvent(tx, item.event)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if cursor := p.marks.preview(seqs); cursor > 0 {
+			return tx.AdvanceCursor(p.cursorID, cursor)
+		}
+		return nil
+	})
+}
+
+// watermark tracks events in the order they were read, so that the cursor
+// can advance to the newest event with nothing unapplied before it.
+type watermark struct {
+	mu      sync.Mutex
+	base    uint64
+	pending []mark
+	applied int64
+}
+
+type mark struct {
+	cursor int64
+	time   int64
+	done   bool
+}
+
+func (w *watermark) add(cursor, timeUS int64) uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.pending = append(w.pending, mark{cursor: cursor, time: timeUS})
+	return w.base + uint64(len(w.pending)-1)
+}
+
+func (w *watermark) skip(cursor, timeUS int64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.pending) == 0 {
+		w.applied = max(w.applied, cursor)
+		return
+	}
+	w.pending = append(w.pending, mark{cursor: cursor, time: timeUS, done: true})
+}
+
+// preview returns the cursor the watermark would reach once seqs are done,
+// or 0 if it would not move.
+func (w *watermark) preview(seqs []uint64) int64 {
+	ours := make(map[uint64]bool, len(seqs))
+	for _, seq := range seqs {
+		ours[seq] = true
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var cursor int64
+	for n, m := range w.pending {
+		if !m.done && !ours[w.base+uint64(n)] {
+			break
+		}
+		cursor = max(cursor, m.cursor)
+	}
+	return cursor
+}
+
+func (w *watermark) done(seqs []uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, seq := range seqs {
+		if seq >= w.base {
+			w.pending[seq-w.base].done = true
+		}
+	}
+	n := 0
+	for n < len(w.pending) && w.pending[n].done {
+		w.applied = max(w.applied, w.pending[n].cursor)
+		n++
+	}
+	w.pending = w.pending[n:]
+	w.base += uint64(n)
+}
+
+func (w *watermark) appliedCursor() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.applied
+}
+
+func (w *watermark) pendingCount() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.pending)
+}
+
+// lag is how long ago the oldest unapplied event happened.
+func (w *watermark) lag() time.Duration {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.pending) == 0 || w.pending[0].time == 0 {
+		return 0
+	}
+	return time.Since(time.UnixMicro(w.pending[0].time))
+}
@@ -0,0 +1,471 @@
+package firehose
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/gorilla/websocket"
+	"github.com/ipfs/go-cid"
+	"margin.at/internal/crypto"
+	"margin.at/internal/db"
+	"margin.at/internal/repo"
+	"margin.at/internal/xrpc"
+)
+
+const (
+	SourceJetstream = "jetstream"
+	SourceRelay     = "relay"
+)
+
+type repoStreamHeader struct {
+	Op   int64  `cbor:"op"`
+	Type string `cbor:"t"`
+}
+
+type repoStreamError struct {
+	Error   string `cbor:"error"`
+	Message string `cbor:"message"`
+}
+
+type repoCommitEvent struct {
+	Seq    int64        `cbor:"seq"`
+	Repo   string       `cbor:"repo"`
+	Rev    string       `cbor:"rev"`
+	TooBig bool         `cbor:"tooBig"`
+	Commit cbor.Tag     `cbor:"commit"`
+	Blocks []byte       `cbor:"blocks"`
+	Ops    []repoOpInfo `cbor:"ops"`
+	Time   string       `cbor:"time"`
+}
+
+type repoOpInfo struct {
+	Action string    `cbor:"action"`
+	Path   string    `cbor:"path"`
+	CID    *cbor.Tag `cbor:"cid"`
+}
+
+type repoIdentityEvent struct {
+	Seq    int64   `cbor:"seq"`
+	Did    string  `cbor:"did"`
+	Time   string  `cbor:"time"`
+	Handle *string `cbor:"handle"`
+}
+
+type repoAccountEvent struct {
+	Seq    int64   `cbor:"seq"`
+	Did    string  `cbor:"did"`
+	Time   string  `cbor:"time"`
+	Active bool    `cbor:"active"`
+	Status *string `cbor:"status"`
+}
+
+type repoSyncEvent struct {
+	Seq  int64  `cbor:"seq"`
+	Did  string `cbor:"did"`
+	Time string `cbor:"time"`
+}
+
+func (i *Ingester) subscribeRepos(ctx context.Context) error {
+	cursor, err := i.db.GetCursor("relay_cursor")
+	if err != nil {
+		log.Printf("Failed to get relay cursor from DB: %v", err)
+	}
+
+	url := strings.TrimSuffix(i.cfg.RelayHost, "/") + "/xrpc/com.atproto.sync.subscribeRepos"
+	if cursor > 0 {
+		url = fmt.Sprintf("%s?cursor=%d", url, cursor)
+	}
+
+	log.Printf("Connecting to relay: %s", url)
+	return i.consume(ctx, url, "relay_cursor", i.relays[0], i.readRepoStream)
+}
+
+func (i *Ingester) readRepoStream(ctx context.Context, conn *websocket.Conn, pool *shardedPool) error {
+	for {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			return fmt.Errorf("websocket read failed: %w", err)
+		}
+		if err := i.handleRepoFrame(ctx, pool, message); err != nil {
+			return err
+		}
+	}
+}
+
+// handleRepoFrame decodes one subscribeRepos frame, a CBOR header followed by
+// a CBOR body, and hands what it carries to the pool in Jetstream's shape.
+func (i *Ingester) handleRepoFrame(ctx context.Context, pool *shardedPool, message []byte) error {
+	var header repoStreamHeader
+	body, err := cbor.UnmarshalFirst(message, &header)
+	if err != nil {
+		log.Printf("Malformed relay frame: %v", err)
+		return nil
+	}
+	if header.Op == -1 {
+		var streamErr repoStreamError
+		cbor.Unmarshal(body, &streamErr)
+		return fmt.Errorf("relay error %s: %s", streamErr.Error, streamErr.Message)
+	}
+
+	switch header.Type {
+	case "#commit":
+		var event repoCommitEvent
+		if err := cbor.Unmarshal(body, &event); err != nil {
+			log.Printf("Malformed relay commit: %v", err)
+			return nil
+		}
+		timeUS := parseEventTime(event.Time)
+		if len(i.wantedOps(&event)) == 0 {
+			pool.skip(event.Seq, timeUS)
+			return nil
+		}
+		if event.TooBig {
+			go i.triggerLazySync(event.Repo)
+			pool.skip(event.Seq, timeUS)
+			return nil
+		}
+		// Verifying may have to resolve the repo's DID document, so it is
+		// left to the repo's worker rather than holding up the stream.
+		return pool.submit(ctx, JetstreamEvent{
+			Did:         event.Repo,
+			Time:        timeUS,
+			Kind:        "commit",
+			relayCommit: &relayCommit{event: &event, frame: body},
+		}, event.Seq)
+
+	case "#identity":
+		var event repoIdentityEvent
+		if err := cbor.Unmarshal(body, &event); err != nil {
+			log.Printf("Malformed relay identity event: %v", err)
+			return nil
+		}
+		signingKeys.forget(event.Did)
+		identity := &JetstreamIdentity{Did: event.Did, Seq: event.Seq, Time: event.Time}
+		if event.Handle != nil {
+			identity.Handle = *event.Handle
+		}
+		return pool.submit(ctx, JetstreamEvent{
+			Did:      event.Did,
+			Time:     parseEventTime(event.Time),
+			Kind:     "identity",
+			Identity: identity,
+		}, event.Seq)
+
+	case "#account":
+		var event repoAccountEvent
+		if err := cbor.Unmarshal(body, &event); err != nil {
+			log.Printf("Malformed relay account event: %v", err)
+			return nil
+		}
+		account := &JetstreamAccount{Did: event.Did, Active: event.Active, Seq: event.Seq, Time: event.Time}
+		if event.Status != nil {
+			account.Status = *event.Status
+		}
+		return pool.submit(ctx, JetstreamEvent{
+			Did:     event.Did,
+			Time:    parseEventTime(event.Time),
+			Kind:    "account",
+			Account: account,
+		}, event.Seq)
+
+	case "#sync":
+		// The repo was reset to a new state without a diff; refetch it.
+		var event repoSyncEvent
+		if err := cbor.Unmarshal(body, &event); err != nil {
+			log.Printf("Malformed relay sync event: %v", err)
+			return nil
+		}
+		go i.triggerLazySync(event.Did)
+		pool.skip(event.Seq, parseEventTime(event.Time))
+
+	case "#info":
+		var info repoStreamError
+		cbor.Unmarshal(body, &info)
+		log.Printf("Relay info %s: %s", info.Error, info.Message)
+	}
+	return nil
+}
+
+// relayCommit is a subscribeRepos commit on its way to the worker of its
+// repo, which verifies it before the batch that applies it begins, so no
+// DID lookup runs with the transaction open. frame is the CBOR body of the
+// event, kept for ingest_failures if it is rejected.
+type relayCommit struct {
+	event  *repoCommitEvent
+	frame  []byte
+	events []JetstreamEvent
+	err    error
+}
+
+func (i *Ingester) verifyRelayCommit(rc *relayCommit) {
+	rc.events, rc.err = i.commitEvents(rc.event, parseEventTime(rc.event.Time))
+}
+
+// applyRelayCommit applies a verified commit, or records each of its
+// operations we handle in ingest_failures if it was rejected.
+func (i *Ingester) applyRelayCommit(tx *db.DB, rc *relayCommit) {
+	if rc.err == nil {
+		for _, event := range rc.events {
+			i.handleCommit(tx, event)
+		}
+		return
+	}
+
+	log.Printf("Rejected commit %d from %s: %v", rc.event.Seq, rc.event.Repo, rc.err)
+	car, _ := repo.ReadCAR(bytes.NewReader(rc.event.Blocks))
+	frame := base64.StdEncoding.EncodeToString(rc.frame)
+	for _, op := range i.wantedOps(rc.event) {
+		collection, rkey, _ := strings.Cut(op.Path, "/")
+		event := &FirehoseEvent{
+			Repo:       rc.event.Repo,
+			Collection: collection,
+			Rkey:       rkey,
+			Operation:  op.Action,
+			Cursor:     parseEventTime(rc.event.Time),
+			frame:      frame,
+		}
+		// The record is unverified and kept only so it can be inspected.
+		if op.CID != nil {
+			if recordCID, err := repo.ParseLink(*op.CID); err == nil {
+				event.CID = recordCID.String()
+				if car != nil {
+					if block, err := car.Block(recordCID); err == nil {
+						event.Record, _ = repo.RecordJSON(block)
+					}
+				}
+			}
+		}
+		uri := fmt.Sprintf("at://%s/%s", rc.event.Repo, op.Path)
+		i.recordFailure(tx, event, uri, db.IngestFailureCommit, rc.err)
+	}
+}
+
+// wantedOps returns the operations of a commit on collections we handle.
+func (i *Ingester) wantedOps(event *repoCommitEvent) []repoOpInfo {
+	var ops []repoOpInfo
+	for _, op := range event.Ops {
+		collection, _, _ := strings.Cut(op.Path, "/")
+		if _, ok := i.handlers[collection]; ok {
+			ops = append(ops, op)
+		}
+	}
+	return ops
+}
+
+// commitEvents verifies a commit and splits it into one event per operation
+// on a collection we handle.
+func (i *Ingester) commitEvents(event *repoCommitEvent, timeUS int64) ([]JetstreamEvent, error) {
+	car, err := repo.ReadCAR(bytes.NewReader(event.Blocks))
+	if err != nil {
+		return nil, err
+	}
+	commitCID, err := repo.ParseLink(event.Commit)
+	if err != nil {
+		return nil, fmt.Errorf("commit link: %w", err)
+	}
+	commit, err := verifyCommit(car, commitCID, event.Repo)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkOps(car, commit, event.Ops); err != nil {
+		return nil, err
+	}
+
+	var events []JetstreamEvent
+	for _, op := range i.wantedOps(event) {
+		collection, rkey, _ := strings.Cut(op.Path, "/")
+		jc := &JetstreamCommit{
+			Rev:        commit.Rev,
+			Operation:  op.Action,
+			Collection: collection,
+			Rkey:       rkey,
+		}
+		if op.Action != "delete" {
+			if op.CID == nil {
+				return nil, fmt.Errorf("%s %s has no CID", op.Action, op.Path)
+			}
+			recordCID, err := repo.ParseLink(*op.CID)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", op.Path, err)
+			}
+			block, err := car.Block(recordCID)
+			if err != nil {
+				return nil, err
+			}
+			if jc.Record, err = repo.RecordJSON(block); err != nil {
+				return nil, fmt.Errorf("%s: %w", op.Path, err)
+			}
+			jc.Cid = recordCID.String()
+		}
+		events = append(events, JetstreamEvent{
+			Did:    event.Repo,
+			Time:   timeUS,
+			Kind:   "commit",
+			Commit: jc,
+		})
+	}
+	return events, nil
+}
+
+// verifyCommit checks the commit signature, refreshing the cached key once
+// in case the repo rotated it.
+func verifyCommit(car *repo.CAR, commitCID cid.Cid, did string) (*repo.Commit, error) {
+	key, err := signingKeys.get(did)
+	if err != nil {
+		return nil, err
+	}
+	commit, err := car.LoadCommit(commitCID, did, key)
+	if !errors.Is(err, crypto.ErrInvalidSignature) {
+		return commit, err
+	}
+	signingKeys.forget(did)
+	if key, err = signingKeys.get(did); err != nil {
+		return nil, err
+	}
+	return car.LoadCommit(commitCID, did, key)
+}
+
+// checkOps checks every operation of a commit against the MST the commit
+// signs. The ops list itself is unsigned, so without this a relay could pair
+// any record with a valid commit.
+func checkOps(car *repo.CAR, commit *repo.Commit, ops []repoOpInfo) error {
+	tree, err := car.LoadTree(commit.Data)
+	if err != nil {
+		return err
+	}
+	for _, op := range ops {
+		value, inTree := tree.Entries[op.Path]
+		switch op.Action {
+		case "create", "update":
+			if op.CID == nil {
+				return fmt.Errorf("%s %s has no CID", op.Action, op.Path)
+			}
+			recordCID, err := repo.ParseLink(*op.CID)
+			if err != nil {
+				return fmt.Errorf("%s: %w", op.Path, err)
+			}
+			if !inTree || !value.Equals(recordCID) {
+				return fmt.Errorf("%s %s does not match the signed tree", op.Action, op.Path)
+			}
+		case "delete":
+			if inTree || !tree.Known(op.Path) {
+				return fmt.Errorf("delete %s is not absent from the signed tree", op.Path)
+			}
+		default:
+			return fmt.Errorf("unknown operation %q on %s", op.Action, op.Path)
+		}
+	}
+	return nil
+}
+
+func parseEventTime(value string) int64 {
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return time.Now().UnixMicro()
+	}
+	return t.UnixMicro()
+}
+
+// signingKeys caches repo signing keys resolved from DID documents. Identity
+// events evict the repo's entry, since they announce key rotations; entries
+// also expire after keyCacheTTL in case such an event was missed.
+var signingKeys = newKeyCache(maxCachedKeys, keyCacheTTL)
+
+const (
+	maxCachedKeys = 50000
+	keyCacheTTL   = 24 * time.Hour
+)
+
+// keyCache is a least-recently-used cache of signing keys, bounded in size
+// and in the age of each entry.
+type keyCache struct {
+	mu      sync.Mutex
+	max     int
+	ttl     time.Duration
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type cachedKey struct {
+	did       string
+	key       crypto.PublicKey
+	expiresAt time.Time
+}
+
+func newKeyCache(max int, ttl time.Duration) *keyCache {
+	return &keyCache{
+		max:     max,
+		ttl:     ttl,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+func (c *keyCache) get(did string) (crypto.PublicKey, error) {
+	if key, ok := c.lookup(did); ok {
+		return key, nil
+	}
+
+	encoded, err := xrpc.ResolveSigningKey(did)
+	if err != nil {
+		return nil, fmt.Errorf("resolve signing key: %w", err)
+	}
+	key, err := crypto.ParsePublicKeyMultibase(encoded)
+	if err != nil {
+		return nil, err
+	}
+	c.add(did, key)
+	return key, nil
+}
+
+func (c *keyCache) lookup(did string) (crypto.PublicKey, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[did]
+	if !ok {
+		return nil, false
+	}
+	entry := el.Value.(*cachedKey)
+	if time.Now().After(entry.expiresAt) {
+		c.order.Remove(el)
+		delete(c.entries, did)
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return entry.key, true
+}
+
+func (c *keyCache) add(did string, key crypto.PublicKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry := &cachedKey{did: did, key: key, expiresAt: time.Now().Add(c.ttl)}
+	if el, ok := c.entries[did]; ok {
+		el.Value = entry
+		c.order.MoveToFront(el)
+		return
+	}
+	c.entries[did] = c.order.PushFront(entry)
+	for c.order.Len() > c.max {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cachedKey).did)
+	}
+}
+
+func (c *keyCache) forget(did string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[did]; ok {
+		c.order.Remove(el)
+		delete(c.entries, did)
+	}
+}
@@ -0,0 +1,148 @@
+// Package lexicon validates records against the lexicon schemas under
+// lexicons/, so records from the network are held to the same limits as the
+// ones this service writes.
+package lexicon
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// rejects counts records that failed validation, by collection. It is
+// published at /debug/vars.
+var rejects = expvar.NewMap("lexicon_rejects")
+
+// Catalog holds the definitions of a set of lexicons. A nil Catalog accepts
+// every record.
+type Catalog struct {
+	defs map[string]*def
+}
+
+// def is one lexicon definition. Only the fields used in validation are
+// decoded.
+type def struct {
+	Type         string          `json:"type"`
+	Ref          string          `json:"ref"`
+	Refs         []string        `json:"refs"`
+	Closed       bool            `json:"closed"`
+	Record       *def            `json:"record"`
+	Required     []string        `json:"required"`
+	Nullable     []string        `json:"nullable"`
+	Properties   map[string]*def `json:"properties"`
+	Items        *def            `json:"items"`
+	Format       string          `json:"format"`
+	MinLength    *int            `json:"minLength"`
+	MaxLength    *int            `json:"maxLength"`
+	MinGraphemes *int            `json:"minGraphemes"`
+	MaxGraphemes *int            `json:"maxGraphemes"`
+	Minimum      *int64          `json:"minimum"`
+	Maximum      *int64          `json:"maximum"`
+	Enum         []interface{}   `json:"enum"`
+	Const        interface{}     `json:"const"`
+}
+
+type document struct {
+	Lexicon int             `json:"lexicon"`
+	ID      string          `json:"id"`
+	Defs    map[string]*def `json:"defs"`
+}
+
+// Load reads every .json lexicon under dir.
+func Load(dir string) (*Catalog, error) {
+	c := &Catalog{defs: make(map[string]*def)}
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || filepath.Ext(path) != ".json" {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var doc document
+		if err := json.Unmarshal(data, &doc); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if doc.Lexicon != 1 || doc.ID == "" {
+			return fmt.Errorf("%s: not a lexicon", path)
+		}
+		for name, d := range doc.Defs {
+			c.defs[doc.ID+"#"+name] = d
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Records lists the collections with a record lexicon.
+func (c *Catalog) Records() []string {
+	var nsids []string
+	if c == nil {
+		return nsids
+	}
+	for key, d := range c.defs {
+		if nsid, ok := strings.CutSuffix(key, "#main"); ok && d.Type == "record" {
+			nsids = append(nsids, nsid)
+		}
+	}
+	return nsids
+}
+
+// ValidationError describes why a record does not match its lexicon.
+type ValidationError struct {
+	Collection string
+	Path       string
+	Message    string
+}
+
+func (e *ValidationError) Error() string {
+	if e.Path == "" {
+		return fmt.Sprintf("invalid %s record: %s", e.Collection, e.Message)
+	}
+	return fmt.Sprintf("invalid %s record: %s: %s", e.Collection, e.Path, e.Message)
+}
+
+// ValidateRecord checks record against the lexicon of collection. Records of
+// collections without a lexicon in the catalog are accepted.
+func (c *Catalog) ValidateRecord(collection string, record json.RawMessage) error {
+	if c == nil {
+		return nil
+	}
+	main, ok := c.defs[collection+"#main"]
+	if !ok || main.Type != "record" || main.Record == nil {
+		return nil
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(record))
+	dec.UseNumber()
+	var value interface{}
+	if err := dec.Decode(&value); err != nil {
+		return err
+	}
+
+	v := &validator{catalog: c, collection: collection}
+	if obj, ok := value.(map[string]interface{}); ok {
+		if t, ok := obj["$type"].(string); ok && t != collection {
+			v.fail("$type", "expected %s, got %s", collection, t)
+		}
+	}
+	if v.err == nil {
+		v.validate(collection, main.Record, value, "")
+	}
+	if v.err != nil {
+		rejects.Add(collection, 1)
+		return v.err
+	}
+	return nil
+}
@@ -0,0 +1,342 @@
+package lexicon
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/ipfs/go-cid"
+)
+
+// validator walks a decoded record, stopping at the first violation.
+type validator struct {
+	catalog    *Catalog
+	collection string
+	err        *ValidationError
+}
+
+func (v *validator) fail(path, format string, args ...interface{}) {
+	if v.err == nil {
+		v.err = &ValidationError{Collection: v.collection, Path: path, Message: fmt.Sprintf(format, args...)}
+	}
+}
+
+// resolve finds the definition ref points to, relative to the lexicon nsid,
+// and returns it with its full name and the lexicon it belongs to.
+func (v *validator) resolve(nsid, ref string) (key, owner string, d *def) {
+	key = qualify(nsid, ref)
+	owner, _, _ = strings.Cut(key, "#")
+	return key, owner, v.catalog.defs[key]
+}
+
+// qualify turns a ref into nsid#name form.
+func qualify(nsid, ref string) string {
+	if strings.HasPrefix(ref, "#") {
+		return nsid + ref
+	}
+	if !strings.Contains(ref, "#") {
+		return ref + "#main"
+	}
+	return ref
+}
+
+func (v *validator) validate(nsid string, d *def, value interface{}, path string) {
+	if v.err != nil {
+		return
+	}
+	switch d.Type {
+	case "object":
+		v.validateObject(nsid, d, value, path)
+	case "ref":
+		_, owner, target := v.resolve(nsid, d.Ref)
+		// References to lexicons we do not have, such as
+		// com.atproto.label.defs, cannot be checked.
+		if target != nil {
+			v.validate(owner, target, value, path)
+		}
+	case "union":
+		v.validateUnion(nsid, d, value, path)
+	case "array":
+		items, ok := value.([]interface{})
+		if !ok {
+			v.fail(path, "expected an array")
+			return
+		}
+		if d.MaxLength != nil && len(items) > *d.MaxLength {
+			v.fail(path, "more than %d items", *d.MaxLength)
+		}
+		if d.MinLength != nil && len(items) < *d.MinLength {
+			v.fail(path, "fewer than %d items", *d.MinLength)
+		}
+		if d.Items != nil {
+			for n, item := range items {
+				v.validate(nsid, d.Items, item, fmt.Sprintf("%s[%d]", path, n))
+			}
+		}
+	case "string":
+		v.validateString(d, value, path)
+	case "integer":
+		v.validateInteger(d, value, path)
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			v.fail(path, "expected a boolean")
+		}
+	case "bytes":
+		if !hasStringKey(value, "$bytes") {
+			v.fail(path, "expected bytes")
+		}
+	case "cid-link":
+		if !hasStringKey(value, "$link") {
+			v.fail(path, "expected a CID link")
+		}
+	case "blob", "unknown":
+		if _, ok := value.(map[string]interface{}); !ok {
+			v.fail(path, "expected an object")
+		}
+	}
+}
+
+func (v *validator) validateObject(nsid string, d *def, value interface{}, path string) {
+	obj, ok := value.(map[string]interface{})
+	if !ok {
+		v.fail(path, "expected an object")
+		return
+	}
+	for _, name := range d.Required {
+		if _, ok := obj[name]; !ok {
+			v.fail(join(path, name), "required")
+			return
+		}
+	}
+	for name, prop := range d.Properties {
+		field, ok := obj[name]
+		if !ok {
+			continue
+		}
+		if field == nil {
+			if !contains(d.Nullable, name) {
+				v.fail(join(path, name), "must not be null")
+			}
+			continue
+		}
+		v.validate(nsid, prop, field, join(path, name))
+	}
+}
+
+// validateUnion matches value to one of the union's refs by $type. The
+// selectors this service writes name their variant with the W3C "type"
+// property instead, so that is matched against each ref's type const when
+// $type is absent. Open unions accept variants they do not know.
+func (v *validator) validateUnion(nsid string, d *def, value interface{}, path string) {
+	obj, ok := value.(map[string]interface{})
+	if !ok {
+		v.fail(path, "expected an object")
+		return
+	}
+
+	if t, ok := obj["$type"].(string); ok {
+		want := qualify("", t)
+		for _, ref := range d.Refs {
+			key, owner, target := v.resolve(nsid, ref)
+			if key == want {
+				if target != nil {
+					v.validate(owner, target, value, path)
+				}
+				return
+			}
+		}
+		if d.Closed {
+			v.fail(path, "%s is not one of the allowed types", t)
+		}
+		return
+	}
+
+	if t, ok := obj["type"].(string); ok {
+		for _, ref := range d.Refs {
+			_, owner, target := v.resolve(nsid, ref)
+			if target == nil || target.Properties["type"] == nil {
+				continue
+			}
+			if target.Properties["type"].Const == t {
+				v.validate(owner, target, value, path)
+				return
+			}
+		}
+	}
+	if d.Closed {
+		v.fail(path, "missing or unknown $type")
+	}
+}
+
+func (v *validator) validateString(d *def, value interface{}, path string) {
+	s, ok := value.(string)
+	if !ok {
+		v.fail(path, "expected a string")
+		return
+	}
+	if d.MaxLength != nil && len(s) > *d.MaxLength {
+		v.fail(path, "longer than %d bytes", *d.MaxLength)
+		return
+	}
+	if d.MinLength != nil && len(s) < *d.MinLength {
+		v.fail(path, "shorter than %d bytes", *d.MinLength)
+		return
+	}
+	if d.MaxGraphemes != nil || d.MinGraphemes != nil {
+		n := graphemeCount(s)
+		if d.MaxGraphemes != nil && n > *d.MaxGraphemes {
+			v.fail(path, "longer than %d graphemes", *d.MaxGraphemes)
+			return
+		}
+		if d.MinGraphemes != nil && n < *d.MinGraphemes {
+			v.fail(path, "shorter than %d graphemes", *d.MinGraphemes)
+			return
+		}
+	}
+	if c, ok := d.Const.(string); ok && s != c {
+		v.fail(path, "must be %q", c)
+		return
+	}
+	if len(d.Enum) > 0 && !containsValue(d.Enum, s) {
+		v.fail(path, "%q is not an allowed value", s)
+		return
+	}
+	if d.Format != "" && !validFormat(d.Format, s) {
+		v.fail(path, "not a valid %s", d.Format)
+	}
+}
+
+func (v *validator) validateInteger(d *def, value interface{}, path string) {
+	num, ok := value.(json.Number)
+	if !ok {
+		v.fail(path, "expected an integer")
+		return
+	}
+	n, err := num.Int64()
+	if err != nil {
+		v.fail(path, "expected an integer")
+		return
+	}
+	if d.Minimum != nil && n < *d.Minimum {
+		v.fail(path, "less than %d", *d.Minimum)
+	}
+	if d.Maximum != nil && n > *d.Maximum {
+		v.fail(path, "greater than %d", *d.Maximum)
+	}
+	if c, ok := d.Const.(float64); ok && float64(n) != c {
+		v.fail(path, "must be %v", c)
+	}
+	if len(d.Enum) > 0 && !containsValue(d.Enum, float64(n)) {
+		v.fail(path, "%d is not an allowed value", n)
+	}
+}
+
+func validFormat(format, s string) bool {
+	switch format {
+	case "datetime":
+		_, err := time.Parse(time.RFC3339, s)
+		return err == nil
+	case "uri":
+		u, err := url.Parse(s)
+		return err == nil && u.Scheme != ""
+	case "at-uri":
+		return strings.HasPrefix(s, "at://") && len(s) > len("at://")
+	case "did":
+		return validDID(s)
+	case "handle":
+		return strings.Contains(s, ".") && !strings.ContainsAny(s, " /@:")
+	case "at-identifier":
+		return validDID(s) || (strings.Contains(s, ".") && !strings.ContainsAny(s, " /@:"))
+	case "nsid":
+		return strings.Count(s, ".") >= 2
+	case "cid":
+		_, err := cid.Decode(s)
+		return err == nil
+	case "tid":
+		return len(s) == 13
+	case "record-key":
+		return s != "" && len(s) <= 512 && s != "." && s != ".."
+	case "language":
+		return s != ""
+	}
+	return true
+}
+
+func validDID(s string) bool {
+	parts := strings.SplitN(s, ":", 3)
+	return len(parts) == 3 && parts[0] == "did" && parts[1] != "" && parts[2] != ""
+}
+
+// graphemeCount approximates the number of user-perceived characters:
+// combining marks, variation selectors, skin tone modifiers and characters
+// joined by ZWJ do not start a new one, and regional indicators pair up.
+func graphemeCount(s string) int {
+	count := 0
+	joined := false
+	regional := false
+	for _, r := range s {
+		switch {
+		case r == '\u200d':
+			joined = true
+			continue
+		case unicode.Is(unicode.Mn, r), unicode.Is(unicode.Me, r), unicode.Is(unicode.Variation_Selector, r),
+			r >= 0x1F3FB && r <= 0x1F3FF:
+			continue
+		case r >= 0x1F1E6 && r <= 0x1F1FF:
+			if regional {
+				regional = false
+				continue
+			}
+			regional = true
+		default:
+			regional = false
+		}
+		if joined {
+			joined = false
+			continue
+		}
+		count++
+	}
+	if count == 0 && s != "" {
+		return utf8.RuneCountInString(s)
+	}
+	return count
+}
+
+func hasStringKey(value interface{}, key string) bool {
+	obj, ok := value.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	_, ok = obj[key].(string)
+	return ok
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func containsValue(list []interface{}, value interface{}) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+func join(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
@@ -0,0 +1,167 @@
+package metadata
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// jsonLD holds the fields read from the most specific schema.org node on the
+// page: an article if there is one, otherwise any web page node.
+type jsonLD struct {
+	kind        string
+	headline    string
+	description string
+	image       string
+	author      string
+	published   string
+	publisher   string
+	language    string
+	wordCount   int
+}
+
+var articleTypes = map[string]bool{
+	"article": true, "newsarticle": true, "blogposting": true, "techarticle": true,
+	"scholarlyarticle": true, "report": true, "socialmediaposting": true,
+	"reviewarticle": true, "analysisnewsarticle": true, "opinionnewsarticle": true,
+}
+
+var pageTypes = map[string]bool{
+	"webpage": true, "itempage": true, "aboutpage": true, "profilepage": true,
+	"videoobject": true, "recipe": true, "book": true, "product": true,
+}
+
+func parseJSONLD(scripts []string) jsonLD {
+	var nodes []map[string]any
+	for _, script := range scripts {
+		var doc any
+		if err := json.Unmarshal([]byte(strings.TrimSpace(script)), &doc); err != nil {
+			continue
+		}
+		nodes = appendNodes(nodes, doc)
+	}
+
+	node, kind := pickNode(nodes, articleTypes)
+	if node == nil {
+		node, kind = pickNode(nodes, pageTypes)
+	}
+	if node == nil {
+		return jsonLD{}
+	}
+
+	ld := jsonLD{
+		kind:        kind,
+		headline:    firstOf(str(node["headline"]), str(node["name"])),
+		description: str(node["description"]),
+		image:       urlOf(node["image"]),
+		author:      names(node["author"]),
+		published:   str(node["datePublished"]),
+		publisher:   names(node["publisher"]),
+		language:    str(node["inLanguage"]),
+	}
+	if articleTypes[strings.ToLower(kind)] {
+		ld.kind = "article"
+	} else if kind == "VideoObject" {
+		ld.kind = "video"
+	} else {
+		ld.kind = strings.ToLower(kind)
+	}
+	if n, ok := node["wordCount"].(float64); ok {
+		ld.wordCount = int(n)
+	}
+	return ld
+}
+
+// appendNodes flattens top-level arrays and @graph containers into a list of
+// typed nodes.
+func appendNodes(nodes []map[string]any, doc any) []map[string]any {
+	switch v := doc.(type) {
+	case []any:
+		for _, item := range v {
+			nodes = appendNodes(nodes, item)
+		}
+	case map[string]any:
+		if graph, ok := v["@graph"]; ok {
+			nodes = appendNodes(nodes, graph)
+		}
+		if _, ok := v["@type"]; ok {
+			nodes = append(nodes, v)
+		}
+	}
+	return nodes
+}
+
+func pickNode(nodes []map[string]any, types map[string]bool) (map[string]any, string) {
+	for _, node := range nodes {
+		for _, t := range strs(node["@type"]) {
+			if types[strings.ToLower(t)] {
+				return node, t
+			}
+		}
+	}
+	return nil, ""
+}
+
+func str(v any) string {
+	switch v := v.(type) {
+	case string:
+		return strings.TrimSpace(v)
+	case []any:
+		if len(v) > 0 {
+			return str(v[0])
+		}
+	}
+	return ""
+}
+
+func strs(v any) []string {
+	switch v := v.(type) {
+	case string:
+		return []string{v}
+	case []any:
+		var out []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+// urlOf reads an image-like value: a URL, an ImageObject or a list of either.
+func urlOf(v any) string {
+	switch v := v.(type) {
+	case string:
+		return strings.TrimSpace(v)
+	case map[string]any:
+		return firstOf(str(v["url"]), str(v["contentUrl"]))
+	case []any:
+		for _, item := range v {
+			if u := urlOf(item); u != "" {
+				return u
+			}
+		}
+	}
+	return ""
+}
+
+// names reads a Person or Organization value, or a list of them, as a
+// comma-separated string.
+func names(v any) string {
+	switch v := v.(type) {
+	case string:
+		return strings.TrimSpace(v)
+	case map[string]any:
+		return str(v["name"])
+	case []any:
+		var out []string
+		for _, item := range v {
+			if name := names(item); name != "" {
+				out = append(out, name)
+			}
+		}
+		return strings.Join(out, ", ")
+	}
+	return ""
+}
@@ -0,0 +1,258 @@
+// Package metadata extracts a structured description of a web page from its
+// HTML: OpenGraph, Twitter cards, <meta itemprop>, JSON-LD and plain markup,
+// in that order of preference.
+package metadata
+
+import (
+	"io"
+	"math"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+const wordsPerMinute = 230
+
+type Metadata struct {
+	Title        string
+	Description  string
+	Image        string
+	Favicon      string
+	SiteName     string
+	CanonicalURL string
+	Language     string
+	Author       string
+	PublishedAt  *time.Time
+	Type         string
+	// ReadingTime is the estimated reading time in minutes, or 0 when the
+	// page has too little text to say.
+	ReadingTime int
+	// OEmbedURL is the page's JSON oEmbed discovery link, if it has one.
+	OEmbedURL string
+}
+
+// skipped elements do not count towards the reading time.
+var skipped = map[atom.Atom]bool{
+	atom.Script: true, atom.Style: true, atom.Noscript: true, atom.Template: true,
+	atom.Nav: true, atom.Header: true, atom.Footer: true, atom.Aside: true,
+}
+
+type parser struct {
+	meta      map[string]string
+	title     strings.Builder
+	inTitle   bool
+	inJSONLD  bool
+	jsonld    []string
+	skipDepth int
+	inBody    bool
+	words     int
+	lang      string
+	canonical string
+	icon      string
+	touchIcon string
+	oembed    string
+}
+
+// Parse reads an HTML document fetched from pageURL. Relative URLs in the
+// result are resolved against pageURL.
+func Parse(pageURL string, r io.Reader) (*Metadata, error) {
+	p := &parser{meta: make(map[string]string)}
+	z := html.NewTokenizer(r)
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			if err := z.Err(); err != io.EOF {
+				return nil, err
+			}
+			return p.result(pageURL), nil
+		case html.StartTagToken, html.SelfClosingTagToken:
+			p.startTag(z.Token())
+		case html.EndTagToken:
+			p.endTag(z.Token())
+		case html.TextToken:
+			p.text(string(z.Text()))
+		}
+	}
+}
+
+func (p *parser) startTag(t html.Token) {
+	switch t.DataAtom {
+	case atom.Html:
+		p.lang = attr(t, "lang")
+	case atom.Body:
+		p.inBody = true
+	case atom.Title:
+		p.inTitle = p.title.Len() == 0
+	case atom.Meta:
+		p.metaTag(t)
+	case atom.Link:
+		p.linkTag(t)
+	case atom.Script:
+		if strings.EqualFold(strings.TrimSpace(attr(t, "type")), "application/ld+json") {
+			p.inJSONLD = true
+			return
+		}
+	}
+	if skipped[t.DataAtom] && t.Type == html.StartTagToken {
+		p.skipDepth++
+	}
+}
+
+func (p *parser) endTag(t html.Token) {
+	switch t.DataAtom {
+	case atom.Title:
+		p.inTitle = false
+	case atom.Script:
+		if p.inJSONLD {
+			p.inJSONLD = false
+			return
+		}
+	}
+	if skipped[t.DataAtom] && p.skipDepth > 0 {
+		p.skipDepth--
+	}
+}
+
+func (p *parser) text(s string) {
+	switch {
+	case p.inTitle:
+		p.title.WriteString(s)
+	case p.inJSONLD:
+		p.jsonld = append(p.jsonld, s)
+	case p.inBody && p.skipDepth == 0:
+		p.words += len(strings.Fields(s))
+	}
+}
+
+func (p *parser) metaTag(t html.Token) {
+	content := strings.TrimSpace(attr(t, "content"))
+	if content == "" {
+		return
+	}
+	for _, name := range []string{"property", "name", "itemprop"} {
+		if key := strings.ToLower(strings.TrimSpace(attr(t, name))); key != "" {
+			if _, seen := p.meta[key]; !seen {
+				p.meta[key] = content
+			}
+		}
+	}
+}
+
+func (p *parser) linkTag(t html.Token) {
+	href := strings.TrimSpace(attr(t, "href"))
+	if href == "" {
+		return
+	}
+	for _, rel := range strings.Fields(strings.ToLower(attr(t, "rel"))) {
+		switch rel {
+		case "canonical":
+			setOnce(&p.canonical, href)
+		case "icon":
+			setOnce(&p.icon, href)
+		case "apple-touch-icon":
+			setOnce(&p.touchIcon, href)
+		case "alternate":
+			if strings.EqualFold(attr(t, "type"), "application/json+oembed") {
+				setOnce(&p.oembed, href)
+			}
+		}
+	}
+}
+
+func (p *parser) result(pageURL string) *Metadata {
+	base, _ := url.Parse(pageURL)
+	ld := parseJSONLD(p.jsonld)
+
+	m := &Metadata{
+		Title:        firstOf(p.meta["og:title"], p.meta["twitter:title"], ld.headline, p.meta["name"], collapse(p.title.String())),
+		Description:  firstOf(p.meta["og:description"], p.meta["twitter:description"], p.meta["description"], ld.description),
+		Image:        firstOf(p.meta["og:image"], p.meta["og:image:url"], p.meta["twitter:image"], p.meta["twitter:image:src"], p.meta["image"], ld.image),
+		SiteName:     firstOf(p.meta["og:site_name"], p.meta["application-name"], ld.publisher),
+		CanonicalURL: firstOf(p.canonical, p.meta["og:url"]),
+		Language:     firstOf(p.lang, p.meta["og:locale"], ld.language),
+		Author:       firstOf(p.meta["author"], ld.author, p.meta["article:author"], p.meta["twitter:creator"]),
+		Type:         firstOf(p.meta["og:type"], ld.kind),
+		OEmbedURL:    p.oembed,
+	}
+	m.PublishedAt = parseDate(firstOf(p.meta["article:published_time"], p.meta["datepublished"], ld.published, p.meta["date"]))
+
+	m.Image = resolve(base, m.Image)
+	m.CanonicalURL = resolve(base, m.CanonicalURL)
+	m.OEmbedURL = resolve(base, m.OEmbedURL)
+	m.Favicon = resolve(base, firstOf(p.icon, p.touchIcon))
+	if m.Favicon == "" && base != nil && base.Host != "" {
+		m.Favicon = base.Scheme + "://" + base.Host + "/favicon.ico"
+	}
+
+	words := p.words
+	if ld.wordCount > 0 {
+		words = ld.wordCount
+	}
+	if words >= wordsPerMinute/2 {
+		m.ReadingTime = int(math.Ceil(float64(words) / wordsPerMinute))
+	}
+	return m
+}
+
+var dateLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05Z0700",
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02",
+	time.RFC1123,
+	time.RFC1123Z,
+}
+
+func parseDate(value string) *time.Time {
+	value = strings.TrimSpace(value)
+	for _, layout := range dateLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			t = t.UTC()
+			return &t
+		}
+	}
+	return nil
+}
+
+func resolve(base *url.URL, ref string) string {
+	if ref == "" || base == nil {
+		return ref
+	}
+	u, err := url.Parse(ref)
+	if err != nil {
+		return ref
+	}
+	return base.ResolveReference(u).String()
+}
+
+func attr(t html.Token, key string) string {
+	for _, a := range t.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+func setOnce(dst *string, value string) {
+	if *dst == "" {
+		*dst = value
+	}
+}
+
+func firstOf(values ...string) string {
+	for _, v := range values {
+		if v = strings.TrimSpace(v); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func collapse(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
@@ -0,0 +1,217 @@
+package metadata
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const pageURL = "https://example.com/posts/hello"
+
+func parseFixture(t *testing.T, name string) *Metadata {
+	t.Helper()
+	f, err := os.Open(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	m, err := Parse(pageURL, f)
+	if err != nil {
+		t.Fatalf("Parse(%s): %v", name, err)
+	}
+	return m
+}
+
+func date(s string) *time.Time {
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		panic(err)
+	}
+	t = t.UTC()
+	return &t
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		fixture string
+		want    Metadata
+	}{
+		{
+			fixture: "single_quoted.html",
+			want: Metadata{
+				Title:        "Single quoted title",
+				Description:  "A description in single quotes",
+				Image:        "https://example.com/images/cover.png",
+				Favicon:      "https://example.com/static/icon.svg",
+				SiteName:     "Example Site",
+				CanonicalURL: "https://example.com/canonical/post",
+				Language:     "en-GB",
+				PublishedAt:  date("2024-03-05T08:30:00Z"),
+				Type:         "article",
+			},
+		},
+		{
+			fixture: "twitter.html",
+			want: Metadata{
+				Title:       "Twitter card title",
+				Description: "Twitter card description",
+				Image:       "https://cdn.example.com/card.jpg",
+				Favicon:     "https://example.com/touch.png",
+				Author:      "@someone",
+			},
+		},
+		{
+			fixture: "itemprop.html",
+			want: Metadata{
+				Title:       "Microdata title",
+				Description: "Microdata description",
+				Image:       "https://example.com/posts/img/hero.jpg",
+				Favicon:     "https://example.com/favicon.ico",
+				PublishedAt: date("2023-11-20T00:00:00Z"),
+			},
+		},
+		{
+			fixture: "jsonld_article.html",
+			want: Metadata{
+				Title:       "JSON-LD headline",
+				Description: "JSON-LD description",
+				Image:       "https://example.com/ld.jpg",
+				Favicon:     "https://example.com/favicon.ico",
+				SiteName:    "The Blog",
+				Language:    "en",
+				Author:      "Ada Lovelace, Charles Babbage",
+				PublishedAt: date("2022-07-14T18:00:00Z"),
+				Type:        "article",
+				ReadingTime: 6,
+			},
+		},
+		{
+			fixture: "oembed.html",
+			want: Metadata{
+				Title:     "Video page",
+				Favicon:   "https://example.com/favicon.ico",
+				OEmbedURL: "https://example.com/oembed?url=https%3A%2F%2Fvideo.example.com%2Fwatch%2F1&format=json",
+			},
+		},
+		{
+			// Words in the script, nav and footer would push it to 2.
+			fixture: "reading_time.html",
+			want: Metadata{
+				Title:       "Long read",
+				Favicon:     "https://example.com/favicon.ico",
+				ReadingTime: 1,
+			},
+		},
+		{
+			fixture: "short.html",
+			want: Metadata{
+				Favicon: "https://example.com/favicon.ico",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			got := parseFixture(t, tt.fixture)
+			checkMetadata(t, got, &tt.want)
+		})
+	}
+}
+
+func checkMetadata(t *testing.T, got, want *Metadata) {
+	t.Helper()
+	fields := []struct {
+		name      string
+		got, want string
+	}{
+		{"Title", got.Title, want.Title},
+		{"Description", got.Description, want.Description},
+		{"Image", got.Image, want.Image},
+		{"Favicon", got.Favicon, want.Favicon},
+		{"SiteName", got.SiteName, want.SiteName},
+		{"CanonicalURL", got.CanonicalURL, want.CanonicalURL},
+		{"Language", got.Language, want.Language},
+		{"Author", got.Author, want.Author},
+		{"Type", got.Type, want.Type},
+		{"OEmbedURL", got.OEmbedURL, want.OEmbedURL},
+	}
+	for _, f := range fields {
+		if f.got != f.want {
+			t.Errorf("%s = %q, want %q", f.name, f.got, f.want)
+		}
+	}
+	if got.ReadingTime != want.ReadingTime {
+		t.Errorf("ReadingTime = %d, want %d", got.ReadingTime, want.ReadingTime)
+	}
+	switch {
+	case got.PublishedAt == nil && want.PublishedAt != nil:
+		t.Errorf("PublishedAt = nil, want %s", want.PublishedAt)
+	case got.PublishedAt != nil && want.PublishedAt == nil:
+		t.Errorf("PublishedAt = %s, want nil", got.PublishedAt)
+	case got.PublishedAt != nil && !got.PublishedAt.Equal(*want.PublishedAt):
+		t.Errorf("PublishedAt = %s, want %s", got.PublishedAt, want.PublishedAt)
+	}
+}
+
+func TestOEmbed(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("format") != "json" {
+			http.Error(w, "bad format", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{
+			"type": "video",
+			"version": "1.0",
+			"title": "oEmbed title",
+			"author_name": "Video Author",
+			"provider_name": "VideoHost",
+			"thumbnail_url": "https://video.example.com/thumb.jpg"
+		}`))
+	}))
+	defer srv.Close()
+
+	m := parseFixture(t, "oembed.html")
+	if !m.NeedsOEmbed() {
+		t.Fatal("NeedsOEmbed = false for a page without author or image")
+	}
+
+	o, err := FetchOEmbed(context.Background(), srv.Client(), srv.URL+"/oembed?format=json")
+	if err != nil {
+		t.Fatalf("FetchOEmbed: %v", err)
+	}
+	m.ApplyOEmbed(o)
+
+	// The page's own title wins over the oEmbed one.
+	checkMetadata(t, m, &Metadata{
+		Title:     "Video page",
+		Image:     "https://video.example.com/thumb.jpg",
+		Favicon:   "https://example.com/favicon.ico",
+		SiteName:  "VideoHost",
+		Author:    "Video Author",
+		Type:      "video",
+		OEmbedURL: m.OEmbedURL,
+	})
+	if m.NeedsOEmbed() {
+		t.Error("NeedsOEmbed = true after ApplyOEmbed filled every gap")
+	}
+
+	if _, err := FetchOEmbed(context.Background(), srv.Client(), srv.URL+"/oembed?format=xml"); err == nil {
+		t.Error("FetchOEmbed succeeded on a non-200 response")
+	}
+}
+
+func TestApplyOEmbedLinkType(t *testing.T) {
+	m := &Metadata{Type: ""}
+	m.ApplyOEmbed(&OEmbed{Type: "link", Title: "Linked"})
+	if m.Type != "" {
+		t.Errorf("Type = %q, want empty for an oEmbed link", m.Type)
+	}
+	if m.Title != "Linked" {
+		t.Errorf("Title = %q, want %q", m.Title, "Linked")
+	}
+}
@@ -0,0 +1,63 @@
+package metadata
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+const maxOEmbedBytes = 64 * 1024
+
+// OEmbed is the subset of an oEmbed response used to fill gaps in page
+// metadata.
+type OEmbed struct {
+	Type         string `json:"type"`
+	Title        string `json:"title"`
+	AuthorName   string `json:"author_name"`
+	ProviderName string `json:"provider_name"`
+	ThumbnailURL string `json:"thumbnail_url"`
+}
+
+// FetchOEmbed requests a JSON oEmbed endpoint discovered on a page.
+func FetchOEmbed(ctx context.Context, client *http.Client, endpoint string) (*OEmbed, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("oembed %s: status %d", endpoint, resp.StatusCode)
+	}
+
+	var o OEmbed
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxOEmbedBytes)).Decode(&o); err != nil {
+		return nil, err
+	}
+	return &o, nil
+}
+
+// NeedsOEmbed reports whether the page left fields that an oEmbed response
+// could fill.
+func (m *Metadata) NeedsOEmbed() bool {
+	return m.OEmbedURL != "" && (m.Title == "" || m.Author == "" || m.Image == "")
+}
+
+// ApplyOEmbed fills fields the page itself did not provide.
+func (m *Metadata) ApplyOEmbed(o *OEmbed) {
+	setOnce(&m.Title, o.Title)
+	setOnce(&m.Author, o.AuthorName)
+	setOnce(&m.SiteName, o.ProviderName)
+	setOnce(&m.Image, o.ThumbnailURL)
+	if o.Type != "" && o.Type != "link" {
+		setOnce(&m.Type, o.Type)
+	}
+}
@@ -464,18 +464,9 @@ func (h *Handler) HandleCallback(w http.ResponseWriter, r *http.Request) {
 	})
 
 	go h.cleanupOrphanedReplies(tokenResp.Sub, tokenResp.AccessToken, string(dpopKeyPEM), pending.PDS)
-	go func() {
-		log.Printf("Starting background sync for %s...", tokenResp.Sub)
-		_, err := h.syncService.PerformSync(context.Background(), tokenResp.Sub, func(ctx context.Context, did string) (*xrpc.Client, error) {
-			return xrpc.NewClient(pending.PDS, tokenResp.AccessToken, pending.DPoPKey), nil
-		})
-
-		if err != nil {
-			log.Printf("Background sync failed for %s: %v", tokenResp.Sub, err)
-		} else {
-			log.Printf("Background sync completed for %s", tokenResp.Sub)
-		}
-	}()
+	if err := h.syncService.Enqueue(tokenResp.Sub); err != nil {
+		log.Printf("Failed to queue sync for %s: %v", tokenResp.Sub, err)
+	}
 
 	http.Redirect(w, r, "/home?logged_in=true", http.StatusFound)
 }
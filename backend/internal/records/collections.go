@@ -0,0 +1,656 @@
+package records
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"margin.at/internal/db"
+	"margin.at/internal/xrpc"
+)
+
+func init() {
+	register(&Collection{
+		NSID:  xrpc.CollectionAnnotation,
+		Parse: parseAnnotation,
+		Upsert: func(tx *db.DB, row interface{}) error {
+			return tx.CreateAnnotation(row.(*db.Annotation))
+		},
+		Delete:    (*db.DB).DeleteAnnotation,
+		LocalURIs: (*db.DB).GetAnnotationURIs,
+	})
+	register(&Collection{
+		NSID:  xrpc.CollectionHighlight,
+		Parse: parseHighlight,
+		Upsert: func(tx *db.DB, row interface{}) error {
+			return tx.CreateHighlight(row.(*db.Highlight))
+		},
+		Delete:    (*db.DB).DeleteHighlight,
+		LocalURIs: (*db.DB).GetHighlightURIs,
+	})
+	register(&Collection{
+		NSID:  xrpc.CollectionBookmark,
+		Parse: parseBookmark,
+		Upsert: func(tx *db.DB, row interface{}) error {
+			return tx.CreateBookmark(row.(*db.Bookmark))
+		},
+		Delete:    (*db.DB).DeleteBookmark,
+		LocalURIs: (*db.DB).GetBookmarkURIs,
+	})
+	register(&Collection{
+		NSID:  xrpc.CollectionReply,
+		Parse: parseReply,
+		Upsert: func(tx *db.DB, row interface{}) error {
+			return tx.CreateReply(row.(*db.Reply))
+		},
+		Delete: (*db.DB).DeleteReply,
+		LocalURIs: func(d *db.DB, did string) ([]string, error) {
+			replies, err := d.GetRepliesByAuthor(did)
+			uris := make([]string, len(replies))
+			for n, r := range replies {
+				uris[n] = r.URI
+			}
+			return uris, err
+		},
+	})
+	register(&Collection{
+		NSID:  xrpc.CollectionLike,
+		Parse: parseLike,
+		Upsert: func(tx *db.DB, row interface{}) error {
+			return tx.CreateLike(row.(*db.Like))
+		},
+		Delete: (*db.DB).DeleteLike,
+		LocalURIs: func(d *db.DB, did string) ([]string, error) {
+			likes, err := d.GetLikesByAuthor(did)
+			uris := make([]string, len(likes))
+			for n, l := range likes {
+				uris[n] = l.URI
+			}
+			return uris, err
+		},
+	})
+	register(&Collection{
+		NSID:      xrpc.CollectionCollection,
+		Parse:     parseCollection,
+		Upsert:    upsertCollection,
+		Delete:    (*db.DB).DeleteCollection,
+		LocalURIs: collectionURIs,
+	})
+	register(&Collection{
+		NSID:      xrpc.CollectionCollectionItem,
+		Parse:     parseCollectionItem,
+		Upsert:    upsertCollectionItem,
+		Delete:    (*db.DB).RemoveFromCollection,
+		LocalURIs: collectionItemURIs,
+	})
+	register(&Collection{
+		NSID:   xrpc.CollectionAPIKey,
+		Parse:  parseAPIKey,
+		Upsert: func(tx *db.DB, row interface{}) error { return tx.CreateAPIKey(row.(*db.APIKey)) },
+		Delete: func(tx *db.DB, uri string) error {
+			return tx.DeleteAPIKeyByURI(uri)
+		},
+		LocalURIs: (*db.DB).GetAPIKeyURIs,
+	})
+	register(&Collection{
+		NSID:  xrpc.CollectionPreferences,
+		Parse: parsePreferences,
+		Upsert: func(tx *db.DB, row interface{}) error {
+			return tx.UpsertPreferences(row.(*db.Preferences))
+		},
+		Delete:    (*db.DB).DeletePreferences,
+		LocalURIs: (*db.DB).GetPreferenceURIs,
+	})
+	register(&Collection{
+		NSID:   xrpc.CollectionProfile,
+		Parse:  parseProfile,
+		Upsert: upsertProfile,
+		Delete: (*db.DB).DeleteProfile,
+		LocalURIs: func(d *db.DB, did string) ([]string, error) {
+			p, err := d.GetProfile(did)
+			if err != nil || p == nil {
+				return nil, err
+			}
+			return []string{p.URI}, nil
+		},
+	})
+	register(&Collection{
+		NSID:  xrpc.CollectionSembleCard,
+		Parse: parseSembleCard,
+		Upsert: func(tx *db.DB, row interface{}) error {
+			switch row := row.(type) {
+			case *db.Annotation:
+				return tx.CreateAnnotation(row)
+			case *db.Bookmark:
+				return tx.CreateBookmark(row)
+			}
+			return fmt.Errorf("unexpected Semble card row %T", row)
+		},
+		Delete: func(tx *db.DB, uri string) error {
+			return errors.Join(tx.DeleteAnnotation(uri), tx.DeleteBookmark(uri))
+		},
+		LocalURIs: func(d *db.DB, did string) ([]string, error) {
+			annotations, err := d.GetAnnotationURIs(did)
+			if err != nil {
+				return nil, err
+			}
+			bookmarks, err := d.GetBookmarkURIs(did)
+			return append(annotations, bookmarks...), err
+		},
+	})
+	register(&Collection{
+		NSID:      xrpc.CollectionSembleCollection,
+		Parse:     parseSembleCollection,
+		Upsert:    upsertCollection,
+		Delete:    (*db.DB).DeleteCollection,
+		LocalURIs: collectionURIs,
+	})
+	register(&Collection{
+		NSID:      xrpc.CollectionSembleCollectionLink,
+		Parse:     parseSembleCollectionLink,
+		Upsert:    upsertCollectionItem,
+		Delete:    (*db.DB).RemoveFromCollection,
+		LocalURIs: collectionItemURIs,
+	})
+}
+
+// createdAt parses a record's createdAt, falling back to now.
+func createdAt(raw string) time.Time {
+	t, err := time.Parse(time.RFC3339, raw)
+	if err != nil {
+		return time.Now()
+	}
+	return t
+}
+
+func optional(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+func rawJSON(raw json.RawMessage) *string {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil
+	}
+	s := string(raw)
+	return &s
+}
+
+func jsonList(items []string) *string {
+	if len(items) == 0 {
+		return nil
+	}
+	b, _ := json.Marshal(items)
+	s := string(b)
+	return &s
+}
+
+func parseAnnotation(tx *db.DB, ref Ref, value json.RawMessage) (interface{}, error) {
+	var record struct {
+		Motivation string `json:"motivation"`
+		Body       struct {
+			Value  string `json:"value"`
+			Format string `json:"format"`
+			URI    string `json:"uri"`
+		} `json:"body"`
+		Target struct {
+			Source   string          `json:"source"`
+			Title    string          `json:"title"`
+			Selector json.RawMessage `json:"selector"`
+		} `json:"target"`
+		Tags      []string `json:"tags"`
+		CreatedAt string   `json:"createdAt"`
+
+		// Fields of the first version of the lexicon.
+		URL   string `json:"url"`
+		Text  string `json:"text"`
+		Title string `json:"title"`
+	}
+	if err := json.Unmarshal(value, &record); err != nil {
+		return nil, err
+	}
+
+	targetSource := record.Target.Source
+	if targetSource == "" {
+		targetSource = record.URL
+	}
+	var targetHash string
+	if targetSource != "" {
+		targetHash = tx.HashURL(targetSource)
+	}
+	bodyValue := record.Body.Value
+	if bodyValue == "" {
+		bodyValue = record.Text
+	}
+	targetTitle := record.Target.Title
+	if targetTitle == "" {
+		targetTitle = record.Title
+	}
+	motivation := record.Motivation
+	if motivation == "" {
+		motivation = "commenting"
+	}
+
+	return &db.Annotation{
+		URI:          ref.URI(),
+		AuthorDID:    ref.DID,
+		Motivation:   motivation,
+		BodyValue:    optional(bodyValue),
+		BodyFormat:   optional(record.Body.Format),
+		BodyURI:      optional(record.Body.URI),
+		TargetSource: targetSource,
+		TargetHash:   targetHash,
+		TargetDomain: tx.URLDomain(targetSource),
+		TargetTitle:  optional(targetTitle),
+		SelectorJSON: rawJSON(record.Target.Selector),
+		TagsJSON:     jsonList(record.Tags),
+		CreatedAt:    createdAt(record.CreatedAt),
+		IndexedAt:    time.Now(),
+		CID:          optional(ref.CID),
+	}, nil
+}
+
+func parseHighlight(tx *db.DB, ref Ref, value json.RawMessage) (interface{}, error) {
+	var record struct {
+		Target struct {
+			Source   string          `json:"source"`
+			Title    string          `json:"title"`
+			Selector json.RawMessage `json:"selector"`
+		} `json:"target"`
+		Color     string   `json:"color"`
+		Tags      []string `json:"tags"`
+		CreatedAt string   `json:"createdAt"`
+	}
+	if err := json.Unmarshal(value, &record); err != nil {
+		return nil, err
+	}
+
+	var targetHash string
+	if record.Target.Source != "" {
+		targetHash = tx.HashURL(record.Target.Source)
+	}
+
+	return &db.Highlight{
+		URI:          ref.URI(),
+		AuthorDID:    ref.DID,
+		TargetSource: record.Target.Source,
+		TargetHash:   targetHash,
+		TargetDomain: tx.URLDomain(record.Target.Source),
+		TargetTitle:  optional(record.Target.Title),
+		SelectorJSON: rawJSON(record.Target.Selector),
+		Color:        optional(record.Color),
+		TagsJSON:     jsonList(record.Tags),
+		CreatedAt:    createdAt(record.CreatedAt),
+		IndexedAt:    time.Now(),
+		CID:          optional(ref.CID),
+	}, nil
+}
+
+func parseBookmark(tx *db.DB, ref Ref, value json.RawMessage) (interface{}, error) {
+	var record struct {
+		Source      string   `json:"source"`
+		Title       string   `json:"title"`
+		Description string   `json:"description"`
+		Tags        []string `json:"tags"`
+		CreatedAt   string   `json:"createdAt"`
+	}
+	if err := json.Unmarshal(value, &record); err != nil {
+		return nil, err
+	}
+
+	var sourceHash string
+	if record.Source != "" {
+		sourceHash = tx.HashURL(record.Source)
+	}
+
+	return &db.Bookmark{
+		URI:          ref.URI(),
+		AuthorDID:    ref.DID,
+		Source:       record.Source,
+		SourceHash:   sourceHash,
+		SourceDomain: tx.URLDomain(record.Source),
+		Title:        optional(record.Title),
+		Description:  optional(record.Description),
+		TagsJSON:     jsonList(record.Tags),
+		CreatedAt:    createdAt(record.CreatedAt),
+		IndexedAt:    time.Now(),
+		CID:          optional(ref.CID),
+	}, nil
+}
+
+// parseReply rejects a reply whose parent or root is not a record URI, since
+// it could never be shown in a thread.
+func parseReply(tx *db.DB, ref Ref, value json.RawMessage) (interface{}, error) {
+	var record struct {
+		Parent    xrpc.StrongRef `json:"parent"`
+		Root      xrpc.StrongRef `json:"root"`
+		Text      string         `json:"text"`
+		Format    string         `json:"format"`
+		CreatedAt string         `json:"createdAt"`
+	}
+	if err := json.Unmarshal(value, &record); err != nil {
+		return nil, err
+	}
+	if _, err := ParseURI(record.Parent.URI); err != nil {
+		return nil, fmt.Errorf("reply parent: %w", err)
+	}
+	if _, err := ParseURI(record.Root.URI); err != nil {
+		return nil, fmt.Errorf("reply root: %w", err)
+	}
+
+	return &db.Reply{
+		URI:       ref.URI(),
+		AuthorDID: ref.DID,
+		ParentURI: record.Parent.URI,
+		RootURI:   record.Root.URI,
+		Text:      record.Text,
+		Format:    optional(record.Format),
+		CreatedAt: createdAt(record.CreatedAt),
+		IndexedAt: time.Now(),
+		CID:       optional(ref.CID),
+	}, nil
+}
+
+func parseLike(tx *db.DB, ref Ref, value json.RawMessage) (interface{}, error) {
+	var record struct {
+		Subject   xrpc.StrongRef `json:"subject"`
+		CreatedAt string         `json:"createdAt"`
+	}
+	if err := json.Unmarshal(value, &record); err != nil {
+		return nil, err
+	}
+
+	return &db.Like{
+		URI:        ref.URI(),
+		AuthorDID:  ref.DID,
+		SubjectURI: record.Subject.URI,
+		CreatedAt:  createdAt(record.CreatedAt),
+		IndexedAt:  time.Now(),
+	}, nil
+}
+
+func parseCollection(tx *db.DB, ref Ref, value json.RawMessage) (interface{}, error) {
+	var record struct {
+		Name        string `json:"name"`
+		Description string `json:"description"`
+		Icon        string `json:"icon"`
+		CreatedAt   string `json:"createdAt"`
+	}
+	if err := json.Unmarshal(value, &record); err != nil {
+		return nil, err
+	}
+
+	return &db.Collection{
+		URI:         ref.URI(),
+		AuthorDID:   ref.DID,
+		Name:        record.Name,
+		Description: optional(record.Description),
+		Icon:        optional(record.Icon),
+		CreatedAt:   createdAt(record.CreatedAt),
+		IndexedAt:   time.Now(),
+	}, nil
+}
+
+func parseSembleCollection(tx *db.DB, ref Ref, value json.RawMessage) (interface{}, error) {
+	var record xrpc.SembleCollection
+	if err := json.Unmarshal(value, &record); err != nil {
+		return nil, err
+	}
+
+	return &db.Collection{
+		URI:         ref.URI(),
+		AuthorDID:   ref.DID,
+		Name:        record.Name,
+		Description: optional(record.Description),
+		Icon:        optional("icon:semble"),
+		CreatedAt:   createdAt(record.CreatedAt),
+		IndexedAt:   time.Now(),
+	}, nil
+}
+
+func upsertCollection(tx *db.DB, row interface{}) error {
+	return tx.CreateCollection(row.(*db.Collection))
+}
+
+func collectionURIs(d *db.DB, did string) ([]string, error) {
+	collections, err := d.GetCollectionsByAuthor(did)
+	uris := make([]string, len(collections))
+	for n, c := range collections {
+		uris[n] = c.URI
+	}
+	return uris, err
+}
+
+func parseCollectionItem(tx *db.DB, ref Ref, value json.RawMessage) (interface{}, error) {
+	var record struct {
+		Collection string `json:"collection"`
+		Annotation string `json:"annotation"`
+		Position   int    `json:"position"`
+		CreatedAt  string `json:"createdAt"`
+	}
+	if err := json.Unmarshal(value, &record); err != nil {
+		return nil, err
+	}
+
+	return &db.CollectionItem{
+		URI:           ref.URI(),
+		AuthorDID:     ref.DID,
+		CollectionURI: record.Collection,
+		AnnotationURI: record.Annotation,
+		Position:      record.Position,
+		CreatedAt:     createdAt(record.CreatedAt),
+		IndexedAt:     time.Now(),
+	}, nil
+}
+
+func parseSembleCollectionLink(tx *db.DB, ref Ref, value json.RawMessage) (interface{}, error) {
+	var record xrpc.SembleCollectionLink
+	if err := json.Unmarshal(value, &record); err != nil {
+		return nil, err
+	}
+
+	return &db.CollectionItem{
+		URI:           ref.URI(),
+		AuthorDID:     ref.DID,
+		CollectionURI: record.Collection.URI,
+		AnnotationURI: record.Card.URI,
+		CreatedAt:     createdAt(record.CreatedAt),
+		IndexedAt:     time.Now(),
+	}, nil
+}
+
+func upsertCollectionItem(tx *db.DB, row interface{}) error {
+	return tx.AddToCollection(row.(*db.CollectionItem))
+}
+
+func collectionItemURIs(d *db.DB, did string) ([]string, error) {
+	items, err := d.GetCollectionItemsByAuthor(did)
+	uris := make([]string, len(items))
+	for n, item := range items {
+		uris[n] = item.URI
+	}
+	return uris, err
+}
+
+func parseAPIKey(tx *db.DB, ref Ref, value json.RawMessage) (interface{}, error) {
+	var record struct {
+		Name      string `json:"name"`
+		KeyHash   string `json:"keyHash"`
+		CreatedAt string `json:"createdAt"`
+	}
+	if err := json.Unmarshal(value, &record); err != nil {
+		return nil, err
+	}
+
+	return &db.APIKey{
+		ID:        ref.Rkey,
+		OwnerDID:  ref.DID,
+		Name:      record.Name,
+		KeyHash:   record.KeyHash,
+		CreatedAt: createdAt(record.CreatedAt),
+		URI:       ref.URI(),
+		CID:       optional(ref.CID),
+		IndexedAt: time.Now(),
+	}, nil
+}
+
+func parsePreferences(tx *db.DB, ref Ref, value json.RawMessage) (interface{}, error) {
+	if ref.Rkey != "self" {
+		return nil, nil
+	}
+	var record struct {
+		ExternalLinkSkippedHostnames []string        `json:"externalLinkSkippedHostnames"`
+		SubscribedLabelers           json.RawMessage `json:"subscribedLabelers"`
+		LabelPreferences             json.RawMessage `json:"labelPreferences"`
+		CreatedAt                    string          `json:"createdAt"`
+	}
+	if err := json.Unmarshal(value, &record); err != nil {
+		return nil, err
+	}
+
+	return &db.Preferences{
+		URI:                          ref.URI(),
+		AuthorDID:                    ref.DID,
+		ExternalLinkSkippedHostnames: jsonList(record.ExternalLinkSkippedHostnames),
+		SubscribedLabelers:           rawJSON(record.SubscribedLabelers),
+		LabelPreferences:             rawJSON(record.LabelPreferences),
+		CreatedAt:                    createdAt(record.CreatedAt),
+		IndexedAt:                    time.Now(),
+		CID:                          optional(ref.CID),
+	}, nil
+}
+
+// profileRow carries the avatar blob alongside the profile, since the URL
+// it is served from depends on the PDS.
+type profileRow struct {
+	profile   *db.Profile
+	avatarCID string
+}
+
+func parseProfile(tx *db.DB, ref Ref, value json.RawMessage) (interface{}, error) {
+	if ref.Rkey != "self" {
+		return nil, nil
+	}
+	var record struct {
+		DisplayName string        `json:"displayName"`
+		Avatar      *xrpc.BlobRef `json:"avatar"`
+		Bio         string        `json:"bio"`
+		Website     string        `json:"website"`
+		Links       []string      `json:"links"`
+		CreatedAt   string        `json:"createdAt"`
+	}
+	if err := json.Unmarshal(value, &record); err != nil {
+		return nil, err
+	}
+
+	row := &profileRow{profile: &db.Profile{
+		URI:         ref.URI(),
+		AuthorDID:   ref.DID,
+		DisplayName: optional(record.DisplayName),
+		Bio:         optional(record.Bio),
+		Website:     optional(record.Website),
+		LinksJSON:   jsonList(record.Links),
+		CreatedAt:   createdAt(record.CreatedAt),
+		IndexedAt:   time.Now(),
+		CID:         optional(ref.CID),
+	}}
+	if record.Avatar != nil {
+		row.avatarCID = record.Avatar.Ref.Link
+	}
+	return row, nil
+}
+
+// upsertProfile serves the avatar from the author's PDS when we know it, and
+// otherwise keeps the avatar already stored.
+func upsertProfile(tx *db.DB, row interface{}) error {
+	r := row.(*profileRow)
+	p := r.profile
+	if r.avatarCID != "" {
+		if account, err := tx.GetAccount(p.AuthorDID); err == nil && account != nil && account.PDS != "" {
+			avatar := fmt.Sprintf("%s/xrpc/com.atproto.sync.getBlob?did=%s&cid=%s", strings.TrimSuffix(account.PDS, "/"), p.AuthorDID, r.avatarCID)
+			p.Avatar = &avatar
+		} else if existing, err := tx.GetProfile(p.AuthorDID); err == nil && existing != nil {
+			p.Avatar = existing.Avatar
+		}
+	}
+	return tx.UpsertProfile(p)
+}
+
+func parseSembleCard(tx *db.DB, ref Ref, value json.RawMessage) (interface{}, error) {
+	var card xrpc.SembleCard
+	if err := json.Unmarshal(value, &card); err != nil {
+		return nil, err
+	}
+	content, err := card.ParseContent()
+	if err != nil {
+		return nil, err
+	}
+
+	switch card.Type {
+	case "NOTE":
+		note, ok := content.(*xrpc.SembleNoteContent)
+		if !ok || card.URL == "" {
+			return nil, nil
+		}
+
+		motivation := "commenting"
+		bodyValue := note.Text
+		var selectorJSONPtr *string
+
+		// Semble stores a quoted passage as the first line of the note.
+		if strings.HasPrefix(bodyValue, "\"") && strings.Contains(bodyValue, "\"\n") {
+			parts := strings.SplitN(bodyValue, "\"\n", 2)
+			if len(parts) == 2 {
+				bodyValue = parts[1]
+				motivation = "highlighting"
+				selectorBytes, _ := json.Marshal(xrpc.TextQuoteSelector{
+					Type:  xrpc.SelectorTypeQuote,
+					Exact: strings.TrimPrefix(parts[0], "\""),
+				})
+				selectorJSONPtr = rawJSON(selectorBytes)
+			}
+		}
+
+		return &db.Annotation{
+			URI:          ref.URI(),
+			AuthorDID:    ref.DID,
+			Motivation:   motivation,
+			BodyValue:    &bodyValue,
+			TargetSource: card.URL,
+			TargetHash:   tx.HashURL(card.URL),
+			TargetDomain: tx.URLDomain(card.URL),
+			SelectorJSON: selectorJSONPtr,
+			CreatedAt:    card.GetCreatedAtTime(),
+			IndexedAt:    time.Now(),
+			CID:          optional(ref.CID),
+		}, nil
+
+	case "URL":
+		urlContent, ok := content.(*xrpc.SembleURLContent)
+		if !ok || urlContent.URL == "" {
+			return nil, nil
+		}
+
+		var titlePtr *string
+		if urlContent.Metadata != nil {
+			titlePtr = optional(urlContent.Metadata.Title)
+		}
+
+		return &db.Bookmark{
+			URI:          ref.URI(),
+			AuthorDID:    ref.DID,
+			Source:       urlContent.URL,
+			SourceHash:   tx.HashURL(urlContent.URL),
+			SourceDomain: tx.URLDomain(urlContent.URL),
+			Title:        titlePtr,
+			CreatedAt:    card.GetCreatedAtTime(),
+			IndexedAt:    time.Now(),
+			CID:          optional(ref.CID),
+		}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,119 @@
+// Package records maps each record collection we index to the code that
+// parses, stores, deletes and lists it, so the firehose, repo sync and
+// backfill all index a record the same way.
+package records
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"margin.at/internal/db"
+)
+
+// ErrMalformed wraps errors from a record that cannot be parsed, which
+// retrying will not fix.
+var ErrMalformed = errors.New("malformed record")
+
+// Ref names a record in a repo.
+type Ref struct {
+	DID        string
+	Collection string
+	Rkey       string
+	CID        string
+}
+
+func (r Ref) URI() string {
+	return fmt.Sprintf("at://%s/%s/%s", r.DID, r.Collection, r.Rkey)
+}
+
+// ParseURI splits an at:// record URI into its ref, without a CID.
+func ParseURI(uri string) (Ref, error) {
+	parts := strings.SplitN(strings.TrimPrefix(uri, "at://"), "/", 3)
+	if !strings.HasPrefix(uri, "at://") || len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return Ref{}, fmt.Errorf("not a record URI: %q", uri)
+	}
+	return Ref{DID: parts[0], Collection: parts[1], Rkey: parts[2]}, nil
+}
+
+// Collection is how the records of one NSID are indexed.
+type Collection struct {
+	NSID string
+	// Parse decodes a record into the row it is stored as, or nil when the
+	// record is well formed but not something we index. Target URLs are
+	// hashed with tx's canonicalizer.
+	Parse func(tx *db.DB, ref Ref, value json.RawMessage) (interface{}, error)
+	// Upsert stores a row returned by Parse.
+	Upsert func(tx *db.DB, row interface{}) error
+	Delete func(tx *db.DB, uri string) error
+	// LocalURIs lists the indexed records of did. It may include records
+	// of other collections stored in the same table.
+	LocalURIs func(d *db.DB, did string) ([]string, error)
+}
+
+var (
+	registry = make(map[string]*Collection)
+	nsids    []string
+)
+
+func register(c *Collection) {
+	registry[c.NSID] = c
+	nsids = append(nsids, c.NSID)
+}
+
+// Lookup returns the collection registered for nsid, or nil.
+func Lookup(nsid string) *Collection {
+	return registry[nsid]
+}
+
+// NSIDs lists every indexed collection in registration order.
+func NSIDs() []string {
+	return append([]string(nil), nsids...)
+}
+
+// Index parses value and stores it. Records of collections not registered
+// are ignored.
+func Index(tx *db.DB, ref Ref, value json.RawMessage) error {
+	c := Lookup(ref.Collection)
+	if c == nil {
+		return nil
+	}
+	row, err := c.Parse(tx, ref, value)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrMalformed, err)
+	}
+	if row == nil {
+		return nil
+	}
+	return c.Upsert(tx, row)
+}
+
+// Delete removes the record at uri of collection nsid from the index.
+func Delete(tx *db.DB, nsid, uri string) error {
+	c := Lookup(nsid)
+	if c == nil {
+		return nil
+	}
+	return c.Delete(tx, uri)
+}
+
+// LocalURIs lists the indexed records of collection nsid authored by did.
+func LocalURIs(d *db.DB, nsid, did string) ([]string, error) {
+	c := Lookup(nsid)
+	if c == nil {
+		return nil, nil
+	}
+	uris, err := c.LocalURIs(d, did)
+	if err != nil {
+		return nil, err
+	}
+	needle := "/" + nsid + "/"
+	out := make([]string, 0, len(uris))
+	for _, u := range uris {
+		if strings.Contains(u, needle) {
+			out = append(out, u)
+		}
+	}
+	return out, nil
+}
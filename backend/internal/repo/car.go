@@ -0,0 +1,105 @@
+package repo
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/ipfs/go-cid"
+)
+
+// MaxBlockSize bounds a single CAR block, so a malformed length cannot make
+// us allocate without limit.
+const MaxBlockSize = 2 << 20
+
+// CAR is a decoded CARv1 archive. Every block has been checked against its
+// CID.
+type CAR struct {
+	Roots  []cid.Cid
+	Blocks map[cid.Cid][]byte
+}
+
+// ReadCAR reads a CARv1 archive to the end.
+func ReadCAR(r io.Reader) (*CAR, error) {
+	br := bufio.NewReader(r)
+
+	header, err := readSection(br)
+	if err != nil {
+		return nil, fmt.Errorf("read CAR header: %w", err)
+	}
+	var h struct {
+		Version int        `cbor:"version"`
+		Roots   []cbor.Tag `cbor:"roots"`
+	}
+	if err := cbor.Unmarshal(header, &h); err != nil {
+		return nil, fmt.Errorf("decode CAR header: %w", err)
+	}
+	if h.Version != 1 {
+		return nil, fmt.Errorf("unsupported CAR version %d", h.Version)
+	}
+
+	car := &CAR{Blocks: make(map[cid.Cid][]byte)}
+	for _, root := range h.Roots {
+		c, err := ParseLink(root)
+		if err != nil {
+			return nil, fmt.Errorf("CAR root: %w", err)
+		}
+		car.Roots = append(car.Roots, c)
+	}
+
+	for {
+		section, err := readSection(br)
+		if err == io.EOF {
+			return car, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read CAR block: %w", err)
+		}
+		n, c, err := cid.CidFromBytes(section)
+		if err != nil {
+			return nil, fmt.Errorf("CAR block CID: %w", err)
+		}
+		data := section[n:]
+		if err := checkBlock(c, data); err != nil {
+			return nil, err
+		}
+		car.Blocks[c] = data
+	}
+}
+
+// Block returns the block for c, or an error if the archive lacks it.
+func (car *CAR) Block(c cid.Cid) ([]byte, error) {
+	data, ok := car.Blocks[c]
+	if !ok {
+		return nil, fmt.Errorf("block %s missing from CAR", c)
+	}
+	return data, nil
+}
+
+func readSection(br *bufio.Reader) ([]byte, error) {
+	size, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, err
+	}
+	if size == 0 || size > MaxBlockSize {
+		return nil, fmt.Errorf("invalid section length %d", size)
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(br, buf); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return buf, nil
+}
+
+func checkBlock(c cid.Cid, data []byte) error {
+	computed, err := c.Prefix().Sum(data)
+	if err != nil {
+		return err
+	}
+	if !computed.Equals(c) {
+		return fmt.Errorf("block %s does not match its CID", c)
+	}
+	return nil
+}
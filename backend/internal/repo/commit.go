@@ -0,0 +1,96 @@
+package repo
+
+import (
+	"fmt"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/ipfs/go-cid"
+
+	"margin.at/internal/crypto"
+)
+
+// Commit is a signed repo commit (version 3).
+type Commit struct {
+	DID     string
+	Version int64
+	Data    cid.Cid
+	Rev     string
+	Sig     []byte
+
+	// unsigned is the DAG-CBOR encoding of the commit without its signature,
+	// which is what the signature covers.
+	unsigned []byte
+}
+
+var dagCBOR cbor.EncMode
+
+func init() {
+	var err error
+	dagCBOR, err = cbor.CanonicalEncOptions().EncMode()
+	if err != nil {
+		panic(err)
+	}
+}
+
+// DecodeCommit decodes a commit block.
+func DecodeCommit(block []byte) (*Commit, error) {
+	var fields map[string]interface{}
+	if err := cbor.Unmarshal(block, &fields); err != nil {
+		return nil, fmt.Errorf("decode commit: %w", err)
+	}
+
+	c := &Commit{}
+	var ok bool
+	if c.DID, ok = fields["did"].(string); !ok {
+		return nil, fmt.Errorf("commit has no did")
+	}
+	if c.Rev, ok = fields["rev"].(string); !ok {
+		return nil, fmt.Errorf("commit has no rev")
+	}
+	if c.Sig, ok = fields["sig"].([]byte); !ok {
+		return nil, fmt.Errorf("commit is not signed")
+	}
+	version, ok := fields["version"].(uint64)
+	if !ok || version != 3 {
+		return nil, fmt.Errorf("unsupported commit version %v", fields["version"])
+	}
+	c.Version = int64(version)
+	data, ok := fields["data"].(cbor.Tag)
+	if !ok {
+		return nil, fmt.Errorf("commit has no data root")
+	}
+	var err error
+	if c.Data, err = ParseLink(data); err != nil {
+		return nil, fmt.Errorf("commit data root: %w", err)
+	}
+
+	delete(fields, "sig")
+	if c.unsigned, err = dagCBOR.Marshal(fields); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Verify checks the commit signature against the repo's signing key.
+func (c *Commit) Verify(key crypto.PublicKey) error {
+	return key.Verify(c.unsigned, c.Sig)
+}
+
+// LoadCommit reads, decodes and verifies the commit with the given CID.
+func (car *CAR) LoadCommit(c cid.Cid, did string, key crypto.PublicKey) (*Commit, error) {
+	block, err := car.Block(c)
+	if err != nil {
+		return nil, err
+	}
+	commit, err := DecodeCommit(block)
+	if err != nil {
+		return nil, err
+	}
+	if commit.DID != did {
+		return nil, fmt.Errorf("commit is for %s, not %s", commit.DID, did)
+	}
+	if err := commit.Verify(key); err != nil {
+		return nil, fmt.Errorf("commit %s: %w", c, err)
+	}
+	return commit, nil
+}
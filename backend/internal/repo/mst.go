@@ -0,0 +1,187 @@
+package repo
+
+import (
+	"crypto/sha256"
+	"fmt"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/ipfs/go-cid"
+)
+
+// mstNode is a node of the repo's Merkle search tree. Entry keys are
+// compressed against the previous key of the node.
+type mstNode struct {
+	Left    *cbor.Tag `cbor:"l"`
+	Entries []struct {
+		Prefix int       `cbor:"p"`
+		Key    []byte    `cbor:"k"`
+		Value  cbor.Tag  `cbor:"v"`
+		Tree   *cbor.Tag `cbor:"t"`
+	} `cbor:"e"`
+}
+
+// keyRange is the open interval (after, before) of keys a subtree holds. An
+// empty bound is unbounded.
+type keyRange struct {
+	after, before string
+}
+
+func (r keyRange) contains(key string) bool {
+	return key > r.after && (r.before == "" || key < r.before)
+}
+
+// Tree is the content of a repo's MST as far as a CAR carries it. A diff
+// from getRepo?since= leaves out the subtrees that did not change; their key
+// ranges are remembered, so a key outside them that is not in Entries is
+// known to be absent from the repo.
+type Tree struct {
+	// Entries maps collection/rkey to the CID of the record.
+	Entries map[string]cid.Cid
+	missing []keyRange
+}
+
+// LoadTree walks the MST rooted at root through the blocks of the CAR,
+// checking that keys are in order and each sits at the layer its hash puts
+// it on.
+func (car *CAR) LoadTree(root cid.Cid) (*Tree, error) {
+	t := &Tree{Entries: make(map[string]cid.Cid)}
+	if err := t.walk(car, root, keyRange{}, -1); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// keyLayer is the MST layer of key: the number of leading zero bits of its
+// SHA-256, counted in pairs for a fanout of 4.
+func keyLayer(key string) int {
+	layer := 0
+	for _, b := range sha256.Sum256([]byte(key)) {
+		if b == 0 {
+			layer += 4
+			continue
+		}
+		switch {
+		case b&0xfc == 0:
+			layer += 3
+		case b&0xf0 == 0:
+			layer += 2
+		case b&0xc0 == 0:
+			layer++
+		}
+		return layer
+	}
+	return layer
+}
+
+// walk loads the subtree at c, which holds keys within bounds and sits on
+// layer, or on any layer when layer is -1.
+func (t *Tree) walk(car *CAR, c cid.Cid, bounds keyRange, layer int) error {
+	block, ok := car.Blocks[c]
+	if !ok {
+		t.missing = append(t.missing, bounds)
+		return nil
+	}
+	var node mstNode
+	if err := cbor.Unmarshal(block, &node); err != nil {
+		return fmt.Errorf("decode MST node %s: %w", c, err)
+	}
+
+	keys := make([]string, len(node.Entries))
+	prev := ""
+	for n, e := range node.Entries {
+		if e.Prefix < 0 || e.Prefix > len(prev) {
+			return fmt.Errorf("MST node %s: bad key prefix", c)
+		}
+		key := prev[:e.Prefix] + string(e.Key)
+		if !bounds.contains(key) || (n > 0 && key <= prev) {
+			return fmt.Errorf("MST node %s: key %q out of order", c, key)
+		}
+		if n == 0 && layer < 0 {
+			layer = keyLayer(key)
+		}
+		if keyLayer(key) != layer {
+			return fmt.Errorf("MST node %s: key %q on wrong layer", c, key)
+		}
+		keys[n] = key
+		prev = key
+	}
+	// Subtrees sit one layer down. Below an empty root the layer is unknown.
+	below := -1
+	if layer > 0 {
+		below = layer - 1
+	}
+	hasSubtree := node.Left != nil
+	for _, e := range node.Entries {
+		hasSubtree = hasSubtree || e.Tree != nil
+	}
+	if layer == 0 && hasSubtree {
+		return fmt.Errorf("MST node %s: subtree below layer 0", c)
+	}
+
+	upper := func(n int) string {
+		if n < len(keys) {
+			return keys[n]
+		}
+		return bounds.before
+	}
+
+	if node.Left != nil {
+		left, err := ParseLink(*node.Left)
+		if err != nil {
+			return fmt.Errorf("MST node %s: %w", c, err)
+		}
+		if err := t.walk(car, left, keyRange{bounds.after, upper(0)}, below); err != nil {
+			return err
+		}
+	}
+	for n, e := range node.Entries {
+		value, err := ParseLink(e.Value)
+		if err != nil {
+			return fmt.Errorf("MST node %s: %w", c, err)
+		}
+		t.Entries[keys[n]] = value
+		if e.Tree != nil {
+			right, err := ParseLink(*e.Tree)
+			if err != nil {
+				return fmt.Errorf("MST node %s: %w", c, err)
+			}
+			if err := t.walk(car, right, keyRange{keys[n], upper(n + 1)}, below); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Complete reports whether the CAR held the whole tree.
+func (t *Tree) Complete() bool {
+	return len(t.missing) == 0
+}
+
+// Known reports whether the tree shows if key exists: it is either among
+// Entries or outside every subtree the CAR left out.
+func (t *Tree) Known(key string) bool {
+	if _, ok := t.Entries[key]; ok {
+		return true
+	}
+	for _, r := range t.missing {
+		if r.contains(key) {
+			return false
+		}
+	}
+	return true
+}
+
+// Unchanged reports whether every key under prefix lies in a single subtree
+// the CAR left out, so nothing under it changed.
+func (t *Tree) Unchanged(prefix string) bool {
+	// Record keys are printable ASCII, so each key under prefix sorts
+	// before prefix followed by DEL.
+	end := prefix + "\x7f"
+	for _, r := range t.missing {
+		if r.after < prefix && (r.before == "" || r.before >= end) {
+			return true
+		}
+	}
+	return false
+}
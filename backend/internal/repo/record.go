@@ -0,0 +1,76 @@
+package repo
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/ipfs/go-cid"
+)
+
+// cidTag is the CBOR tag DAG-CBOR uses for links.
+const cidTag = 42
+
+// RecordJSON converts a DAG-CBOR record into the atproto JSON form, where
+// links become {"$link": ...} and bytes become {"$bytes": ...}. This is the
+// shape the rest of the app receives records in from Jetstream and XRPC.
+func RecordJSON(block []byte) (json.RawMessage, error) {
+	var value interface{}
+	if err := cbor.Unmarshal(block, &value); err != nil {
+		return nil, fmt.Errorf("decode record: %w", err)
+	}
+	converted, err := toJSONValue(value)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(converted)
+}
+
+func toJSONValue(v interface{}) (interface{}, error) {
+	switch val := v.(type) {
+	case map[interface{}]interface{}:
+		out := make(map[string]interface{}, len(val))
+		for k, item := range val {
+			key, ok := k.(string)
+			if !ok {
+				return nil, fmt.Errorf("record has a non-string map key")
+			}
+			converted, err := toJSONValue(item)
+			if err != nil {
+				return nil, err
+			}
+			out[key] = converted
+		}
+		return out, nil
+	case []interface{}:
+		out := make([]interface{}, len(val))
+		for n, item := range val {
+			converted, err := toJSONValue(item)
+			if err != nil {
+				return nil, err
+			}
+			out[n] = converted
+		}
+		return out, nil
+	case []byte:
+		return map[string]string{"$bytes": base64.RawStdEncoding.EncodeToString(val)}, nil
+	case cbor.Tag:
+		c, err := ParseLink(val)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]string{"$link": c.String()}, nil
+	default:
+		return val, nil
+	}
+}
+
+// ParseLink decodes a DAG-CBOR link as decoded into a cbor.Tag.
+func ParseLink(tag cbor.Tag) (cid.Cid, error) {
+	raw, ok := tag.Content.([]byte)
+	if tag.Number != cidTag || !ok || len(raw) == 0 || raw[0] != 0 {
+		return cid.Undef, fmt.Errorf("not a CID link")
+	}
+	return cid.Cast(raw[1:])
+}
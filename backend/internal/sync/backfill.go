@@ -0,0 +1,334 @@
+package sync
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	gosync "sync"
+	"time"
+
+	"margin.at/internal/db"
+	"margin.at/internal/safehttp"
+	"margin.at/internal/xrpc"
+)
+
+// BackfillOptions configure a network backfill.
+type BackfillOptions struct {
+	// Relay is the https base URL of the relay whose repo list is walked.
+	Relay string
+	// RequestsPerSecond caps requests to the relay and to PDSes combined.
+	// A sync counts as one request per collection it lists.
+	RequestsPerSecond float64
+	// Concurrency is how many repos are checked at once.
+	Concurrency int
+	// Restart discards earlier progress instead of resuming it.
+	Restart bool
+}
+
+// listReposPageSize stays well under the bound-parameter limits of both
+// databases, since each page is checked against backfill_repos at once.
+const listReposPageSize = 500
+
+// MaxRepoSize bounds the CAR getRepo may return, since it is held in memory
+// while it is read. Repos bigger than this, mostly with posts from other
+// apps, are listed collection by collection instead.
+const MaxRepoSize = 64 << 20
+
+// syncClient fetches from relays and from PDSes named in DID documents.
+var syncClient = safehttp.NewClient(safehttp.Config{Timeout: 30 * time.Second})
+
+// repoClient downloads repo exports, which take longer than other requests.
+var repoClient = safehttp.NewClient(safehttp.Config{Timeout: 5 * time.Minute, MaxBodyBytes: MaxRepoSize})
+
+// Backfill enumerates every repo on the relay with listRepos and syncs the
+// ones whose describeRepo lists a collection we index. Progress is saved
+// after each page and for each repo, so an interrupted run resumes where it
+// stopped; repos that failed are retried on the next run.
+func (s *Service) Backfill(ctx context.Context, opts BackfillOptions) error {
+	relay := strings.TrimSuffix(opts.Relay, "/")
+	if opts.Restart {
+		if err := s.db.ResetBackfill(relay); err != nil {
+			return err
+		}
+	}
+	state, err := s.db.GetBackfillState(relay)
+	if err != nil {
+		return err
+	}
+	limit := newRateLimiter(opts.RequestsPerSecond)
+	workers := max(opts.Concurrency, 1)
+
+	cursor := ""
+	if state != nil {
+		if state.Complete {
+			log.Printf("Backfill from %s already complete; retrying failed repos (use --restart to run it again)", relay)
+			return s.retryFailedBackfills(ctx, limit, workers)
+		}
+		cursor = state.ListCursor
+		log.Printf("Resuming backfill from %s at cursor %q", relay, cursor)
+	}
+
+	for {
+		if err := limit.wait(ctx, 1); err != nil {
+			return err
+		}
+		page, err := listRepos(ctx, relay, cursor)
+		if err != nil {
+			return fmt.Errorf("listRepos: %w", err)
+		}
+
+		var dids []string
+		for _, r := range page.Repos {
+			if r.Active == nil || *r.Active {
+				dids = append(dids, r.DID)
+			}
+		}
+		done, err := s.db.BackfillDone(dids)
+		if err != nil {
+			return err
+		}
+
+		var todo []string
+		for _, did := range dids {
+			if !done[did] {
+				todo = append(todo, did)
+			}
+		}
+		if err := s.backfillRepos(ctx, limit, workers, todo); err != nil {
+			return err
+		}
+
+		if err := s.db.SaveBackfillCursor(relay, page.Cursor, page.Cursor == ""); err != nil {
+			return err
+		}
+		if counts, err := s.db.BackfillCounts(); err == nil {
+			log.Printf("Backfill: %d synced, %d skipped, %d failed", counts[db.BackfillSynced], counts[db.BackfillSkipped], counts[db.BackfillFailed])
+		}
+		if page.Cursor == "" {
+			return nil
+		}
+		cursor = page.Cursor
+	}
+}
+
+// retryFailedBackfills gives every failed repo one more attempt.
+func (s *Service) retryFailedBackfills(ctx context.Context, limit *rateLimiter, workers int) error {
+	dids, err := s.db.BackfillReposWithStatus(db.BackfillFailed, 100000)
+	if err != nil {
+		return err
+	}
+	if err := s.backfillRepos(ctx, limit, workers, dids); err != nil {
+		return err
+	}
+	counts, err := s.db.BackfillCounts()
+	if err != nil {
+		return err
+	}
+	log.Printf("Backfill retry: %d of %d repos still failing", counts[db.BackfillFailed], len(dids))
+	return nil
+}
+
+func (s *Service) backfillRepos(ctx context.Context, limit *rateLimiter, workers int, dids []string) error {
+	queue := make(chan string)
+	var wg gosync.WaitGroup
+	for n := 0; n < workers; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for did := range queue {
+				s.backfillRepo(ctx, limit, did)
+			}
+		}()
+	}
+	for _, did := range dids {
+		select {
+		case queue <- did:
+		case <-ctx.Done():
+		}
+	}
+	close(queue)
+	wg.Wait()
+	return ctx.Err()
+}
+
+func (s *Service) backfillRepo(ctx context.Context, limit *rateLimiter, did string) {
+	status, err := s.backfillRepoStatus(ctx, limit, did)
+	if ctx.Err() != nil {
+		// Leave the repo unrecorded so the resumed run picks it up.
+		return
+	}
+	msg := ""
+	if err != nil {
+		status, msg = db.BackfillFailed, err.Error()
+		log.Printf("Backfill of %s failed: %v", did, err)
+	}
+	if err := s.db.SetBackfillRepo(did, status, msg); err != nil {
+		log.Printf("Failed to record backfill of %s: %v", did, err)
+	}
+}
+
+func (s *Service) backfillRepoStatus(ctx context.Context, limit *rateLimiter, did string) (string, error) {
+	pds, err := s.repoPDS(did)
+	if err != nil {
+		return "", err
+	}
+
+	if err := limit.wait(ctx, 1); err != nil {
+		return "", err
+	}
+	var described struct {
+		Collections []string `json:"collections"`
+	}
+	endpoint := fmt.Sprintf("%s/xrpc/com.atproto.repo.describeRepo?repo=%s", strings.TrimSuffix(pds, "/"), url.QueryEscape(did))
+	if err := getJSON(ctx, endpoint, &described); err != nil {
+		return "", fmt.Errorf("describeRepo: %w", err)
+	}
+	if !holdsIndexedCollection(described.Collections) {
+		return db.BackfillSkipped, nil
+	}
+
+	if err := limit.wait(ctx, len(Collections)); err != nil {
+		return "", err
+	}
+	_, err = s.PerformSync(ctx, did, func(ctx context.Context, _ string) (*xrpc.Client, error) {
+		return &xrpc.Client{PDS: pds}, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return db.BackfillSynced, nil
+}
+
+// repoPDS prefers the PDS the firehose last announced for did.
+func (s *Service) repoPDS(did string) (string, error) {
+	if account, err := s.db.GetAccount(did); err == nil && account != nil && account.PDS != "" {
+		return account.PDS, nil
+	}
+	pds, err := xrpc.ResolveDIDToPDS(did)
+	if err != nil {
+		return "", fmt.Errorf("resolve PDS: %w", err)
+	}
+	if pds == "" {
+		return "", fmt.Errorf("no PDS for %s", did)
+	}
+	if err := s.db.SetAccountPDS(did, pds); err != nil {
+		log.Printf("Failed to save PDS for %s: %v", did, err)
+	}
+	return pds, nil
+}
+
+func holdsIndexedCollection(collections []string) bool {
+	for _, c := range collections {
+		for _, indexed := range Collections {
+			if c == indexed {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type listReposPage struct {
+	Cursor string `json:"cursor"`
+	Repos  []struct {
+		DID    string `json:"did"`
+		Active *bool  `json:"active"`
+	} `json:"repos"`
+}
+
+func listRepos(ctx context.Context, relay, cursor string) (*listReposPage, error) {
+	endpoint := fmt.Sprintf("%s/xrpc/com.atproto.sync.listRepos?limit=%d", relay, listReposPageSize)
+	if cursor != "" {
+		endpoint += "&cursor=" + url.QueryEscape(cursor)
+	}
+	var page listReposPage
+	if err := getJSON(ctx, endpoint, &page); err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+// getJSON fetches endpoint into out, waiting out up to three 429 responses.
+func getJSON(ctx context.Context, endpoint string, out interface{}) error {
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, "GET", endpoint, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := syncClient.Do(req)
+		if err != nil {
+			return err
+		}
+
+		if resp.StatusCode == http.StatusTooManyRequests && attempt < 3 {
+			wait := retryAfter(resp.Header)
+			resp.Body.Close()
+			select {
+			case <-time.After(wait):
+				continue
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+			resp.Body.Close()
+			return fmt.Errorf("status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+		}
+		err = json.NewDecoder(resp.Body).Decode(out)
+		resp.Body.Close()
+		return err
+	}
+}
+
+// retryAfter reads Retry-After, or the ratelimit-reset epoch atproto
+// servers send, capped at a minute.
+func retryAfter(h http.Header) time.Duration {
+	wait := 10 * time.Second
+	if secs, err := strconv.Atoi(h.Get("Retry-After")); err == nil {
+		wait = time.Duration(secs) * time.Second
+	} else if reset, err := strconv.ParseInt(h.Get("Ratelimit-Reset"), 10, 64); err == nil {
+		wait = time.Until(time.Unix(reset, 0))
+	}
+	return min(max(wait, time.Second), time.Minute)
+}
+
+// rateLimiter spaces requests evenly at a fixed rate across goroutines.
+type rateLimiter struct {
+	mu       gosync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+func newRateLimiter(perSecond float64) *rateLimiter {
+	if perSecond <= 0 {
+		return &rateLimiter{}
+	}
+	return &rateLimiter{interval: time.Duration(float64(time.Second) / perSecond)}
+}
+
+// wait blocks until n more requests may be made.
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	at := l.next
+	l.next = l.next.Add(time.Duration(n) * l.interval)
+	l.mu.Unlock()
+
+	select {
+	case <-time.After(time.Until(at)):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
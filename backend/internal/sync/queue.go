@@ -0,0 +1,157 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"margin.at/internal/xrpc"
+)
+
+var (
+	// SyncJobTimeout bounds one attempt, so a PDS that stops answering
+	// does not hold a worker forever.
+	SyncJobTimeout = 10 * time.Minute
+	// A failed sync is retried after SyncRetryBase, doubling up to
+	// SyncRetryMax, and given up on after SyncMaxAttempts attempts.
+	SyncRetryBase   = 30 * time.Second
+	SyncRetryMax    = time.Hour
+	SyncMaxAttempts = 5
+)
+
+const syncPollInterval = 5 * time.Second
+
+// Enqueue schedules a sync of did. It is a no-op while one is already
+// queued or running.
+func (s *Service) Enqueue(did string) error {
+	queued, err := s.db.EnqueueSyncJob(did)
+	if err != nil {
+		return err
+	}
+	if queued {
+		select {
+		case s.wake <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// StartQueue runs Config.Workers workers draining the sync queue until ctx
+// is done. Jobs left running by a previous process are queued again first.
+func (s *Service) StartQueue(ctx context.Context) {
+	if n, err := s.db.RequeueRunningSyncJobs(); err != nil {
+		log.Printf("Failed to requeue interrupted syncs: %v", err)
+	} else if n > 0 {
+		log.Printf("Requeued %d interrupted syncs", n)
+	}
+	for n := 0; n < max(s.cfg.Workers, 1); n++ {
+		go s.syncWorker(ctx)
+	}
+}
+
+func (s *Service) syncWorker(ctx context.Context) {
+	ticker := time.NewTicker(syncPollInterval)
+	defer ticker.Stop()
+	for {
+		for ctx.Err() == nil {
+			s.claimMu.Lock()
+			job, err := s.db.ClaimSyncJob()
+			s.claimMu.Unlock()
+			if err != nil {
+				log.Printf("Failed to claim sync job: %v", err)
+				break
+			}
+			if job == nil {
+				break
+			}
+			s.runSyncJob(ctx, job.DID, job.Attempts)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Service) runSyncJob(ctx context.Context, did string, attempts int) {
+	jobCtx, cancel := context.WithTimeout(ctx, SyncJobTimeout)
+	defer cancel()
+
+	progress := make(map[string]string)
+	jobCtx = withProgress(jobCtx, func(collection, result string) {
+		progress[collection] = result
+		if err := s.db.SetSyncJobProgress(did, progress); err != nil {
+			log.Printf("Failed to save sync progress of %s: %v", did, err)
+		}
+	})
+
+	results, err := s.PerformSync(jobCtx, did, func(ctx context.Context, did string) (*xrpc.Client, error) {
+		pds, err := s.repoPDS(did)
+		if err != nil {
+			return nil, err
+		}
+		return &xrpc.Client{PDS: pds}, nil
+	})
+	if ctx.Err() != nil {
+		// Shutting down; the job is requeued on the next start.
+		return
+	}
+	if err == nil {
+		for _, collection := range Collections {
+			if result := results[collection]; strings.HasPrefix(result, "error") {
+				err = fmt.Errorf("%s: %s", collection, result)
+				break
+			}
+		}
+	}
+	if results == nil {
+		results = progress
+	}
+
+	if err == nil {
+		if err := s.db.CompleteSyncJob(did, results); err != nil {
+			log.Printf("Failed to record sync of %s: %v", did, err)
+		}
+		return
+	}
+
+	attempts++
+	var retryAt *time.Time
+	if attempts < SyncMaxAttempts {
+		at := time.Now().Add(syncRetryBackoff(attempts))
+		retryAt = &at
+		log.Printf("Sync of %s failed (attempt %d), retrying at %s: %v", did, attempts, at.Format(time.RFC3339), err)
+	} else {
+		log.Printf("Sync of %s failed after %d attempts: %v", did, attempts, err)
+	}
+	if err := s.db.FailSyncJob(did, results, err.Error(), retryAt); err != nil {
+		log.Printf("Failed to record sync failure of %s: %v", did, err)
+	}
+}
+
+func syncRetryBackoff(attempts int) time.Duration {
+	wait := SyncRetryBase
+	for n := 1; n < attempts && wait < SyncRetryMax; n++ {
+		wait *= 2
+	}
+	return min(wait, SyncRetryMax)
+}
+
+type progressKey struct{}
+
+// withProgress has the sync running under ctx report each collection's
+// result to fn as it finishes.
+func withProgress(ctx context.Context, fn func(collection, result string)) context.Context {
+	return context.WithValue(ctx, progressKey{}, fn)
+}
+
+func reportProgress(ctx context.Context, collection, result string) {
+	if fn, ok := ctx.Value(progressKey{}).(func(collection, result string)); ok {
+		fn(collection, result)
+	}
+}
@@ -0,0 +1,198 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"margin.at/internal/crypto"
+	"margin.at/internal/records"
+	"margin.at/internal/repo"
+	"margin.at/internal/xrpc"
+)
+
+// PerformSync brings the indexed records of did up to date with its repo.
+// A repo whose revision matches the last sync is skipped; otherwise only the
+// changes since that revision are fetched with getRepo?since=. The first
+// sync, or one the PDS cannot serve incrementally, exports the whole repo,
+// and lists every collection only if that fails too.
+func (s *Service) PerformSync(ctx context.Context, did string, getClient func(context.Context, string) (*xrpc.Client, error)) (map[string]string, error) {
+	client, err := getClient(ctx, did)
+	if err != nil {
+		return nil, err
+	}
+	pds := strings.TrimSuffix(client.PDS, "/")
+
+	var latest struct {
+		CID string `json:"cid"`
+		Rev string `json:"rev"`
+	}
+	endpoint := fmt.Sprintf("%s/xrpc/com.atproto.sync.getLatestCommit?did=%s", pds, url.QueryEscape(did))
+	if err := getJSON(ctx, endpoint, &latest); err != nil || latest.Rev == "" {
+		log.Printf("getLatestCommit for %s failed (%v), listing all records", did, err)
+		return s.fullSync(ctx, did, client)
+	}
+
+	synced, err := s.db.GetRepoRev(did)
+	if err != nil {
+		return nil, err
+	}
+	if synced == latest.Rev {
+		results := make(map[string]string, len(Collections))
+		for _, collection := range Collections {
+			results[collection] = "unchanged"
+		}
+		return results, nil
+	}
+
+	since := ""
+	if synced != "" && synced < latest.Rev {
+		since = synced
+	}
+	for {
+		results, rev, err := s.syncFromRepo(ctx, did, pds, since)
+		if err == nil {
+			if err := s.db.SetRepoRev(did, rev); err != nil {
+				log.Printf("Failed to save repo rev of %s: %v", did, err)
+			}
+			return results, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if since == "" {
+			log.Printf("Repo export of %s failed (%v), listing all records", did, err)
+			break
+		}
+		log.Printf("Incremental sync of %s failed (%v), exporting the whole repo", did, err)
+		since = ""
+	}
+
+	results, err := s.fullSync(ctx, did, client)
+	if err != nil {
+		return nil, err
+	}
+	for _, result := range results {
+		if strings.HasPrefix(result, "error") {
+			return results, nil
+		}
+	}
+	// Changes made while listing are newer than latest.Rev, so the next
+	// sync fetches them again.
+	if err := s.db.SetRepoRev(did, latest.Rev); err != nil {
+		log.Printf("Failed to save repo rev of %s: %v", did, err)
+	}
+	return results, nil
+}
+
+// syncFromRepo applies did's repo, or only its changes since rev when rev is
+// set, from a getRepo export, and returns the revision it reached. The
+// commit signature, the MST and every record's CID are checked, and records
+// of every indexed collection are extracted in one pass over the tree.
+func (s *Service) syncFromRepo(ctx context.Context, did, pds, since string) (map[string]string, string, error) {
+	endpoint := fmt.Sprintf("%s/xrpc/com.atproto.sync.getRepo?did=%s", pds, url.QueryEscape(did))
+	if since != "" {
+		endpoint += "&since=" + url.QueryEscape(since)
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	resp, err := repoClient.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("getRepo: status %d", resp.StatusCode)
+	}
+	car, err := repo.ReadCAR(resp.Body)
+	if err != nil {
+		return nil, "", fmt.Errorf("getRepo: %w", err)
+	}
+	if len(car.Roots) == 0 {
+		return nil, "", fmt.Errorf("getRepo: CAR has no root")
+	}
+
+	encoded, err := xrpc.ResolveSigningKey(did)
+	if err != nil {
+		return nil, "", fmt.Errorf("resolve signing key: %w", err)
+	}
+	key, err := crypto.ParsePublicKeyMultibase(encoded)
+	if err != nil {
+		return nil, "", err
+	}
+	commit, err := car.LoadCommit(car.Roots[0], did, key)
+	if err != nil {
+		return nil, "", err
+	}
+	tree, err := car.LoadTree(commit.Data)
+	if err != nil {
+		return nil, "", err
+	}
+	if since == "" && !tree.Complete() {
+		return nil, "", fmt.Errorf("getRepo: export of %s is missing MST nodes", did)
+	}
+
+	counts := make(map[string]int, len(Collections))
+	for key, value := range tree.Entries {
+		collection, _, _ := strings.Cut(key, "/")
+		if records.Lookup(collection) == nil {
+			continue
+		}
+		// Records a diff does not carry are unchanged.
+		block, ok := car.Blocks[value]
+		if !ok {
+			continue
+		}
+		uri := "at://" + did + "/" + key
+		record, err := repo.RecordJSON(block)
+		if err != nil {
+			log.Printf("Error decoding %s: %v", uri, err)
+			continue
+		}
+		if s.cfg.VerifyCIDs {
+			if err := crypto.VerifyRecordCID(record, value.String(), uri); err != nil {
+				log.Printf("CID verification failed for %s: %v (skipping)", uri, err)
+				continue
+			}
+		}
+		if err := s.upsertRecord(did, collection, uri, value.String(), record); err != nil {
+			log.Printf("Error upserting %s: %v", uri, err)
+			continue
+		}
+		s.db.ClearIngestFailure(uri)
+		counts[collection]++
+	}
+
+	results := make(map[string]string, len(Collections))
+	for _, collection := range Collections {
+		if tree.Unchanged(collection + "/") {
+			results[collection] = "unchanged"
+			reportProgress(ctx, collection, results[collection])
+			continue
+		}
+
+		deleted := 0
+		localURIs, err := records.LocalURIs(s.db, collection, did)
+		if err != nil {
+			return nil, "", err
+		}
+		for _, uri := range localURIs {
+			key := strings.TrimPrefix(uri, "at://"+did+"/")
+			if _, ok := tree.Entries[key]; !ok && tree.Known(key) {
+				if err := records.Delete(s.db, collection, uri); err != nil {
+					log.Printf("Error deleting %s: %v", uri, err)
+					continue
+				}
+				deleted++
+			}
+		}
+		results[collection] = fmt.Sprintf("synced %d records, deleted %d stale", counts[collection], deleted)
+		reportProgress(ctx, collection, results[collection])
+	}
+	return results, commit.Rev, nil
+}
@@ -0,0 +1,162 @@
+package urlcanon
+
+import (
+	"net/url"
+	"path"
+	"strings"
+)
+
+// Rule rewrites a parsed URL in place. Rules run in order, after the host has
+// been lowercased and before the query is re-encoded.
+type Rule func(u *url.URL)
+
+// Canonicalizer maps the many spellings of a page's URL onto a single key,
+// so annotations made on any of them land in the same bucket.
+type Canonicalizer struct {
+	rules []Rule
+}
+
+func New(rules ...Rule) *Canonicalizer {
+	return &Canonicalizer{rules: rules}
+}
+
+// Default strips tracking parameters, mobile and AMP variants and applies the
+// built-in site rules.
+func Default() *Canonicalizer {
+	return New(
+		StripHostPrefixes("www.", "m.", "mobile.", "amp."),
+		StripParams(TrackingParams...),
+		StripAMP,
+		ForHost("youtu.be", shortYouTube),
+		ForHost("youtube.com", KeepParams("v", "list")),
+	)
+}
+
+// With returns a copy of c with extra rules appended.
+func (c *Canonicalizer) With(rules ...Rule) *Canonicalizer {
+	combined := make([]Rule, 0, len(c.rules)+len(rules))
+	combined = append(combined, c.rules...)
+	return New(append(combined, rules...)...)
+}
+
+// Key returns the scheme-less "host/path?query" form used for hashing. It
+// returns false for values that are not absolute URLs.
+func (c *Canonicalizer) Key(rawURL string) (string, bool) {
+	u, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil || u.Host == "" {
+		return "", false
+	}
+
+	u.Host = strings.ToLower(u.Host)
+	if (u.Scheme == "https" && u.Port() == "443") || (u.Scheme == "http" && u.Port() == "80") {
+		u.Host = u.Hostname()
+	}
+	u.Fragment, u.RawFragment = "", ""
+	for _, rule := range c.rules {
+		rule(u)
+	}
+
+	key := u.Host + strings.TrimSuffix(u.Path, "/")
+	if query := u.Query(); len(query) > 0 {
+		key += "?" + query.Encode()
+	}
+	return key, true
+}
+
+// TrackingParams are query parameters that identify a campaign or click
+// rather than the page. Entries ending in "*" match by prefix.
+var TrackingParams = []string{
+	"utm_*", "fbclid", "gclid", "dclid", "gbraid", "wbraid", "msclkid",
+	"mc_cid", "mc_eid", "igshid", "yclid", "twclid", "ref_src", "ref_url",
+	"_hsenc", "_hsmi", "mkt_tok", "oly_anon_id", "oly_enc_id", "vero_id",
+}
+
+func StripHostPrefixes(prefixes ...string) Rule {
+	return func(u *url.URL) {
+		for _, prefix := range prefixes {
+			if rest := strings.TrimPrefix(u.Host, prefix); rest != u.Host && strings.Contains(rest, ".") {
+				u.Host = rest
+			}
+		}
+	}
+}
+
+func StripParams(names ...string) Rule {
+	return func(u *url.URL) {
+		query := u.Query()
+		for key := range query {
+			if matchParam(key, names) {
+				query.Del(key)
+			}
+		}
+		u.RawQuery = query.Encode()
+	}
+}
+
+// KeepParams drops every query parameter not listed in names.
+func KeepParams(names ...string) Rule {
+	return func(u *url.URL) {
+		query := u.Query()
+		for key := range query {
+			if !matchParam(key, names) {
+				query.Del(key)
+			}
+		}
+		u.RawQuery = query.Encode()
+	}
+}
+
+// ForHost applies rules only to host and its subdomains.
+func ForHost(host string, rules ...Rule) Rule {
+	host = strings.ToLower(host)
+	return func(u *url.URL) {
+		if u.Host != host && !strings.HasSuffix(u.Host, "."+host) {
+			return
+		}
+		for _, rule := range rules {
+			rule(u)
+		}
+	}
+}
+
+// StripAMP maps AMP page variants back to the article they render.
+func StripAMP(u *url.URL) {
+	query := u.Query()
+	if _, ok := query["amp"]; ok {
+		query.Del("amp")
+		u.RawQuery = query.Encode()
+	}
+	switch {
+	case strings.HasPrefix(u.Path, "/amp/"):
+		u.Path = strings.TrimPrefix(u.Path, "/amp")
+	case path.Base(u.Path) == "amp":
+		u.Path = path.Dir(u.Path)
+	case strings.HasSuffix(u.Path, ".amp"):
+		u.Path = strings.TrimSuffix(u.Path, ".amp")
+	}
+	u.RawPath = ""
+}
+
+func shortYouTube(u *url.URL) {
+	id := strings.Trim(u.Path, "/")
+	if id == "" {
+		return
+	}
+	query := u.Query()
+	query.Set("v", id)
+	u.Host, u.Path, u.RawQuery = "youtube.com", "/watch", query.Encode()
+}
+
+func matchParam(key string, names []string) bool {
+	key = strings.ToLower(key)
+	for _, name := range names {
+		if prefix, ok := strings.CutSuffix(name, "*"); ok {
+			if strings.HasPrefix(key, prefix) {
+				return true
+			}
+		} else if key == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,108 @@
+package urlcanon
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultTimeout = 5 * time.Second
+	UserAgent      = "Margin (margin.at)"
+	maxHeadBytes   = 256 * 1024
+)
+
+var (
+	linkTagPattern = regexp.MustCompile(`(?is)<link\s[^>]*>`)
+	relPattern     = regexp.MustCompile(`(?is)\brel\s*=\s*["']?([^"'>]+)`)
+	hrefPattern    = regexp.MustCompile(`(?is)\bhref\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s>]+))`)
+)
+
+// LinkResolver follows a page's <link rel="canonical"> so records made on a
+// syndicated or parameterised copy hash to the publisher's preferred URL.
+type LinkResolver struct {
+	httpClient *http.Client
+}
+
+// NewLinkResolver fetches pages with client. Page URLs come from users, so
+// client should refuse to reach internal addresses.
+func NewLinkResolver(client *http.Client) *LinkResolver {
+	return &LinkResolver{httpClient: client}
+}
+
+// Resolve returns the absolute canonical URL declared by the page at rawURL,
+// or "" when the page does not declare one.
+func (r *LinkResolver) Resolve(ctx context.Context, rawURL string) (string, error) {
+	base, err := url.Parse(rawURL)
+	if err != nil || (base.Scheme != "http" && base.Scheme != "https") {
+		return "", fmt.Errorf("not an http url: %q", rawURL)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("User-Agent", UserAgent)
+	req.Header.Set("Accept", "text/html")
+
+	resp, err := r.httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("fetch %s: status %d", rawURL, resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "" && !strings.Contains(ct, "html") {
+		return "", nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxHeadBytes))
+	if err != nil {
+		return "", err
+	}
+
+	href := canonicalHref(string(body))
+	if href == "" {
+		return "", nil
+	}
+	ref, err := url.Parse(href)
+	if err != nil {
+		return "", nil
+	}
+	// Resolve against the final URL so relative links survive redirects.
+	return resp.Request.URL.ResolveReference(ref).String(), nil
+}
+
+// canonicalHref returns the raw href of the first <link rel="canonical"> in
+// the document head.
+func canonicalHref(html string) string {
+	if end := strings.Index(strings.ToLower(html), "</head>"); end != -1 {
+		html = html[:end]
+	}
+	for _, tag := range linkTagPattern.FindAllString(html, -1) {
+		rel := relPattern.FindStringSubmatch(tag)
+		if rel == nil || !hasToken(rel[1], "canonical") {
+			continue
+		}
+		if href := hrefPattern.FindStringSubmatch(tag); href != nil {
+			return strings.TrimSpace(href[1] + href[2] + href[3])
+		}
+	}
+	return ""
+}
+
+func hasToken(list, token string) bool {
+	for _, t := range strings.Fields(strings.ToLower(list)) {
+		if t == token {
+			return true
+		}
+	}
+	return false
+}
@@ -98,7 +98,65 @@ func ResolveDIDToPDS(did string) (string, error) {
 	return resolveDIDToPDSDirect(did)
 }
 
+// ResolveDIDToPDSFresh reads the PDS from the DID document itself rather
+// than Slingshot, whose cached copy can predate a PDS migration.
+func ResolveDIDToPDSFresh(did string) (string, error) {
+	return resolveDIDToPDSDirect(did)
+}
+
 func resolveDIDToPDSDirect(did string) (string, error) {
+	doc, err := fetchDIDDocument(did)
+	if err != nil || doc == nil {
+		return "", err
+	}
+
+	for _, svc := range doc.Service {
+		if svc.ID == "#atproto_pds" && svc.Type == "AtprotoPersonalDataServer" {
+			return svc.ServiceEndpoint, nil
+		}
+	}
+	for _, svc := range doc.Service {
+		if svc.Type == "AtprotoPersonalDataServer" {
+			return svc.ServiceEndpoint, nil
+		}
+	}
+	return "", nil
+}
+
+// ResolveSigningKey returns the publicKeyMultibase of the repo signing key
+// in the DID document of did.
+func ResolveSigningKey(did string) (string, error) {
+	doc, err := fetchDIDDocument(did)
+	if err != nil {
+		return "", err
+	}
+	if doc == nil {
+		return "", fmt.Errorf("unsupported DID method: %s", did)
+	}
+
+	for _, vm := range doc.VerificationMethod {
+		if (vm.ID == "#atproto" || vm.ID == did+"#atproto") && vm.Type == "Multikey" {
+			return vm.PublicKeyMultibase, nil
+		}
+	}
+	return "", fmt.Errorf("no atproto signing key for %s", did)
+}
+
+type didDocument struct {
+	Service []struct {
+		ID              string `json:"id"`
+		Type            string `json:"type"`
+		ServiceEndpoint string `json:"serviceEndpoint"`
+	} `json:"service"`
+	VerificationMethod []struct {
+		ID                 string `json:"id"`
+		Type               string `json:"type"`
+		PublicKeyMultibase string `json:"publicKeyMultibase"`
+	} `json:"verificationMethod"`
+}
+
+// fetchDIDDocument returns nil for DID methods other than plc and web.
+func fetchDIDDocument(did string) (*didDocument, error) {
 	var docURL string
 	if strings.HasPrefix(did, "did:plc:") {
 		docURL = config.Get().PLCResolveURL(did)
@@ -106,7 +164,7 @@ func resolveDIDToPDSDirect(did string) (string, error) {
 		domain := strings.TrimPrefix(did, "did:web:")
 		docURL = fmt.Sprintf("https://%s/.well-known/did.json", domain)
 	} else {
-		return "", nil
+		return nil, nil
 	}
 
 	client := &http.Client{
@@ -114,36 +172,19 @@ func resolveDIDToPDSDirect(did string) (string, error) {
 	}
 	resp, err := client.Get(docURL)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != 200 {
-		return "", fmt.Errorf("failed to fetch DID doc: %d", resp.StatusCode)
+		return nil, fmt.Errorf("failed to fetch DID doc: %d", resp.StatusCode)
 	}
 
-	var doc struct {
-		Service []struct {
-			ID              string `json:"id"`
-			Type            string `json:"type"`
-			ServiceEndpoint string `json:"serviceEndpoint"`
-		} `json:"service"`
-	}
+	var doc didDocument
 	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
-		return "", err
-	}
-
-	for _, svc := range doc.Service {
-		if svc.ID == "#atproto_pds" && svc.Type == "AtprotoPersonalDataServer" {
-			return svc.ServiceEndpoint, nil
-		}
+		return nil, err
 	}
-	for _, svc := range doc.Service {
-		if svc.Type == "AtprotoPersonalDataServer" {
-			return svc.ServiceEndpoint, nil
-		}
-	}
-	return "", nil
+	return &doc, nil
 }
 
 func ResolveHandle(handle string) (string, error) {
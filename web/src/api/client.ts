@@ -118,6 +118,7 @@ interface GetFeedParams {
   type?: string;
   limit?: number;
   offset?: number;
+  cursor?: string;
   motivation?: string;
   tag?: string;
   creator?: string;
@@ -243,6 +244,7 @@ export async function getFeed({
   type = "all",
   limit = 50,
   offset = 0,
+  cursor,
   motivation,
   tag,
   creator,
@@ -251,7 +253,8 @@ export async function getFeed({
   if (source) params.append("source", source);
   if (type) params.append("type", type);
   if (limit) params.append("limit", limit.toString());
-  if (offset) params.append("offset", offset.toString());
+  if (cursor) params.append("cursor", cursor);
+  else if (offset) params.append("offset", offset.toString());
   if (motivation) params.append("motivation", motivation);
   if (tag) params.append("tag", tag);
   if (creator) params.append("creator", creator);
@@ -294,7 +297,10 @@ export async function getFeed({
     return {
       cursor: data.cursor,
       items: groupedItems,
-      hasMore: normalizedItems.length >= limit,
+      hasMore:
+        data.cursor !== undefined
+          ? Boolean(data.cursor)
+          : normalizedItems.length >= limit,
       fetchedCount: normalizedItems.length,
     };
   } catch (e) {
@@ -42,6 +42,7 @@ function FeedContent({
   const [loadingMore, setLoadingMore] = useState(false);
   const [hasMore, setHasMore] = useState(false);
   const [offset, setOffset] = useState(0);
+  const [cursor, setCursor] = useState<string | undefined>();
 
   const LIMIT = 50;
 
@@ -59,6 +60,7 @@ function FeedContent({
           setHasMore(fetched.length >= LIMIT);
         }
         setOffset(data?.fetchedCount ?? fetched.length);
+        setCursor(data?.cursor || undefined);
         setLoading(false);
       })
       .catch((e) => {
@@ -83,6 +85,7 @@ function FeedContent({
         tag,
         limit: LIMIT,
         offset,
+        cursor,
       });
       const fetched = data?.items || [];
       setItems((prev) => [...prev, ...fetched]);
@@ -92,12 +95,13 @@ function FeedContent({
         setHasMore(fetched.length >= LIMIT);
       }
       setOffset((prev) => prev + (data?.fetchedCount ?? fetched.length));
+      setCursor(data?.cursor || undefined);
     } catch (e) {
       console.error(e);
     } finally {
       setLoadingMore(false);
     }
-  }, [type, motivation, tag, offset]);
+  }, [type, motivation, tag, offset, cursor]);
 
   const handleDelete = (uri: string) => {
     setItems((prev) => prev.filter((i) => i.uri !== uri));